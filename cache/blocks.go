@@ -0,0 +1,150 @@
+/*
+ * blocks.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"github.com/billziss-gh/objfs/errno"
+	"github.com/boltdb/bolt"
+)
+
+// blocks_t records which blocks of a sparsely cached file are present. The
+// record applies only while the object has signature Sig. A cached file that
+// has a blocks_t record is never uploaded; it is either fully downloaded
+// before it is written or it is evicted.
+type blocks_t struct {
+	Size      int64
+	BlockSize int64
+	Sig       string
+	Bitmap    []byte
+}
+
+func newBlocks(size int64, blocksize int64, sig string) *blocks_t {
+	count := (size + blocksize - 1) / blocksize
+	return &blocks_t{
+		Size:      size,
+		BlockSize: blocksize,
+		Sig:       sig,
+		Bitmap:    make([]byte, (count+7)/8),
+	}
+}
+
+func (blk *blocks_t) Get(tx *bolt.Tx, ino uint64) (err error) {
+	var kbuf [8]byte
+	k := kbuf[:]
+
+	putUint64(k, 0, ino)
+	v := tx.Bucket(blockname).Get(k)
+	if nil == v || nil != blk.Decode(v) {
+		err = errno.ENOENT
+	}
+
+	return
+}
+
+func (blk *blocks_t) Put(tx *bolt.Tx, ino uint64) (err error) {
+	var kbuf [8]byte
+	k := kbuf[:]
+
+	putUint64(k, 0, ino)
+	if nil != blk {
+		v := make([]byte, blk.EncodeLen())
+		v = blk.Encode(v)
+		err = tx.Bucket(blockname).Put(k, v)
+	} else {
+		err = tx.Bucket(blockname).Delete(k)
+	}
+
+	return
+}
+
+// Count returns the number of blocks in the file.
+func (blk *blocks_t) Count() int64 {
+	return (blk.Size + blk.BlockSize - 1) / blk.BlockSize
+}
+
+// Has determines if block i is present.
+func (blk *blocks_t) Has(i int64) bool {
+	return 0 != blk.Bitmap[i/8]&(1<<uint(i%8))
+}
+
+// Set marks block i as present.
+func (blk *blocks_t) Set(i int64) {
+	blk.Bitmap[i/8] |= 1 << uint(i%8)
+}
+
+// IsComplete determines if all blocks are present.
+func (blk *blocks_t) IsComplete() bool {
+	for i, n := int64(0), blk.Count(); n > i; i++ {
+		if !blk.Has(i) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (blk *blocks_t) EncodeLen() int {
+	return 8 + 8 + 4 + 2 + len(blk.Bitmap) + len(blk.Sig)
+}
+
+func (blk *blocks_t) Encode(b []byte) []byte {
+	// encode order: uint64*, uint32*, uint16*, uint8*
+	// Size, BlockSize, len(Bitmap), len(Sig), Bitmap, Sig
+
+	lb := len(blk.Bitmap)
+	ls := len(blk.Sig)
+
+	i := 0
+	i = putUint64(b, i, uint64(blk.Size))
+	i = putUint64(b, i, uint64(blk.BlockSize))
+	i = putUint32(b, i, uint32(lb))
+	i = putUint16(b, i, uint16(ls))
+	i = putBytes(b, i, blk.Bitmap, 1<<31-1)
+	i = putString(b, i, blk.Sig, 1<<16-1)
+	return b[:i]
+}
+
+func (blk *blocks_t) Decode(b []byte) (err error) {
+	// encode order: uint64*, uint32*, uint16*, uint8*
+	// Size, BlockSize, len(Bitmap), len(Sig), Bitmap, Sig
+
+	defer func() {
+		if r := recover(); nil != r {
+			err = errno.EIO
+		}
+	}()
+
+	i := 0
+	i, size := getUint64(b, i)
+	i, blocksize := getUint64(b, i)
+	i, lb := getUint32(b, i)
+	i, ls := getUint16(b, i)
+	i, bitmap := getBytes(b, i, int(lb))
+	i, sig := getString(b, i, int(ls))
+
+	if 0 == blocksize || (int64(size)+int64(blocksize)-1)/int64(blocksize) > int64(lb)*8 {
+		return errno.EIO
+	}
+
+	blk.Size = int64(size)
+	blk.BlockSize = int64(blocksize)
+	blk.Bitmap = append([]byte(nil), bitmap...)
+	blk.Sig = sig
+
+	return nil
+}
@@ -0,0 +1,310 @@
+/*
+ * blocks_test.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/billziss-gh/golib/errors"
+	"github.com/billziss-gh/objfs/errno"
+	"github.com/billziss-gh/objfs/objio"
+	"github.com/billziss-gh/objfs/objio/objiotest"
+	"github.com/boltdb/bolt"
+)
+
+func TestBlocksEncodeDecode(t *testing.T) {
+	blk := newBlocks(10*4096+1, 4096, "fortytwo")
+	if 11 != blk.Count() || 2 != len(blk.Bitmap) {
+		t.Error()
+	}
+
+	blk.Set(0)
+	blk.Set(7)
+	blk.Set(10)
+
+	b := make([]byte, blk.EncodeLen())
+	b = blk.Encode(b)
+	if len(b) != blk.EncodeLen() {
+		t.Error()
+	}
+
+	blk2 := blocks_t{}
+	err := blk2.Decode(b)
+	if nil != err {
+		t.Error(err)
+	}
+
+	if blk.Size != blk2.Size || blk.BlockSize != blk2.BlockSize || blk.Sig != blk2.Sig ||
+		!bytes.Equal(blk.Bitmap, blk2.Bitmap) {
+		t.Error()
+	}
+
+	for i := int64(0); blk2.Count() > i; i++ {
+		if (0 == i || 7 == i || 10 == i) != blk2.Has(i) {
+			t.Error(i)
+		}
+	}
+
+	if blk2.IsComplete() {
+		t.Error()
+	}
+	for i := int64(0); blk2.Count() > i; i++ {
+		blk2.Set(i)
+	}
+	if !blk2.IsComplete() {
+		t.Error()
+	}
+
+	err = blk2.Decode(b[:20])
+	if errno.EIO != err {
+		t.Error(err)
+	}
+}
+
+func TestBlocksPutGetDelete(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "cache_blocks_test")
+	os.Remove(path)
+	defer os.Remove(path)
+
+	blk := newBlocks(1<<20, 4096, "fortytwo")
+	blk.Set(42)
+
+	db, err := bolt.Open(path, 0600, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) (err error) {
+		_, err = tx.CreateBucketIfNotExists(blockname)
+		if nil == err {
+			err = blk.Put(tx, 42)
+		}
+		return
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	blk2 := blocks_t{}
+	err = db.View(func(tx *bolt.Tx) (err error) {
+		err = blk2.Get(tx, 42)
+		return
+	})
+	if nil != err {
+		t.Error(err)
+	}
+	if !blk2.Has(42) || blk2.Has(41) || blk.Sig != blk2.Sig {
+		t.Error()
+	}
+
+	err = db.Update(func(tx *bolt.Tx) (err error) {
+		err = (*blocks_t)(nil).Put(tx, 42)
+		return
+	})
+	if nil != err {
+		t.Error(err)
+	}
+
+	err = db.View(func(tx *bolt.Tx) (err error) {
+		err = blk2.Get(tx, 42)
+		return
+	})
+	if errno.ENOENT != err {
+		t.Error(err)
+	}
+}
+
+// countingStorage counts the objects opened and the bytes read from them.
+type countingStorage struct {
+	*objiotest.MemObjectStorage
+	opens int64
+	count int64
+}
+
+type countingReader struct {
+	io.ReadCloser
+	storage *countingStorage
+}
+
+func (self *countingStorage) OpenRead(
+	name string, sig string) (info objio.ObjectInfo, reader io.ReadCloser, err error) {
+	info, reader, err = self.MemObjectStorage.OpenRead(name, sig)
+	if nil != reader {
+		atomic.AddInt64(&self.opens, 1)
+		reader = &countingReader{reader, self}
+	}
+	return
+}
+
+func (self *countingReader) Read(p []byte) (n int, err error) {
+	n, err = self.ReadCloser.Read(p)
+	atomic.AddInt64(&self.storage.count, int64(n))
+	return
+}
+
+func (self *countingReader) ReadAt(p []byte, off int64) (n int, err error) {
+	n, err = self.ReadCloser.(io.ReaderAt).ReadAt(p, off)
+	atomic.AddInt64(&self.storage.count, int64(n))
+	return
+}
+
+func TestSparseRead(t *testing.T) {
+	const blocksize = 4096
+	const size = 64*blocksize + 100
+
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	storage := &countingStorage{MemObjectStorage: objiotest.NewMemObjectStorage(false)}
+	config := &Config{BlockSize: blocksize, PartSize: 4 * blocksize}
+	cache, _ := newTestCache(t, storage, map[string]string{"/file": string(data)}, config, Open)
+	defer cache.CloseCache()
+
+	ino, err := cache.Open("/file")
+	if nil != err {
+		t.Fatal(err)
+	}
+	_, err = cache.Stat(ino)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 100)
+	for _, off := range []int64{0, 10*blocksize - 50, size - 100} {
+		atomic.StoreInt64(&storage.count, 0)
+		n, err := cache.ReadAt(ino, buf, off)
+		if io.EOF == err && len(buf) == n {
+			err = nil
+		}
+		if nil != err || len(buf) != n || !bytes.Equal(data[off:off+100], buf) {
+			t.Error("ReadAt", off, n, err)
+		}
+		if 2*blocksize < storage.count {
+			t.Error("ReadAt downloaded", storage.count)
+		}
+	}
+
+	// read again from cached blocks
+	atomic.StoreInt64(&storage.count, 0)
+	_, err = cache.ReadAt(ino, buf, 0)
+	if nil != err || 0 != storage.count {
+		t.Error("ReadAt cached", storage.count, err)
+	}
+
+	cache.Close(ino)
+
+	// reopen; cached blocks survive and the object is not opened for them
+	ino, err = cache.Open("/file")
+	if nil != err {
+		t.Fatal(err)
+	}
+	atomic.StoreInt64(&storage.opens, 0)
+	atomic.StoreInt64(&storage.count, 0)
+	_, err = cache.ReadAt(ino, buf, 0)
+	if nil != err || 0 != storage.count || 0 != storage.opens {
+		t.Error("ReadAt after reopen", storage.opens, storage.count, err)
+	}
+
+	// write completes the file
+	_, err = cache.WriteAt(ino, []byte("hello"), 5*blocksize)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	rbuf := make([]byte, size)
+	n, err := cache.ReadAt(ino, rbuf, 0)
+	if io.EOF == err && size == n {
+		err = nil
+	}
+	copy(data[5*blocksize:], "hello")
+	if nil != err || size != n || !bytes.Equal(data, rbuf) {
+		t.Error("ReadAt after WriteAt", n, err)
+	}
+
+	cache.Close(ino)
+
+	err = cache.database.View(func(tx *bolt.Tx) (err error) {
+		return (&blocks_t{}).Get(tx, ino)
+	})
+	if errno.ENOENT != err {
+		t.Error("blocks record after WriteAt", err)
+	}
+}
+
+func TestSparseReadChanged(t *testing.T) {
+	const blocksize = 4096
+	const size = 16 * blocksize
+
+	storage := objiotest.NewMemObjectStorage(false)
+	config := &Config{BlockSize: blocksize}
+	cache, _ := newTestCache(t, storage, map[string]string{
+		"/file": string(make([]byte, size)),
+	}, config, Open)
+	defer cache.CloseCache()
+
+	read := func(off int64) (err error) {
+		ino, err := cache.Open("/file")
+		if nil != err {
+			t.Fatal(err)
+		}
+		defer cache.Close(ino)
+		_, err = cache.Stat(ino)
+		if nil == err {
+			_, err = cache.ReadAt(ino, make([]byte, 100), off)
+		}
+		return
+	}
+
+	err := read(0)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	// the object changes after the sparse file is opened, but before a
+	// missing block is read from it
+	ino, err := cache.Open("/file")
+	if nil == err {
+		_, err = cache.Stat(ino)
+	}
+	if nil == err {
+		_, err = cache.ReadAt(ino, make([]byte, 100), 0)
+	}
+	if nil != err {
+		t.Fatal(err)
+	}
+	writeTestObjects(t, storage, map[string]string{"/file": string(make([]byte, size))})
+	_, err = cache.ReadAt(ino, make([]byte, 100), 10*blocksize)
+	cache.Close(ino)
+	if !errors.HasAttachment(err, errno.ESTALE) {
+		t.Error("ReadAt after change", err)
+	}
+
+	// the sparse file is started anew when it is next opened
+	err = read(10 * blocksize)
+	if nil != err {
+		t.Error("ReadAt after reopen", err)
+	}
+}
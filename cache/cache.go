@@ -21,9 +21,11 @@ import (
 	"unsafe"
 
 	"bytes"
+	"container/heap"
 	"crypto/sha256"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path"
 	"path/filepath"
@@ -39,7 +41,7 @@ import (
 	"github.com/boltdb/bolt"
 )
 
-const Version = 1 // bump version when database format changes
+const Version = 3 // bump version when database format changes (see migrations)
 
 const (
 	DefaultDirPathTimeout  = time.Second * 10
@@ -49,6 +51,10 @@ const (
 	DefaultLoopPeriod      = time.Second * 10
 	DefaultUploadDelay     = DefaultLoopPeriod
 	DefaultEvictDelay      = DefaultLoopPeriod * 3
+	DefaultPartSize        = objio.DefaultPartSize
+	DefaultParallelism     = objio.DefaultParallelism
+	DefaultBlockSize       = 1024 * 1024
+	DefaultUploadWorkers   = 4
 )
 
 type Config struct {
@@ -73,12 +79,58 @@ type Config struct {
 
 	// UploadDelay is how long the background thread will wait before evicting a file.
 	EvictDelay time.Duration
+
+	// PartSize is the size of the parts that large files are transferred in.
+	PartSize int64
+
+	// Parallelism is the maximum number of parts transferred concurrently.
+	// A value of 1 disables multi-part transfers.
+	Parallelism int
+
+	// UploadWorkers is the maximum number of files uploaded (or evicted)
+	// concurrently by the background thread. Each upload may itself transfer
+	// up to Parallelism parts concurrently.
+	UploadWorkers int
+
+	// UploadPolicy controls the order and the times in which the background
+	// thread uploads files.
+	UploadPolicy UploadPolicy
+
+	// BlockSize is the size of the blocks that files are cached in when they
+	// are only read. Blocks are downloaded as they are read, using ranged reads
+	// on storages that support them. A negative value disables block caching,
+	// in which case files are downloaded in full when first accessed.
+	BlockSize int64
+
+	// MaxCacheSize is the maximum disk space used by cached files. When it is
+	// exceeded the least recently used files that are not modified are evicted.
+	// A value of 0 means no limit.
+	MaxCacheSize int64
+
+	// MinFreeSpace is the minimum disk space that is kept free on the disk that
+	// holds the cache. A value of 0 means no limit.
+	MinFreeSpace int64
+
+	// ConflictPolicy determines how a modified file is uploaded when its
+	// object has changed on storage since the file was cached.
+	ConflictPolicy ConflictPolicy
+
+	// Consistency determines when cached files are revalidated against
+	// storage as they are opened. The zero policy revalidates them every
+	// time.
+	Consistency ConsistencyPolicy
+
+	// Verify hashes the cached files when the cache is opened (and when it
+	// lists its files) to find the modified files, instead of trusting the
+	// dirty state recorded for files that have not changed since.
+	Verify bool
 }
 
 const (
 	OpenIfExists = 0
 	Open         = 1
 	Activate     = 2
+	Inspect      = 3 // open existing cache as is (for Check)
 )
 
 type Cache struct {
@@ -87,6 +139,8 @@ type Cache struct {
 	storage   objio.ObjectStorage
 	config    Config
 	isCaseIns bool
+	caps      objio.Capability
+	maxsize   int64
 	infomux   sync.Mutex
 	info      objio.StorageInfo
 	infotime  time.Time
@@ -99,8 +153,22 @@ type Cache struct {
 	lrumux    sync.Mutex
 	rwmap     map[uint64]*lruitem_t
 	rwlst     link_t
+	rankq     []*lruitem_t // rwlst items to rank for an ordered upload policy
+	waitq     uploadq_t    // ranked items by ready time
+	readyq    uploadq_t    // ranked items that are ready, by upload policy
 	romap     map[uint64]*lruitem_t
 	rolst     link_t
+	validmux  sync.Mutex
+	validmap  map[uint64]time.Time // files last validated against storage
+	space     space_t
+	stats     stats_t
+	hostname  string
+	offmux    sync.Mutex
+	offline   bool
+	nochanges bool
+	listener  net.Listener
+	ctlmux    sync.Mutex
+	ctlconns  map[net.Conn]struct{} // control connections being served
 	done      chan struct{}
 	wg        sync.WaitGroup
 }
@@ -125,9 +193,20 @@ func OpenCache(
 		return
 	}
 
+	cfg := Config{}
+	if nil != config {
+		cfg = *config
+	}
+	cfg.setDefaults()
+	err = cfg.validate()
+	if nil != err {
+		err = errors.New("", err)
+		return
+	}
+
 	idxpath := filepath.Join(path, "index")
 
-	if OpenIfExists == flag {
+	if OpenIfExists == flag || Inspect == flag {
 		_, err = os.Stat(idxpath)
 		if nil != err {
 			err = errors.New("", err)
@@ -141,6 +220,7 @@ func OpenCache(
 		return
 	}
 	isCaseIns := info.IsCaseInsensitive()
+	caps, maxsize := objio.GetCapabilities(info)
 
 	err = os.MkdirAll(path, 0700)
 	if nil != err {
@@ -154,42 +234,50 @@ func OpenCache(
 		return
 	}
 
-	err = database.Update(func(tx *bolt.Tx) (err error) {
-		metaname := []byte("m")
-		vername := []byte("version")
-
-		var verbuf [8]byte
-		putUint64(verbuf[:], 0, Version)
-
-		var version []byte
-		meta := tx.Bucket(metaname)
-		if nil != meta {
-			version = meta.Get(vername)
-		} else if nil == tx.Bucket(idxname) {
-			meta, err = tx.CreateBucket(metaname)
-			if nil != err {
-				return
-			}
+	err = backupDatabase(database, idxpath)
+	if nil != err {
+		database.Close()
+		err = errors.New("", err)
+		return
+	}
 
-			version = verbuf[:]
-			err = meta.Put(vername, version)
+	err = database.Update(func(tx *bolt.Tx) (err error) {
+		if nil == tx.Bucket(metaname) && nil == tx.Bucket(idxname) {
+			err = putDatabaseVersion(tx, Version)
 			if nil != err {
 				return
 			}
 		}
 
-		if !bytes.Equal(verbuf[:], version) {
-			err = errors.New("incorrect database version")
-			return
-		}
-
 		_, err = tx.CreateBucketIfNotExists(idxname)
 		if nil == err {
 			_, err = tx.CreateBucketIfNotExists(catname)
 		}
+		if nil == err {
+			_, err = tx.CreateBucketIfNotExists(sessname)
+		}
+		if nil == err {
+			_, err = tx.CreateBucketIfNotExists(mtimename)
+		}
+		if nil == err {
+			_, err = tx.CreateBucketIfNotExists(blockname)
+		}
+		if nil == err {
+			_, err = tx.CreateBucketIfNotExists(pinname)
+		}
+		if nil == err {
+			_, err = tx.CreateBucketIfNotExists(conflictname)
+		}
+		if nil == err {
+			_, err = tx.CreateBucketIfNotExists(journalname)
+		}
+		if nil == err {
+			err = migrateDatabase(tx)
+		}
 		return
 	})
 	if nil != err {
+		database.Close()
 		err = errors.New("", err)
 		return
 	}
@@ -199,43 +287,108 @@ func OpenCache(
 		database:  database,
 		storage:   storage,
 		isCaseIns: isCaseIns,
+		caps:      caps,
+		maxsize:   maxsize,
 		pathmap:   map[string]*pathmux_t{},
 		openmap:   map[uint64]*node_t{},
 		rwmap:     map[uint64]*lruitem_t{},
 		romap:     map[uint64]*lruitem_t{},
+		validmap:  map[uint64]time.Time{},
 		wg:        sync.WaitGroup{},
 	}
 	self.rwlst.Init()
 	self.rolst.Init()
 
-	if nil != config {
-		self.config = *config
-	}
-	if 0 >= self.config.DirPathTimeout {
-		self.config.DirPathTimeout = DefaultDirPathTimeout
-	}
-	if 0 >= self.config.DirPathMaxCount {
-		self.config.DirPathMaxCount = DefaultDirPathMaxCount
-	}
-	if 0 >= self.config.NegPathTimeout {
-		self.config.NegPathTimeout = DefaultNegPathTimeout
-	}
-	if 0 >= self.config.NegPathMaxCount {
-		self.config.NegPathMaxCount = DefaultNegPathMaxCount
-	}
-	if 0 >= self.config.LoopPeriod {
-		self.config.LoopPeriod = DefaultLoopPeriod
+	self.config = cfg
+	self.waitq.less = func(a *lruitem_t, b *lruitem_t) bool { return a.ready < b.ready }
+	self.readyq.less = self.config.UploadPolicy.before
+
+	self.hostname, _ = os.Hostname()
+
+	self.database.View(func(tx *bolt.Tx) (err error) {
+		// remain offline until the journal has been replayed
+		k, _ := tx.Bucket(journalname).Cursor().First()
+		self.offline = nil != k
+		return
+	})
+
+	self.dirpres = newPathPresenceCache(self.config.DirPathTimeout, self.config.DirPathMaxCount)
+	self.negpres = newPathPresenceCache(self.config.NegPathTimeout, self.config.NegPathMaxCount)
+
+	if Inspect != flag {
+		self.removeOrphans()
 	}
-	if 0 >= self.config.UploadDelay {
-		self.config.UploadDelay = DefaultUploadDelay
+
+	past := time.Now().Add(-self.config.UploadDelay - self.config.EvictDelay).UnixNano()
+	var stalekeys [][]byte
+	var stalenodes []node_t
+	self.database.View(func(tx *bolt.Tx) (err error) {
+		ntx := nodetx_t{Tx: tx}
+		cursor := ntx.Cat().Cursor()
+		for k, v := cursor.First(); nil != k; k, v = cursor.Next() {
+			n := node_t{}
+			if nil != n.Decode(v) {
+				continue
+			}
+
+			item := &lruitem_t{ino: n.Ino, atime: past}
+			if nil == (&blocks_t{}).Get(tx, n.Ino) {
+				// sparse files are never dirty
+				self.romap[n.Ino] = item
+				item.InsertTail(&self.rolst)
+				continue
+			}
+			dirty, stale, err0 := self.fileState(&n, self.config.Verify)
+			if nil != err0 || !dirty {
+				self.romap[n.Ino] = item
+				item.InsertTail(&self.rolst)
+			} else {
+				self.rwmap[n.Ino] = item
+				item.InsertTail(&self.rwlst)
+				self.unrankItem(item)
+			}
+			if stale {
+				stalekeys = append(stalekeys, append([]byte(nil), k...))
+				stalenodes = append(stalenodes, n)
+			}
+		}
+
+		return
+	})
+
+	if 0 != len(stalekeys) && Inspect != flag {
+		// record the state of files that had to be hashed, so that they need
+		// not be hashed again the next time
+		self.database.Update(func(tx *bolt.Tx) (err error) {
+			ntx := nodetx_t{Tx: tx}
+			for i, k := range stalekeys {
+				err = stalenodes[i].Put(&ntx, k)
+				if nil != err {
+					return
+				}
+			}
+			return
+		})
 	}
-	if 0 >= self.config.EvictDelay {
-		self.config.EvictDelay = DefaultEvictDelay
+
+	self.measureSpace()
+
+	if Activate == flag {
+		_ = self.resetCache(true, nil)
+
+		self.done = make(chan struct{})
+		self.wg.Add(1)
+		go self.loop()
+
+		self.startControl()
 	}
 
-	self.dirpres = newPathPresenceCache(self.config.DirPathTimeout, self.config.DirPathMaxCount)
-	self.negpres = newPathPresenceCache(self.config.NegPathTimeout, self.config.NegPathMaxCount)
+	return
+}
 
+// removeOrphans removes cached files, upload sessions and sparse file records
+// that belong to no node, as may be left behind by a crash.
+func (self *Cache) removeOrphans() {
 	self.database.View(func(tx *bolt.Tx) (err error) {
 		ntx := nodetx_t{Tx: tx}
 		filepath.Walk(self.path, func(path string, stat os.FileInfo, err error) error {
@@ -260,45 +413,55 @@ func OpenCache(
 		return
 	})
 
-	past := time.Now().Add(-self.config.UploadDelay - self.config.EvictDelay).UnixNano()
-	self.database.View(func(tx *bolt.Tx) (err error) {
+	self.database.Update(func(tx *bolt.Tx) (err error) {
 		ntx := nodetx_t{Tx: tx}
-		cursor := ntx.Cat().Cursor()
-		for k, v := cursor.First(); nil != k; k, v = cursor.Next() {
+		keys := make([][]byte, 0, 16)
+		cursor := tx.Bucket(sessname).Cursor()
+		for k, _ := cursor.First(); nil != k; k, _ = cursor.Next() {
+			_, ino := getUint64(k, 0)
 			n := node_t{}
-			if nil != n.Decode(v) {
-				continue
+			if errno.ENOENT == n.GetWithIno(&ntx, ino) {
+				keys = append(keys, append([]byte(nil), k...))
 			}
+		}
 
-			item := &lruitem_t{ino: n.Ino, atime: past}
-			hash, err0 := hashFile(self.filePath(n.Ino))
-			if nil != err0 || bytes.Equal(n.Hash, hash) {
-				self.romap[n.Ino] = item
-				item.InsertTail(&self.rolst)
-			} else {
-				self.rwmap[n.Ino] = item
-				item.InsertTail(&self.rwlst)
+		for _, k := range keys {
+			tx.Bucket(sessname).Delete(k)
+		}
+
+		keys = keys[:0]
+		cursor = tx.Bucket(blockname).Cursor()
+		for k, _ := cursor.First(); nil != k; k, _ = cursor.Next() {
+			_, ino := getUint64(k, 0)
+			n := node_t{}
+			if errno.ENOENT == n.GetWithIno(&ntx, ino) {
+				keys = append(keys, append([]byte(nil), k...))
 			}
 		}
 
+		for _, k := range keys {
+			tx.Bucket(blockname).Delete(k)
+		}
+
 		return
 	})
-
-	if Activate == flag {
-		_ = self.resetCache(true, nil)
-
-		self.done = make(chan struct{})
-		self.wg.Add(1)
-		go self.loop()
-	}
-
-	return
 }
 
 func (self *Cache) Storage() objio.ObjectStorage {
 	return self.storage
 }
 
+// Config gets the effective configuration of the cache.
+func (self *Cache) Config() Config {
+	return self.config
+}
+
+// Capabilities gets the capabilities and maximum object size (0 for no
+// limit) of the underlying storage.
+func (self *Cache) Capabilities() (objio.Capability, int64) {
+	return self.caps, self.maxsize
+}
+
 func (self *Cache) ListCache() (paths []string) {
 	self.database.View(func(tx *bolt.Tx) (err error) {
 		ntx := nodetx_t{Tx: tx}
@@ -311,10 +474,10 @@ func (self *Cache) ListCache() (paths []string) {
 
 			path := n.Path
 
-			hash, err0 := hashFile(self.filePath(n.Ino))
+			dirty, _, err0 := self.fileState(&n, self.config.Verify)
 			if nil != err0 {
 				path = "-" + path
-			} else if bytes.Equal(n.Hash, hash) {
+			} else if nil == (&blocks_t{}).Get(tx, n.Ino) || !dirty {
 				path = "=" + path
 			} else {
 				path = "+" + path
@@ -328,12 +491,45 @@ func (self *Cache) ListCache() (paths []string) {
 	return
 }
 
+// fileState determines if the cached file of a node is dirty, i.e. modified
+// since it was downloaded or uploaded. The state recorded in the node is
+// trusted for as long as the file has the size and mtime recorded with it.
+// Otherwise (or if verify is true) the file is hashed and compared against
+// the node hash; the state so found is recorded in the node and stale is true
+// if the node should be saved.
+func (self *Cache) fileState(node *node_t, verify bool) (dirty bool, stale bool, err error) {
+	filePath := self.filePath(node.Ino)
+
+	fileinfo, err := os.Stat(filePath)
+	if nil != err {
+		return
+	}
+
+	dirty, ok := node.FileState(fileinfo)
+	if ok && !verify {
+		return
+	}
+
+	hash, err := hashFile(filePath)
+	if nil != err {
+		return
+	}
+
+	modified := !bytes.Equal(node.Hash, hash)
+	stale = !ok || modified != dirty
+	dirty = modified
+	node.SetFileState(dirty, fileinfo)
+
+	return
+}
+
 func (self *Cache) ResetCache(progress func(path string)) (err error) {
 	return self.resetCache(true, progress)
 }
 
 func (self *Cache) CloseCache() (err error) {
 	if nil != self.done {
+		self.stopControl()
 		close(self.done)
 		self.wg.Wait()
 
@@ -435,109 +631,353 @@ func (self *Cache) Chtime(ino uint64, mtime time.Time) (err error) {
 	return
 }
 
-func (self *Cache) Readdir(ino uint64, maxcount int) (infos []objio.ObjectInfo, err error) {
+func (self *Cache) Symlink(ino uint64, target string) (err error) {
 	node, err := self.getOpenNode(ino)
 	if nil == err {
-		infos, err = self.readdirNode(node, maxcount)
+		err = self.symlinkNode(node, target)
 	}
 
 	return
 }
 
-func (self *Cache) ReadAt(ino uint64, buf []byte, off int64) (n int, err error) {
+func (self *Cache) Readlink(ino uint64) (target string, err error) {
 	node, err := self.getOpenNode(ino)
 	if nil == err {
-		err = self.performFileIoOnNode(node, true, -1, func(file *os.File) (err error) {
-			n, err = file.ReadAt(buf, off)
-			return
-		})
+		target, err = self.readlinkNode(node)
 	}
 
 	return
 }
 
-func (self *Cache) WriteAt(ino uint64, buf []byte, off int64) (n int, err error) {
-	node, err := self.getOpenNode(ino)
-	if nil == err {
-		err = self.performFileIoOnNode(node, true, -1, func(file *os.File) (err error) {
-			n, err = file.WriteAt(buf, off)
-			if nil == err {
-				self.touchIno(node.Ino, true)
-			}
-			return
-		})
+// Prefetch populates the catalog with the entries below prefix, in the same
+// way that Readdir does, so that later lookups are satisfied from the cache.
+// Directories are listed at most depth levels below prefix; a negative depth
+// means no limit. If content is set the files are also downloaded, with at
+// most Parallelism downloads proceeding concurrently.
+func (self *Cache) Prefetch(
+	prefix string, depth int, content bool, progress func(path string)) (err error) {
+
+	prefix = path.Clean("/" + prefix)
+
+	if nil != progress {
+		var mux sync.Mutex
+		fn := progress
+		progress = func(path string) {
+			mux.Lock()
+			defer mux.Unlock()
+			fn(path)
+		}
+	}
+
+	var files chan string
+	var wg sync.WaitGroup
+	var errmux sync.Mutex
+	var fileErr error
+	if content {
+		files = make(chan string)
+		for i := 0; self.config.Parallelism > i; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for p := range files {
+					err := self.prefetchFile(p, progress)
+					if nil != err {
+						errmux.Lock()
+						if nil == fileErr {
+							fileErr = err
+						}
+						errmux.Unlock()
+					}
+				}
+			}()
+		}
+	}
+
+	err = self.prefetchDir(prefix, depth, files, progress)
+
+	if content {
+		close(files)
+		wg.Wait()
+
+		if nil == err {
+			err = fileErr
+		}
 	}
 
 	return
 }
 
-func (self *Cache) Truncate(ino uint64, size int64) (err error) {
-	node, err := self.getOpenNode(ino)
-	if nil == err {
-		err = self.performFileIoOnNode(node, true, size, func(file *os.File) (err error) {
-			err = file.Truncate(size)
-			if nil == err {
-				self.touchIno(node.Ino, true)
+func (self *Cache) prefetchDir(
+	dir string, depth int, files chan<- string, progress func(path string)) (err error) {
+
+	ino, err := self.Open(dir)
+	if nil != err {
+		return
+	}
+
+	infos, err := self.Readdir(ino, 0)
+	self.Close(ino)
+	if nil != err {
+		return
+	}
+
+	if nil != progress {
+		progress("=" + strings.TrimSuffix(dir, "/") + "/")
+	}
+
+	for _, info := range infos {
+		p := path.Join(dir, info.Name())
+		if info.IsDir() {
+			if 0 != depth {
+				err = self.prefetchDir(p, depth-1, files, progress)
+				if nil != err {
+					return
+				}
 			}
-			return
-		})
+		} else if nil != files && !objio.IsSymlink(info) {
+			files <- p
+		}
 	}
 
 	return
 }
 
-func (self *Cache) Sync(ino uint64) (err error) {
+func (self *Cache) prefetchFile(path string, progress func(path string)) (err error) {
+	ino, err := self.Open(path)
+	if nil != err {
+		return
+	}
+	defer self.Close(ino)
+
 	node, err := self.getOpenNode(ino)
 	if nil == err {
-		err = self.performFileIoOnNode(node, false, -1, func(file *os.File) (err error) {
-			err = file.Sync()
-			return
+		err = self.ensureSpace(self.readSpace(node, -1))
+	}
+	if nil == err {
+		err = self.performFileIoOnNode(node, true, -1, func(file *os.File) error {
+			return nil
 		})
 	}
+	if nil != err {
+		return
+	}
+
+	if nil != progress {
+		progress("=" + path)
+	}
 
 	return
 }
 
-func (self *Cache) Close(ino uint64) (err error) {
-	closefile := false
+// Pin pins a file or directory so that it is available offline. The files
+// of a pinned path (recursively for a directory) are downloaded and they are
+// never evicted. Pinning a path again downloads any files added since.
+func (self *Cache) Pin(p string, progress func(path string)) (err error) {
+	p = path.Clean("/" + p)
 
-	self.openmux.Lock()
-	n := self.openmap[ino]
-	if nil == n {
-		err = errno.EBADF
-	} else {
-		if 0 == n.Dereference() {
-			closefile = true
-			delete(self.openmap, ino)
-		}
+	info, err := self.storage.Stat(p)
+	if nil != err {
+		return
 	}
-	self.openmux.Unlock()
 
-	if closefile {
-		_ = self.closeNode(n)
+	pathKey := self.pathKey(p)
+	err = self.database.Update(func(tx *bolt.Tx) (err error) {
+		return putPin(tx, []byte(pathKey), p)
+	})
+	if nil != err {
+		return
 	}
 
-	return
-}
-
-func (self *Cache) getOpenNode(ino uint64) (node *node_t, err error) {
-	self.openmux.Lock()
-	n := self.openmap[ino]
-	if nil == n {
-		err = errno.EBADF
-	} else {
-		node = n
+	if info.IsDir() {
+		err = self.Prefetch(p, -1, true, progress)
+	} else if !objio.IsSymlink(info) {
+		err = self.prefetchFile(p, progress)
 	}
-	self.openmux.Unlock()
 
 	return
 }
 
-func (self *Cache) openNode(path string) (node *node_t, err error) {
-	if !strings.HasPrefix(path, "/") {
-		err = errno.ENOENT
-		return
-	}
+// Unpin removes the pin from a file or directory. Its files become subject
+// to eviction again.
+func (self *Cache) Unpin(p string) (err error) {
+	p = path.Clean("/" + p)
+
+	k := []byte(self.pathKey(p))
+	inos := make([]uint64, 0, 16)
+	err = self.database.Update(func(tx *bolt.Tx) (err error) {
+		_, err = getPin(tx, k)
+		if nil != err {
+			return
+		}
+
+		err = putPin(tx, k, "")
+		if nil != err {
+			return
+		}
+
+		ntx := nodetx_t{Tx: tx}
+		cursor := ntx.Cat().Cursor()
+		for i, v := cursor.Seek(k); nil != i; i, v = cursor.Next() {
+			if !pathKeyHasPrefix(i, k) {
+				break
+			}
+
+			n := node_t{}
+			if nil == n.Decode(v) && !n.IsDir {
+				inos = append(inos, n.Ino)
+			}
+		}
+
+		return
+	})
+	if nil != err {
+		return
+	}
+
+	// enter the files in rolst so that they can be evicted again
+	for _, ino := range inos {
+		self.touchIno(ino, false)
+	}
+
+	return
+}
+
+// ListPins lists the pinned paths.
+func (self *Cache) ListPins() (paths []string) {
+	self.database.View(func(tx *bolt.Tx) (err error) {
+		cursor := tx.Bucket(pinname).Cursor()
+		for k, v := cursor.First(); nil != k; k, v = cursor.Next() {
+			paths = append(paths, string(v))
+		}
+
+		return
+	})
+
+	return
+}
+
+func (self *Cache) Readdir(ino uint64, maxcount int) (infos []objio.ObjectInfo, err error) {
+	node, err := self.getOpenNode(ino)
+	if nil == err {
+		infos, err = self.readdirNode(node, maxcount)
+	}
+
+	return
+}
+
+func (self *Cache) ReadAt(ino uint64, buf []byte, off int64) (n int, err error) {
+	node, err := self.getOpenNode(ino)
+	if nil == err {
+		err = self.ensureSpace(self.readSpace(node, len(buf)))
+	}
+	if nil == err {
+		err = self.performReadIoOnNode(node, off, len(buf), func(file *os.File) (err error) {
+			n, err = file.ReadAt(buf, off)
+			return
+		})
+	}
+
+	return
+}
+
+func (self *Cache) WriteAt(ino uint64, buf []byte, off int64) (n int, err error) {
+	node, err := self.getOpenNode(ino)
+	if nil == err {
+		err = self.ensureSpace(self.readSpace(node, -1) + int64(len(buf)))
+	}
+	if nil == err {
+		err = self.performFileIoOnNode(node, true, -1, func(file *os.File) (err error) {
+			var grow int64
+			if fileinfo, err0 := file.Stat(); nil == err0 && off+int64(len(buf)) > fileinfo.Size() {
+				grow = off + int64(len(buf)) - fileinfo.Size()
+			}
+			n, err = file.WriteAt(buf, off)
+			if nil == err {
+				self.space.Add(grow)
+				self.touchIno(node.Ino, true)
+			}
+			return
+		})
+	}
+
+	return
+}
+
+func (self *Cache) Truncate(ino uint64, size int64) (err error) {
+	node, err := self.getOpenNode(ino)
+	if nil == err {
+		err = self.ensureSpace(size)
+	}
+	if nil == err {
+		err = self.performFileIoOnNode(node, true, size, func(file *os.File) (err error) {
+			var grow int64
+			if fileinfo, err0 := file.Stat(); nil == err0 {
+				grow = size - fileinfo.Size()
+			}
+			err = file.Truncate(size)
+			if nil == err {
+				self.space.Add(grow)
+				self.touchIno(node.Ino, true)
+			}
+			return
+		})
+	}
+
+	return
+}
+
+func (self *Cache) Sync(ino uint64) (err error) {
+	node, err := self.getOpenNode(ino)
+	if nil == err {
+		err = self.performFileIoOnNode(node, false, -1, func(file *os.File) (err error) {
+			err = file.Sync()
+			return
+		})
+	}
+
+	return
+}
+
+func (self *Cache) Close(ino uint64) (err error) {
+	closefile := false
+
+	self.openmux.Lock()
+	n := self.openmap[ino]
+	if nil == n {
+		err = errno.EBADF
+	} else {
+		if 0 == n.Dereference() {
+			closefile = true
+			delete(self.openmap, ino)
+		}
+	}
+	self.openmux.Unlock()
+
+	if closefile {
+		_ = self.closeNode(n)
+	}
+
+	return
+}
+
+func (self *Cache) getOpenNode(ino uint64) (node *node_t, err error) {
+	self.openmux.Lock()
+	n := self.openmap[ino]
+	if nil == n {
+		err = errno.EBADF
+	} else {
+		node = n
+	}
+	self.openmux.Unlock()
+
+	return
+}
+
+func (self *Cache) openNode(path string) (node *node_t, err error) {
+	if !strings.HasPrefix(path, "/") {
+		err = errno.ENOENT
+		return
+	}
 
 	pathKey := self.pathKey(path)
 	self.lockPath(pathKey)
@@ -591,11 +1031,50 @@ func (self *Cache) makeNode(node *node_t, dir bool) (err error) {
 	}
 
 	var info objio.ObjectInfo
+	offline := self.isOffline()
+	if !offline {
+		info, err = self.makeOnStorage(node.Path, dir)
+		if nil != err {
+			if !self.setOffline(err) {
+				return
+			}
+			offline = true
+		}
+	}
+
+	if offline {
+		return self.makeNodeOffline(node, pathKey, dir)
+	}
+
+	n := *node
+	n.CopyStat(info)
+
+	k := []byte(pathKey)
+	err = self.database.Update(func(tx *bolt.Tx) (err error) {
+		ntx := nodetx_t{Tx: tx}
+		err = n.Put(&ntx, k)
+		return
+	})
+	if nil != err {
+		return
+	}
+
+	node.CopyStat(info)
+
+	self.negpres.removePath(pathKey)
+
+	return
+}
+
+func (self *Cache) makeOnStorage(p string, dir bool) (info objio.ObjectInfo, err error) {
 	if dir {
-		info, err = self.storage.Mkdir(node.Path)
+		info, err = self.storage.Mkdir(p)
+		if nil == err && 0 == self.caps&objio.CapEmptyDir {
+			err = self.makePlaceholder(p)
+		}
 	} else {
 		var writer objio.WriteWaiter
-		writer, err = self.storage.OpenWrite(node.Path, 0)
+		writer, err = self.storage.OpenWrite(p, 0)
 		if nil != err {
 			return
 		}
@@ -604,24 +1083,75 @@ func (self *Cache) makeNode(node *node_t, dir bool) (err error) {
 		info, err = writer.Wait()
 	}
 
-	if nil != err {
-		return
-	}
+	return
+}
+
+// makeNodeOffline makes a node in the catalog only and journals the make.
+// A file is made as an empty cached file that is uploaded when the cache is
+// back online.
+func (self *Cache) makeNodeOffline(node *node_t, pathKey string, dir bool) (err error) {
+	now := time.Now()
 
 	n := *node
-	n.CopyStat(info)
+	n.Size = 0
+	n.Btime = now
+	n.Mtime = now
+	n.IsDir = dir
+	n.Sig = ""
+	n.Hash = nil
+	n.Valid = true
+	n.SetLink(false, "")
+
+	var fileinfo os.FileInfo
+	if !dir {
+		filePath := self.filePath(n.Ino)
+
+		err = os.MkdirAll(filepath.Dir(filePath), 0700)
+		if nil != err {
+			return
+		}
+
+		var file *os.File
+		file, err = openFile(filePath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+		if nil != err {
+			return
+		}
+		file.Close()
+
+		os.Chtimes(filePath, now, now)
+
+		// a new file is dirty until it is uploaded
+		fileinfo, _ = os.Stat(filePath)
+		n.SetFileState(true, fileinfo)
+	}
+
+	op := uint8(journalMkdir)
+	if !dir {
+		op = journalCreate
+	}
 
 	k := []byte(pathKey)
 	err = self.database.Update(func(tx *bolt.Tx) (err error) {
 		ntx := nodetx_t{Tx: tx}
 		err = n.Put(&ntx, k)
+		if nil == err {
+			err = self.putJournal(tx, &journal_t{Op: op, Path: n.Path})
+		}
 		return
 	})
 	if nil != err {
 		return
 	}
 
+	info, _ := n.Stat()
 	node.CopyStat(info)
+	node.SetLink(false, "")
+	node.Hash = nil
+	node.SetFileState(n.Dirty, fileinfo)
+
+	if !dir {
+		self.touchIno(node.Ino, true)
+	}
 
 	self.negpres.removePath(pathKey)
 
@@ -669,10 +1199,13 @@ func (self *Cache) removeNode(node *node_t, dir bool) (err error) {
 		}
 	}
 
-	if dir {
-		err = self.storage.Rmdir(node.Path)
-	} else {
-		err = self.storage.Remove(node.Path)
+	offline := self.isOffline()
+	if !offline {
+		if dir {
+			err = self.removeDirFromStorage(node.Path)
+		} else {
+			err = self.storage.Remove(node.Path)
+		}
 	}
 	if nil != err {
 		if errors.HasAttachment(err, errno.ENOENT) {
@@ -681,19 +1214,40 @@ func (self *Cache) removeNode(node *node_t, dir bool) (err error) {
 			//
 			// For Remove we will process ENOENT as if nothing has happened, but
 			// we will remember to return ENOENT in the end.
+		} else if self.setOffline(err) {
+			offline = true
+			err = nil
 		} else {
 			return
 		}
 	}
 
+	var journal *journal_t
+	if offline {
+		journal = &journal_t{Op: journalRemove, Path: node.Path, Sig: node.Sig}
+		if dir {
+			journal.Op = journalRmdir
+		}
+	}
+
 	err0 := self.database.Update(func(tx *bolt.Tx) (err error) {
 		ntx := nodetx_t{Tx: tx}
 		err = (*node_t)(nil).Put(&ntx, k)
+		if nil == err {
+			err = (*mtime_t)(nil).Put(tx, k)
+		}
+		if nil == err {
+			err = putPin(tx, k, "")
+		}
+		if nil == err && nil != journal {
+			err = self.putJournal(tx, journal)
+		}
 		return
 	})
 
 	if nil == err0 {
 		node.Deleted = true
+		self.setValidated(node.Ino, time.Time{})
 		self.negpres.addPath(pathKey)
 	}
 	if nil == err {
@@ -741,7 +1295,14 @@ func (self *Cache) renameNode(node *node_t, newpath string) (err error) {
 		return
 	}
 
-	err = self.storage.Rename(oldpath, newpath)
+	offline := self.isOffline()
+	if !offline {
+		err = self.renameOnStorage(node, pathKey, oldpath, newpath)
+		if nil != err && self.setOffline(err) {
+			offline = true
+			err = nil
+		}
+	}
 	if nil != err {
 		if errors.HasAttachment(err, errno.ENOENT) {
 			// Our view of the file system namespace is inconsistent with the one
@@ -809,6 +1370,15 @@ func (self *Cache) renameNode(node *node_t, newpath string) (err error) {
 			inos = append(inos, n.Ino)
 		}
 
+		err = self.renameMtimes(tx, k, newk)
+		if nil == err {
+			err = self.renamePins(tx, k, newk, oldpath, newpath)
+		}
+		if nil == err && offline {
+			err = self.putJournal(tx, &journal_t{
+				Op: journalRename, IsDir: node.IsDir, Path: oldpath, NewPath: newpath, Sig: node.Sig})
+		}
+
 		return
 	})
 
@@ -825,6 +1395,8 @@ func (self *Cache) renameNode(node *node_t, newpath string) (err error) {
 	}
 	self.openmux.Unlock()
 
+	self.unrankInos(inos)
+
 	if pathKey != newpathKey {
 		self.negpres.removeAllPath(newpathKey)
 		self.negpres.addPath(pathKey)
@@ -833,50 +1405,136 @@ func (self *Cache) renameNode(node *node_t, newpath string) (err error) {
 	return
 }
 
-func (self *Cache) statNode(node *node_t) (info objio.ObjectInfo, err error) {
-	pathKey := self.pathKey(node.Path)
-	self.lockPath(pathKey)
-	defer self.unlockPath(pathKey)
+// renamePins moves the pins of the renamed nodes.
+func (self *Cache) renamePins(
+	tx *bolt.Tx, k []byte, newk []byte, oldpath string, newpath string) (err error) {
+	if bytes.Equal(k, newk) && oldpath == newpath {
+		return
+	}
 
-	if !node.Valid {
-		if node.Deleted {
-			err = errno.EPERM
+	keys := make([][]byte, 0, 16)
+	cursor := tx.Bucket(pinname).Cursor()
+	for i, _ := cursor.Seek(k); nil != i; i, _ = cursor.Next() {
+		if !pathKeyHasPrefix(i, k) {
+			break
+		}
+
+		keys = append(keys, append([]byte(nil), i...))
+	}
+
+	for _, i := range keys {
+		p, err0 := getPin(tx, i)
+		if nil != err0 {
+			continue
+		}
+
+		err = putPin(tx, i, "")
+		if nil != err {
 			return
 		}
 
-		err = self.statNodeNoLock(node, pathKey)
+		err = putPin(tx, append(append([]byte(nil), newk...), i[len(k):]...),
+			newpath+p[len(oldpath):])
 		if nil != err {
 			return
 		}
 	}
 
-	info, err = node.Stat()
-
 	return
 }
 
-func (self *Cache) statNodeNoLock(node *node_t, pathKey string) (err error) {
-	if self.negpres.hasPath(pathKey) {
-		err = errno.ENOENT
+// renameMtimes moves the recorded modification times of the renamed nodes.
+func (self *Cache) renameMtimes(tx *bolt.Tx, k []byte, newk []byte) (err error) {
+	if bytes.Equal(k, newk) {
 		return
 	}
 
-	var i objio.ObjectInfo
+	err = (*mtime_t)(nil).Put(tx, newk)
+	if nil != err {
+		return
+	}
+
+	keys := make([][]byte, 0, 16)
+	cursor := tx.Bucket(mtimename).Cursor()
+	for i, _ := cursor.Seek(k); nil != i; i, _ = cursor.Next() {
+		if !pathKeyHasPrefix(i, k) {
+			break
+		}
+
+		keys = append(keys, append([]byte(nil), i...))
+	}
+
+	for _, i := range keys {
+		mt := mtime_t{}
+		if nil != mt.Get(tx, i) {
+			continue
+		}
+
+		err = (*mtime_t)(nil).Put(tx, i)
+		if nil != err {
+			return
+		}
+
+		err = mt.Put(tx, append(append([]byte(nil), newk...), i[len(k):]...))
+		if nil != err {
+			return
+		}
+	}
+
+	return
+}
+
+func (self *Cache) statNode(node *node_t) (info objio.ObjectInfo, err error) {
+	pathKey := self.pathKey(node.Path)
+	self.lockPath(pathKey)
+	defer self.unlockPath(pathKey)
+
+	if !node.Valid {
+		if node.Deleted {
+			err = errno.EPERM
+			return
+		}
+
+		err = self.statNodeNoLock(node, pathKey)
+		if nil != err {
+			return
+		}
+	}
+
+	info, err = node.Stat()
+
+	return
+}
+
+func (self *Cache) statNodeNoLock(node *node_t, pathKey string) (err error) {
+	if self.negpres.hasPath(pathKey) || self.isOffline() {
+		// when offline nodes that are not in the catalog do not exist
+		err = errno.ENOENT
+		return
+	}
+
+	var i objio.ObjectInfo
 	i, err = self.storage.Stat(node.Path)
 	if nil != err {
 		if errors.HasAttachment(err, errno.ENOENT) {
 			self.negpres.addPath(pathKey)
+		} else if self.setOffline(err) {
+			err = errno.ENOENT
 		}
 
 		return
 	}
 
+	islink, link := self.statLink(node, i)
+
 	n := *node
-	n.CopyStat(i)
 
 	k := []byte(pathKey)
 	err = self.database.Update(func(tx *bolt.Tx) (err error) {
 		ntx := nodetx_t{Tx: tx}
+		i = applyMtime(tx, k, i)
+		n.CopyStat(i)
+		n.SetLink(islink, link)
 		err = n.Put(&ntx, k)
 		return
 	})
@@ -885,314 +1543,268 @@ func (self *Cache) statNodeNoLock(node *node_t, pathKey string) (err error) {
 	}
 
 	node.CopyStat(i)
+	node.SetLink(islink, link)
 
 	self.negpres.removePath(pathKey)
 
 	return
 }
 
-func (self *Cache) chtimeNode(node *node_t, mtime time.Time) (err error) {
-	err = errno.ENOSYS
-	return
-}
-
-func (self *Cache) readdirNode(node *node_t, maxcount int) (infos []objio.ObjectInfo, err error) {
-	pathKey := self.pathKey(node.Path)
-	self.lockPath(pathKey)
-	defer self.unlockPath(pathKey)
-
-	if node.Deleted {
-		err = errno.EPERM
+// statLink determines if an object is a symbolic link and gets its target if
+// it can be readily determined. XSym symbolic links are read only when the
+// object has changed.
+func (self *Cache) statLink(node *node_t, info objio.ObjectInfo) (islink bool, link string) {
+	if objio.IsSymlink(info) {
+		islink = true
 		return
 	}
 
-	count := maxcount
-
-	if self.dirpres.hasPath(pathKey) {
-		k := []byte(pathKey)
-		err = self.database.View(func(tx *bolt.Tx) (err error) {
-			ntx := nodetx_t{Tx: tx}
-
-			cursor := ntx.Cat().Cursor()
-			for i, v := cursor.Seek(k); nil != i; i, v = cursor.Next() {
-				if !pathKeyHasPrefix(i, k) {
-					break
-				}
+	if info.IsDir() || objio.XSymSize != info.Size() {
+		return
+	}
 
-				if bytes.Equal(i, k) || -1 != bytes.IndexByte(i[len(k)+1:], '/') {
-					continue
-				}
+	if node.Valid && node.Sig == info.Sig() && "" != info.Sig() {
+		islink, link = node.IsLink, node.Link
+		return
+	}
 
-				n := node_t{}
-				err = n.Decode(v)
-				if nil != err {
-					continue
-				}
+	link, err := self.readXSym(node.Path)
+	islink = nil == err
 
-				var info objio.ObjectInfo
-				info, err = n.Stat()
-				if nil != err {
-					return
-				}
+	return
+}
 
-				infos = append(infos, info)
+// readdirLinks determines which of the listed objects that are not already
+// cached are symbolic links. It returns a map of the infos index to target.
+func (self *Cache) readdirLinks(
+	pathKey string, dirpath string, infos []objio.ObjectInfo) (links map[int]string) {
 
-				if 0 < maxcount {
-					count--
-					if 0 >= count {
-						break
-					}
-				}
+	cand := make([]int, 0)
+	self.database.View(func(tx *bolt.Tx) (err error) {
+		ntx := nodetx_t{Tx: tx}
+		for i, info := range infos {
+			if !objio.IsSymlink(info) && (info.IsDir() || objio.XSymSize != info.Size()) {
+				continue
 			}
 
-			return
-		})
+			n := node_t{}
+			if nil == n.Get(&ntx, []byte(path.Join(pathKey, self.pathKey(info.Name())))) {
+				continue
+			}
 
-		if nil != err {
-			infos = nil
+			cand = append(cand, i)
 		}
 
 		return
-	}
+	})
 
-	marker := ""
-	for {
-		var i []objio.ObjectInfo
-		marker, i, err = self.storage.List(node.Path, marker, count)
-		if nil != err {
-			return
+	links = make(map[int]string, len(cand))
+	for _, i := range cand {
+		n := node_t{Path: path.Join(dirpath, infos[i].Name())}
+		if islink, link := self.statLink(&n, infos[i]); islink {
+			links[i] = link
 		}
+	}
 
-		infos = append(infos, i...)
+	return
+}
 
-		if "" == marker {
-			break
-		}
+func (self *Cache) readXSym(name string) (target string, err error) {
+	_, reader, err := self.storage.OpenRead(name, "")
+	if nil != err {
+		return
+	}
+	defer reader.Close()
 
-		if 0 < maxcount {
-			count -= len(i)
-			if 0 >= count {
-				break
-			}
-		}
+	b := make([]byte, objio.XSymSize+1)
+	n, err := io.ReadFull(reader, b)
+	if io.ErrUnexpectedEOF == err {
+		err = nil
+	}
+	if nil != err {
+		return
 	}
 
-	// cache these infos as we may get a flurry of Stat calls
-	inos := make([]uint64, 0, len(infos))
-	err = self.database.Update(func(tx *bolt.Tx) (err error) {
-		ntx := nodetx_t{Tx: tx}
+	target, ok := objio.DecodeXSym(b[:n])
+	if !ok {
+		err = errno.EINVAL
+	}
 
-		for i := range infos {
-			info := infos[i]
-			name := info.Name()
-			k := []byte(path.Join(pathKey, self.pathKey(name)))
+	return
+}
 
-			n := node_t{}
-			err = n.Get(&ntx, k)
-			if nil == err {
-				// Our view of the file system namespace may be inconsistent with the
-				// one in the object storage.
-				//
-				// To minimize user confusion we prefer our information to the one
-				// from the storage.
+func (self *Cache) symlinkNode(node *node_t, target string) (err error) {
+	pathKey := self.pathKey(node.Path)
+	self.lockPath(pathKey)
+	defer self.unlockPath(pathKey)
 
-				info, err = n.Stat()
-				if nil != err {
-					return
-				}
+	if node.Deleted {
+		err = errno.EPERM
+		return
+	}
 
-				infos[i] = info
+	_ = self.statNodeNoLock(node, pathKey)
 
-				inos = append(inos, n.Ino)
-				continue
-			}
+	if node.Valid {
+		err = errno.EEXIST
+		return
+	}
 
-			var ino uint64
-			ino, err = n.NextIno(&ntx)
-			if nil != err {
+	var info objio.ObjectInfo
+	offline := self.isOffline()
+	if !offline {
+		info, err = self.symlinkOnStorage(node.Path, target)
+		if nil != err {
+			if !self.setOffline(err) {
 				return
 			}
+			offline = true
+		}
+	}
 
-			n.Path = path.Join(node.Path, name)
-			n.CopyStat(info)
-
-			err = n.Put(&ntx, k)
-			if nil != err {
-				return
-			}
+	if offline {
+		return self.symlinkNodeOffline(node, pathKey, target)
+	}
 
-			inos = append(inos, ino)
-		}
+	n := *node
+	n.CopyStat(info)
+	n.SetLink(true, target)
 
+	k := []byte(pathKey)
+	err = self.database.Update(func(tx *bolt.Tx) (err error) {
+		ntx := nodetx_t{Tx: tx}
+		err = n.Put(&ntx, k)
 		return
 	})
-
 	if nil != err {
-		infos = nil
 		return
 	}
 
-	for _, ino := range inos {
-		self.touchIno(ino, false)
-	}
+	node.CopyStat(info)
+	node.SetLink(true, target)
 
-	self.dirpres.addPath(pathKey)
 	self.negpres.removePath(pathKey)
 
 	return
 }
 
-func (self *Cache) performFileIoOnNode(
-	node *node_t, ensure bool, size int64, fn func(file *os.File) error) (
-	err error) {
+// symlinkNodeOffline makes a symlink node in the catalog only and journals
+// the symlink.
+func (self *Cache) symlinkNodeOffline(node *node_t, pathKey string, target string) (err error) {
+	now := time.Now()
 
-	pathKey := self.pathKey(node.Path)
-	self.lockPath(pathKey)
-	defer self.unlockPath(pathKey)
+	n := *node
+	n.Size = 0
+	n.Btime = now
+	n.Mtime = now
+	n.IsDir = false
+	n.Sig = ""
+	n.Hash = nil
+	n.Valid = true
+	n.SetLink(true, target)
 
-	if ensure && nil == node.File {
-		if node.Deleted {
-			err = errno.EPERM
-			return
+	k := []byte(pathKey)
+	err = self.database.Update(func(tx *bolt.Tx) (err error) {
+		ntx := nodetx_t{Tx: tx}
+		err = n.Put(&ntx, k)
+		if nil == err {
+			err = self.putJournal(tx, &journal_t{Op: journalSymlink, Path: n.Path, NewPath: target})
 		}
+		return
+	})
+	if nil != err {
+		return
+	}
 
-		var info objio.ObjectInfo
-		var hash []byte
-		var file *os.File
-		info, hash, file, err = self.readNodeFromStorage(node, size)
-		if nil != err {
-			return
-		}
+	info, _ := n.Stat()
+	node.CopyStat(info)
+	node.SetLink(true, target)
+	node.Hash = nil
 
-		if nil != info {
-			n := *node
-			n.CopyStat(info)
-			n.Hash = hash
+	self.negpres.removePath(pathKey)
 
-			k := []byte(pathKey)
-			err = self.database.Update(func(tx *bolt.Tx) (err error) {
-				ntx := nodetx_t{Tx: tx}
-				err = n.Put(&ntx, k)
-				return
-			})
-			if nil != err {
-				file.Close()
+	return
+}
+
+// symlinkOnStorage makes a symbolic link on the storage; a storage that does
+// not support symbolic links gets an xsym file instead.
+func (self *Cache) symlinkOnStorage(p string, target string) (info objio.ObjectInfo, err error) {
+	if storage, ok := self.storage.(objio.ObjectStorageSymlink); ok {
+		info, err = storage.Symlink(p, target)
+		if nil != err {
+			if !errors.HasAttachment(err, errno.ENOSYS) {
 				return
 			}
-
-			node.CopyStat(info)
-			node.Hash = hash
+			info, err = nil, nil
 		}
-
-		node.File = file
-
-		self.negpres.removePath(pathKey)
 	}
 
-	if nil != node.File {
-		err = fn(node.File)
-	}
+	if nil == info {
+		var b []byte
+		b, err = objio.EncodeXSym(target)
+		if nil != err {
+			return
+		}
 
-	return
-}
-
-func (self *Cache) readNodeFromStorage(
-	node *node_t, size int64) (
-	info objio.ObjectInfo, hash []byte, file *os.File, err error) {
-
-	filePath := self.filePath(node.Ino)
-	sig := node.Sig
-
-	f, err := openFile(filePath, os.O_RDWR, 0600)
-	if nil != err {
-		sig = ""
-
-		err = os.MkdirAll(filepath.Dir(filePath), 0700)
+		var writer objio.WriteWaiter
+		writer, err = self.storage.OpenWrite(p, int64(len(b)))
 		if nil != err {
 			return
 		}
+		defer writer.Close()
 
-		f, err = openFile(filePath, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
+		_, err = writer.Write(b)
 		if nil != err {
 			return
 		}
 
-		defer func() {
-			if nil != err {
-				os.Remove(filePath)
-			}
-		}()
+		info, err = writer.Wait()
 	}
 
-	defer func() {
-		if nil != err {
-			f.Close()
-		}
-	}()
+	return
+}
 
-	i, reader, err := self.storage.OpenRead(node.Path, sig)
-	if nil != err {
+func (self *Cache) readlinkNode(node *node_t) (target string, err error) {
+	pathKey := self.pathKey(node.Path)
+	self.lockPath(pathKey)
+	defer self.unlockPath(pathKey)
+
+	if node.Deleted {
+		err = errno.EPERM
 		return
 	}
 
-	if nil != reader {
-		defer reader.Close()
-
-		h := sha256.New()
-		reader := io.TeeReader(reader, h)
-
-		if -1 == size {
-			_, err = io.Copy(f, reader)
-		} else {
-			_, err = io.CopyN(f, reader, size)
-			if io.EOF == err {
-				err = nil
-			}
-		}
+	if !node.Valid {
+		err = self.statNodeNoLock(node, pathKey)
 		if nil != err {
 			return
 		}
-
-		info = i
-		hash = h.Sum(nil)
 	}
 
-	file = f
-
-	return
-}
-
-func (self *Cache) closeNode(node *node_t) (err error) {
-	if nil != node.File {
-		if node.Valid && !node.Deleted {
-			err = self.closeAndUpdateNode(node)
-		}
-
-		node.File.Close()
-		node.File = nil
+	if !node.IsLink {
+		err = errno.EINVAL
+		return
 	}
 
-	if node.Valid {
-		self.touchIno(node.Ino, false)
+	if "" != node.Link {
+		target = node.Link
+		return
 	}
 
-	return
-}
-
-func (self *Cache) closeAndUpdateNode(node *node_t) (err error) {
-	pathKey := self.pathKey(node.Path)
-	self.lockPath(pathKey)
-	defer self.unlockPath(pathKey)
-
-	var fileinfo os.FileInfo
-	fileinfo, err = node.File.Stat()
+	xsym := true
+	if storage, ok := self.storage.(objio.ObjectStorageSymlink); ok {
+		target, err = storage.Readlink(node.Path)
+		xsym = nil != err && errors.HasAttachment(err, errno.ENOSYS)
+	}
+	if xsym {
+		target, err = self.readXSym(node.Path)
+	}
 	if nil != err {
 		return
 	}
 
 	n := *node
-	n.Size = fileinfo.Size()
-	n.Mtime = fileinfo.ModTime()
+	n.Link = target
 
 	k := []byte(pathKey)
 	err = self.database.Update(func(tx *bolt.Tx) (err error) {
@@ -1204,349 +1816,2690 @@ func (self *Cache) closeAndUpdateNode(node *node_t) (err error) {
 		return
 	}
 
-	node.Size = n.Size
-	node.Mtime = n.Mtime
+	node.Link = target
 
 	return
 }
 
-func (self *Cache) touchIno(ino uint64, rw bool) {
-	self.lrumux.Lock()
-
-	var thismap, thatmap map[uint64]*lruitem_t
-	var thislst *link_t
+func (self *Cache) chtimeNode(node *node_t, mtime time.Time) (err error) {
+	pathKey := self.pathKey(node.Path)
+	self.lockPath(pathKey)
+	defer self.unlockPath(pathKey)
 
-	if rw {
-		thismap, thatmap = self.rwmap, self.romap
-		thislst = &self.rwlst
-	} else {
-		thismap, thatmap = self.romap, self.rwmap
-		thislst = &self.rolst
+	if node.Deleted {
+		err = errno.EPERM
+		return
 	}
 
-	item := thismap[ino]
-	if nil != item {
-		item.Remove()
-	} else {
-		item = thatmap[ino]
-		if nil != item {
-			if !rw {
-				// The ino is a candidate for upload; we cannot evict it.
-				self.lrumux.Unlock()
-				return
-			}
-			item.Remove()
-			delete(thatmap, ino)
-		} else {
-			item = &lruitem_t{ino: ino}
+	if !node.Valid {
+		err = self.statNodeNoLock(node, pathKey)
+		if nil != err {
+			return
 		}
-		thismap[ino] = item
 	}
 
-	item.atime = time.Now().UnixNano()
-	item.InsertTail(thislst)
+	mtime = mtime.UTC()
+	filePath := self.filePath(node.Ino)
 
+	self.lrumux.Lock()
+	_, dirty := self.rwmap[node.Ino]
 	self.lrumux.Unlock()
-}
 
-func (self *Cache) uploadOne(force bool, progress func(path string)) (err error) {
-	self.lrumux.Lock()
+	// The file state is recorded anew if the file is dirty or if it is known
+	// to be clean. (It may be being uploaded if its state is anything else.)
+	record := dirty
+	if fileinfo, err0 := os.Stat(filePath); nil == err0 {
+		recorded, ok := node.FileState(fileinfo)
+		record = dirty || (ok && !recorded)
+	}
 
-	var item *lruitem_t
-	link := self.rwlst.next
-	if &self.rwlst != link {
-		var i *lruitem_t
-		i = (*lruitem_t)(containerOf(unsafe.Pointer(link), unsafe.Offsetof(i.link_t)))
+	var info objio.ObjectInfo
+	var mt *mtime_t
+	var journal *journal_t
+	if dirty {
+		// The file will be uploaded; defer the change until then.
+		err = os.Chtimes(filePath, mtime, mtime)
+		if nil != err {
+			return
+		}
 
-		if force || i.atime+int64(self.config.UploadDelay) < time.Now().UnixNano() {
-			i.Remove()
-			delete(self.rwmap, i.ino)
-			item = i
+		mt = &mtime_t{Mtime: mtime}
+	} else {
+		offline := self.isOffline()
+		storage, ok := self.storage.(objio.ObjectStorageChtime)
+		if ok && !offline {
+			info, err = storage.Chtime(node.Path, mtime)
+			if nil != err {
+				if self.setOffline(err) {
+					offline = true
+				} else if !errors.HasAttachment(err, errno.ENOSYS) {
+					return
+				} else {
+					ok = false
+				}
+				err = nil
+			}
+		}
+
+		if nil == info {
+			// The storage cannot set the mtime; record it for as long as the
+			// object remains unchanged.
+			mt = &mtime_t{Mtime: mtime, Sig: node.Sig}
+
+			// When offline the mtime is set on the storage once it can be
+			// reached again.
+			if ok && offline && "" != node.Sig {
+				journal = &journal_t{Op: journalChtime, Path: node.Path}
+			}
 		}
+
+		// the file may not be cached
+		os.Chtimes(filePath, mtime, mtime)
 	}
 
-	self.lrumux.Unlock()
+	var fileinfo os.FileInfo
+	if record {
+		fileinfo, _ = os.Stat(filePath)
+	}
 
-	if nil == item {
-		err = errNoItem
-		return
+	n := *node
+	if nil != info {
+		n.CopyStat(info)
+	} else {
+		n.Mtime = mtime
+	}
+	if record {
+		n.SetFileState(dirty, fileinfo)
 	}
 
-	touch := true
-	defer func() {
-		if touch {
-			// If there was an error enter ino in rwlst to retry the upload.
-			// If there was no error enter ino in rolst to evict it.
-			self.touchIno(item.ino, nil != err)
+	k := []byte(pathKey)
+	err = self.database.Update(func(tx *bolt.Tx) (err error) {
+		ntx := nodetx_t{Tx: tx}
+		err = mt.Put(tx, k)
+		if nil == err {
+			err = n.Put(&ntx, k)
 		}
-	}()
-
-	n, pathKey, err := self.getLockedNodeWithIno(item.ino)
-	if nil != err {
-		if errno.ENOENT == err {
-			err = nil
+		if nil == err && nil != journal {
+			err = self.putJournal(tx, journal)
 		}
 		return
+	})
+	if nil != err {
+		return
 	}
-	defer self.unlockPath(pathKey)
 
-	if n.Deleted {
-		// bail if the node is Deleted
-		touch = false
-		return
+	if nil != info {
+		node.CopyStat(info)
+	} else {
+		node.Mtime = mtime
+	}
+	if record {
+		node.SetFileState(dirty, fileinfo)
 	}
 
-	self.lrumux.Lock()
-	_, ok := self.rwmap[item.ino]
-	self.lrumux.Unlock()
-	if ok {
-		// bail if the ino snuck back in
-		touch = false
+	return
+}
+
+func (self *Cache) readdirNode(node *node_t, maxcount int) (infos []objio.ObjectInfo, err error) {
+	pathKey := self.pathKey(node.Path)
+	self.lockPath(pathKey)
+	defer self.unlockPath(pathKey)
+
+	if node.Deleted {
+		err = errno.EPERM
 		return
 	}
 
-	filePath := self.filePath(item.ino)
+	count := maxcount
 
-	file, err := openFile(filePath, os.O_RDONLY, 0)
-	if nil != err {
-		if os.IsNotExist(err) {
-			err = nil
+	if self.dirpres.hasPath(pathKey) || self.isOffline() {
+		k := []byte(pathKey)
+		err = self.database.View(func(tx *bolt.Tx) (err error) {
+			ntx := nodetx_t{Tx: tx}
+
+			cursor := ntx.Cat().Cursor()
+			for i, v := cursor.Seek(k); nil != i; i, v = cursor.Next() {
+				if !pathKeyHasPrefix(i, k) {
+					break
+				}
+
+				if bytes.Equal(i, k) || -1 != bytes.IndexByte(i[len(k)+1:], '/') {
+					continue
+				}
+
+				n := node_t{}
+				err = n.Decode(v)
+				if nil != err {
+					continue
+				}
+
+				var info objio.ObjectInfo
+				info, err = n.Stat()
+				if nil != err {
+					return
+				}
+
+				infos = append(infos, info)
+
+				if 0 < maxcount {
+					count--
+					if 0 >= count {
+						break
+					}
+				}
+			}
+
+			return
+		})
+
+		if nil != err {
+			infos = nil
 		}
-		return
-	}
-	defer file.Close()
 
-	stat, err := file.Stat()
-	if nil != err {
 		return
 	}
 
-	writer, err := self.storage.OpenWrite(n.Path, stat.Size())
-	if nil != err {
+	marker := ""
+	for {
+		var i []objio.ObjectInfo
+		marker, i, err = self.storage.List(node.Path, marker, count)
+		if nil != err {
+			return
+		}
+
+		for _, info := range i {
+			if 0 == self.caps&objio.CapEmptyDir && dirPlaceholder == info.Name() {
+				continue
+			}
+			infos = append(infos, info)
+		}
+
+		if "" == marker {
+			break
+		}
+
+		if 0 < maxcount {
+			count -= len(i)
+			if 0 >= count {
+				break
+			}
+		}
+	}
+
+	links := self.readdirLinks(pathKey, node.Path, infos)
+
+	// cache these infos as we may get a flurry of Stat calls
+	inos := make([]uint64, 0, len(infos))
+	err = self.database.Update(func(tx *bolt.Tx) (err error) {
+		ntx := nodetx_t{Tx: tx}
+
+		for i := range infos {
+			info := infos[i]
+			name := info.Name()
+			k := []byte(path.Join(pathKey, self.pathKey(name)))
+
+			n := node_t{}
+			err = n.Get(&ntx, k)
+			if nil == err {
+				// Our view of the file system namespace may be inconsistent with the
+				// one in the object storage.
+				//
+				// To minimize user confusion we prefer our information to the one
+				// from the storage.
+
+				info, err = n.Stat()
+				if nil != err {
+					return
+				}
+
+				infos[i] = info
+
+				inos = append(inos, n.Ino)
+				continue
+			}
+
+			var ino uint64
+			ino, err = n.NextIno(&ntx)
+			if nil != err {
+				return
+			}
+
+			link, islink := links[i]
+
+			n.Path = path.Join(node.Path, name)
+			n.CopyStat(applyMtime(tx, k, info))
+			n.SetLink(islink, link)
+
+			err = n.Put(&ntx, k)
+			if nil != err {
+				return
+			}
+
+			infos[i], err = n.Stat()
+			if nil != err {
+				return
+			}
+
+			inos = append(inos, ino)
+		}
+
+		if 0 == self.caps&objio.CapConsistentList && 0 >= maxcount {
+			infos, inos, err = self.mergeRecentNodes(&ntx, pathKey, infos, inos)
+		}
+
+		return
+	})
+
+	if nil != err {
+		infos = nil
+		return
+	}
+
+	for _, ino := range inos {
+		self.touchIno(ino, false)
+	}
+
+	self.dirpres.addPath(pathKey)
+	self.negpres.removePath(pathKey)
+
+	return
+}
+
+// makePlaceholder creates a placeholder object that keeps an otherwise empty
+// directory in existence on storages that do not support empty directories.
+func (self *Cache) makePlaceholder(dirpath string) (err error) {
+	writer, err := self.storage.OpenWrite(path.Join(dirpath, dirPlaceholder), 0)
+	if nil != err {
+		return
+	}
+	defer writer.Close()
+
+	_, err = writer.Wait()
+
+	return
+}
+
+func (self *Cache) removeDirFromStorage(dirpath string) (err error) {
+	if 0 == self.caps&objio.CapEmptyDir {
+		err = self.storage.Remove(path.Join(dirpath, dirPlaceholder))
+		if nil != err && !errors.HasAttachment(err, errno.ENOENT) {
+			return
+		}
+
+		// the directory may have disappeared along with its placeholder
+		err = self.storage.Rmdir(dirpath)
+		if nil != err && errors.HasAttachment(err, errno.ENOENT) {
+			err = nil
+		}
+
+		return
+	}
+
+	return self.storage.Rmdir(dirpath)
+}
+
+// renameOnStorage renames an object on the storage emulating directory
+// rename and rename-overwrite when the storage does not support them.
+func (self *Cache) renameOnStorage(
+	node *node_t, pathKey string, oldpath string, newpath string) (err error) {
+
+	if 0 == self.caps&objio.CapRenameOverwrite && pathKey != self.pathKey(newpath) {
+		var info objio.ObjectInfo
+		info, err = self.storage.Stat(newpath)
+		if nil == err {
+			if info.IsDir() {
+				err = self.removeDirFromStorage(newpath)
+			} else {
+				err = self.storage.Remove(newpath)
+			}
+		} else if errors.HasAttachment(err, errno.ENOENT) {
+			err = nil
+		}
+		if nil != err {
+			return
+		}
+	}
+
+	if 0 == self.caps&objio.CapDirRename && pathKey != self.pathKey(newpath) {
+		if !node.Valid {
+			err = self.statNodeNoLock(node, pathKey)
+			if nil != err {
+				return
+			}
+		}
+
+		if node.IsDir {
+			return self.renameDirOnStorage(oldpath, newpath)
+		}
+	}
+
+	return self.storage.Rename(oldpath, newpath)
+}
+
+// renameDirOnStorage emulates a directory rename by making the new directory,
+// moving the children and removing the old directory.
+func (self *Cache) renameDirOnStorage(oldpath string, newpath string) (err error) {
+	_, err = self.storage.Mkdir(newpath)
+	if nil != err && !errors.HasAttachment(err, errno.EEXIST) {
+		return
+	}
+
+	var infos []objio.ObjectInfo
+	marker := ""
+	for {
+		var i []objio.ObjectInfo
+		marker, i, err = self.storage.List(oldpath, marker, 0)
+		if nil != err {
+			return
+		}
+
+		infos = append(infos, i...)
+
+		if "" == marker {
+			break
+		}
+	}
+
+	for _, info := range infos {
+		oldname := path.Join(oldpath, info.Name())
+		newname := path.Join(newpath, info.Name())
+		if info.IsDir() {
+			err = self.renameDirOnStorage(oldname, newname)
+		} else {
+			err = self.storage.Rename(oldname, newname)
+		}
+		if nil != err {
+			return
+		}
+	}
+
+	err = self.storage.Rmdir(oldpath)
+	if nil != err && errors.HasAttachment(err, errno.ENOENT) {
+		err = nil
+	}
+
+	return
+}
+
+// mergeRecentNodes adds recently changed nodes that are missing from a
+// directory listing. It is used with storages whose listings may not yet
+// reflect completed changes.
+func (self *Cache) mergeRecentNodes(
+	ntx *nodetx_t, pathKey string, infos []objio.ObjectInfo, inos []uint64) (
+	oinfos []objio.ObjectInfo, oinos []uint64, err error) {
+
+	listed := make(map[string]bool, len(infos))
+	for _, info := range infos {
+		listed[self.pathKey(info.Name())] = true
+	}
+
+	recent := time.Now().Add(-self.config.EvictDelay)
+
+	k := []byte(pathKey)
+	cursor := ntx.Cat().Cursor()
+	for i, v := cursor.Seek(k); nil != i; i, v = cursor.Next() {
+		if !pathKeyHasPrefix(i, k) {
+			break
+		}
+
+		if bytes.Equal(i, k) || -1 != bytes.IndexByte(i[len(k)+1:], '/') {
+			continue
+		}
+
+		if listed[strings.TrimPrefix(string(i[len(k):]), "/")] {
+			continue
+		}
+
+		n := node_t{}
+		if nil != n.Decode(v) || n.Mtime.Before(recent) {
+			continue
+		}
+
+		var info objio.ObjectInfo
+		info, err = n.Stat()
+		if nil != err {
+			return
+		}
+
+		infos = append(infos, info)
+		inos = append(inos, n.Ino)
+	}
+
+	oinfos = infos
+	oinos = inos
+
+	return
+}
+
+func (self *Cache) performFileIoOnNode(
+	node *node_t, ensure bool, size int64, fn func(file *os.File) error) (
+	err error) {
+
+	pathKey := self.pathKey(node.Path)
+	self.lockPath(pathKey)
+	defer self.unlockPath(pathKey)
+
+	if ensure {
+		if nil == node.File {
+			err = self.openNodeFile(node, pathKey, size, false)
+			if nil != err {
+				return
+			}
+		}
+
+		if nil != node.Download {
+			err = self.waitDownload(node, pathKey, -1)
+			if nil != err {
+				return
+			}
+		}
+
+		if nil != node.Blocks {
+			err = self.completeSparseFile(node, pathKey)
+			if nil != err {
+				return
+			}
+		}
+	}
+
+	if nil != node.File {
+		err = fn(node.File)
+	}
+
+	return
+}
+
+// performReadIoOnNode is like performFileIoOnNode, but it ensures only that
+// the count bytes at off are present in the file. If the file is cached
+// sparsely the missing blocks in that range are downloaded. If the file is
+// downloaded in full the read waits only until the range has arrived.
+func (self *Cache) performReadIoOnNode(
+	node *node_t, off int64, count int, fn func(file *os.File) error) (
+	err error) {
+
+	pathKey := self.pathKey(node.Path)
+	self.lockPath(pathKey)
+	defer self.unlockPath(pathKey)
+
+	if nil == node.File {
+		var ok bool
+		ok, err = self.openSparseFile(node, pathKey, true)
+		if nil == err && !ok {
+			err = self.openNodeFile(node, pathKey, -1, true)
+		}
+		if nil != err {
+			return
+		}
+	}
+
+	if nil != node.Download {
+		err = self.waitDownload(node, pathKey, off+int64(count))
+		if nil != err {
+			return
+		}
+	}
+
+	if nil != node.Blocks {
+		err = self.readBlocks(node, off, int64(count))
+		if nil != err {
+			return
+		}
+	}
+
+	if nil != node.File {
+		err = fn(node.File)
+	}
+
+	return
+}
+
+// openNodeFile opens the cached file of a node, downloading it if necessary.
+// If stream is set a download in full proceeds in the background and must be
+// waited for with node.Download.
+func (self *Cache) openNodeFile(
+	node *node_t, pathKey string, size int64, stream bool) (err error) {
+	if node.Deleted {
+		err = errno.EPERM
+		return
+	}
+
+	if -1 == size {
+		// A sparse file left from an earlier open must not be mistaken for
+		// a whole file; reopen it sparsely and let the caller complete it.
+		var ok bool
+		ok, err = self.openSparseFile(node, pathKey, false)
+		if nil != err || ok {
+			return
+		}
+	} else {
+		err = self.discardSparseFile(node)
+		if nil != err {
+			return
+		}
+	}
+
+	var info objio.ObjectInfo
+	var hash []byte
+	var file *os.File
+	var dl *download_t
+	info, hash, file, dl, err = self.readNodeFromStorage(node, size, stream)
+	if nil != err {
+		return
+	}
+
+	if nil != dl {
+		node.File = file
+		node.Download = dl
+		return
+	}
+
+	if nil != info {
+		err = self.updateDownloadedNode(node, pathKey, info, hash)
+		if nil != err {
+			file.Close()
+			return
+		}
+	}
+
+	node.File = file
+
+	self.negpres.removePath(pathKey)
+
+	return
+}
+
+func (self *Cache) updateDownloadedNode(
+	node *node_t, pathKey string, info objio.ObjectInfo, hash []byte) (err error) {
+	filePath := self.filePath(node.Ino)
+	var fileinfo os.FileInfo
+
+	n := *node
+	n.Hash = hash
+
+	k := []byte(pathKey)
+	err = self.database.Update(func(tx *bolt.Tx) (err error) {
+		ntx := nodetx_t{Tx: tx}
+		info = applyMtime(tx, k, info)
+		n.CopyStat(info)
+
+		// the file state includes the mtime that the file is given
+		mtime := info.Mtime()
+		os.Chtimes(filePath, mtime, mtime)
+		fileinfo, _ = os.Stat(filePath)
+		n.SetFileState(false, fileinfo)
+
+		err = n.Put(&ntx, k)
+		return
+	})
+	if nil != err {
+		return
+	}
+
+	node.CopyStat(info)
+	node.Hash = hash
+	node.SetFileState(false, fileinfo)
+
+	self.space.Add(info.Size())
+
+	return
+}
+
+// waitDownload waits until the background download of a node has end bytes
+// (or is done if end is negative). When the download is done the node is
+// updated; if the download failed the cached file is removed.
+func (self *Cache) waitDownload(node *node_t, pathKey string, end int64) (err error) {
+	dl := node.Download
+	if !dl.Wait(end) {
+		return
+	}
+
+	node.Download = nil
+
+	self.stats.Count(&self.stats.BytesDownloaded, uint64(dl.Downloaded()))
+
+	info, hash, err := dl.Result()
+	if nil == err {
+		err = self.updateDownloadedNode(node, pathKey, info, hash)
+	}
+	if nil != err {
+		node.File.Close()
+		node.File = nil
+		os.Remove(self.filePath(node.Ino))
+		return
+	}
+
+	self.negpres.removePath(pathKey)
+
+	return
+}
+
+// openSparseFile opens the cached file of a node for block caching. If there
+// is no sparse file left from an earlier open and create is set, a new one is
+// created. It reports false if the file should instead be downloaded in full:
+// block caching is disabled or unsupported, the object is small or the file
+// is already cached in full.
+func (self *Cache) openSparseFile(node *node_t, pathKey string, create bool) (ok bool, err error) {
+	if node.Deleted {
+		err = errno.EPERM
+		return
+	}
+
+	filePath := self.filePath(node.Ino)
+
+	blk := &blocks_t{}
+	err = self.database.View(func(tx *bolt.Tx) (err error) {
+		return blk.Get(tx, node.Ino)
+	})
+	if nil != err {
+		err = nil
+		blk = nil
+
+		if !create || 0 > self.config.BlockSize || 0 == self.caps&objio.CapRangeRead ||
+			!node.Valid || node.IsDir || node.Size <= self.config.BlockSize {
+			return
+		}
+
+		if _, e := os.Stat(filePath); nil == e {
+			return
+		}
+	}
+
+	if 0 == self.caps&objio.CapRangeRead {
+		if nil != blk {
+			err = self.discardSparseFile(node)
+		}
+		return
+	}
+
+	// The object is only opened for reading when a block is missing (see
+	// readBlocks), so that reopening a sparse file does not start a transfer.
+	info, err := self.storage.Stat(node.Path)
+	if nil != err {
+		return
+	}
+
+	var file *os.File
+	if nil != blk && blk.Sig == info.Sig() && blk.Size == info.Size() {
+		file, err = openFile(filePath, os.O_RDWR, 0600)
+		if nil != err {
+			if !os.IsNotExist(err) {
+				return
+			}
+			blk = nil
+		}
+	} else {
+		blk = nil
+	}
+
+	if nil == blk {
+		blocksize := self.config.BlockSize
+		if 0 > blocksize {
+			blocksize = DefaultBlockSize
+		}
+		blk = newBlocks(info.Size(), blocksize, info.Sig())
+
+		err = os.MkdirAll(filepath.Dir(filePath), 0700)
+		if nil != err {
+			return
+		}
+
+		file, err = openFile(filePath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+		if nil != err {
+			return
+		}
+
+		err = file.Truncate(info.Size())
+		if nil != err {
+			file.Close()
+			return
+		}
+	}
+
+	n := *node
+	n.Hash = nil
+
+	k := []byte(pathKey)
+	err = self.database.Update(func(tx *bolt.Tx) (err error) {
+		ntx := nodetx_t{Tx: tx}
+		info = applyMtime(tx, k, info)
+		n.CopyStat(info)
+		err = n.Put(&ntx, k)
+		if nil == err {
+			err = blk.Put(tx, node.Ino)
+		}
+		return
+	})
+	if nil != err {
+		file.Close()
+		return
+	}
+
+	mtime := info.Mtime()
+	os.Chtimes(filePath, mtime, mtime)
+
+	node.CopyStat(info)
+	node.Hash = nil
+	node.File = file
+	node.Blocks = blk
+
+	self.negpres.removePath(pathKey)
+
+	ok = true
+
+	return
+}
+
+// discardSparseFile removes a sparse file left from an earlier open, so that
+// the file can be downloaded in full.
+func (self *Cache) discardSparseFile(node *node_t) (err error) {
+	blk := &blocks_t{}
+	err = self.database.Update(func(tx *bolt.Tx) (err error) {
+		err = blk.Get(tx, node.Ino)
+		if nil == err {
+			err = (*blocks_t)(nil).Put(tx, node.Ino)
+			if nil == err {
+				err = os.Remove(self.filePath(node.Ino))
+				if os.IsNotExist(err) {
+					err = nil
+				}
+			}
+		} else if errno.ENOENT == err {
+			err = nil
+		}
+		return
+	})
+
+	return
+}
+
+// openSparseReader opens the object of a sparse file for ranged reads. It
+// fails with ESTALE if the object has changed since the file was opened.
+func (self *Cache) openSparseReader(node *node_t) (err error) {
+	info, reader, err := self.storage.OpenRead(node.Path, "")
+	if nil != err {
+		return
+	}
+
+	if _, ok := reader.(io.ReaderAt); !ok {
+		reader.Close()
+		err = errors.New(": ranged reads not supported", nil, errno.ENOSYS)
+		return
+	}
+	if node.Blocks.Sig != info.Sig() || node.Blocks.Size != info.Size() {
+		reader.Close()
+		err = errors.New(": "+node.Path+" has changed", nil, errno.ESTALE)
+		return
+	}
+
+	node.Reader = reader
+
+	return
+}
+
+// readBlocks downloads the missing blocks that overlap the count bytes at off.
+// The object is opened on the first missing block and is kept open until the
+// file is closed or complete.
+func (self *Cache) readBlocks(node *node_t, off int64, count int64) (err error) {
+	blk := node.Blocks
+
+	end := off + count
+	if end > blk.Size {
+		end = blk.Size
+	}
+	if 0 > off || off >= end {
+		return
+	}
+
+	maxrun := self.config.PartSize / blk.BlockSize
+	if 1 > maxrun {
+		maxrun = 1
+	}
+
+	dirty := false
+	defer func() {
+		if dirty {
+			err0 := self.database.Update(func(tx *bolt.Tx) (err error) {
+				return blk.Put(tx, node.Ino)
+			})
+			if nil == err {
+				err = err0
+			}
+		}
+	}()
+
+	var buf []byte
+	last := (end - 1) / blk.BlockSize
+	for i := off / blk.BlockSize; last >= i; i++ {
+		if blk.Has(i) {
+			continue
+		}
+
+		j := i + 1
+		for last >= j && maxrun > j-i && !blk.Has(j) {
+			j++
+		}
+
+		o := i * blk.BlockSize
+		e := j * blk.BlockSize
+		if e > blk.Size {
+			e = blk.Size
+		}
+
+		if int64(len(buf)) < e-o {
+			buf = make([]byte, e-o)
+		}
+
+		if nil == node.Reader {
+			err = self.openSparseReader(node)
+			if nil != err {
+				return
+			}
+		}
+
+		var n int
+		n, err = node.Reader.(io.ReaderAt).ReadAt(buf[:e-o], o)
+		if io.EOF == err && int64(n) == e-o {
+			err = nil
+		}
+		if nil != err {
+			return
+		}
+
+		_, err = node.File.WriteAt(buf[:e-o], o)
+		if nil != err {
+			return
+		}
+
+		self.space.Add(e - o)
+		self.stats.Count(&self.stats.RangedReads, 1)
+		self.stats.Count(&self.stats.BytesDownloaded, uint64(e-o))
+
+		for k := i; j > k; k++ {
+			blk.Set(k)
+		}
+		i = j - 1
+
+		dirty = true
+	}
+
+	return
+}
+
+// completeSparseFile downloads all missing blocks of a sparse file and turns
+// it into a whole file that can be written and uploaded.
+func (self *Cache) completeSparseFile(node *node_t, pathKey string) (err error) {
+	err = self.readBlocks(node, 0, node.Blocks.Size)
+	if nil != err {
+		return
+	}
+
+	hash, err := hashFile(self.filePath(node.Ino))
+	if nil != err {
+		return
+	}
+
+	filePath := self.filePath(node.Ino)
+
+	mtime := node.Mtime
+	os.Chtimes(filePath, mtime, mtime)
+	fileinfo, _ := os.Stat(filePath)
+
+	n := *node
+	n.Hash = hash
+	n.SetFileState(false, fileinfo)
+
+	k := []byte(pathKey)
+	err = self.database.Update(func(tx *bolt.Tx) (err error) {
+		ntx := nodetx_t{Tx: tx}
+		err = n.Put(&ntx, k)
+		if nil == err {
+			err = (*blocks_t)(nil).Put(tx, node.Ino)
+		}
+		return
+	})
+	if nil != err {
+		return
+	}
+
+	node.Hash = hash
+	node.SetFileState(false, fileinfo)
+	node.Blocks = nil
+	if nil != node.Reader {
+		node.Reader.Close()
+		node.Reader = nil
+	}
+
+	return
+}
+
+// readNodeFromStorage downloads a node to its cached file. If stream is set
+// and the file has to be downloaded in full, the download (in parallel parts
+// if possible) proceeds in the background and is returned in dl; info and
+// hash are then reported by dl.
+func (self *Cache) readNodeFromStorage(
+	node *node_t, size int64, stream bool) (
+	info objio.ObjectInfo, hash []byte, file *os.File, dl *download_t, err error) {
+
+	filePath := self.filePath(node.Ino)
+	sig := node.Sig
+	cached := true
+
+	f, err := openFile(filePath, os.O_RDWR, 0600)
+	if nil != err {
+		sig = ""
+		cached = false
+
+		err = os.MkdirAll(filepath.Dir(filePath), 0700)
+		if nil != err {
+			return
+		}
+
+		f, err = openFile(filePath, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
+		if nil != err {
+			return
+		}
+
+		defer func() {
+			if nil != err {
+				os.Remove(filePath)
+			}
+		}()
+	}
+
+	defer func() {
+		if nil != err {
+			f.Close()
+		}
+	}()
+
+	if cached && (self.isOffline() || self.isValidated(node)) {
+		// when offline (or when the consistency of the file allows it) use
+		// the cached file as is
+		self.stats.Count(&self.stats.ContentHits, 1)
+		file = f
+		return
+	}
+
+	i, reader, err := self.storage.OpenRead(node.Path, sig)
+	if nil != err {
+		if cached && self.setOffline(err) {
+			self.stats.Count(&self.stats.ContentHits, 1)
+			err = nil
+			file = f
+		}
+		return
+	}
+
+	validated := time.Now()
+	defer func() {
+		if nil == err {
+			self.setValidated(node.Ino, validated)
+		}
+	}()
+
+	if nil == reader {
+		// the cached file is current
+		self.stats.Count(&self.stats.ContentHits, 1)
+	}
+
+	if nil != reader {
+		self.stats.Count(&self.stats.Downloads, 1)
+
+		// a download in parts is preferred to a sequential one
+		readat, parallel := reader.(io.ReaderAt)
+		parallel = parallel && -1 == size && self.isParallel(i.Size())
+
+		if stream && -1 == size {
+			err = f.Truncate(0)
+			if nil != err {
+				reader.Close()
+				return
+			}
+
+			partsize := int64(0)
+			if parallel {
+				partsize = self.config.PartSize
+			}
+
+			dl = newDownload(i, reader)
+			dl.Start(f, partsize, self.config.Parallelism)
+			file = f
+
+			return
+		}
+
+		defer reader.Close()
+
+		h := sha256.New()
+
+		if parallel {
+			err = f.Truncate(i.Size())
+			if nil != err {
+				return
+			}
+
+			err = objio.ReadParallel(
+				f, readat, i.Size(), self.config.PartSize, self.config.Parallelism)
+			if nil != err {
+				return
+			}
+
+			self.stats.Count(&self.stats.BytesDownloaded, uint64(i.Size()))
+
+			_, err = io.Copy(h, io.NewSectionReader(f, 0, i.Size()))
+			if nil != err {
+				return
+			}
+
+			info = i
+			hash = h.Sum(nil)
+			file = f
+
+			return
+		}
+
+		reader := io.TeeReader(reader, h)
+
+		var n int64
+		if -1 == size {
+			n, err = io.Copy(f, reader)
+		} else {
+			n, err = io.CopyN(f, reader, size)
+			if io.EOF == err {
+				err = nil
+			}
+		}
+		self.stats.Count(&self.stats.BytesDownloaded, uint64(n))
+		if nil != err {
+			return
+		}
+
+		info = i
+		hash = h.Sum(nil)
+	}
+
+	file = f
+
+	return
+}
+
+func (self *Cache) closeNode(node *node_t) (err error) {
+	if nil != node.Download {
+		self.closeDownload(node)
+	}
+
+	if nil != node.File {
+		if node.Valid && !node.Deleted && nil == node.Blocks {
+			// a sparse file is not modified; its mtime is that of the blocks
+			// downloaded last
+			err = self.closeAndUpdateNode(node)
+		}
+
+		node.File.Close()
+		node.File = nil
+	}
+
+	if nil != node.Reader {
+		node.Reader.Close()
+		node.Reader = nil
+	}
+	node.Blocks = nil
+
+	if node.Valid {
+		self.touchIno(node.Ino, false)
+	}
+
+	return
+}
+
+// closeDownload cancels the background download of a node that is closed
+// before the download is done. An incomplete file is not kept in the cache.
+func (self *Cache) closeDownload(node *node_t) {
+	pathKey := self.pathKey(node.Path)
+	self.lockPath(pathKey)
+	defer self.unlockPath(pathKey)
+
+	if nil != node.Download {
+		node.Download.Cancel()
+		self.waitDownload(node, pathKey, -1)
+	}
+}
+
+func (self *Cache) closeAndUpdateNode(node *node_t) (err error) {
+	pathKey := self.pathKey(node.Path)
+	self.lockPath(pathKey)
+	defer self.unlockPath(pathKey)
+
+	var fileinfo os.FileInfo
+	fileinfo, err = node.File.Stat()
+	if nil != err {
+		return
+	}
+
+	// The file is dirty if it is waiting to be uploaded or if it has changed
+	// since its state was recorded. (It is not in rwmap while it is being
+	// uploaded; only the upload records it clean.)
+	self.lrumux.Lock()
+	_, dirty := self.rwmap[node.Ino]
+	self.lrumux.Unlock()
+	if recorded, ok := node.FileState(fileinfo); recorded || !ok {
+		dirty = true
+	}
+
+	n := *node
+	n.Size = fileinfo.Size()
+	n.Mtime = fileinfo.ModTime()
+	n.SetFileState(dirty, fileinfo)
+
+	k := []byte(pathKey)
+	err = self.database.Update(func(tx *bolt.Tx) (err error) {
+		ntx := nodetx_t{Tx: tx}
+		err = n.Put(&ntx, k)
+		return
+	})
+	if nil != err {
+		return
+	}
+
+	node.Size = n.Size
+	node.Mtime = n.Mtime
+	node.SetFileState(dirty, fileinfo)
+
+	return
+}
+
+func (self *Cache) touchIno(ino uint64, rw bool) {
+	self.lrumux.Lock()
+
+	var thismap, thatmap map[uint64]*lruitem_t
+	var thislst *link_t
+
+	if rw {
+		thismap, thatmap = self.rwmap, self.romap
+		thislst = &self.rwlst
+	} else {
+		thismap, thatmap = self.romap, self.rwmap
+		thislst = &self.rolst
+	}
+
+	item := thismap[ino]
+	if nil != item {
+		item.Remove()
+	} else {
+		item = thatmap[ino]
+		if nil != item {
+			if !rw {
+				// The ino is a candidate for upload; we cannot evict it.
+				self.lrumux.Unlock()
+				return
+			}
+			item.Remove()
+			delete(thatmap, ino)
+		} else {
+			item = &lruitem_t{ino: ino}
+		}
+		thismap[ino] = item
+	}
+
+	item.atime = time.Now().UnixNano()
+	item.InsertTail(thislst)
+	item.unqueue()
+	if rw {
+		self.unrankItem(item)
+	}
+
+	self.lrumux.Unlock()
+}
+
+func (self *Cache) uploadOne(force bool, progress func(path string)) (err error) {
+	item := self.nextUpload(force)
+	if nil == item {
+		err = errNoItem
+		return
+	}
+
+	touch := true
+	defer func() {
+		if touch {
+			// If there was an error enter ino in rwlst to retry the upload.
+			// If there was no error enter ino in rolst to evict it.
+			self.touchIno(item.ino, nil != err)
+		}
+	}()
+
+	n, pathKey, err := self.getLockedNodeWithIno(item.ino)
+	if nil != err {
+		if errno.ENOENT == err {
+			err = nil
+		}
+		return
+	}
+	defer self.unlockPath(pathKey)
+
+	if n.Deleted {
+		// bail if the node is Deleted
+		touch = false
+		return
+	}
+
+	self.lrumux.Lock()
+	_, ok := self.rwmap[item.ino]
+	self.lrumux.Unlock()
+	if ok {
+		// bail if the ino snuck back in
+		touch = false
+		return
+	}
+
+	filePath := self.filePath(item.ino)
+
+	file, err := openFile(filePath, os.O_RDONLY, 0)
+	if nil != err {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if nil != err {
+		return
+	}
+
+	defer func() {
+		if nil != err {
+			self.stats.Count(&self.stats.UploadFailures, 1)
+		}
+	}()
+
+	var conflict *Conflict
+	info, hash, err := self.writeNodeToStorage(n, file, stat, false)
+	if nil != err && errors.HasAttachment(err, errno.ESTALE) {
+		if ConflictLocalWins != self.config.ConflictPolicy {
+			err = self.resolveConflict(n, pathKey, file, stat, progress)
+			touch = nil != err
+			return
+		}
+
+		// overwrite the changed object
+		_, err = file.Seek(0, io.SeekStart)
+		if nil != err {
+			return
+		}
+		info, hash, err = self.writeNodeToStorage(n, file, stat, true)
+		conflict = &Conflict{Time: time.Now(), Path: n.Path, Policy: ConflictLocalWins}
+	}
+	if nil != err {
+		return
+	}
+
+	info, err = self.chtimeAfterUpload(n, pathKey, stat, info)
+	if nil != err {
+		return
+	}
+
+	mtime := info.Mtime()
+	err = os.Chtimes(filePath, mtime, mtime)
+	if nil != err {
+		return
+	}
+
+	stat, err = os.Stat(filePath)
+	if nil != err {
+		return
+	}
+
+	n.CopyStat(info)
+	n.Hash = hash
+	n.SetFileState(false, stat)
+
+	k := []byte(pathKey)
+	err = self.database.Update(func(tx *bolt.Tx) (err error) {
+		ntx := nodetx_t{Tx: tx}
+		err = n.Put(&ntx, k)
+		if nil == err && nil != conflict {
+			err = conflict.Put(tx)
+		}
+		return
+	})
+
+	if nil != err {
+		return
+	}
+
+	self.stats.Count(&self.stats.Uploads, 1)
+	self.stats.Count(&self.stats.BytesUploaded, uint64(stat.Size()))
+
+	self.openmux.Lock()
+	node := self.openmap[item.ino]
+	if nil != node {
+		node.CopyStat(info)
+		node.Hash = n.Hash
+		node.SetFileState(false, stat)
+	}
+	self.openmux.Unlock()
+
+	if nil != progress {
+		if nil != conflict {
+			progress("!" + n.Path)
+		}
+		progress("+" + n.Path)
+	}
+
+	return
+}
+
+// nextUpload removes the next ino to upload from rwlst. Without an ordered
+// upload policy this is the least recently modified ino.
+func (self *Cache) nextUpload(force bool) (item *lruitem_t) {
+	policy := &self.config.UploadPolicy
+	now := time.Now()
+
+	if !force && !policy.isAllowed(now) {
+		return
+	}
+	if !force && policy.Unmetered && self.isMetered() {
+		return
+	}
+
+	ordered := policy.isOrdered()
+	if ordered {
+		self.rankUploads()
+	}
+
+	self.lrumux.Lock()
+	defer self.lrumux.Unlock()
+
+	if !ordered {
+		if &self.rwlst != self.rwlst.next {
+			var i *lruitem_t
+			i = (*lruitem_t)(containerOf(unsafe.Pointer(self.rwlst.next), unsafe.Offsetof(i.link_t)))
+			if force || i.atime+int64(self.config.UploadDelay) < now.UnixNano() {
+				item = i
+			}
+		}
+	} else {
+		// move the items whose delay has passed to the ready heap
+		for i := self.waitq.first(); nil != i && (force || i.ready < now.UnixNano()); i = self.waitq.first() {
+			heap.Pop(&self.waitq)
+			heap.Push(&self.readyq, i)
+		}
+		if nil != self.readyq.first() {
+			item = heap.Pop(&self.readyq).(*lruitem_t)
+		}
+	}
+
+	if nil != item {
+		item.Remove()
+		delete(self.rwmap, item.ino)
+	}
+
+	return
+}
+
+// isMetered determines if the link to the storage is metered.
+func (self *Cache) isMetered() bool {
+	if nil != self.config.UploadPolicy.Metered {
+		return self.config.UploadPolicy.Metered()
+	}
+
+	_, err := os.Stat(filepath.Join(self.path, meteredName))
+	return nil == err
+}
+
+// rankUploads gets the path and size of the inos in rankq that the upload
+// policy needs to order them and enters them in waitq.
+func (self *Cache) rankUploads() {
+	type rank_t struct {
+		item  *lruitem_t
+		atime int64
+		path  string
+		size  int64
+	}
+
+	var ranks []rank_t
+	self.lrumux.Lock()
+	for _, i := range self.rankq {
+		i.unranked = false
+		ranks = append(ranks, rank_t{item: i, atime: i.atime})
+	}
+	self.rankq = nil
+	self.lrumux.Unlock()
+
+	if 0 == len(ranks) {
+		return
+	}
+
+	self.database.View(func(tx *bolt.Tx) (err error) {
+		ntx := nodetx_t{Tx: tx}
+		for j := range ranks {
+			n := node_t{}
+			if nil == n.GetWithIno(&ntx, ranks[j].item.ino) {
+				ranks[j].path = n.Path
+			}
+		}
+		return
+	})
+
+	for j := range ranks {
+		if fileinfo, err := os.Stat(self.filePath(ranks[j].item.ino)); nil == err {
+			ranks[j].size = fileinfo.Size()
+		}
+	}
+
+	policy := &self.config.UploadPolicy
+	self.lrumux.Lock()
+	for _, r := range ranks {
+		// the ino may have been touched, unranked or uploaded in the meantime
+		i := r.item
+		if i.atime == r.atime && !i.unranked && i == self.rwmap[i.ino] {
+			i.path = r.path
+			i.size = r.size
+			i.ready = i.atime + int64(policy.delay(i.path, self.config.UploadDelay))
+			i.unqueue()
+			heap.Push(&self.waitq, i)
+		}
+	}
+	self.lrumux.Unlock()
+}
+
+// unrankItem makes the upload policy rank an item of rwlst again. It must be
+// called with lrumux held.
+func (self *Cache) unrankItem(item *lruitem_t) {
+	if !self.config.UploadPolicy.isOrdered() {
+		return
+	}
+
+	item.unqueue()
+	if !item.unranked {
+		item.unranked = true
+		self.rankq = append(self.rankq, item)
+	}
+}
+
+// unrankInos makes the upload policy rank inos again; used when their paths
+// change.
+func (self *Cache) unrankInos(inos []uint64) {
+	self.lrumux.Lock()
+	for _, ino := range inos {
+		if item := self.rwmap[ino]; nil != item {
+			self.unrankItem(item)
+		}
+	}
+	self.lrumux.Unlock()
+}
+
+// writeNodeToStorage uploads a file. Unless force is true, it fails with
+// ESTALE if the object has changed on storage since the file was cached.
+func (self *Cache) writeNodeToStorage(
+	node *node_t, file *os.File, stat os.FileInfo, force bool) (
+	info objio.ObjectInfo, hash []byte, err error) {
+
+	var writer objio.WriteWaiter
+	var off int64
+
+	if !force && "" != node.Sig {
+		if storage, ok := self.storage.(objio.ObjectStorageConditional); ok {
+			// Only overwrite the object if it has not changed since we cached it.
+			// Conditional writes take precedence over resumable and multi-part ones.
+			writer, err = storage.OpenWriteIf(node.Path, stat.Size(), node.Sig)
+			if nil != err {
+				if !errors.HasAttachment(err, errno.ENOSYS) {
+					return
+				}
+				writer, err = nil, nil
+			}
+		}
+
+		if nil == writer {
+			// Without conditional writes compare signatures before writing.
+			// This leaves a window in which a change on storage is lost.
+			var i objio.ObjectInfo
+			i, err = self.storage.Stat(node.Path)
+			if nil != err {
+				if !errors.HasAttachment(err, errno.ENOENT) {
+					return
+				}
+				err = nil
+			} else if i.Sig() != node.Sig {
+				err = errors.New(": "+node.Path+" has changed on storage", nil, errno.ESTALE)
+				return
+			}
+		}
+	}
+
+	if storage, ok := self.storage.(objio.ObjectStorageResumable); ok && nil == writer {
+		writer, off, err = self.openResumableWrite(storage, node.Ino, node.Path, stat)
+		if nil != err {
+			if !errors.HasAttachment(err, errno.ENOSYS) {
+				return
+			}
+			writer, off, err = nil, 0, nil
+		}
+	}
+
+	if nil == writer && self.isParallel(stat.Size()) {
+		if storage, ok := self.storage.(objio.ObjectStorageMultipart); ok {
+			var pwriter objio.PartWriteWaiter
+			pwriter, err = storage.OpenWriteParts(node.Path, stat.Size(), self.config.PartSize)
+			if nil == err {
+				defer pwriter.Close()
+
+				err = objio.WriteParallel(
+					pwriter, file, stat.Size(), self.config.PartSize, self.config.Parallelism)
+				if nil != err {
+					return
+				}
+
+				info, err = pwriter.Wait()
+				if nil != err {
+					return
+				}
+
+				h := sha256.New()
+				_, err = io.Copy(h, io.NewSectionReader(file, 0, stat.Size()))
+				if nil != err {
+					return
+				}
+
+				hash = h.Sum(nil)
+
+				return
+			}
+			if !errors.HasAttachment(err, errno.ENOSYS) {
+				return
+			}
+			err = nil
+		}
+	}
+
+	if nil == writer {
+		writer, err = self.storage.OpenWrite(node.Path, stat.Size())
+		if nil != err {
+			return
+		}
+	}
+	defer writer.Close()
+
+	h := sha256.New()
+	if 0 < off {
+		// hash the part of the file that has already been committed
+		_, err = io.CopyN(h, file, off)
+		if nil != err {
+			return
+		}
+	}
+	reader := io.TeeReader(file, h)
+
+	_, err = io.CopyN(writer, reader, stat.Size()-off)
+	if nil != err {
+		return
+	}
+
+	info, err = writer.Wait()
+	if nil != err {
+		return
+	}
+
+	if _, ok := writer.(*sessionWriter); ok {
+		self.database.Update(func(tx *bolt.Tx) (err error) {
+			err = (*session_t)(nil).Put(tx, node.Ino)
+			return
+		})
+	}
+
+	hash = h.Sum(nil)
+
+	return
+}
+
+// chtimeAfterUpload applies a modification time that was set on a file while
+// it was waiting to be uploaded. Writes that follow the setting of the time
+// also change it, so the mtime of the cached file is the one to apply.
+func (self *Cache) chtimeAfterUpload(
+	node *node_t, pathKey string, stat os.FileInfo, info objio.ObjectInfo) (
+	oinfo objio.ObjectInfo, err error) {
+
+	oinfo = info
+
+	k := []byte(pathKey)
+	mt := mtime_t{}
+	err = self.database.View(func(tx *bolt.Tx) (err error) {
+		err = mt.Get(tx, k)
+		return
+	})
+	if nil != err {
+		err = nil
+		return
+	}
+
+	mtime := stat.ModTime().UTC()
+
+	var i objio.ObjectInfo
+	if storage, ok := self.storage.(objio.ObjectStorageChtime); ok {
+		i, err = storage.Chtime(node.Path, mtime)
+		if nil != err {
+			if !errors.HasAttachment(err, errno.ENOSYS) {
+				return
+			}
+			err = nil
+		}
+	}
+
+	var pmt *mtime_t
+	if nil != i {
+		oinfo = i
+	} else {
+		pmt = &mtime_t{Mtime: mtime, Sig: info.Sig()}
+		oinfo = &mtimeinfo_t{ObjectInfo: info, mtime: mtime}
+	}
+
+	err = self.database.Update(func(tx *bolt.Tx) (err error) {
+		err = pmt.Put(tx, k)
+		return
+	})
+
+	return
+}
+
+// resolveConflict is called when an object has changed on the storage since
+// it was cached. With ConflictKeepBoth the cached file is uploaded as a
+// conflict copy next to the object; with ConflictRemoteWins it is dropped.
+// In either case the cached file is then evicted, so that the changed object
+// is downloaded when it is next opened.
+func (self *Cache) resolveConflict(
+	node *node_t, pathKey string, file *os.File, stat os.FileInfo, progress func(path string)) (
+	err error) {
+
+	self.openmux.Lock()
+	_, ok := self.openmap[node.Ino]
+	self.openmux.Unlock()
+	if ok {
+		// retry when the file is no longer open
+		err = errors.New(": "+node.Path+" has changed on storage", nil, errno.ESTALE)
+		return
+	}
+
+	conflict := Conflict{Time: time.Now(), Path: node.Path, Policy: self.config.ConflictPolicy}
+
+	if ConflictKeepBoth == conflict.Policy {
+		_, err = file.Seek(0, io.SeekStart)
+		if nil != err {
+			return
+		}
+
+		conflict.Copy = makeConflictPath(node.Path, self.hostname, conflict.Time)
+
+		var writer objio.WriteWaiter
+		writer, err = self.storage.OpenWrite(conflict.Copy, stat.Size())
+		if nil != err {
+			return
+		}
+		defer writer.Close()
+
+		_, err = io.CopyN(writer, file, stat.Size())
+		if nil != err {
+			return
+		}
+
+		_, err = writer.Wait()
+		if nil != err {
+			return
+		}
+	}
+
+	k := []byte(pathKey)
+	err = self.database.Update(func(tx *bolt.Tx) (err error) {
+		ntx := nodetx_t{Tx: tx}
+		err = (*node_t)(nil).Put(&ntx, k)
+		if nil == err {
+			err = (*session_t)(nil).Put(tx, node.Ino)
+		}
+		if nil == err {
+			err = (*mtime_t)(nil).Put(tx, k)
+		}
+		if nil == err {
+			err = conflict.Put(tx)
+		}
+		return
+	})
+	if nil != err {
+		return
+	}
+
+	file.Close()
+	self.removeFile(node.Ino)
+
+	self.dirpres.removePath(self.pathKey(path.Dir(node.Path)))
+
+	if nil != progress {
+		progress("!" + node.Path)
+		if "" != conflict.Copy {
+			progress("+" + conflict.Copy)
+		}
+	}
+
+	return
+}
+
+// ListConflicts lists the recorded conflicts in the order they occurred.
+func (self *Cache) ListConflicts() (conflicts []Conflict) {
+	self.database.View(func(tx *bolt.Tx) (err error) {
+		cursor := tx.Bucket(conflictname).Cursor()
+		for k, v := cursor.First(); nil != k; k, v = cursor.Next() {
+			c := Conflict{}
+			if nil == c.Decode(v) {
+				conflicts = append(conflicts, c)
+			}
+		}
+		return
+	})
+
+	return
+}
+
+// ClearConflicts removes all recorded conflicts.
+func (self *Cache) ClearConflicts() (err error) {
+	err = self.database.Update(func(tx *bolt.Tx) (err error) {
+		err = tx.DeleteBucket(conflictname)
+		if nil == err {
+			_, err = tx.CreateBucket(conflictname)
+		}
+		return
+	})
+	if nil != err {
+		err = errors.New("", err)
+	}
+
+	return
+}
+
+func (self *Cache) isParallel(size int64) bool {
+	return 1 < self.config.Parallelism && self.config.PartSize < size
+}
+
+// Open a resumable write for ino, resuming a previous upload session if one
+// exists and the cached file has not changed since it was started.
+func (self *Cache) openResumableWrite(
+	storage objio.ObjectStorageResumable, ino uint64, path string, stat os.FileInfo) (
+	writer objio.WriteWaiter, off int64, err error) {
+
+	session := session_t{}
+	self.database.View(func(tx *bolt.Tx) (err error) {
+		err = session.Get(tx, ino)
+		return
+	})
+
+	now := time.Now()
+	if "" != session.Session &&
+		(session.Size != stat.Size() || !session.Mtime.Equal(stat.ModTime().UTC()) ||
+			("" != session.Path && path != session.Path) || session.IsExpired(now)) {
+		// The session cannot be resumed; abandon it on the storage if it
+		// can do so, so that the data committed to it are not kept there
+		// until it expires.
+		if s, ok := storage.(objio.ObjectStorageResumableAbort); ok {
+			p := session.Path
+			if "" == p {
+				p = path
+			}
+			s.AbortResumableWrite(p, session.Session)
+		}
+		session.Session = ""
+	}
+
+	var w objio.ResumableWriteWaiter
+	if "" != session.Session {
+		w, err = storage.OpenResumableWrite(path, stat.Size(), session.Session)
+		if nil != err && errors.HasAttachment(err, errno.ENOENT) {
+			session.Session = ""
+		}
+	}
+	if "" == session.Session {
+		w, err = storage.OpenResumableWrite(path, stat.Size(), "")
+	}
+	if nil != err {
+		return
+	}
+
+	created := now
+	if "" != session.Session && !session.Time.IsZero() {
+		// the session has been resumed
+		created = session.Time
+	}
+
+	session = session_t{
+		Ino:     ino,
+		Offset:  w.Offset(),
+		Size:    stat.Size(),
+		Mtime:   stat.ModTime().UTC(),
+		Session: w.Session(),
+		Time:    created,
+		Path:    path,
+	}
+	err = self.database.Update(func(tx *bolt.Tx) (err error) {
+		err = session.Put(tx, ino)
+		return
+	})
+	if nil != err {
+		w.Close()
+		return
+	}
+
+	writer = &sessionWriter{ResumableWriteWaiter: w, database: self.database, session: session}
+	off = session.Offset
+
+	return
+}
+
+func (self *Cache) uploadAll(force bool, progress func(path string)) (err error) {
+	return self.runWorkers(progress, func(progress func(path string)) error {
+		return self.uploadOne(force, progress)
+	})
+}
+
+func (self *Cache) evictOne(force bool, progress func(path string)) (err error) {
+	self.lrumux.Lock()
+
+	var item *lruitem_t
+	link := self.rolst.next
+	if &self.rolst != link {
+		var i *lruitem_t
+		i = (*lruitem_t)(containerOf(unsafe.Pointer(link), unsafe.Offsetof(i.link_t)))
+
+		if force || i.atime+int64(self.config.EvictDelay) < time.Now().UnixNano() {
+			i.Remove()
+			delete(self.romap, i.ino)
+			item = i
+		}
+	}
+
+	self.lrumux.Unlock()
+
+	if nil == item {
+		err = errNoItem
+		return
+	}
+
+	defer func() {
+		// If there was an error enter ino in rolst to retry the evict.
+		if nil != err {
+			self.touchIno(item.ino, false)
+		}
+	}()
+
+	n, pathKey, err := self.getLockedNodeWithIno(item.ino)
+	if nil != err {
+		if errno.ENOENT != err {
+			return
+		}
+
+		// The node is gone, so the file is not pinned: the nodes of pinned
+		// files are kept when their paths are invalidated (invalidateNodes).
+		// Make sure that the node has not been made again in the meantime.
+		err = self.database.Update(func(tx *bolt.Tx) (err error) {
+			ntx := nodetx_t{Tx: tx}
+			if nil == (&node_t{}).GetWithIno(&ntx, item.ino) {
+				return errno.EEXIST
+			}
+			err = (*blocks_t)(nil).Put(tx, item.ino)
+			return
+		})
+		if errno.EEXIST == err {
+			// bail if the node snuck back in
+			err = nil
+			return
+		}
+		if nil != err {
+			return
+		}
+
+		self.removeFile(item.ino)
+
+		return
+	}
+	defer self.unlockPath(pathKey)
+
+	self.lrumux.Lock()
+	_, ok1 := self.rwmap[item.ino]
+	_, ok2 := self.romap[item.ino]
+	self.lrumux.Unlock()
+	if ok1 || ok2 {
+		// bail if the ino snuck back in
+		return
+	}
+
+	self.openmux.Lock()
+	_, ok1 = self.openmap[item.ino]
+	self.openmux.Unlock()
+	if ok1 {
+		// bail if the ino is still open
+		//self.touchIno(item.ino, false)
+		return
+	}
+
+	pinned := false
+	self.database.View(func(tx *bolt.Tx) (err error) {
+		pinned = isPinned(tx, pathKey)
+		return
+	})
+	if pinned {
+		// bail if the node is pinned; it is entered in rolst again on Unpin
+		return
+	}
+
+	k := []byte(pathKey)
+	err = self.database.Update(func(tx *bolt.Tx) (err error) {
+		ntx := nodetx_t{Tx: tx}
+		err = ((*node_t)(nil)).Put(&ntx, k)
+		if nil == err {
+			err = (*blocks_t)(nil).Put(tx, item.ino)
+		}
+		return
+	})
+
+	if nil != err {
+		return
+	}
+
+	self.removeFile(item.ino)
+
+	self.stats.Count(&self.stats.Evictions, 1)
+
+	if nil != progress {
+		progress("-" + n.Path)
+	}
+
+	return
+}
+
+func (self *Cache) evictAll(force bool, progress func(path string)) (err error) {
+	return self.runWorkers(progress, func(progress func(path string)) error {
+		return self.evictOne(force, progress)
+	})
+}
+
+// runWorkers calls fn repeatedly in UploadWorkers concurrent workers. Each
+// worker stops when fn fails; errNoItem means that there is no more work.
+// The first other error is returned.
+func (self *Cache) runWorkers(
+	progress func(path string), fn func(progress func(path string)) error) (err error) {
+
+	workers := self.config.UploadWorkers
+
+	if 1 < workers && nil != progress {
+		var mux sync.Mutex
+		report := progress
+		progress = func(path string) {
+			mux.Lock()
+			defer mux.Unlock()
+			report(path)
+		}
+	}
+
+	errs := make(chan error, workers)
+	for i := 0; workers > i; i++ {
+		go func() {
+			var err error
+			for nil == err {
+				err = fn(progress)
+			}
+			errs <- err
+		}()
+	}
+
+	for i := 0; workers > i; i++ {
+		if e := <-errs; errNoItem != e && nil == err {
+			err = e
+		}
+	}
+
+	return
+}
+
+// removeFile removes the cached file of an ino and accounts for the space
+// freed.
+func (self *Cache) removeFile(ino uint64) {
+	self.setValidated(ino, time.Time{})
+
+	filePath := self.filePath(ino)
+	if fileinfo, err := os.Stat(filePath); nil == err {
+		if nil == os.Remove(filePath) {
+			self.space.Add(-diskUsage(fileinfo))
+		}
+	}
+}
+
+// measureSpace measures the disk space used by the cached files and the
+// disk space still free.
+func (self *Cache) measureSpace() (err error) {
+	var usage int64
+	filepath.Walk(self.path, func(path string, fileinfo os.FileInfo, err error) error {
+		if nil != err || fileinfo.IsDir() {
+			return nil
+		}
+
+		if _, err := self.parseIno(path); nil == err {
+			usage += diskUsage(fileinfo)
+		}
+
+		return nil
+	})
+
+	free, err := diskFree(self.path)
+	if nil != err {
+		err = errors.New("", err)
+		return
+	}
+
+	self.space.Set(usage, free)
+
+	return
+}
+
+// readSpace estimates the disk space that reading from a node may add to
+// the cache. A negative count means that the node must be downloaded in full.
+func (self *Cache) readSpace(node *node_t, count int) int64 {
+	if nil != node.File || node.IsDir {
+		return 0
+	}
+
+	if 0 <= count && 0 <= self.config.BlockSize && 0 != self.caps&objio.CapRangeRead &&
+		node.Size > self.config.BlockSize {
+		return int64(count) + 2*self.config.BlockSize
+	}
+
+	return node.Size
+}
+
+// ensureSpace ensures that n more bytes can be added to the cache without
+// exceeding its limits, by evicting files that are not modified if necessary.
+func (self *Cache) ensureSpace(n int64) (err error) {
+	if 0 >= self.config.MaxCacheSize && 0 >= self.config.MinFreeSpace {
+		return
+	}
+
+	if !self.space.IsOverLimit(n, self.config.MaxCacheSize, self.config.MinFreeSpace) {
+		return
+	}
+
+	return self.evictOverLimit(n, nil)
+}
+
+// evictOverLimit evicts the least recently used files that are not modified
+// until n more bytes can be added to the cache without exceeding its limits.
+func (self *Cache) evictOverLimit(n int64, progress func(path string)) (err error) {
+	if 0 >= self.config.MaxCacheSize && 0 >= self.config.MinFreeSpace {
+		return
+	}
+
+	for self.space.IsOverLimit(n, self.config.MaxCacheSize, self.config.MinFreeSpace) {
+		err = self.evictOne(true, progress)
+		if errNoItem == err {
+			err = errors.New(": cache size limit exceeded by modified or open files",
+				nil, errno.ENOSPC)
+			return
+		}
+		if nil != err {
+			return
+		}
+	}
+
+	return
+}
+
+// Get and lock node from ino; ensure that proper node.Path gets locked!
+func (self *Cache) getLockedNodeWithIno(ino uint64) (node *node_t, pathKey string, err error) {
+	pk0 := ""
+	for {
+		n := node_t{}
+		err = self.database.View(func(tx *bolt.Tx) (err error) {
+			ntx := nodetx_t{Tx: tx}
+			err = n.GetWithIno(&ntx, ino)
+			return
+		})
+
+		if nil != err {
+			if "" != pk0 {
+				self.unlockPath(pk0)
+			}
+			return
+		}
+
+		pk := self.pathKey(n.Path)
+		if pk0 == pk {
+			node = &n
+			pathKey = pk
+			return
+		}
+
+		if "" != pk0 {
+			self.unlockPath(pk0)
+		}
+		self.lockPath(pk)
+
+		pk0 = pk
+	}
+}
+
+func (self *Cache) resetCache(force bool, progress func(path string)) (err error) {
+	// the journal must be replayed before files are uploaded
+	err = self.replayJournal(progress)
+	if nil == err {
+		err = self.uploadAll(force, progress)
+	}
+	if nil == err {
+		err = self.evictAll(force, progress)
+	}
+
+	if nil != err {
+		err = errors.New("", err)
+	}
+
+	return
+}
+
+func (self *Cache) loop() {
+	defer self.wg.Done()
+
+	ticker := time.NewTicker(self.config.LoopPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if nil == self.replayJournal(nil) {
+				self.syncChanges()
+				self.resetCache(false, nil)
+			}
+			// the space is measured here and adjusted in between
+			if nil == self.measureSpace() {
+				self.evictOverLimit(0, nil)
+			}
+		case <-self.done:
+			return
+		}
+	}
+}
+
+func (self *Cache) isOffline() bool {
+	self.offmux.Lock()
+	offline := self.offline
+	self.offmux.Unlock()
+
+	return offline
+}
+
+// setOffline takes the cache offline if err means that the storage cannot be
+// reached. It reports whether it did.
+func (self *Cache) setOffline(err error) bool {
+	if !isOfflineError(err) {
+		return false
+	}
+
+	self.offmux.Lock()
+	self.offline = true
+	self.offmux.Unlock()
+
+	return true
+}
+
+// putJournal appends a journal entry in tx. The cache is kept offline until
+// the entry has been replayed, even if it has come back online since the
+// operation found it offline.
+func (self *Cache) putJournal(tx *bolt.Tx, journal *journal_t) (err error) {
+	err = journal.Put(tx)
+	if nil == err {
+		self.offmux.Lock()
+		self.offline = true
+		self.offmux.Unlock()
+	}
+
+	return
+}
+
+// ListJournal lists the operations that are waiting to be replayed.
+func (self *Cache) ListJournal() (ops []string) {
+	self.database.View(func(tx *bolt.Tx) (err error) {
+		cursor := tx.Bucket(journalname).Cursor()
+		for k, v := cursor.First(); nil != k; k, v = cursor.Next() {
+			journal := journal_t{}
+			if nil == journal.Decode(v) {
+				ops = append(ops, journal.String())
+			}
+		}
+		return
+	})
+
+	return
+}
+
+// replayJournal brings the cache back online by replaying the journal in
+// order. It fails if the storage still cannot be reached.
+func (self *Cache) replayJournal(progress func(path string)) (err error) {
+	if self.isOffline() {
+		_, err = self.storage.Info(true)
+		if nil != err {
+			return
+		}
+	}
+
+	for {
+		var k []byte
+		journal := journal_t{}
+		err = self.database.View(func(tx *bolt.Tx) (err error) {
+			i, v := tx.Bucket(journalname).Cursor().First()
+			if nil != i {
+				k = append([]byte(nil), i...)
+				err = journal.Decode(v)
+			}
+			return
+		})
+		if nil == k {
+			// Come back online only if the journal is still empty. Journal
+			// entries are appended in update transactions, which cannot
+			// run concurrently with this one.
+			done := false
+			err = self.database.Update(func(tx *bolt.Tx) (err error) {
+				if i, _ := tx.Bucket(journalname).Cursor().First(); nil == i {
+					self.offmux.Lock()
+					self.offline = false
+					self.offmux.Unlock()
+					done = true
+				}
+				return
+			})
+			if nil != err || done {
+				return
+			}
+			continue
+		}
+
+		var conflict *Conflict
+		if nil == err {
+			err = self.replayOne(&journal)
+			if nil != err {
+				if self.setOffline(err) {
+					return
+				}
+
+				// The operation can no longer be applied. Drop it and refresh
+				// our view of the paths it affected.
+				conflict = &Conflict{Time: time.Now(), Path: journal.Path, Policy: ConflictRemoteWins}
+				self.invalidatePath(journal.Path, nil)
+				if journalRename == journal.Op {
+					self.invalidatePath(journal.NewPath, nil)
+				}
+			}
+		}
+
+		err = self.database.Update(func(tx *bolt.Tx) (err error) {
+			err = tx.Bucket(journalname).Delete(k)
+			if nil == err && nil != conflict {
+				err = conflict.Put(tx)
+			}
+			return
+		})
+		if nil != err {
+			return
+		}
+
+		if nil != progress {
+			if nil != conflict {
+				progress("!" + journal.Path)
+			} else {
+				progress(">" + journal.String())
+			}
+		}
+	}
+}
+
+// replayOne applies a journaled operation to the storage.
+func (self *Cache) replayOne(journal *journal_t) (err error) {
+	var info objio.ObjectInfo
+
+	switch journal.Op {
+	case journalMkdir:
+		info, err = self.makeOnStorage(journal.Path, true)
+		if nil != err && errors.HasAttachment(err, errno.EEXIST) {
+			info, err = self.storage.Stat(journal.Path)
+		}
+		if nil == err {
+			self.setReplayedSig(journal.Path, info.Sig())
+		}
+
+	case journalCreate:
+		_, err = self.storage.Stat(journal.Path)
+		if nil == err {
+			// The object has been made on storage while we were offline.
+			// Let the upload of the file resolve the conflict.
+			self.setReplayedSig(journal.Path, staleSig)
+		} else if errors.HasAttachment(err, errno.ENOENT) {
+			info, err = self.makeOnStorage(journal.Path, false)
+			if nil == err {
+				self.setReplayedSig(journal.Path, info.Sig())
+			}
+		}
+
+	case journalRmdir, journalRemove:
+		err = self.checkReplaySig(journal)
+		if nil == err {
+			if journalRmdir == journal.Op {
+				err = self.removeDirFromStorage(journal.Path)
+			} else {
+				err = self.storage.Remove(journal.Path)
+			}
+		}
+		if nil != err && errors.HasAttachment(err, errno.ENOENT) {
+			err = nil
+		}
+
+	case journalRename:
+		err = self.checkReplaySig(journal)
+		if nil != err {
+			break
+		}
+		node := node_t{Path: journal.Path, IsDir: journal.IsDir, Valid: true}
+		err = self.renameOnStorage(&node, self.pathKey(journal.Path), journal.Path, journal.NewPath)
+
+	case journalSymlink:
+		_, err = self.storage.Stat(journal.Path)
+		if nil == err {
+			// The object has been made on storage while we were offline.
+			err = errors.New(": "+journal.Path+" exists on storage", nil, errno.EEXIST)
+		} else if errors.HasAttachment(err, errno.ENOENT) {
+			info, err = self.symlinkOnStorage(journal.Path, journal.NewPath)
+			if nil == err {
+				self.setReplayedSig(journal.Path, info.Sig())
+			}
+		}
+
+	case journalChtime:
+		err = self.replayChtime(journal.Path)
+	}
+
+	return
+}
+
+// checkReplaySig verifies that the object removed or renamed by a journaled
+// operation has not changed on storage since the operation was journaled.
+func (self *Cache) checkReplaySig(journal *journal_t) (err error) {
+	if "" == journal.Sig {
+		// the object was made offline
+		return
+	}
+
+	info, err := self.storage.Stat(journal.Path)
+	if nil != err {
+		return
+	}
+	if journal.Sig != info.Sig() {
+		err = errors.New(": "+journal.Path+" has changed on storage", nil, errno.ESTALE)
+		return
+	}
+
+	return
+}
+
+// replayChtime sets the mtime recorded for p while offline on the storage,
+// unless the object has changed since.
+func (self *Cache) replayChtime(p string) (err error) {
+	storage, ok := self.storage.(objio.ObjectStorageChtime)
+	if !ok {
 		return
 	}
-	defer writer.Close()
 
-	h := sha256.New()
-	reader := io.TeeReader(file, h)
+	pathKey := self.pathKey(p)
+	self.lockPath(pathKey)
+	defer self.unlockPath(pathKey)
 
-	_, err = io.CopyN(writer, reader, stat.Size())
-	if nil != err {
+	k := []byte(pathKey)
+	mt := mtime_t{}
+	self.database.View(func(tx *bolt.Tx) (err error) {
+		return mt.Get(tx, k)
+	})
+	if "" == mt.Sig {
+		// the mtime has since been set again, uploaded or renamed away
 		return
 	}
 
-	info, err := writer.Wait()
+	info, err := self.storage.Stat(p)
 	if nil != err {
 		return
 	}
+	if mt.Sig != info.Sig() {
+		err = errors.New(": "+p+" has changed on storage", nil, errno.ESTALE)
+		return
+	}
 
-	mtime := info.Mtime()
-	err = os.Chtimes(filePath, mtime, mtime)
+	info, err = storage.Chtime(p, mt.Mtime)
 	if nil != err {
+		if errors.HasAttachment(err, errno.ENOSYS) {
+			// the mtime remains recorded for as long as the object is unchanged
+			err = nil
+		}
 		return
 	}
 
-	n.CopyStat(info)
-	n.Hash = h.Sum(nil)
-
-	k := []byte(pathKey)
+	n := node_t{}
 	err = self.database.Update(func(tx *bolt.Tx) (err error) {
 		ntx := nodetx_t{Tx: tx}
-		err = n.Put(&ntx, k)
+		err = (*mtime_t)(nil).Put(tx, k)
+		if nil == err && nil == n.Get(&ntx, k) && mt.Sig == n.Sig {
+			n.CopyStat(info)
+			err = n.Put(&ntx, k)
+		}
 		return
 	})
-
-	if nil != err {
+	if nil != err || info.Sig() != n.Sig {
 		return
 	}
 
 	self.openmux.Lock()
-	node := self.openmap[item.ino]
-	if nil != node {
+	node := self.openmap[n.Ino]
+	if nil != node && mt.Sig == node.Sig {
 		node.CopyStat(info)
-		node.Hash = n.Hash
 	}
 	self.openmux.Unlock()
 
-	if nil != progress {
-		progress("+" + n.Path)
-	}
-
 	return
 }
 
-func (self *Cache) uploadAll(force bool, progress func(path string)) (err error) {
-	for {
-		err = self.uploadOne(force, progress)
-		if nil != err {
-			break
+// setReplayedSig sets the Sig of a node made offline, unless the node has
+// since been removed, renamed or uploaded.
+func (self *Cache) setReplayedSig(p string, sig string) {
+	pathKey := self.pathKey(p)
+	self.lockPath(pathKey)
+	defer self.unlockPath(pathKey)
+
+	k := []byte(pathKey)
+	n := node_t{}
+	self.database.Update(func(tx *bolt.Tx) (err error) {
+		ntx := nodetx_t{Tx: tx}
+		err = n.Get(&ntx, k)
+		if nil != err || "" != n.Sig || p != n.Path {
+			return
 		}
+		n.Sig = sig
+		err = n.Put(&ntx, k)
+		return
+	})
+	if "" == n.Sig || sig != n.Sig {
+		return
 	}
 
-	if errNoItem == err {
-		err = nil
+	self.openmux.Lock()
+	node := self.openmap[n.Ino]
+	if nil != node && "" == node.Sig {
+		node.Sig = sig
 	}
-
-	return
+	self.openmux.Unlock()
 }
 
-func (self *Cache) evictOne(force bool, progress func(path string)) (err error) {
-	self.lrumux.Lock()
-
-	var item *lruitem_t
-	link := self.rolst.next
-	if &self.rolst != link {
-		var i *lruitem_t
-		i = (*lruitem_t)(containerOf(unsafe.Pointer(link), unsafe.Offsetof(i.link_t)))
-
-		if force || i.atime+int64(self.config.EvictDelay) < time.Now().UnixNano() {
-			i.Remove()
-			delete(self.romap, i.ino)
-			item = i
-		}
+func (self *Cache) syncChanges() (err error) {
+	storage, ok := self.storage.(objio.ObjectStorageChanges)
+	if !ok || self.nochanges {
+		return
 	}
 
-	self.lrumux.Unlock()
-
-	if nil == item {
-		err = errNoItem
+	var cursor []byte
+	self.database.View(func(tx *bolt.Tx) (err error) {
+		cursor = append(cursor, tx.Bucket(metaname).Get(cursorname)...)
 		return
-	}
+	})
 
-	defer func() {
-		// If there was an error enter ino in rolst to retry the evict.
+	for {
+		reset := false
+
+		var c string
+		var changes []objio.ObjectChange
+		c, changes, err = storage.Changes(string(cursor))
 		if nil != err {
-			self.touchIno(item.ino, false)
+			if errors.HasAttachment(err, errno.ENOSYS) {
+				self.nochanges = true
+				err = nil
+				return
+			}
+			if !errors.HasAttachment(err, errno.EINVAL) || 0 == len(cursor) {
+				return
+			}
+
+			// The cursor is no longer valid; we do not know what has changed
+			// so we have to assume that everything has.
+			self.invalidatePath("/", nil)
+			c, changes, err = "", nil, nil
+			reset = true
 		}
-	}()
 
-	n, pathKey, err := self.getLockedNodeWithIno(item.ino)
-	if nil != err {
-		if errno.ENOENT != err {
-			return
+		for _, change := range changes {
+			self.invalidatePath(change.Path(), change.Info())
 		}
 
-		err = nil
-		os.Remove(self.filePath(item.ino))
+		if string(cursor) != c {
+			cursor = []byte(c)
+			err = self.database.Update(func(tx *bolt.Tx) (err error) {
+				err = tx.Bucket(metaname).Put(cursorname, cursor)
+				return
+			})
+			if nil != err {
+				return
+			}
+		}
 
-		return
+		if 0 == len(changes) && !reset {
+			break
+		}
 	}
-	defer self.unlockPath(pathKey)
 
-	self.lrumux.Lock()
-	_, ok1 := self.rwmap[item.ino]
-	_, ok2 := self.romap[item.ino]
-	self.lrumux.Unlock()
-	if ok1 || ok2 {
-		// bail if the ino snuck back in
-		return
-	}
+	return
+}
 
-	self.openmux.Lock()
-	_, ok1 = self.openmap[item.ino]
-	self.openmux.Unlock()
-	if ok1 {
-		// bail if the ino is still open
-		//self.touchIno(item.ino, false)
-		return
+// Invalidate cached information about name and any paths below it. Dirty or
+// open nodes are left alone; if info is not nil nodes with a matching Sig are
+// considered up-to-date. Pinned files are downloaded again rather than
+// dropped.
+func (self *Cache) invalidatePath(name string, info objio.ObjectInfo) {
+	for _, p := range self.invalidateNodes(name, info, true) {
+		err := self.prefetchFile(p, nil)
+		if errno.ENOENT == errno.ErrnoFromErr(err) {
+			// the pinned file is gone from storage
+			self.invalidateNodes(p, nil, false)
+		}
 	}
+}
+
+// invalidateNodes removes the nodes of name and any paths below it. If
+// keepPinned is set the nodes of pinned files are kept and their paths are
+// returned instead.
+func (self *Cache) invalidateNodes(
+	name string, info objio.ObjectInfo, keepPinned bool) (pinned []string) {
+
+	pathKey := self.pathKey(name)
+	self.lockPath(pathKey)
+	defer self.unlockPath(pathKey)
 
 	k := []byte(pathKey)
-	err = self.database.Update(func(tx *bolt.Tx) (err error) {
+	keys := make([][]byte, 0, 16)
+	inos := make([]uint64, 0, 16)
+	dirs := make([]string, 0, 16)
+	self.database.View(func(tx *bolt.Tx) (err error) {
 		ntx := nodetx_t{Tx: tx}
-		err = ((*node_t)(nil)).Put(&ntx, k)
-		return
-	})
 
-	if nil != err {
-		return
-	}
+		cursor := ntx.Cat().Cursor()
+		for i, v := cursor.Seek(k); nil != i; i, v = cursor.Next() {
+			if !pathKeyHasPrefix(i, k) {
+				break
+			}
 
-	os.Remove(self.filePath(item.ino))
+			n := node_t{}
+			if nil != n.Decode(v) {
+				continue
+			}
 
-	if nil != progress {
-		progress("-" + n.Path)
-	}
+			if nil != info && bytes.Equal(i, k) && info.Sig() == n.Sig {
+				continue
+			}
 
-	return
-}
+			self.lrumux.Lock()
+			_, dirty := self.rwmap[n.Ino]
+			self.lrumux.Unlock()
+			self.openmux.Lock()
+			_, open := self.openmap[n.Ino]
+			self.openmux.Unlock()
+			if dirty || open {
+				continue
+			}
 
-func (self *Cache) evictAll(force bool, progress func(path string)) (err error) {
-	for {
-		err = self.evictOne(force, progress)
-		if nil != err {
-			break
-		}
-	}
+			if keepPinned && !n.IsDir && !n.IsLink && isPinned(tx, string(i)) {
+				// the file is validated again when it is downloaded
+				self.setValidated(n.Ino, time.Time{})
+				pinned = append(pinned, n.Path)
+				continue
+			}
 
-	if errNoItem == err {
-		err = nil
-	}
+			keys = append(keys, append([]byte(nil), i...))
+			inos = append(inos, n.Ino)
+			if n.IsDir {
+				dirs = append(dirs, string(i))
+			}
+		}
 
-	return
-}
+		return
+	})
 
-// Get and lock node from ino; ensure that proper node.Path gets locked!
-func (self *Cache) getLockedNodeWithIno(ino uint64) (node *node_t, pathKey string, err error) {
-	pk0 := ""
-	for {
-		n := node_t{}
-		err = self.database.View(func(tx *bolt.Tx) (err error) {
+	if 0 != len(keys) {
+		err := self.database.Update(func(tx *bolt.Tx) (err error) {
 			ntx := nodetx_t{Tx: tx}
-			err = n.GetWithIno(&ntx, ino)
+			for _, i := range keys {
+				err = (*node_t)(nil).Put(&ntx, i)
+				if nil != err {
+					return
+				}
+			}
 			return
 		})
-
 		if nil != err {
-			if "" != pk0 {
-				self.unlockPath(pk0)
-			}
-			return
-		}
-
-		pk := self.pathKey(n.Path)
-		if pk0 == pk {
-			node = &n
-			pathKey = pk
+			// catalog entries remain and may be stale; drop all directory listings
+			self.dirpres.removeAllPath(pathKey)
+			self.negpres.removePathPrefix(pathKey)
 			return
 		}
-
-		if "" != pk0 {
-			self.unlockPath(pk0)
-		}
-		self.lockPath(pk)
-
-		pk0 = pk
 	}
-}
 
-func (self *Cache) resetCache(force bool, progress func(path string)) (err error) {
-	err = self.uploadAll(force, progress)
-	if nil == err {
-		err = self.evictAll(force, progress)
+	for _, ino := range inos {
+		self.setValidated(ino, time.Time{})
 	}
-
-	if nil != err {
-		err = errors.New("", err)
+	for _, d := range dirs {
+		self.dirpres.removePath(d)
 	}
+	self.dirpres.removePath(pathKey)
+	self.dirpres.removePath(self.pathKey(path.Dir(name)))
 
-	return
-}
-
-func (self *Cache) loop() {
-	defer self.wg.Done()
-
-	ticker := time.NewTicker(self.config.LoopPeriod)
-	defer ticker.Stop()
+	// paths below name may have been made (e.g. by a directory rename) that
+	// are not reported as changes of their own
+	self.negpres.removePathPrefix(pathKey)
 
-	for {
-		select {
-		case <-ticker.C:
-			self.resetCache(false, nil)
-		case <-self.done:
-			return
-		}
-	}
+	return
 }
 
 func (self *Cache) filePath(ino uint64) string {
@@ -1622,6 +4575,32 @@ func (self *Cache) unlockPath(path string) {
 	}
 }
 
+// dirPlaceholder is the name of the object that keeps an otherwise empty
+// directory in existence on storages that do not support empty directories.
+const dirPlaceholder = ".objfs-dir"
+
+// makeConflictPath makes the path of the conflict copy of a file.
+func makeConflictPath(p string, host string, t time.Time) string {
+	dir, base := path.Split(p)
+	ext := path.Ext(base)
+	if ext == base {
+		ext = ""
+	}
+	base = base[:len(base)-len(ext)]
+
+	host = strings.Map(func(r rune) rune {
+		if '/' == r || '\\' == r || ' ' == r {
+			return '-'
+		}
+		return r
+	}, host)
+	if "" != host {
+		host += " "
+	}
+
+	return dir + base + " (conflict " + host + t.Format("2006-01-02 150405") + ")" + ext
+}
+
 func partialPaths(path string) []string {
 	paths := make([]string, 0, 16)
 	paths = append(paths, "/")
@@ -1700,6 +4679,8 @@ type pathPresenceCache struct {
 	presmux      sync.Mutex
 	presmap      map[string]*pathitem_t
 	preslst      link_t
+	hits         uint64
+	misses       uint64
 }
 
 func (self *pathPresenceCache) hasPath(pathKey string) (ok bool) {
@@ -1714,11 +4695,31 @@ func (self *pathPresenceCache) hasPath(pathKey string) (ok bool) {
 		}
 	}
 
+	if ok {
+		self.hits++
+	} else {
+		self.misses++
+	}
+
+	self.presmux.Unlock()
+
+	return
+}
+
+func (self *pathPresenceCache) counts() (hits uint64, misses uint64) {
+	self.presmux.Lock()
+	hits, misses = self.hits, self.misses
 	self.presmux.Unlock()
 
 	return
 }
 
+func (self *pathPresenceCache) resetCounts() {
+	self.presmux.Lock()
+	self.hits, self.misses = 0, 0
+	self.presmux.Unlock()
+}
+
 func (self *pathPresenceCache) addPath(pathKey string) {
 	self.presmux.Lock()
 
@@ -1758,6 +4759,21 @@ func (self *pathPresenceCache) removePath(pathKey string) {
 	self.presmux.Unlock()
 }
 
+// removePathPrefix removes pathKey and any paths below it.
+func (self *pathPresenceCache) removePathPrefix(pathKey string) {
+	self.presmux.Lock()
+
+	k := []byte(pathKey)
+	for p, item := range self.presmap {
+		if pathKeyHasPrefix([]byte(p), k) {
+			item.Remove()
+			delete(self.presmap, p)
+		}
+	}
+
+	self.presmux.Unlock()
+}
+
 func (self *pathPresenceCache) removeAllPath(pathKey string) {
 	self.presmux.Lock()
 
@@ -1792,8 +4808,16 @@ type pathitem_t struct {
 
 type lruitem_t struct {
 	link_t
-	ino   uint64
-	atime int64
+	ino      uint64
+	atime    int64
+	unranked bool       // in rankq; path and size are not known to the upload policy
+	path     string     // path when ranked
+	size     int64      // size when ranked
+	ready    int64      // time after which it is uploaded when ranked
+	queue    *uploadq_t // heap of ranked items that it is in
+	qindex   int        // index in queue
 }
 
 var errNoItem = errors.New("")
+
+var cursorname = []byte("cursor")
@@ -18,9 +18,84 @@
 package cache
 
 import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/billziss-gh/golib/errors"
+	"github.com/billziss-gh/objfs/errno"
+	"github.com/billziss-gh/objfs/objio"
+	"github.com/billziss-gh/objfs/objio/objiotest"
+	"github.com/boltdb/bolt"
 )
 
+// newTestDir makes a temporary directory that is removed when the test ends.
+func newTestDir(t *testing.T) string {
+	path, err := ioutil.TempDir("", "cache_test")
+	if nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(path) })
+
+	return path
+}
+
+// writeTestObjects writes objects (names and contents) to storage. A name
+// that ends in / makes a directory.
+func writeTestObjects(t *testing.T, storage objio.ObjectStorage, objects map[string]string) {
+	names := make([]string, 0, len(objects))
+	for name := range objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if strings.HasSuffix(name, "/") {
+			_, err := storage.Mkdir(strings.TrimSuffix(name, "/"))
+			if nil != err {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		data := objects[name]
+		writer, err := storage.OpenWrite(name, int64(len(data)))
+		if nil != err {
+			t.Fatal(err)
+		}
+		writer.Write([]byte(data))
+		_, err = writer.Wait()
+		writer.Close()
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newTestCache writes objects to storage and opens a cache on it in a new
+// temporary directory. The caller closes the cache; the directory is removed
+// when the test ends.
+func newTestCache(
+	t *testing.T, storage objio.ObjectStorage, objects map[string]string, config *Config, flag int) (
+	cache *Cache, path string) {
+
+	writeTestObjects(t, storage, objects)
+
+	path = newTestDir(t)
+	cache, err := OpenCache(path, storage, config, flag)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	return
+}
+
 func TestPartialPaths(t *testing.T) {
 	var paths []string
 
@@ -86,3 +161,433 @@ func TestNormalizeCase(t *testing.T) {
 		t.Error(s)
 	}
 }
+
+func TestMakeConflictPath(t *testing.T) {
+	tm := time.Date(2018, 3, 14, 15, 9, 26, 0, time.UTC)
+	s := ""
+
+	s = makeConflictPath("/foo/bar.txt", "host", tm)
+	if "/foo/bar (conflict host 2018-03-14 150926).txt" != s {
+		t.Error(s)
+	}
+
+	s = makeConflictPath("/foo/bar", "host", tm)
+	if "/foo/bar (conflict host 2018-03-14 150926)" != s {
+		t.Error(s)
+	}
+
+	s = makeConflictPath("/foo/.bar", "host", tm)
+	if "/foo/.bar (conflict host 2018-03-14 150926)" != s {
+		t.Error(s)
+	}
+
+	s = makeConflictPath("/foo/bar.tar.gz", "host", tm)
+	if "/foo/bar.tar (conflict host 2018-03-14 150926).gz" != s {
+		t.Error(s)
+	}
+
+	s = makeConflictPath("/foo/bar.txt", "my host/x", tm)
+	if "/foo/bar (conflict my-host-x 2018-03-14 150926).txt" != s {
+		t.Error(s)
+	}
+
+	s = makeConflictPath("/foo/bar.txt", "", tm)
+	if "/foo/bar (conflict 2018-03-14 150926).txt" != s {
+		t.Error(s)
+	}
+}
+
+func TestFileState(t *testing.T) {
+	storage := objiotest.NewMemObjectStorage(false)
+	cache, path := newTestCache(t, storage, nil, nil, Open)
+
+	inos := map[string]uint64{}
+	write := func(name string) {
+		ino, err := cache.Open(name)
+		if nil != err {
+			t.Fatal(err)
+		}
+		err = cache.Make(ino, false)
+		if nil == err {
+			_, err = cache.WriteAt(ino, []byte(name), 0)
+		}
+		cache.Close(ino)
+		if nil != err {
+			t.Fatal(err)
+		}
+		inos[name] = ino
+	}
+
+	write("/a")
+	err := cache.uploadAll(true, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	write("/b")
+
+	getNode := func(name string) (n node_t) {
+		err := cache.database.View(func(tx *bolt.Tx) (err error) {
+			return n.GetWithIno(&nodetx_t{Tx: tx}, inos[name])
+		})
+		if nil != err {
+			t.Fatal(err)
+		}
+		return
+	}
+	isDirty := func(name string) bool {
+		cache.lrumux.Lock()
+		_, dirty := cache.rwmap[inos[name]]
+		cache.lrumux.Unlock()
+		return dirty
+	}
+	reopen := func(verify bool) {
+		cache.CloseCache()
+		cache, err = OpenCache(path, storage, &Config{Verify: verify}, Open)
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	if n := getNode("/a"); n.Dirty || 0 > n.FileSize {
+		t.Error("/a state", n.Dirty, n.FileSize)
+	}
+	if n := getNode("/b"); !n.Dirty || 0 > n.FileSize {
+		t.Error("/b state", n.Dirty, n.FileSize)
+	}
+
+	reopen(false)
+	if isDirty("/a") || !isDirty("/b") {
+		t.Error("dirty after open")
+	}
+
+	// modify /a behind the back of the cache, so that its size and mtime do
+	// not change; the recorded state is trusted unless files are verified
+	n := getNode("/a")
+	ioutil.WriteFile(cache.filePath(inos["/a"]), []byte("/A"), 0600)
+	os.Chtimes(cache.filePath(inos["/a"]), n.FileMtime, n.FileMtime)
+
+	reopen(false)
+	if isDirty("/a") {
+		t.Error("/a dirty without verify")
+	}
+	list := cache.ListCache()
+	sort.Strings(list)
+	if "+/b,=/a" != strings.Join(list, ",") {
+		t.Error("ListCache", list)
+	}
+
+	reopen(true)
+	if !isDirty("/a") || !isDirty("/b") {
+		t.Error("dirty after verify")
+	}
+
+	// an unknown state (as of an older node record) is found by hashing the
+	// file and then recorded
+	err = cache.database.Update(func(tx *bolt.Tx) (err error) {
+		ntx := nodetx_t{Tx: tx}
+		n := node_t{}
+		err = n.GetWithIno(&ntx, inos["/b"])
+		if nil == err {
+			n.SetFileState(false, nil)
+			err = n.Put(&ntx, []byte(cache.pathKey(n.Path)))
+		}
+		return
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	reopen(false)
+	if !isDirty("/b") {
+		t.Error("/b not dirty after open")
+	}
+	if n := getNode("/b"); !n.Dirty || 0 > n.FileSize {
+		t.Error("/b state not recorded", n.Dirty, n.FileSize)
+	}
+
+	cache.CloseCache()
+}
+
+// changesStorage reports the changes recorded with change.
+type changesStorage struct {
+	*objiotest.MemObjectStorage
+	mux     sync.Mutex
+	changes []objio.ObjectChange
+}
+
+type objectChange struct {
+	path string
+	info objio.ObjectInfo
+}
+
+func (self *changesStorage) change(name string) {
+	info, _ := self.Stat(name)
+
+	self.mux.Lock()
+	self.changes = append(self.changes, &objectChange{name, info})
+	self.mux.Unlock()
+}
+
+func (self *changesStorage) Changes(
+	icursor string) (ocursor string, changes []objio.ObjectChange, err error) {
+
+	self.mux.Lock()
+	defer self.mux.Unlock()
+
+	i, _ := strconv.Atoi(icursor)
+	if i > len(self.changes) {
+		err = errors.New(": invalid cursor", nil, errno.EINVAL)
+		return
+	}
+
+	ocursor = strconv.Itoa(len(self.changes))
+	changes = self.changes[i:]
+
+	return
+}
+
+func (self *objectChange) Path() string {
+	return self.path
+}
+
+func (self *objectChange) IsRemoved() bool {
+	return nil == self.info
+}
+
+func (self *objectChange) Info() objio.ObjectInfo {
+	return self.info
+}
+
+func TestSyncChanges(t *testing.T) {
+	storage := &changesStorage{MemObjectStorage: objiotest.NewMemObjectStorage(false)}
+	cache, _ := newTestCache(t, storage, map[string]string{
+		"/dir/":  "",
+		"/dir/a": "old",
+		"/dir/b": "old",
+	}, nil, Open)
+	defer cache.CloseCache()
+
+	err := cache.syncChanges()
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	read := func(name string) (string, error) {
+		ino, err := cache.Open(name)
+		if nil != err {
+			return "", err
+		}
+		defer cache.Close(ino)
+
+		_, err = cache.Stat(ino)
+		if nil != err {
+			return "", err
+		}
+
+		buf := make([]byte, 16)
+		n, err := cache.ReadAt(ino, buf, 0)
+		if io.EOF == err {
+			err = nil
+		}
+		return string(buf[:n]), err
+	}
+	readdir := func(name string) string {
+		ino, err := cache.Open(name)
+		if nil != err {
+			t.Fatal(err)
+		}
+		defer cache.Close(ino)
+
+		infos, err := cache.Readdir(ino, 0)
+		if nil != err {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+
+	if s := readdir("/dir"); "a,b" != s {
+		t.Error("Readdir", s)
+	}
+	for _, name := range []string{"/dir/a", "/dir/b"} {
+		if s, err := read(name); nil != err || "old" != s {
+			t.Error("read", name, s, err)
+		}
+	}
+	if _, err := read("/dir/sub/c"); nil == err {
+		t.Error("read /dir/sub/c")
+	}
+
+	// update /dir/a, delete /dir/b and make /dir/sub (e.g. by a directory
+	// rename, so that /dir/sub/c is not reported as a change of its own)
+	writeTestObjects(t, storage, map[string]string{
+		"/dir/a":     "new",
+		"/dir/sub/":  "",
+		"/dir/sub/c": "new",
+	})
+	storage.Remove("/dir/b")
+	storage.change("/dir/a")
+	storage.change("/dir/b")
+	storage.change("/dir/sub")
+
+	err = cache.syncChanges()
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if s := readdir("/dir"); "a,sub" != s {
+		t.Error("Readdir after changes", s)
+	}
+	for name, data := range map[string]string{"/dir/a": "new", "/dir/sub/c": "new"} {
+		if s, err := read(name); nil != err || data != s {
+			t.Error("read after changes", name, s, err)
+		}
+	}
+	if _, err := read("/dir/b"); !errors.HasAttachment(err, errno.ENOENT) {
+		t.Error("read /dir/b after changes", err)
+	}
+}
+
+// capsStorage reports that it can neither keep empty directories nor rename
+// directories or over existing objects, and refuses to do the latter.
+type capsStorage struct {
+	*objiotest.MemObjectStorage
+}
+
+type capsStorageInfo struct {
+	objio.StorageInfo
+}
+
+func (self *capsStorage) Info(getsize bool) (info objio.StorageInfo, err error) {
+	info, err = self.MemObjectStorage.Info(getsize)
+	if nil == err {
+		info = &capsStorageInfo{info}
+	}
+	return
+}
+
+func (self *capsStorage) Rename(oldname string, newname string) (err error) {
+	info, err := self.Stat(oldname)
+	if nil == err && info.IsDir() {
+		return errors.New(": cannot rename directory "+oldname, nil, errno.ENOSYS)
+	}
+	_, err = self.Stat(newname)
+	if nil == err {
+		return errors.New(": cannot replace "+newname, nil, errno.EEXIST)
+	}
+	return self.MemObjectStorage.Rename(oldname, newname)
+}
+
+func (info *capsStorageInfo) Capabilities() objio.Capability {
+	return objio.CapRangeRead | objio.CapConsistentList
+}
+
+func (info *capsStorageInfo) MaxObjectSize() int64 {
+	return 0
+}
+
+func TestCapabilityEmulation(t *testing.T) {
+	storage := &capsStorage{objiotest.NewMemObjectStorage(false)}
+	cache, _ := newTestCache(t, storage, map[string]string{
+		"/a": "a",
+		"/b": "b",
+	}, nil, Open)
+	defer cache.CloseCache()
+
+	if 0 != cache.caps&(objio.CapEmptyDir|objio.CapDirRename|objio.CapRenameOverwrite) {
+		t.Fatal("caps", cache.caps)
+	}
+
+	makeNode := func(name string, dir bool) {
+		ino, err := cache.Open(name)
+		if nil == err {
+			err = cache.Make(ino, dir)
+			cache.Close(ino)
+		}
+		if nil != err {
+			t.Fatal("Make", name, err)
+		}
+	}
+	rename := func(name string, newname string) {
+		ino, err := cache.Open(name)
+		if nil == err {
+			err = cache.Rename(ino, newname)
+			cache.Close(ino)
+		}
+		if nil != err {
+			t.Fatal("Rename", name, err)
+		}
+	}
+	readdir := func(name string) string {
+		ino, err := cache.Open(name)
+		if nil != err {
+			t.Fatal(err)
+		}
+		defer cache.Close(ino)
+
+		infos, err := cache.Readdir(ino, 0)
+		if nil != err {
+			t.Fatal("Readdir", name, err)
+		}
+		names := []string{}
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+	exists := func(name string) bool {
+		_, err := storage.Stat(name)
+		return nil == err
+	}
+
+	// a made directory is kept by a placeholder that is hidden from listings
+	makeNode("/dir", true)
+	if !exists("/dir/" + dirPlaceholder) {
+		t.Error("placeholder not made")
+	}
+	if s := readdir("/dir"); "" != s {
+		t.Error("Readdir /dir", s)
+	}
+	makeNode("/dir/file", false)
+	makeNode("/dir/sub", true)
+	if s := readdir("/dir"); "file,sub" != s {
+		t.Error("Readdir /dir", s)
+	}
+
+	// a directory is renamed by moving its children
+	rename("/dir", "/newdir")
+	if exists("/dir") || !exists("/newdir/file") || !exists("/newdir/sub/"+dirPlaceholder) ||
+		!exists("/newdir/"+dirPlaceholder) {
+		t.Error("directory rename")
+	}
+	if s := readdir("/newdir"); "file,sub" != s {
+		t.Error("Readdir /newdir", s)
+	}
+
+	// a rename over an existing object removes it first
+	rename("/a", "/b")
+	if exists("/a") || !exists("/b") {
+		t.Error("rename overwrite")
+	}
+
+	// a directory that holds only its placeholder can be removed
+	ino, err := cache.Open("/newdir/sub")
+	if nil == err {
+		err = cache.Remove(ino, true)
+		cache.Close(ino)
+	}
+	if nil != err {
+		t.Fatal("Remove", err)
+	}
+	if exists("/newdir/sub/"+dirPlaceholder) || exists("/newdir/sub") {
+		t.Error("rmdir placeholder-only directory")
+	}
+	if s := readdir("/newdir"); "file" != s {
+		t.Error("Readdir /newdir after rmdir", s)
+	}
+}
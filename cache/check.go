@@ -0,0 +1,354 @@
+/*
+ * check.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/billziss-gh/golib/errors"
+	"github.com/boltdb/bolt"
+)
+
+// Kinds of problems found by Check.
+const (
+	CheckCorruptNode   = "corrupt-node"   // catalog record that cannot be decoded
+	CheckCorruptRecord = "corrupt-record" // sparse file or session record that cannot be decoded
+	CheckPathKey       = "path-key"       // catalog key that is not the key of the node path
+	CheckDuplicateIno  = "duplicate-ino"  // catalog records that share an ino
+	CheckMissingIndex  = "missing-index"  // catalog record that is not indexed by its ino
+	CheckOrphanIndex   = "orphan-index"   // index record without catalog record
+	CheckOrphanFile    = "orphan-file"    // cached file without node
+	CheckOrphanBlocks  = "orphan-blocks"  // sparse file record without node
+	CheckOrphanSession = "orphan-session" // upload session without node
+	CheckMissingFile   = "missing-file"   // sparse file record or upload session without cached file
+	CheckSizeMismatch  = "size-mismatch"  // cached file whose size is not that of its node
+	CheckStaleSession  = "stale-session"  // upload session of a cached file that has changed since
+	CheckFileState     = "file-state"     // cached file recorded as unmodified that is modified
+)
+
+// CheckProblem describes an inconsistency found by Check.
+type CheckProblem struct {
+	Kind     string
+	Ino      uint64
+	Path     string // node path or catalog key; may be empty
+	Repaired bool
+}
+
+func (p CheckProblem) String() string {
+	if "" != p.Path {
+		return p.Kind + " " + p.Path
+	}
+
+	return fmt.Sprintf("%s ino=%x", p.Kind, p.Ino)
+}
+
+// Check verifies the cache index against itself and against the cached
+// files. If repair is true the problems found are also repaired: records
+// that are inconsistent are removed or rewritten and cached files that
+// belong to no node are removed.
+//
+// Check also hashes the cached files and lists the paths of files that
+// differ from their downloaded content. These files are not inconsistent;
+// they are modified and will be uploaded, and Check never changes them.
+// However a modified file that is recorded as unmodified (and would not be
+// uploaded) is a problem; it is repaired by recording it as modified.
+//
+// Check should be used on a cache opened with Inspect, so that the cache
+// has not already cleaned up after itself when it was opened.
+func (self *Cache) Check(repair bool) (problems []CheckProblem, modified []string, err error) {
+	files := map[uint64]os.FileInfo{}
+	filepath.Walk(self.path, func(path string, stat os.FileInfo, err error) error {
+		if nil != err || stat.IsDir() {
+			return nil
+		}
+
+		ino, err := self.parseIno(path)
+		if nil != err || self.filePath(ino) != path {
+			return nil
+		}
+
+		files[ino] = stat
+		return nil
+	})
+
+	report := func(kind string, ino uint64, path string) {
+		problems = append(problems, CheckProblem{kind, ino, path, repair})
+	}
+
+	var remove []uint64
+	check := func(tx *bolt.Tx) (err error) {
+		ntx := nodetx_t{Tx: tx}
+		del := func(b *bolt.Bucket, k []byte) {
+			if repair && nil == err {
+				err = b.Delete(k)
+			}
+		}
+		put := func(b *bolt.Bucket, k []byte, v []byte) {
+			if repair && nil == err {
+				err = b.Put(k, v)
+			}
+		}
+
+		// records are collected before they are checked, because buckets
+		// cannot be modified while iterating over them
+		nodes := map[string]*node_t{}
+		var keys []string
+		var corrupt [][]byte
+		cursor := ntx.Cat().Cursor()
+		for k, v := cursor.First(); nil != k; k, v = cursor.Next() {
+			n := &node_t{}
+			if nil != n.Decode(v) || 0 == n.Ino || "" == n.Path {
+				report(CheckCorruptNode, n.Ino, string(k))
+				corrupt = append(corrupt, append([]byte(nil), k...))
+				continue
+			}
+
+			nodes[string(k)] = n
+			keys = append(keys, string(k))
+		}
+		for _, k := range corrupt {
+			del(ntx.Cat(), k)
+		}
+
+		index := map[uint64]string{}
+		var idxkeys [][]byte
+		cursor = ntx.Idx().Cursor()
+		for k, v := cursor.First(); nil != k; k, v = cursor.Next() {
+			idxkeys = append(idxkeys, append([]byte(nil), k...))
+			if 8 == len(k) {
+				_, ino := getUint64(k, 0)
+				index[ino] = string(v)
+			}
+		}
+
+		for _, k := range keys {
+			n := nodes[k]
+			pk := self.pathKey(n.Path)
+			if pk == k {
+				continue
+			}
+
+			report(CheckPathKey, n.Ino, n.Path)
+			delete(nodes, k)
+			del(ntx.Cat(), []byte(k))
+
+			// move the record to its proper key unless that key is taken
+			if _, ok := nodes[pk]; !ok {
+				nodes[pk] = n
+				put(ntx.Cat(), []byte(pk), n.Encode(make([]byte, n.EncodeLen())))
+				if index[n.Ino] == k {
+					var kbuf [8]byte
+					putUint64(kbuf[:], 0, n.Ino)
+					index[n.Ino] = pk
+					put(ntx.Idx(), kbuf[:], []byte(pk))
+				}
+			}
+		}
+
+		keys = keys[:0]
+		for k := range nodes {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		inos := []uint64{}
+		byino := map[uint64][]string{}
+		for _, k := range keys {
+			ino := nodes[k].Ino
+			if nil == byino[ino] {
+				inos = append(inos, ino)
+			}
+			byino[ino] = append(byino[ino], k)
+		}
+		sort.Slice(inos, func(i, j int) bool { return inos[i] < inos[j] })
+
+		alive := map[uint64]string{}
+		for _, ino := range inos {
+			ks := byino[ino]
+			keep := ks[0]
+			for _, k := range ks {
+				if index[ino] == k {
+					keep = k
+				}
+			}
+
+			for _, k := range ks {
+				if keep != k {
+					report(CheckDuplicateIno, ino, nodes[k].Path)
+					del(ntx.Cat(), []byte(k))
+				}
+			}
+
+			if index[ino] != keep {
+				var kbuf [8]byte
+				putUint64(kbuf[:], 0, ino)
+				report(CheckMissingIndex, ino, nodes[keep].Path)
+				put(ntx.Idx(), kbuf[:], []byte(keep))
+			}
+
+			alive[ino] = keep
+		}
+
+		for _, k := range idxkeys {
+			ino := uint64(0)
+			if 8 == len(k) {
+				_, ino = getUint64(k, 0)
+				if _, ok := alive[ino]; ok {
+					continue
+				}
+			}
+
+			report(CheckOrphanIndex, ino, "")
+			del(ntx.Idx(), k)
+		}
+
+		sparse := map[uint64]bool{}
+		for _, r := range []struct {
+			bucket []byte
+			orphan string
+			decode func(v []byte) error
+		}{
+			{blockname, CheckOrphanBlocks, (&blocks_t{}).Decode},
+			{sessname, CheckOrphanSession, (&session_t{}).Decode},
+		} {
+			var recs [][]byte
+			var bad []bool
+			cursor = tx.Bucket(r.bucket).Cursor()
+			for k, v := cursor.First(); nil != k; k, v = cursor.Next() {
+				recs = append(recs, append([]byte(nil), k...))
+				bad = append(bad, nil != r.decode(v))
+			}
+
+			for i, k := range recs {
+				ino := uint64(0)
+				if 8 == len(k) {
+					_, ino = getUint64(k, 0)
+				}
+
+				key, ok := alive[ino]
+				switch {
+				case !ok:
+					report(r.orphan, ino, "")
+				case bad[i]:
+					report(CheckCorruptRecord, ino, nodes[key].Path)
+					if bytes.Equal(blockname, r.bucket) {
+						// a sparse file without its record would pass for
+						// a complete file; remove it as well
+						remove = append(remove, ino)
+					}
+				case nil == files[ino]:
+					report(CheckMissingFile, ino, nodes[key].Path)
+				default:
+					if bytes.Equal(blockname, r.bucket) {
+						sparse[ino] = true
+					}
+					continue
+				}
+
+				del(tx.Bucket(r.bucket), k)
+			}
+		}
+
+		// sessions of cached files that have changed since they were created
+		// cannot be resumed
+		var stale [][]byte
+		cursor = tx.Bucket(sessname).Cursor()
+		for k, v := cursor.First(); nil != k; k, v = cursor.Next() {
+			session := session_t{}
+			if 8 != len(k) || nil != session.Decode(v) {
+				continue
+			}
+			key, ok := alive[session.Ino]
+			stat := files[session.Ino]
+			if ok && nil != stat &&
+				(session.Size != stat.Size() || !session.Mtime.Equal(stat.ModTime().UTC())) {
+				report(CheckStaleSession, session.Ino, nodes[key].Path)
+				stale = append(stale, append([]byte(nil), k...))
+			}
+		}
+		for _, k := range stale {
+			del(tx.Bucket(sessname), k)
+		}
+
+		for _, ino := range inos {
+			k := alive[ino]
+			n := nodes[k]
+			stat := files[ino]
+			if nil == stat || n.IsDir || n.IsLink || sparse[ino] {
+				continue
+			}
+
+			if stat.Size() != n.Size {
+				report(CheckSizeMismatch, ino, n.Path)
+				if repair && nil == err {
+					n.Size = stat.Size()
+					n.Mtime = stat.ModTime()
+					err = n.Put(&ntx, []byte(k))
+				}
+			}
+
+			hash, e := hashFile(self.filePath(ino))
+			if nil == e && !bytes.Equal(n.Hash, hash) {
+				modified = append(modified, n.Path)
+				if dirty, ok := n.FileState(stat); ok && !dirty {
+					report(CheckFileState, ino, n.Path)
+					if repair && nil == err {
+						n.SetFileState(true, stat)
+						err = n.Put(&ntx, []byte(k))
+					}
+				}
+			}
+		}
+
+		inos = inos[:0]
+		for ino := range files {
+			if _, ok := alive[ino]; !ok {
+				inos = append(inos, ino)
+			}
+		}
+		sort.Slice(inos, func(i, j int) bool { return inos[i] < inos[j] })
+		for _, ino := range inos {
+			report(CheckOrphanFile, ino, "")
+			remove = append(remove, ino)
+		}
+
+		return
+	}
+
+	if repair {
+		err = self.database.Update(check)
+	} else {
+		err = self.database.View(check)
+	}
+	if nil != err {
+		err = errors.New("", err)
+		return
+	}
+
+	if repair {
+		for _, ino := range remove {
+			self.removeFile(ino)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,176 @@
+/*
+ * check_test.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/billziss-gh/objfs/objio/objiotest"
+	"github.com/boltdb/bolt"
+)
+
+func TestCheck(t *testing.T) {
+	storage := objiotest.NewMemObjectStorage(false)
+	cache, path := newTestCache(t, storage, nil, nil, Open)
+
+	inos := map[string]uint64{}
+	for _, name := range []string{"/a", "/b", "/c", "/d"} {
+		ino, err := cache.Open(name)
+		if nil != err {
+			t.Fatal(err)
+		}
+		err = cache.Make(ino, false)
+		if nil == err {
+			_, err = cache.WriteAt(ino, []byte(name), 0)
+		}
+		cache.Close(ino)
+		if nil != err {
+			t.Fatal(err)
+		}
+		inos[name] = ino
+	}
+
+	err := cache.uploadAll(true, nil)
+	if nil == err {
+		err = cache.CloseCache()
+	}
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	cache, err = OpenCache(path, storage, nil, Inspect)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer cache.CloseCache()
+
+	problems, modified, err := cache.Check(false)
+	if nil != err || 0 != len(problems) || 0 != len(modified) {
+		t.Fatal("Check", problems, modified, err)
+	}
+
+	err = cache.database.Update(func(tx *bolt.Tx) (err error) {
+		ntx := nodetx_t{Tx: tx}
+		var kbuf [8]byte
+
+		// path-key: /a is stored under the wrong key
+		n := node_t{}
+		n.Get(&ntx, []byte("/a"))
+		ntx.Cat().Delete([]byte("/a"))
+		n.Put(&ntx, []byte("/wrong"))
+
+		// missing-index and duplicate-ino: /dup shares the ino of /b
+		putUint64(kbuf[:], 0, inos["/b"])
+		ntx.Idx().Delete(kbuf[:])
+		n.Get(&ntx, []byte("/b"))
+		n.Path = "/dup"
+		v := n.Encode(make([]byte, n.EncodeLen()))
+		ntx.Cat().Put([]byte("/dup"), v)
+
+		// corrupt-node and orphan-index
+		ntx.Cat().Put([]byte("/corrupt"), []byte{1, 2, 3})
+		putUint64(kbuf[:], 0, 9999)
+		ntx.Idx().Put(kbuf[:], []byte("/gone"))
+
+		// orphan-blocks and missing-file
+		newBlocks(10, 4, "").Put(tx, 9998)
+		(&session_t{Ino: inos["/c"], Session: "s"}).Put(tx, inos["/c"])
+
+		// stale-session: /a has changed since its session was created
+		(&session_t{Ino: inos["/a"], Size: 1, Session: "s"}).Put(tx, inos["/a"])
+
+		return
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	// orphan-file
+	orphan := cache.filePath(9997)
+	os.MkdirAll(filepath.Dir(orphan), 0700)
+	ioutil.WriteFile(orphan, []byte("orphan"), 0600)
+
+	// size-mismatch (and modified)
+	os.Remove(cache.filePath(inos["/c"]))
+	ioutil.WriteFile(cache.filePath(inos["/b"]), []byte("/b+"), 0600)
+
+	// file-state (and modified): /d is modified without changing its size
+	// and mtime
+	dstat, _ := os.Stat(cache.filePath(inos["/d"]))
+	ioutil.WriteFile(cache.filePath(inos["/d"]), []byte("/D"), 0600)
+	os.Chtimes(cache.filePath(inos["/d"]), dstat.ModTime(), dstat.ModTime())
+
+	expected := []string{
+		"corrupt-node /corrupt",
+		"duplicate-ino /dup",
+		"file-state /d",
+		"missing-file /c",
+		"missing-index /b",
+		"orphan-blocks ino=270e",
+		"orphan-file ino=270d",
+		"orphan-index ino=270f",
+		"path-key /a",
+		"size-mismatch /b",
+		"stale-session /a",
+	}
+	check := func(repair bool) {
+		problems, modified, err := cache.Check(repair)
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		var list []string
+		for _, p := range problems {
+			list = append(list, p.String())
+			if repair != p.Repaired {
+				t.Error("Check Repaired", p)
+			}
+		}
+		sort.Strings(list)
+		if strings.Join(expected, "\n") != strings.Join(list, "\n") {
+			t.Error("Check", repair, list)
+		}
+		if "[/b /d]" != fmt.Sprint(modified) {
+			t.Error("Check modified", modified)
+		}
+	}
+
+	check(false)
+	check(true)
+
+	expected = nil
+	check(false)
+
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Error("orphan file not removed")
+	}
+
+	n := node_t{}
+	err = cache.database.View(func(tx *bolt.Tx) (err error) {
+		return n.GetWithIno(&nodetx_t{Tx: tx}, inos["/a"])
+	})
+	if nil != err || "/a" != n.Path {
+		t.Error("/a not repaired", err)
+	}
+}
@@ -0,0 +1,307 @@
+/*
+ * config.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/billziss-gh/golib/errors"
+	"github.com/billziss-gh/objfs/errno"
+)
+
+// configNames are the names of the configuration settings accepted by
+// Config.Set, in the order listed by Config.Settings.
+var configNames = []string{
+	"dir-path-timeout",
+	"dir-path-max-count",
+	"neg-path-timeout",
+	"neg-path-max-count",
+	"loop-period",
+	"upload-delay",
+	"evict-delay",
+	"part-size",
+	"parallelism",
+	"upload-workers",
+	"block-size",
+	"max-cache-size",
+	"min-free-space",
+	"conflict-policy",
+	"upload-priority",
+	"upload-small-first",
+	"upload-window",
+	"upload-unmetered",
+	"consistency",
+	"verify",
+}
+
+// IsConfigName determines if name is the name of a configuration setting.
+func IsConfigName(name string) bool {
+	for _, n := range configNames {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Set sets a configuration setting from its name and value. Durations use
+// the syntax of time.ParseDuration (e.g. 10s); sizes are in bytes with an
+// optional K, M, G or T suffix. A value of 0 selects the default.
+//
+// The upload-delay setting accepts a default duration as well as the
+// PATTERN:DURATION items of UploadPolicy.Set (e.g. 10s,*.log:1h). The
+// upload-priority, upload-small-first, upload-window and upload-unmetered
+// settings are those of UploadPolicy.Set; the consistency setting is that of
+// ConsistencyPolicy.Set.
+func (config *Config) Set(name string, value string) (err error) {
+	value = strings.TrimSpace(value)
+
+	switch name {
+	case "dir-path-timeout":
+		config.DirPathTimeout, err = parseConfigDuration(name, value)
+	case "dir-path-max-count":
+		config.DirPathMaxCount, err = parseConfigInt(name, value)
+	case "neg-path-timeout":
+		config.NegPathTimeout, err = parseConfigDuration(name, value)
+	case "neg-path-max-count":
+		config.NegPathMaxCount, err = parseConfigInt(name, value)
+	case "loop-period":
+		config.LoopPeriod, err = parseConfigDuration(name, value)
+	case "upload-delay":
+		var delays []string
+		config.UploadDelay = 0
+		for _, item := range strings.Split(value, ",") {
+			if strings.Contains(item, ":") {
+				delays = append(delays, item)
+			} else if "" != strings.TrimSpace(item) {
+				config.UploadDelay, err = parseConfigDuration(name, item)
+				if nil != err {
+					return
+				}
+			}
+		}
+		err = config.UploadPolicy.Set(name, strings.Join(delays, ","))
+	case "evict-delay":
+		config.EvictDelay, err = parseConfigDuration(name, value)
+	case "part-size":
+		config.PartSize, err = parseConfigSize(name, value)
+		if nil == err && 0 > config.PartSize {
+			err = errors.New(": invalid "+name+" "+value, nil, errno.EINVAL)
+		}
+	case "parallelism":
+		config.Parallelism, err = parseConfigInt(name, value)
+	case "upload-workers":
+		config.UploadWorkers, err = parseConfigInt(name, value)
+	case "block-size":
+		// a negative block size disables block caching
+		config.BlockSize, err = parseConfigSize(name, value)
+	case "max-cache-size":
+		config.MaxCacheSize, err = parseConfigSize(name, value)
+		if nil == err && 0 > config.MaxCacheSize {
+			err = errors.New(": invalid "+name+" "+value, nil, errno.EINVAL)
+		}
+	case "min-free-space":
+		config.MinFreeSpace, err = parseConfigSize(name, value)
+		if nil == err && 0 > config.MinFreeSpace {
+			err = errors.New(": invalid "+name+" "+value, nil, errno.EINVAL)
+		}
+	case "conflict-policy":
+		err = config.ConflictPolicy.Set(value)
+	case "upload-priority", "upload-small-first", "upload-window", "upload-unmetered":
+		err = config.UploadPolicy.Set(name, value)
+	case "consistency":
+		err = config.Consistency.Set(value)
+	case "verify":
+		config.Verify, err = strconv.ParseBool(value)
+		if nil != err {
+			err = errors.New(": invalid "+name+" "+value, nil, errno.EINVAL)
+		}
+	default:
+		err = errors.New(": unknown cache setting "+name, nil, errno.EINVAL)
+	}
+
+	return
+}
+
+// Settings lists all configuration settings in the form accepted by Set.
+// Settings that are 0 are listed as such; use the Config of an open Cache
+// to get the effective settings.
+func (config *Config) Settings() (settings []string) {
+	policy := map[string]string{}
+	for _, s := range config.UploadPolicy.Settings() {
+		i := strings.IndexByte(s, '=')
+		policy[s[:i]] = s[i+1:]
+	}
+
+	for _, name := range configNames {
+		var value string
+		switch name {
+		case "dir-path-timeout":
+			value = config.DirPathTimeout.String()
+		case "dir-path-max-count":
+			value = strconv.Itoa(config.DirPathMaxCount)
+		case "neg-path-timeout":
+			value = config.NegPathTimeout.String()
+		case "neg-path-max-count":
+			value = strconv.Itoa(config.NegPathMaxCount)
+		case "loop-period":
+			value = config.LoopPeriod.String()
+		case "upload-delay":
+			value = config.UploadDelay.String()
+			if "" != policy[name] {
+				value += "," + policy[name]
+			}
+		case "evict-delay":
+			value = config.EvictDelay.String()
+		case "part-size":
+			value = formatConfigSize(config.PartSize)
+		case "parallelism":
+			value = strconv.Itoa(config.Parallelism)
+		case "upload-workers":
+			value = strconv.Itoa(config.UploadWorkers)
+		case "block-size":
+			value = formatConfigSize(config.BlockSize)
+		case "max-cache-size":
+			value = formatConfigSize(config.MaxCacheSize)
+		case "min-free-space":
+			value = formatConfigSize(config.MinFreeSpace)
+		case "conflict-policy":
+			value = config.ConflictPolicy.String()
+		case "upload-small-first":
+			value = strconv.FormatBool(config.UploadPolicy.SmallFirst)
+		case "upload-unmetered":
+			value = strconv.FormatBool(config.UploadPolicy.Unmetered)
+		case "consistency":
+			value = config.Consistency.String()
+		case "verify":
+			value = strconv.FormatBool(config.Verify)
+		default:
+			value = policy[name]
+		}
+
+		settings = append(settings, name+"="+value)
+	}
+
+	return
+}
+
+// setDefaults replaces settings that are 0 with their defaults.
+func (config *Config) setDefaults() {
+	if 0 >= config.DirPathTimeout {
+		config.DirPathTimeout = DefaultDirPathTimeout
+	}
+	if 0 >= config.DirPathMaxCount {
+		config.DirPathMaxCount = DefaultDirPathMaxCount
+	}
+	if 0 >= config.NegPathTimeout {
+		config.NegPathTimeout = DefaultNegPathTimeout
+	}
+	if 0 >= config.NegPathMaxCount {
+		config.NegPathMaxCount = DefaultNegPathMaxCount
+	}
+	if 0 >= config.LoopPeriod {
+		config.LoopPeriod = DefaultLoopPeriod
+	}
+	if 0 >= config.UploadDelay {
+		config.UploadDelay = DefaultUploadDelay
+	}
+	if 0 >= config.EvictDelay {
+		config.EvictDelay = DefaultEvictDelay
+	}
+	if 0 >= config.PartSize {
+		config.PartSize = DefaultPartSize
+	}
+	if 0 >= config.Parallelism {
+		config.Parallelism = DefaultParallelism
+	}
+	if 0 >= config.UploadWorkers {
+		config.UploadWorkers = DefaultUploadWorkers
+	}
+	if 0 == config.BlockSize {
+		config.BlockSize = DefaultBlockSize
+	}
+}
+
+// validate checks the settings against each other, after defaults have been
+// set.
+func (config *Config) validate() (err error) {
+	if config.DirPathTimeout >= config.EvictDelay {
+		// a directory listed from the catalog could miss evicted entries
+		err = errors.New(fmt.Sprintf(": dir-path-timeout %v must be less than evict-delay %v",
+			config.DirPathTimeout, config.EvictDelay), nil, errno.EINVAL)
+	}
+
+	return
+}
+
+func parseConfigDuration(name string, value string) (d time.Duration, err error) {
+	d, err = time.ParseDuration(strings.TrimSpace(value))
+	if nil != err || 0 > d {
+		err = errors.New(": invalid "+name+" "+value, nil, errno.EINVAL)
+	}
+
+	return
+}
+
+func parseConfigInt(name string, value string) (n int, err error) {
+	n, err = strconv.Atoi(value)
+	if nil != err || 0 > n {
+		err = errors.New(": invalid "+name+" "+value, nil, errno.EINVAL)
+	}
+
+	return
+}
+
+var sizeSuffixes = "KMGT"
+
+func parseConfigSize(name string, value string) (n int64, err error) {
+	v := value
+	shift := uint(0)
+	if "" != v {
+		if i := strings.IndexByte(sizeSuffixes, v[len(v)-1]&^0x20); -1 != i {
+			shift = 10 * uint(i+1)
+			v = v[:len(v)-1]
+		}
+	}
+
+	n, err = strconv.ParseInt(v, 10, 64)
+	if nil != err || n<<shift>>shift != n {
+		err = errors.New(": invalid "+name+" "+value, nil, errno.EINVAL)
+		return
+	}
+
+	n <<= shift
+
+	return
+}
+
+func formatConfigSize(n int64) string {
+	if 0 != n {
+		for i := len(sizeSuffixes); 0 < i; i-- {
+			if shift := 10 * uint(i); 0 == n&(1<<shift-1) {
+				return strconv.FormatInt(n>>shift, 10) + sizeSuffixes[i-1:i]
+			}
+		}
+	}
+
+	return strconv.FormatInt(n, 10)
+}
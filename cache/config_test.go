@@ -0,0 +1,119 @@
+/*
+ * config_test.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/billziss-gh/objfs/objio/objiotest"
+)
+
+func TestConfigSet(t *testing.T) {
+	config := Config{}
+
+	settings := []string{
+		"dir-path-timeout=20s",
+		"dir-path-max-count=200",
+		"neg-path-timeout=1s",
+		"neg-path-max-count=50",
+		"loop-period=5s",
+		"upload-delay=1m0s,*.log:1h0m0s",
+		"evict-delay=2m0s",
+		"part-size=8M",
+		"parallelism=2",
+		"upload-workers=8",
+		"block-size=-1",
+		"max-cache-size=20G",
+		"min-free-space=1536M",
+		"conflict-policy=local-wins",
+		"upload-priority=*.doc:10",
+		"upload-small-first=true",
+		"upload-window=18:00-08:00",
+		"upload-unmetered=true",
+		"consistency=10m0s,/ref:trust",
+		"verify=true",
+	}
+	for _, s := range settings {
+		i := strings.IndexByte(s, '=')
+		if !IsConfigName(s[:i]) {
+			t.Error("IsConfigName", s)
+		}
+		err := config.Set(s[:i], s[i+1:])
+		if nil != err {
+			t.Error("Set", s, err)
+		}
+	}
+
+	if 20*time.Second != config.DirPathTimeout || time.Minute != config.UploadDelay ||
+		8<<20 != config.PartSize || -1 != config.BlockSize || 20<<30 != config.MaxCacheSize ||
+		ConflictLocalWins != config.ConflictPolicy || 1 != len(config.UploadPolicy.Delays) ||
+		!config.UploadPolicy.Unmetered {
+		t.Error("Set values", config)
+	}
+	if strings.Join(settings, "\n") != strings.Join(config.Settings(), "\n") {
+		t.Error("Settings", config.Settings())
+	}
+
+	for _, s := range [][2]string{
+		{"dir-path-timeout", "-1s"},
+		{"dir-path-max-count", "x"},
+		{"upload-delay", "soon"},
+		{"part-size", "1X"},
+		{"max-cache-size", "-1"},
+		{"max-cache-size", "9999999T"},
+		{"conflict-policy", "mine"},
+		{"consistency", "lax"},
+		{"verify", "maybe"},
+		{"storage", "onedrive"},
+	} {
+		err := config.Set(s[0], s[1])
+		if nil == err {
+			t.Error("Set invalid", s)
+		}
+	}
+
+	if IsConfigName("storage") {
+		t.Error("IsConfigName storage")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	storage := objiotest.NewMemObjectStorage(false)
+	path := newTestDir(t)
+
+	_, err := OpenCache(path, storage, &Config{DirPathTimeout: time.Minute}, Open)
+	if nil == err {
+		t.Error("OpenCache with dir-path-timeout >= evict-delay")
+	}
+
+	cache, err := OpenCache(path, storage, &Config{NegPathTimeout: time.Second}, Open)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer cache.CloseCache()
+
+	config := cache.Config()
+	if DefaultDirPathTimeout != config.DirPathTimeout || time.Second != config.NegPathTimeout {
+		t.Error("Config", config)
+	}
+	if "dir-path-timeout=10s" != config.Settings()[0] {
+		t.Error("Settings", config.Settings())
+	}
+}
@@ -0,0 +1,137 @@
+/*
+ * conflict.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"time"
+
+	"github.com/billziss-gh/golib/errors"
+	"github.com/billziss-gh/objfs/errno"
+	"github.com/boltdb/bolt"
+)
+
+// ConflictPolicy determines how a conflict is resolved. A conflict occurs
+// when a modified file is uploaded, but the object has changed on storage
+// since the file was cached.
+type ConflictPolicy int
+
+const (
+	// ConflictKeepBoth uploads the modified file as a conflict copy next to
+	// the object and discards the modified file from the cache.
+	ConflictKeepBoth ConflictPolicy = iota
+
+	// ConflictRemoteWins discards the modified file from the cache.
+	ConflictRemoteWins
+
+	// ConflictLocalWins uploads the modified file over the object.
+	ConflictLocalWins
+)
+
+var conflictPolicyNames = []string{
+	"keep-both",
+	"remote-wins",
+	"local-wins",
+}
+
+func (policy ConflictPolicy) String() string {
+	if 0 <= policy && int(policy) < len(conflictPolicyNames) {
+		return conflictPolicyNames[policy]
+	}
+
+	return "unknown"
+}
+
+// Set sets the policy from its name. It implements flag.Value.
+func (policy *ConflictPolicy) Set(s string) error {
+	for i, n := range conflictPolicyNames {
+		if n == s {
+			*policy = ConflictPolicy(i)
+			return nil
+		}
+	}
+
+	return errors.New(": unknown conflict policy "+s, nil, errno.EINVAL)
+}
+
+// Conflict records a conflict and its resolution.
+type Conflict struct {
+	Time   time.Time
+	Path   string
+	Copy   string // path of the conflict copy (ConflictKeepBoth only)
+	Policy ConflictPolicy
+}
+
+func (conflict *Conflict) Put(tx *bolt.Tx) (err error) {
+	// key: Time, Path; keeps conflicts in chronological order
+	k := make([]byte, 8+len(conflict.Path))
+	i := putTime(k, 0, conflict.Time)
+	putString(k, i, conflict.Path, len(conflict.Path))
+
+	v := make([]byte, conflict.EncodeLen())
+	v = conflict.Encode(v)
+	err = tx.Bucket(conflictname).Put(k, v)
+
+	return
+}
+
+func (conflict *Conflict) EncodeLen() int {
+	return 8 + 2 + 2 + 1 + len(conflict.Path) + len(conflict.Copy)
+}
+
+func (conflict *Conflict) Encode(b []byte) []byte {
+	// encode order: uint64*, uint32*, uint16*, uint8*
+	// Time, len(Path), len(Copy), Policy, Path, Copy
+
+	lp := len(conflict.Path)
+	lc := len(conflict.Copy)
+
+	i := 0
+	i = putTime(b, i, conflict.Time)
+	i = putUint16(b, i, uint16(lp))
+	i = putUint16(b, i, uint16(lc))
+	i = putUint8(b, i, uint8(conflict.Policy))
+	i = putString(b, i, conflict.Path, 1<<16-1)
+	i = putString(b, i, conflict.Copy, 1<<16-1)
+	return b[:i]
+}
+
+func (conflict *Conflict) Decode(b []byte) (err error) {
+	// encode order: uint64*, uint32*, uint16*, uint8*
+	// Time, len(Path), len(Copy), Policy, Path, Copy
+
+	defer func() {
+		if r := recover(); nil != r {
+			err = errno.EIO
+		}
+	}()
+
+	i := 0
+	i, tm := getTime(b, i)
+	i, lp := getUint16(b, i)
+	i, lc := getUint16(b, i)
+	i, policy := getUint8(b, i)
+	i, p := getString(b, i, int(lp))
+	i, c := getString(b, i, int(lc))
+
+	conflict.Time = tm
+	conflict.Path = p
+	conflict.Copy = c
+	conflict.Policy = ConflictPolicy(policy)
+
+	return nil
+}
@@ -0,0 +1,162 @@
+/*
+ * conflict_test.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/billziss-gh/objfs/objio"
+	"github.com/billziss-gh/objfs/objio/objiotest"
+)
+
+func TestConflictEncodeDecode(t *testing.T) {
+	c := Conflict{
+		Time:   time.Date(2018, 3, 14, 15, 9, 26, 0, time.UTC),
+		Path:   "/foo/bar.txt",
+		Copy:   "/foo/bar (conflict host 2018-03-14 150926).txt",
+		Policy: ConflictKeepBoth,
+	}
+
+	b := c.Encode(make([]byte, c.EncodeLen()))
+	d := Conflict{}
+	err := d.Decode(b)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !c.Time.Equal(d.Time) || c.Path != d.Path || c.Copy != d.Copy || c.Policy != d.Policy {
+		t.Error("Decode", d)
+	}
+
+	err = d.Decode(b[:10])
+	if nil == err {
+		t.Error("Decode truncated")
+	}
+}
+
+func TestConflictPolicySet(t *testing.T) {
+	var policy ConflictPolicy
+	for _, s := range []string{"remote-wins", "local-wins", "keep-both"} {
+		err := policy.Set(s)
+		if nil != err || s != policy.String() {
+			t.Error("Set", s, err)
+		}
+	}
+
+	err := policy.Set("unknown")
+	if nil == err {
+		t.Error("Set unknown")
+	}
+}
+
+func testConflict(t *testing.T, policy ConflictPolicy) (
+	storage objio.ObjectStorage, progress []string) {
+
+	storage = objiotest.NewMemObjectStorage(false)
+	cache, _ := newTestCache(t, storage, map[string]string{"/file.txt": "remote"},
+		&Config{ConflictPolicy: policy}, Open)
+
+	ino, err := cache.Open("/file.txt")
+	if nil != err {
+		t.Fatal(err)
+	}
+	_, err = cache.WriteAt(ino, []byte("LOCAL!"), 0)
+	cache.Close(ino)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	// change the object behind the cache's back
+	writeTestObjects(t, storage, map[string]string{"/file.txt": "change"})
+
+	err = cache.ResetCache(func(path string) {
+		progress = append(progress, path)
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	conflicts := cache.ListConflicts()
+	if 1 != len(conflicts) || "/file.txt" != conflicts[0].Path || policy != conflicts[0].Policy {
+		t.Error("ListConflicts", conflicts)
+	}
+
+	err = cache.ClearConflicts()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 0 != len(cache.ListConflicts()) {
+		t.Error("ListConflicts after ClearConflicts", cache.ListConflicts())
+	}
+
+	cache.CloseCache()
+
+	return
+}
+
+func readObject(t *testing.T, storage objio.ObjectStorage, name string) string {
+	_, reader, err := storage.OpenRead(name, "")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestConflictKeepBoth(t *testing.T) {
+	storage, progress := testConflict(t, ConflictKeepBoth)
+
+	if 2 != len(progress) || "!/file.txt" != progress[0] ||
+		!strings.HasPrefix(progress[1], "+/file (conflict ") {
+		t.Fatal("progress", progress)
+	}
+	if "change" != readObject(t, storage, "/file.txt") {
+		t.Error("object changed")
+	}
+	if "LOCAL!" != readObject(t, storage, progress[1][1:]) {
+		t.Error("conflict copy")
+	}
+}
+
+func TestConflictRemoteWins(t *testing.T) {
+	storage, progress := testConflict(t, ConflictRemoteWins)
+
+	if "!/file.txt" != strings.Join(progress, ",") {
+		t.Error("progress", progress)
+	}
+	if "change" != readObject(t, storage, "/file.txt") {
+		t.Error("object changed")
+	}
+}
+
+func TestConflictLocalWins(t *testing.T) {
+	storage, progress := testConflict(t, ConflictLocalWins)
+
+	if "!/file.txt,+/file.txt,-/file.txt" != strings.Join(progress, ",") {
+		t.Error("progress", progress)
+	}
+	if "LOCAL!" != readObject(t, storage, "/file.txt") {
+		t.Error("object not overwritten")
+	}
+}
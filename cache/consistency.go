@@ -0,0 +1,177 @@
+/*
+ * consistency.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"strings"
+	"time"
+
+	"github.com/billziss-gh/golib/errors"
+	"github.com/billziss-gh/objfs/errno"
+)
+
+// Consistency determines when a cached file is revalidated against storage
+// as it is opened. A positive Consistency is a duration: a file is
+// revalidated only if it was last validated longer ago than that.
+type Consistency time.Duration
+
+const (
+	// ConsistencyStrict revalidates a cached file every time it is opened
+	// (close-to-open consistency).
+	ConsistencyStrict Consistency = 0
+
+	// ConsistencyTrust never revalidates a cached file; changes on storage
+	// are seen only once the file is evicted or reported as changed.
+	ConsistencyTrust Consistency = -1
+)
+
+func (consistency Consistency) String() string {
+	switch {
+	case ConsistencyStrict == consistency:
+		return "strict"
+	case ConsistencyTrust == consistency:
+		return "trust"
+	case 0 < consistency:
+		return time.Duration(consistency).String()
+	}
+
+	return "unknown"
+}
+
+// Set sets the consistency from its name (strict or trust) or from a
+// duration. It implements flag.Value.
+func (consistency *Consistency) Set(s string) error {
+	switch s = strings.TrimSpace(s); s {
+	case "strict":
+		*consistency = ConsistencyStrict
+		return nil
+	case "trust":
+		*consistency = ConsistencyTrust
+		return nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if nil != err || 0 > d {
+		return errors.New(": unknown consistency "+s, nil, errno.EINVAL)
+	}
+
+	*consistency = Consistency(d)
+	return nil
+}
+
+// ConsistencyPolicy determines the consistency of cached files by path
+// pattern. Path patterns are those of UploadPolicy.
+type ConsistencyPolicy struct {
+	// Default is the consistency of files that match no pattern.
+	Default Consistency
+
+	Patterns []ConsistencyPattern
+}
+
+type ConsistencyPattern struct {
+	Pattern     string
+	Consistency Consistency
+}
+
+// Set sets the policy from its configuration value:
+//
+//	consistency=[CONSISTENCY,]PATTERN:CONSISTENCY,...
+//
+// CONSISTENCY is strict, trust or a duration (e.g. 10m).
+func (policy *ConsistencyPolicy) Set(value string) (err error) {
+	p := ConsistencyPolicy{}
+	for _, item := range strings.Split(value, ",") {
+		if "" == strings.TrimSpace(item) {
+			continue
+		}
+
+		if !strings.Contains(item, ":") {
+			err = p.Default.Set(item)
+			if nil != err {
+				return
+			}
+			continue
+		}
+
+		pattern, v, e := splitPolicyItem(item)
+		if nil != e {
+			return e
+		}
+		var consistency Consistency
+		err = consistency.Set(v)
+		if nil != err {
+			return
+		}
+		p.Patterns = append(p.Patterns, ConsistencyPattern{pattern, consistency})
+	}
+
+	*policy = p
+
+	return
+}
+
+func (policy *ConsistencyPolicy) String() string {
+	items := []string{policy.Default.String()}
+	for _, r := range policy.Patterns {
+		items = append(items, r.Pattern+":"+r.Consistency.String())
+	}
+
+	return strings.Join(items, ",")
+}
+
+func (policy *ConsistencyPolicy) consistency(p string) Consistency {
+	for _, r := range policy.Patterns {
+		if matchPolicyPattern(r.Pattern, p) {
+			return r.Consistency
+		}
+	}
+
+	return policy.Default
+}
+
+// isValidated determines if the cached file of a node may be used without
+// revalidating it against storage.
+func (self *Cache) isValidated(node *node_t) bool {
+	consistency := self.config.Consistency.consistency(node.Path)
+	if ConsistencyTrust == consistency {
+		return true
+	}
+	if 0 >= consistency {
+		return false
+	}
+
+	self.validmux.Lock()
+	t, ok := self.validmap[node.Ino]
+	self.validmux.Unlock()
+
+	return ok && time.Since(t) < time.Duration(consistency)
+}
+
+// setValidated records that the cached file of ino has been validated
+// against storage; a zero t forgets that it has. An ino is forgotten when its
+// file is removed or its node is removed or invalidated, so that validmap
+// does not outgrow the cached files.
+func (self *Cache) setValidated(ino uint64, t time.Time) {
+	self.validmux.Lock()
+	if t.IsZero() {
+		delete(self.validmap, ino)
+	} else {
+		self.validmap[ino] = t
+	}
+	self.validmux.Unlock()
+}
@@ -0,0 +1,158 @@
+/*
+ * consistency_test.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/billziss-gh/objfs/objio/objiotest"
+)
+
+func TestConsistencyPolicySet(t *testing.T) {
+	policy := ConsistencyPolicy{}
+	err := policy.Set("trust, /ref:1h ,*.tmp:strict")
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if ConsistencyTrust != policy.Default || 2 != len(policy.Patterns) ||
+		Consistency(time.Hour) != policy.Patterns[0].Consistency {
+		t.Error("Set", policy)
+	}
+	if "trust,/ref:1h0m0s,*.tmp:strict" != policy.String() {
+		t.Error("String", policy.String())
+	}
+
+	for p, c := range map[string]Consistency{
+		"/ref/a/b":       Consistency(time.Hour),
+		"/ref.tmp":       ConsistencyStrict,
+		"/foo/bar":       ConsistencyTrust,
+		"/foo/reference": ConsistencyTrust,
+	} {
+		if c != policy.consistency(p) {
+			t.Error("consistency", p, policy.consistency(p))
+		}
+	}
+
+	for _, s := range []string{"lax", "-1s", "/ref:", "[:trust"} {
+		if nil == policy.Set(s) {
+			t.Error("Set invalid", s)
+		}
+	}
+
+	policy = ConsistencyPolicy{}
+	if "strict" != policy.String() {
+		t.Error("String", policy.String())
+	}
+}
+
+func TestConsistency(t *testing.T) {
+	config := Config{}
+	err := config.Set("consistency", "strict,/ref:trust,*.dat:1h")
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	storage := objiotest.NewMemObjectStorage(false)
+	cache, _ := newTestCache(t, storage, map[string]string{
+		"/ref/":      "",
+		"/ref/a.txt": "old",
+		"/b.txt":     "old",
+		"/c.dat":     "old",
+	}, &config, Open)
+	defer cache.CloseCache()
+
+	names := []string{"/ref/a.txt", "/b.txt", "/c.dat"}
+
+	inos := map[string]uint64{}
+	read := func(name string) string {
+		ino, err := cache.Open(name)
+		if nil != err {
+			t.Fatal(err)
+		}
+		defer cache.Close(ino)
+		inos[name] = ino
+
+		buf := make([]byte, 16)
+		n, err := cache.ReadAt(ino, buf, 0)
+		if nil != err && io.EOF != err {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	for _, name := range names {
+		read(name)
+	}
+
+	// change the objects behind the cache's back
+	writeTestObjects(t, storage, map[string]string{
+		"/ref/a.txt": "new",
+		"/b.txt":     "new",
+		"/c.dat":     "new",
+	})
+
+	cache.ResetStats()
+	for name, data := range map[string]string{
+		"/ref/a.txt": "old",
+		"/b.txt":     "new",
+		"/c.dat":     "old",
+	} {
+		if s := read(name); data != s {
+			t.Error("read", name, s)
+		}
+	}
+	if stats := cache.Stats(); 2 != stats.ContentHits || 1 != stats.Downloads {
+		t.Error("Stats", stats.ContentHits, stats.Downloads)
+	}
+
+	// revalidate /c.dat once its validation has expired
+	cache.setValidated(inos["/c.dat"], time.Now().Add(-2*time.Hour))
+	if s := read("/c.dat"); "new" != s {
+		t.Error("read /c.dat after 1h", s)
+	}
+
+	// inos are forgotten as their nodes are invalidated, removed or evicted
+	isKnown := func(name string) bool {
+		cache.validmux.Lock()
+		_, ok := cache.validmap[inos[name]]
+		cache.validmux.Unlock()
+		return ok
+	}
+	if !isKnown("/ref/a.txt") || !isKnown("/b.txt") || !isKnown("/c.dat") {
+		t.Error("validmap", cache.validmap)
+	}
+	cache.invalidatePath("/ref", nil)
+	ino, err := cache.Open("/b.txt")
+	if nil == err {
+		err = cache.Remove(ino, false)
+		cache.Close(ino)
+	}
+	if nil != err {
+		t.Fatal(err)
+	}
+	err = cache.evictAll(true, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if isKnown("/ref/a.txt") || isKnown("/b.txt") || isKnown("/c.dat") {
+		t.Error("validmap after evict", cache.validmap)
+	}
+}
@@ -0,0 +1,174 @@
+/*
+ * control.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+
+	"github.com/billziss-gh/golib/errors"
+)
+
+// The control socket lets other processes perform operations on an active
+// cache, such as the cache of a running mount; the cache database cannot be
+// opened by more than one process at a time. The control socket is a unix
+// domain socket in the cache directory that serves net/rpc requests.
+
+const controlName = "control"
+
+// ErrNoControl is returned by CallControl when the cache is not active.
+var ErrNoControl = errors.New("cache is not active")
+
+// Control is the net/rpc receiver of the control socket.
+type Control struct {
+	cache *Cache
+}
+
+// PrefetchArgs are the arguments of Control.Prefetch.
+type PrefetchArgs struct {
+	Path    string
+	Depth   int
+	Content bool
+}
+
+// Prefetch calls Cache.Prefetch. The reply contains the progress reports.
+func (self *Control) Prefetch(args PrefetchArgs, reply *[]string) error {
+	return self.cache.Prefetch(args.Path, args.Depth, args.Content, func(path string) {
+		*reply = append(*reply, path)
+	})
+}
+
+// Conflicts calls Cache.ListConflicts and if clear is true Cache.ClearConflicts.
+func (self *Control) Conflicts(clear bool, reply *[]Conflict) (err error) {
+	*reply = self.cache.ListConflicts()
+	if clear {
+		err = self.cache.ClearConflicts()
+	}
+
+	return
+}
+
+// Stats calls Cache.Stats and if reset is true Cache.ResetStats.
+func (self *Control) Stats(reset bool, reply *Stats) (err error) {
+	*reply = self.cache.Stats()
+	if reset {
+		self.cache.ResetStats()
+	}
+
+	return
+}
+
+// Settings lists the effective configuration settings of the cache.
+func (self *Control) Settings(args bool, reply *[]string) error {
+	config := self.cache.Config()
+	*reply = config.Settings()
+	return nil
+}
+
+// CallControl calls a method on the control socket of the active cache in
+// the cache directory path. It returns ErrNoControl if the cache is not
+// active.
+func CallControl(path string, method string, args interface{}, reply interface{}) (err error) {
+	path, err = filepath.Abs(path)
+	if nil != err {
+		err = errors.New("", err)
+		return
+	}
+
+	client, err := rpc.Dial("unix", filepath.Join(path, controlName))
+	if nil != err {
+		err = ErrNoControl
+		return
+	}
+	defer client.Close()
+
+	err = client.Call(method, args, reply)
+	if nil != err {
+		err = errors.New("", err)
+	}
+
+	return
+}
+
+// startControl starts serving the control socket. Failure to do so is not
+// fatal; the cache is then not controllable.
+func (self *Cache) startControl() {
+	server := rpc.NewServer()
+	err := server.Register(&Control{cache: self})
+	if nil != err {
+		return
+	}
+
+	path := filepath.Join(self.path, controlName)
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if nil != err {
+		return
+	}
+
+	self.listener = listener
+	self.ctlconns = map[net.Conn]struct{}{}
+	self.wg.Add(1)
+	go func() {
+		defer self.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if nil != err {
+				return
+			}
+
+			self.ctlmux.Lock()
+			if nil == self.ctlconns {
+				// the control socket has been stopped
+				self.ctlmux.Unlock()
+				conn.Close()
+				return
+			}
+			self.ctlconns[conn] = struct{}{}
+			self.wg.Add(1)
+			self.ctlmux.Unlock()
+
+			go func() {
+				defer self.wg.Done()
+				server.ServeConn(conn)
+
+				self.ctlmux.Lock()
+				delete(self.ctlconns, conn)
+				self.ctlmux.Unlock()
+			}()
+		}
+	}()
+}
+
+// stopControl stops serving the control socket and closes its connections.
+// Calls in progress complete; the cache wg waits for them.
+func (self *Cache) stopControl() {
+	if nil != self.listener {
+		self.listener.Close()
+		self.listener = nil
+	}
+
+	self.ctlmux.Lock()
+	for conn := range self.ctlconns {
+		conn.Close()
+	}
+	self.ctlconns = nil
+	self.ctlmux.Unlock()
+}
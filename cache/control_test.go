@@ -0,0 +1,148 @@
+/*
+ * control_test.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"net"
+	"net/rpc"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/billziss-gh/objfs/objio/objiotest"
+)
+
+func TestControlPrefetch(t *testing.T) {
+	var reply []string
+	err := CallControl(newTestDir(t), "Control.Prefetch", PrefetchArgs{Path: "/a"}, &reply)
+	if ErrNoControl != err {
+		t.Error("CallControl on inactive cache", err)
+	}
+
+	cache, path := newTestCache(t, objiotest.NewMemObjectStorage(false), map[string]string{
+		"/a/":          "",
+		"/a/b/":        "",
+		"/a/b/c/":      "",
+		"/a/file1":     "data",
+		"/a/b/file2":   "data",
+		"/a/b/c/file3": "data",
+	}, nil, Activate)
+	defer cache.CloseCache()
+
+	reply = nil
+	err = CallControl(path, "Control.Prefetch", PrefetchArgs{Path: "/a", Depth: 1}, &reply)
+	if nil != err {
+		t.Fatal(err)
+	}
+	sort.Strings(reply)
+	if "=/a/,=/a/b/" != strings.Join(reply, ",") {
+		t.Error("Prefetch depth 1", reply)
+	}
+	for _, p := range cache.ListCache() {
+		// the catalog has the entries, but no files were downloaded
+		if !strings.HasPrefix(p, "-") {
+			t.Error("Prefetch without content downloaded", p)
+		}
+	}
+
+	reply = nil
+	err = CallControl(path, "Control.Prefetch",
+		PrefetchArgs{Path: "/a", Depth: -1, Content: true}, &reply)
+	if nil != err {
+		t.Fatal(err)
+	}
+	sort.Strings(reply)
+	if "=/a/,=/a/b/,=/a/b/c/,=/a/b/c/file3,=/a/b/file2,=/a/file1" != strings.Join(reply, ",") {
+		t.Error("Prefetch content", reply)
+	}
+
+	reply = nil
+	err = CallControl(path, "Control.Prefetch", PrefetchArgs{Path: "/nonexistent"}, &reply)
+	if nil == err {
+		t.Error("Prefetch nonexistent")
+	}
+}
+
+func TestControlStats(t *testing.T) {
+	cache, path := newTestCache(t, objiotest.NewMemObjectStorage(false), nil, nil, Activate)
+	defer cache.CloseCache()
+
+	var reply []string
+	err := CallControl(path, "Control.Prefetch", PrefetchArgs{Path: "/"}, &reply)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	var stats Stats
+	err = CallControl(path, "Control.Stats", true, &stats)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 0 == stats.DirMisses {
+		t.Error("Stats", stats)
+	}
+
+	stats = Stats{}
+	err = CallControl(path, "Control.Stats", false, &stats)
+	if nil != err || 0 != stats.DirMisses {
+		t.Error("Stats reset", stats, err)
+	}
+}
+
+func TestControlClose(t *testing.T) {
+	cache, path := newTestCache(t, objiotest.NewMemObjectStorage(false), nil, nil, Activate)
+
+	conn, err := net.Dial("unix", filepath.Join(path, controlName))
+	if nil != err {
+		cache.CloseCache()
+		t.Fatal(err)
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+
+	var reply []string
+	err = client.Call("Control.Settings", false, &reply)
+	if nil != err {
+		cache.CloseCache()
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		cache.CloseCache()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("CloseCache waits for an idle connection")
+	}
+
+	// the connection has been closed by the cache
+	call := client.Go("Control.Settings", false, &reply, nil)
+	select {
+	case <-call.Done:
+		if nil == call.Error {
+			t.Error("Call after CloseCache")
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("Call after CloseCache waits")
+	}
+}
@@ -0,0 +1,50 @@
+//go:build darwin || linux
+// +build darwin linux
+
+/*
+ * diskfree_unix.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"os"
+	"syscall"
+)
+
+// diskFree returns the disk space available to unprivileged users on the
+// file system that contains path.
+func diskFree(path string) (free int64, err error) {
+	var stat syscall.Statfs_t
+	err = syscall.Statfs(path, &stat)
+	if nil != err {
+		return
+	}
+
+	free = int64(stat.Bavail) * int64(stat.Bsize)
+
+	return
+}
+
+// diskUsage returns the disk space allocated to a file. This is less than
+// the file size for sparse files.
+func diskUsage(info os.FileInfo) int64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int64(stat.Blocks) * 512
+	}
+
+	return info.Size()
+}
@@ -0,0 +1,54 @@
+/*
+ * diskfree_windows.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"unsafe"
+
+	"os"
+	"syscall"
+)
+
+var procGetDiskFreeSpaceExW = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// diskFree returns the disk space available to the current user on the
+// volume that contains path.
+func diskFree(path string) (free int64, err error) {
+	pathp, err := syscall.UTF16PtrFromString(path)
+	if nil != err {
+		return
+	}
+
+	var avail uint64
+	r1, _, e1 := procGetDiskFreeSpaceExW.Call(
+		uintptr(unsafe.Pointer(pathp)), uintptr(unsafe.Pointer(&avail)), 0, 0)
+	if 0 == r1 {
+		err = e1
+		return
+	}
+
+	free = int64(avail)
+
+	return
+}
+
+// diskUsage returns the disk space allocated to a file. Cache files are not
+// created sparse on Windows, so this is the file size.
+func diskUsage(info os.FileInfo) int64 {
+	return info.Size()
+}
@@ -0,0 +1,269 @@
+/*
+ * download.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"crypto/sha256"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/billziss-gh/objfs/errno"
+	"github.com/billziss-gh/objfs/objio"
+)
+
+// download_t tracks the download of a whole file that proceeds in the
+// background. Readers may access the bytes that have already been written
+// to the file while the download continues.
+type download_t struct {
+	info      objio.ObjectInfo
+	mux       sync.Mutex
+	cond      *sync.Cond
+	reader    io.ReadCloser
+	cancel    chan struct{}
+	avail     int64
+	parts     map[int64]int64
+	bytes     int64
+	done      bool
+	cancelled bool
+	hash      []byte
+	err       error
+}
+
+const downloadBufferSize = 64 * 1024
+
+func newDownload(info objio.ObjectInfo, reader io.ReadCloser) *download_t {
+	dl := &download_t{
+		info:   info,
+		reader: reader,
+		cancel: make(chan struct{}),
+		parts:  map[int64]int64{},
+	}
+	dl.cond = sync.NewCond(&dl.mux)
+	return dl
+}
+
+// Start copies the object to file in a new goroutine. If partsize is not 0
+// and the reader supports io.ReaderAt, the object is copied in parts of
+// partsize bytes, up to parallelism parts concurrently.
+func (dl *download_t) Start(file *os.File, partsize int64, parallelism int) {
+	go dl.run(file, partsize, parallelism)
+}
+
+func (dl *download_t) run(file *os.File, partsize int64, parallelism int) {
+	// The copy proceeds in its own goroutine, so that a cancelled download
+	// is done without waiting for a pending read. The reader is closed only
+	// once the copy has returned.
+	result := make(chan error, 1)
+	go func() {
+		readat, ok := dl.reader.(io.ReaderAt)
+		if ok && 0 != partsize {
+			result <- dl.copyParts(file, readat, partsize, parallelism)
+		} else {
+			result <- dl.copy(file)
+		}
+	}()
+
+	var err error
+	pending := false
+	select {
+	case err = <-result:
+	case <-dl.cancel:
+		err = errno.ECANCELED
+		pending = true
+	}
+
+	dl.mux.Lock()
+	if nil == err && dl.cancelled {
+		err = errno.ECANCELED
+	}
+	dl.err = err
+	dl.done = true
+	dl.mux.Unlock()
+	dl.cond.Broadcast()
+
+	if pending {
+		<-result
+	}
+	dl.reader.Close()
+}
+
+func (dl *download_t) copy(file *os.File) (err error) {
+	h := sha256.New()
+	buf := make([]byte, downloadBufferSize)
+
+	var off int64
+	for {
+		var n int
+		n, err = dl.reader.Read(buf)
+		if 0 < n {
+			if dl.isCancelled() {
+				return errno.ECANCELED
+			}
+
+			h.Write(buf[:n])
+			_, err0 := file.WriteAt(buf[:n], off)
+			if nil != err0 {
+				return err0
+			}
+			off += int64(n)
+
+			dl.mux.Lock()
+			dl.avail = off
+			dl.bytes = off
+			dl.mux.Unlock()
+			dl.cond.Broadcast()
+		}
+		if io.EOF == err {
+			break
+		}
+		if nil != err {
+			return
+		}
+	}
+
+	dl.mux.Lock()
+	dl.hash = h.Sum(nil)
+	dl.mux.Unlock()
+
+	return nil
+}
+
+func (dl *download_t) copyParts(
+	file *os.File, readat io.ReaderAt, partsize int64, parallelism int) (err error) {
+	size := dl.info.Size()
+
+	// parts are requested in order, so the head of the file arrives first
+	err = objio.ReadParallel(&downloadWriter{dl, file}, readat, size, partsize, parallelism)
+	if nil != err {
+		return
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(h, io.NewSectionReader(file, 0, size))
+	if nil != err {
+		return
+	}
+
+	dl.mux.Lock()
+	dl.hash = h.Sum(nil)
+	dl.mux.Unlock()
+
+	return
+}
+
+func (dl *download_t) isCancelled() bool {
+	dl.mux.Lock()
+	cancelled := dl.cancelled
+	dl.mux.Unlock()
+	return cancelled
+}
+
+// downloadWriter writes the parts of a download to the file. The bytes of a
+// part are available to readers once all parts before it have been written.
+type downloadWriter struct {
+	dl   *download_t
+	file *os.File
+}
+
+func (self *downloadWriter) WriteAt(p []byte, off int64) (n int, err error) {
+	dl := self.dl
+	if dl.isCancelled() {
+		return 0, errno.ECANCELED
+	}
+
+	n, err = self.file.WriteAt(p, off)
+	if nil != err {
+		return
+	}
+
+	dl.mux.Lock()
+	dl.bytes += int64(n)
+	dl.parts[off] = off + int64(n)
+	for {
+		end, ok := dl.parts[dl.avail]
+		if !ok {
+			break
+		}
+		delete(dl.parts, dl.avail)
+		dl.avail = end
+	}
+	dl.mux.Unlock()
+	dl.cond.Broadcast()
+
+	return
+}
+
+// Wait waits until the file has end bytes or until the download is done.
+// A negative end waits until the download is done. It reports whether the
+// download is done.
+func (dl *download_t) Wait(end int64) (done bool) {
+	if 0 > end || end > dl.info.Size() {
+		end = dl.info.Size()
+	}
+
+	dl.mux.Lock()
+	for !dl.done && dl.avail < end {
+		dl.cond.Wait()
+	}
+	done = dl.done
+	dl.mux.Unlock()
+
+	if !done && end == dl.info.Size() {
+		// the file has all its bytes but the goroutine may still be finishing
+		dl.mux.Lock()
+		for !dl.done {
+			dl.cond.Wait()
+		}
+		dl.mux.Unlock()
+		done = true
+	}
+
+	return
+}
+
+// Cancel stops the download and waits until it is done. A read from the
+// object that is pending is not waited for.
+func (dl *download_t) Cancel() {
+	dl.mux.Lock()
+	if !dl.cancelled {
+		dl.cancelled = true
+		close(dl.cancel)
+	}
+	dl.mux.Unlock()
+
+	dl.Wait(-1)
+}
+
+// Result returns the object info and file hash of a done download.
+func (dl *download_t) Result() (info objio.ObjectInfo, hash []byte, err error) {
+	dl.mux.Lock()
+	info, hash, err = dl.info, dl.hash, dl.err
+	dl.mux.Unlock()
+
+	return
+}
+
+// Downloaded returns the number of bytes written to the file.
+func (dl *download_t) Downloaded() int64 {
+	dl.mux.Lock()
+	bytes := dl.bytes
+	dl.mux.Unlock()
+
+	return bytes
+}
@@ -0,0 +1,296 @@
+/*
+ * download_test.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/billziss-gh/objfs/objio"
+	"github.com/billziss-gh/objfs/objio/objiotest"
+)
+
+// gatedStorage returns readers that stop after the first gate bytes until
+// the gate channel is closed.
+type gatedStorage struct {
+	*objiotest.MemObjectStorage
+	gate   int64
+	opened chan struct{}
+	open   chan struct{}
+}
+
+type gatedReader struct {
+	io.ReadCloser
+	storage *gatedStorage
+	off     int64
+	closed  chan struct{}
+}
+
+func (self *gatedStorage) OpenRead(
+	name string, sig string) (info objio.ObjectInfo, reader io.ReadCloser, err error) {
+	info, reader, err = self.MemObjectStorage.OpenRead(name, sig)
+	if nil != reader {
+		// hide io.ReaderAt
+		reader = &gatedReader{ReadCloser: reader, storage: self, closed: make(chan struct{})}
+	}
+	return
+}
+
+func (self *gatedReader) Read(p []byte) (n int, err error) {
+	if self.off >= self.storage.gate {
+		select {
+		case <-self.storage.open:
+		case <-self.closed:
+			return 0, io.ErrClosedPipe
+		}
+	} else if self.off+int64(len(p)) > self.storage.gate {
+		p = p[:self.storage.gate-self.off]
+	}
+
+	n, err = self.ReadCloser.Read(p)
+	self.off += int64(n)
+	return
+}
+
+func (self *gatedReader) Close() error {
+	select {
+	case <-self.closed:
+	default:
+		close(self.closed)
+	}
+	return self.ReadCloser.Close()
+}
+
+func TestStreamingRead(t *testing.T) {
+	const size = 1024 * 1024
+
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	storage := &gatedStorage{
+		MemObjectStorage: objiotest.NewMemObjectStorage(false),
+		gate:             size / 4,
+		open:             make(chan struct{}),
+	}
+	config := &Config{BlockSize: -1, Parallelism: 1}
+	cache, _ := newTestCache(t, storage, map[string]string{"/file": string(data)}, config, Open)
+	defer cache.CloseCache()
+
+	ino, err := cache.Open("/file")
+	if nil != err {
+		t.Fatal(err)
+	}
+	_, err = cache.Stat(ino)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	// read from the head of the file while the download is held at the gate
+	buf := make([]byte, 100)
+	n, err := cache.ReadAt(ino, buf, 0)
+	if nil != err || len(buf) != n || !bytes.Equal(data[:100], buf) {
+		t.Error("ReadAt head", n, err)
+	}
+
+	// close before the download is done; the incomplete file is discarded
+	cache.Close(ino)
+	if _, err = os.Stat(cache.filePath(ino)); !os.IsNotExist(err) {
+		t.Error("incomplete file kept", err)
+	}
+
+	ino, err = cache.Open("/file")
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(storage.open)
+	}()
+
+	// read from the tail of the file waits for the download
+	n, err = cache.ReadAt(ino, buf, size-100)
+	if io.EOF == err && len(buf) == n {
+		err = nil
+	}
+	if nil != err || len(buf) != n || !bytes.Equal(data[size-100:], buf) {
+		t.Error("ReadAt tail", n, err)
+	}
+
+	cache.Close(ino)
+
+	rdata, err := ioutil.ReadFile(cache.filePath(ino))
+	if nil != err || !bytes.Equal(data, rdata) {
+		t.Error("cached file", err)
+	}
+}
+
+// partStorage counts the ranged and the sequential reads of its readers. If
+// gate is set, ranged reads past the first part wait until it is closed.
+type partStorage struct {
+	*objiotest.MemObjectStorage
+	partsize   int64
+	gate       chan struct{}
+	ranged     int64
+	sequential int64
+}
+
+type partReader struct {
+	io.ReadCloser
+	storage *partStorage
+}
+
+func (self *partStorage) OpenRead(
+	name string, sig string) (info objio.ObjectInfo, reader io.ReadCloser, err error) {
+	info, reader, err = self.MemObjectStorage.OpenRead(name, sig)
+	if nil != reader {
+		reader = &partReader{reader, self}
+	}
+	return
+}
+
+func (self *partReader) Read(p []byte) (n int, err error) {
+	atomic.AddInt64(&self.storage.sequential, 1)
+	return self.ReadCloser.Read(p)
+}
+
+func (self *partReader) ReadAt(p []byte, off int64) (n int, err error) {
+	atomic.AddInt64(&self.storage.ranged, 1)
+	if nil != self.storage.gate && off >= self.storage.partsize {
+		<-self.storage.gate
+	}
+	return self.ReadCloser.(io.ReaderAt).ReadAt(p, off)
+}
+
+func TestParallelRead(t *testing.T) {
+	const partsize = 64 * 1024
+	const size = 8*partsize + 100
+
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	storage := &partStorage{MemObjectStorage: objiotest.NewMemObjectStorage(false)}
+	config := &Config{BlockSize: -1, PartSize: partsize, Parallelism: 4}
+	cache, _ := newTestCache(t, storage, map[string]string{"/file": string(data)}, config, Open)
+	defer cache.CloseCache()
+
+	ino, err := cache.Open("/file")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer cache.Close(ino)
+
+	buf := make([]byte, 100)
+	n, err := cache.ReadAt(ino, buf, size-100)
+	if io.EOF == err && len(buf) == n {
+		err = nil
+	}
+	if nil != err || len(buf) != n || !bytes.Equal(data[size-100:], buf) {
+		t.Error("ReadAt", n, err)
+	}
+
+	// the file is downloaded in 9 parts rather than streamed
+	if 9 != atomic.LoadInt64(&storage.ranged) || 0 != atomic.LoadInt64(&storage.sequential) {
+		t.Error("reads", storage.ranged, storage.sequential)
+	}
+
+	rdata, err := ioutil.ReadFile(cache.filePath(ino))
+	if nil != err || !bytes.Equal(data, rdata) {
+		t.Error("cached file", err)
+	}
+}
+
+func TestParallelStreamingRead(t *testing.T) {
+	const partsize = 64 * 1024
+	const size = 8*partsize + 100
+
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	storage := &partStorage{
+		MemObjectStorage: objiotest.NewMemObjectStorage(false),
+		partsize:         partsize,
+		gate:             make(chan struct{}),
+	}
+	config := &Config{BlockSize: -1, PartSize: partsize, Parallelism: 4}
+	cache, _ := newTestCache(t, storage, map[string]string{"/file": string(data)}, config, Open)
+	defer cache.CloseCache()
+
+	ino, err := cache.Open("/file")
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	// read from the head of the file while the other parts are held at the gate
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		buf := make([]byte, 100)
+		n, err := cache.ReadAt(ino, buf, 0)
+		if nil != err || len(buf) != n || !bytes.Equal(data[:100], buf) {
+			t.Error("ReadAt head", n, err)
+		}
+
+		// close before the download is done; the incomplete file is discarded
+		cache.Close(ino)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		close(storage.gate)
+		t.Fatal("ReadAt head waits for the download")
+	}
+	if _, err = os.Stat(cache.filePath(ino)); !os.IsNotExist(err) {
+		t.Error("incomplete file kept", err)
+	}
+
+	close(storage.gate)
+
+	ino, err = cache.Open("/file")
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 100)
+	n, err := cache.ReadAt(ino, buf, size-100)
+	if io.EOF == err && len(buf) == n {
+		err = nil
+	}
+	if nil != err || len(buf) != n || !bytes.Equal(data[size-100:], buf) {
+		t.Error("ReadAt tail", n, err)
+	}
+
+	cache.Close(ino)
+
+	rdata, err := ioutil.ReadFile(cache.filePath(ino))
+	if nil != err || !bytes.Equal(data, rdata) {
+		t.Error("cached file", err)
+	}
+}
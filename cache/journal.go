@@ -0,0 +1,187 @@
+/*
+ * journal.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"net"
+
+	"github.com/billziss-gh/golib/errors"
+	"github.com/billziss-gh/objfs/errno"
+	"github.com/boltdb/bolt"
+)
+
+// Offline Mode
+//
+// When the storage cannot be reached the cache goes offline. Namespace
+// operations (make, remove, rename, symlink) and modification time changes
+// are then applied to the catalog only and are appended to the journal, a
+// bucket keyed by sequence number. Cached files remain readable and
+// writable.
+//
+// The journal is replayed in order when the storage can be reached again;
+// only then are modified files uploaded. An operation that can no longer
+// be applied, because the object storage has changed in the meantime, is
+// dropped and recorded as a conflict.
+
+const (
+	journalMkdir = 1 + iota
+	journalCreate
+	journalRmdir
+	journalRemove
+	journalRename
+	journalSymlink
+	journalChtime
+)
+
+var journalOpNames = []string{
+	journalMkdir:   "mkdir",
+	journalCreate:  "create",
+	journalRmdir:   "rmdir",
+	journalRemove:  "remove",
+	journalRename:  "rename",
+	journalSymlink: "symlink",
+	journalChtime:  "chtime",
+}
+
+// staleSig is the Sig of a file made offline when an object of the same name
+// turns out to exist on storage. It matches no object, so that the upload of
+// the file detects a conflict.
+const staleSig = "\x00stale"
+
+// journal_t is a journaled operation. NewPath is the new path of a rename
+// and the target of a symlink. Sig is the Sig of the object removed or
+// renamed; it is empty if the object was made offline. The modification time
+// of a chtime is that of the mtime record of Path.
+type journal_t struct {
+	Op      uint8
+	IsDir   bool
+	Path    string
+	NewPath string
+	Sig     string
+}
+
+// Put appends the journal entry to the journal.
+func (journal *journal_t) Put(tx *bolt.Tx) (err error) {
+	bucket := tx.Bucket(journalname)
+
+	seq, err := bucket.NextSequence()
+	if nil != err {
+		return
+	}
+
+	var kbuf [8]byte
+	k := kbuf[:]
+	putUint64(k, 0, seq)
+
+	v := make([]byte, journal.EncodeLen())
+	v = journal.Encode(v)
+	err = bucket.Put(k, v)
+
+	return
+}
+
+func (journal *journal_t) String() string {
+	s := journalOpNames[journal.Op] + " " + journal.Path
+	if journalRename == journal.Op || journalSymlink == journal.Op {
+		s += " " + journal.NewPath
+	}
+
+	return s
+}
+
+func (journal *journal_t) EncodeLen() int {
+	return 2 + 2 + 2 + 1 + 1 + len(journal.Path) + len(journal.NewPath) + len(journal.Sig)
+}
+
+func (journal *journal_t) Encode(b []byte) []byte {
+	// encode order: uint64*, uint32*, uint16*, uint8*
+	// len(Path), len(NewPath), len(Sig), Op, IsDir, Path, NewPath, Sig
+
+	isdir := uint8(0)
+	if journal.IsDir {
+		isdir = uint8(1)
+	}
+	lp, ln, ls := len(journal.Path), len(journal.NewPath), len(journal.Sig)
+
+	i := 0
+	i = putUint16(b, i, uint16(lp))
+	i = putUint16(b, i, uint16(ln))
+	i = putUint16(b, i, uint16(ls))
+	i = putUint8(b, i, journal.Op)
+	i = putUint8(b, i, isdir)
+	i = putString(b, i, journal.Path, 1<<16-1)
+	i = putString(b, i, journal.NewPath, 1<<16-1)
+	i = putString(b, i, journal.Sig, 1<<16-1)
+	return b[:i]
+}
+
+func (journal *journal_t) Decode(b []byte) (err error) {
+	// encode order: uint64*, uint32*, uint16*, uint8*
+	// len(Path), len(NewPath), len(Sig), Op, IsDir, Path, NewPath, Sig
+
+	defer func() {
+		if r := recover(); nil != r {
+			err = errno.EIO
+		}
+	}()
+
+	i := 0
+	i, lp := getUint16(b, i)
+	i, ln := getUint16(b, i)
+	i, ls := getUint16(b, i)
+	i, op := getUint8(b, i)
+	i, isdir := getUint8(b, i)
+	i, p := getString(b, i, int(lp))
+	i, n := getString(b, i, int(ln))
+	i, g := getString(b, i, int(ls))
+
+	if journalMkdir > op || journalChtime < op {
+		return errno.EIO
+	}
+
+	journal.Op = op
+	journal.IsDir = 0 != isdir
+	journal.Path = p
+	journal.NewPath = n
+	journal.Sig = g
+
+	return nil
+}
+
+// isOfflineError determines if an error means that the storage cannot be
+// reached.
+func isOfflineError(err error) bool {
+	for e := err; nil != e; e = errors.Cause(e) {
+		if _, ok := e.(net.Error); ok {
+			return true
+		}
+
+		a := errors.Attachment(e)
+		if nil == a {
+			a = e
+		}
+
+		switch a {
+		case errno.ENETDOWN, errno.ENETUNREACH, errno.EHOSTUNREACH,
+			errno.ECONNREFUSED, errno.ENOTCONN, errno.ETIMEDOUT:
+			return true
+		}
+	}
+
+	return false
+}
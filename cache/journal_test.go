@@ -0,0 +1,526 @@
+/*
+ * journal_test.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/billziss-gh/golib/errors"
+	"github.com/billziss-gh/objfs/errno"
+	"github.com/billziss-gh/objfs/objio"
+	"github.com/billziss-gh/objfs/objio/objiotest"
+	"github.com/boltdb/bolt"
+)
+
+// offlineStorage fails all operations as unreachable while it is down.
+type offlineStorage struct {
+	*objiotest.MemObjectStorage
+	down int32
+}
+
+func (self *offlineStorage) check() error {
+	if 0 != atomic.LoadInt32(&self.down) {
+		return errors.New(": storage unreachable", nil, errno.ENETUNREACH)
+	}
+	return nil
+}
+
+func (self *offlineStorage) Info(getsize bool) (objio.StorageInfo, error) {
+	if err := self.check(); nil != err {
+		return nil, err
+	}
+	return self.MemObjectStorage.Info(getsize)
+}
+
+func (self *offlineStorage) List(
+	prefix string, marker string, maxcount int) (string, []objio.ObjectInfo, error) {
+	if err := self.check(); nil != err {
+		return "", nil, err
+	}
+	return self.MemObjectStorage.List(prefix, marker, maxcount)
+}
+
+func (self *offlineStorage) Stat(name string) (objio.ObjectInfo, error) {
+	if err := self.check(); nil != err {
+		return nil, err
+	}
+	return self.MemObjectStorage.Stat(name)
+}
+
+func (self *offlineStorage) Mkdir(prefix string) (objio.ObjectInfo, error) {
+	if err := self.check(); nil != err {
+		return nil, err
+	}
+	return self.MemObjectStorage.Mkdir(prefix)
+}
+
+func (self *offlineStorage) Rmdir(prefix string) error {
+	if err := self.check(); nil != err {
+		return err
+	}
+	return self.MemObjectStorage.Rmdir(prefix)
+}
+
+func (self *offlineStorage) Remove(name string) error {
+	if err := self.check(); nil != err {
+		return err
+	}
+	return self.MemObjectStorage.Remove(name)
+}
+
+func (self *offlineStorage) Rename(oldname string, newname string) error {
+	if err := self.check(); nil != err {
+		return err
+	}
+	return self.MemObjectStorage.Rename(oldname, newname)
+}
+
+func (self *offlineStorage) OpenRead(
+	name string, sig string) (objio.ObjectInfo, io.ReadCloser, error) {
+	if err := self.check(); nil != err {
+		return nil, nil, err
+	}
+	return self.MemObjectStorage.OpenRead(name, sig)
+}
+
+func (self *offlineStorage) OpenWrite(name string, size int64) (objio.WriteWaiter, error) {
+	if err := self.check(); nil != err {
+		return nil, err
+	}
+	return self.MemObjectStorage.OpenWrite(name, size)
+}
+
+// chtimeStorage is an offlineStorage that records the mtimes set on it.
+type chtimeStorage struct {
+	offlineStorage
+	mux    sync.Mutex
+	mtimes map[string]time.Time
+}
+
+func (self *chtimeStorage) Chtime(name string, mtime time.Time) (objio.ObjectInfo, error) {
+	if err := self.check(); nil != err {
+		return nil, err
+	}
+	info, err := self.Stat(name)
+	if nil != err {
+		return nil, err
+	}
+	self.mux.Lock()
+	self.mtimes[name] = mtime
+	self.mux.Unlock()
+	return info, nil
+}
+
+func TestJournalEncodeDecode(t *testing.T) {
+	j := journal_t{Op: journalRename, IsDir: true, Path: "/foo", NewPath: "/bar", Sig: "sig"}
+
+	b := j.Encode(make([]byte, j.EncodeLen()))
+	k := journal_t{}
+	err := k.Decode(b)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if j != k {
+		t.Error("Decode", k)
+	}
+	if "rename /foo /bar" != k.String() {
+		t.Error("String", k.String())
+	}
+
+	err = k.Decode(b[:5])
+	if nil == err {
+		t.Error("Decode truncated")
+	}
+}
+
+func TestIsOfflineError(t *testing.T) {
+	if !isOfflineError(errors.New("", errors.New(": x", nil, errno.ETIMEDOUT))) {
+		t.Error("isOfflineError ETIMEDOUT")
+	}
+	if !isOfflineError(errno.ECONNREFUSED) {
+		t.Error("isOfflineError ECONNREFUSED")
+	}
+	if isOfflineError(errors.New(": x", nil, errno.ENOENT)) || isOfflineError(nil) {
+		t.Error("isOfflineError ENOENT")
+	}
+}
+
+func TestOffline(t *testing.T) {
+	storage := &offlineStorage{MemObjectStorage: objiotest.NewMemObjectStorage(false)}
+	cache, _ := newTestCache(t, storage, map[string]string{"/file1": "data"}, nil, Open)
+	defer cache.CloseCache()
+
+	open := func(p string) uint64 {
+		ino, err := cache.Open(p)
+		if nil != err {
+			t.Fatal(err)
+		}
+		return ino
+	}
+
+	// cache /file1
+	ino := open("/file1")
+	buf := make([]byte, 4)
+	_, err := cache.ReadAt(ino, buf, 0)
+	cache.Close(ino)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt32(&storage.down, 1)
+
+	ino = open("/dir")
+	err = cache.Make(ino, true)
+	cache.Close(ino)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	ino = open("/dir/file2")
+	err = cache.Make(ino, false)
+	if nil == err {
+		_, err = cache.WriteAt(ino, []byte("hello"), 0)
+	}
+	cache.Close(ino)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	ino = open("/file1")
+	err = cache.Rename(ino, "/dir/file1")
+	if nil == err {
+		_, err = cache.ReadAt(ino, buf, 0)
+	}
+	cache.Close(ino)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "data" != string(buf) {
+		t.Error("ReadAt offline", string(buf))
+	}
+
+	ino = open("/file3")
+	err = cache.Make(ino, false)
+	if nil == err {
+		err = cache.Remove(ino, false)
+	}
+	cache.Close(ino)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	ino = open("/dir")
+	infos, err := cache.Readdir(ino, 0)
+	cache.Close(ino)
+	if nil != err {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	if "file1,file2" != strings.Join(names, ",") {
+		t.Error("Readdir offline", names)
+	}
+
+	err = cache.ResetCache(nil)
+	if nil == err {
+		t.Error("ResetCache offline")
+	}
+
+	if "mkdir /dir,create /dir/file2,rename /file1 /dir/file1,create /file3,remove /file3" !=
+		strings.Join(cache.ListJournal(), ",") {
+		t.Error("ListJournal", cache.ListJournal())
+	}
+
+	atomic.StoreInt32(&storage.down, 0)
+
+	var progress []string
+	err = cache.ResetCache(func(path string) {
+		progress = append(progress, path)
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 5 > len(progress) || ">mkdir /dir" != progress[0] || ">remove /file3" != progress[4] {
+		t.Error("ResetCache progress", progress)
+	}
+
+	if 0 != len(cache.ListJournal()) {
+		t.Error("ListJournal after replay", cache.ListJournal())
+	}
+	if "hello" != readObject(t, storage, "/dir/file2") {
+		t.Error("/dir/file2")
+	}
+	if "data" != readObject(t, storage, "/dir/file1") {
+		t.Error("/dir/file1")
+	}
+	for _, name := range []string{"/file1", "/file3"} {
+		_, err = storage.Stat(name)
+		if !errors.HasAttachment(err, errno.ENOENT) {
+			t.Error("Stat", name, err)
+		}
+	}
+}
+
+func TestOfflineConflict(t *testing.T) {
+	storage := &offlineStorage{MemObjectStorage: objiotest.NewMemObjectStorage(false)}
+	cache, _ := newTestCache(t, storage, nil, nil, Open)
+	defer cache.CloseCache()
+
+	atomic.StoreInt32(&storage.down, 1)
+
+	ino, err := cache.Open("/file")
+	if nil != err {
+		t.Fatal(err)
+	}
+	err = cache.Make(ino, false)
+	if nil == err {
+		_, err = cache.WriteAt(ino, []byte("local"), 0)
+	}
+	cache.Close(ino)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	ino, err = cache.Open("/gone")
+	if nil != err {
+		t.Fatal(err)
+	}
+	err = cache.Rename(ino, "/moved")
+	cache.Close(ino)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	// the same name is made on storage while we are offline
+	writeTestObjects(t, storage.MemObjectStorage, map[string]string{"/file": "remote"})
+
+	atomic.StoreInt32(&storage.down, 0)
+
+	var progress []string
+	err = cache.ResetCache(func(path string) {
+		progress = append(progress, path)
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 4 != len(progress) || ">create /file" != progress[0] || "!/gone" != progress[1] ||
+		"!/file" != progress[2] || !strings.HasPrefix(progress[3], "+/file (conflict ") {
+		t.Fatal("ResetCache progress", progress)
+	}
+
+	if "remote" != readObject(t, storage, "/file") {
+		t.Error("/file")
+	}
+	if "local" != readObject(t, storage, progress[3][1:]) {
+		t.Error("conflict copy")
+	}
+
+	conflicts := cache.ListConflicts()
+	if 2 != len(conflicts) || "/gone" != conflicts[0].Path || "/file" != conflicts[1].Path {
+		t.Error("ListConflicts", conflicts)
+	}
+}
+
+func TestOfflineChanged(t *testing.T) {
+	storage := &offlineStorage{MemObjectStorage: objiotest.NewMemObjectStorage(false)}
+	cache, _ := newTestCache(t, storage,
+		map[string]string{"/file1": "data1", "/file2": "data2", "/file3": "data3"}, nil, Open)
+	defer cache.CloseCache()
+
+	inos := map[string]uint64{}
+	for _, p := range []string{"/file1", "/file2", "/file3"} {
+		ino, err := cache.Open(p)
+		if nil == err {
+			_, err = cache.Stat(ino)
+		}
+		if nil != err {
+			t.Fatal(err)
+		}
+		inos[p] = ino
+	}
+
+	atomic.StoreInt32(&storage.down, 1)
+
+	err := cache.Remove(inos["/file1"], false)
+	if nil == err {
+		err = cache.Rename(inos["/file2"], "/file4")
+	}
+	if nil == err {
+		err = cache.Remove(inos["/file3"], false)
+	}
+	for _, ino := range inos {
+		cache.Close(ino)
+	}
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	// /file1 and /file2 are changed on storage while we are offline
+	writeTestObjects(t, storage.MemObjectStorage,
+		map[string]string{"/file1": "remote1", "/file2": "remote2"})
+
+	atomic.StoreInt32(&storage.down, 0)
+
+	var progress []string
+	err = cache.ResetCache(func(path string) {
+		progress = append(progress, path)
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 3 != len(progress) || "!/file1" != progress[0] || "!/file2" != progress[1] ||
+		">remove /file3" != progress[2] {
+		t.Fatal("ResetCache progress", progress)
+	}
+
+	if "remote1" != readObject(t, storage, "/file1") {
+		t.Error("/file1")
+	}
+	if "remote2" != readObject(t, storage, "/file2") {
+		t.Error("/file2")
+	}
+	for _, name := range []string{"/file3", "/file4"} {
+		_, err = storage.Stat(name)
+		if !errors.HasAttachment(err, errno.ENOENT) {
+			t.Error("Stat", name, err)
+		}
+	}
+
+	conflicts := cache.ListConflicts()
+	if 2 != len(conflicts) || "/file1" != conflicts[0].Path || "/file2" != conflicts[1].Path {
+		t.Error("ListConflicts", conflicts)
+	}
+}
+
+func TestJournalOnline(t *testing.T) {
+	storage := &offlineStorage{MemObjectStorage: objiotest.NewMemObjectStorage(false)}
+	cache, _ := newTestCache(t, storage, map[string]string{"/file": "data"}, nil, Open)
+	defer cache.CloseCache()
+
+	// an operation that found the cache offline journals after it came back
+	err := cache.database.Update(func(tx *bolt.Tx) error {
+		return cache.putJournal(tx, &journal_t{Op: journalRemove, Path: "/file"})
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !cache.isOffline() {
+		t.Error("isOffline after journal")
+	}
+
+	err = cache.replayJournal(nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if cache.isOffline() || 0 != len(cache.ListJournal()) {
+		t.Error("replayJournal", cache.isOffline(), cache.ListJournal())
+	}
+	_, err = storage.Stat("/file")
+	if !errors.HasAttachment(err, errno.ENOENT) {
+		t.Error("Stat", err)
+	}
+}
+
+func TestOfflineSymlinkChtime(t *testing.T) {
+	storage := &chtimeStorage{
+		offlineStorage: offlineStorage{MemObjectStorage: objiotest.NewMemObjectStorage(false)},
+		mtimes:         map[string]time.Time{},
+	}
+	cache, _ := newTestCache(t, storage, map[string]string{"/file": "data"}, nil, Open)
+	defer cache.CloseCache()
+
+	ino, err := cache.Open("/file")
+	if nil == err {
+		_, err = cache.ReadAt(ino, make([]byte, 4), 0)
+		cache.Close(ino)
+	}
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt32(&storage.down, 1)
+
+	ino, err = cache.Open("/link")
+	if nil == err {
+		err = cache.Symlink(ino, "file")
+		cache.Close(ino)
+	}
+	if nil != err {
+		t.Fatal("Symlink", err)
+	}
+
+	mtime := time.Date(2018, 3, 14, 15, 9, 26, 0, time.UTC)
+	ino, err = cache.Open("/file")
+	if nil == err {
+		err = cache.Chtime(ino, mtime)
+		cache.Close(ino)
+	}
+	if nil != err {
+		t.Fatal("Chtime", err)
+	}
+
+	ino, err = cache.Open("/link")
+	if nil != err {
+		t.Fatal(err)
+	}
+	target, err := cache.Readlink(ino)
+	cache.Close(ino)
+	if nil != err || "file" != target {
+		t.Error("Readlink offline", target, err)
+	}
+	ino, err = cache.Open("/file")
+	if nil != err {
+		t.Fatal(err)
+	}
+	info, err := cache.Stat(ino)
+	cache.Close(ino)
+	if nil != err || !mtime.Equal(info.Mtime()) {
+		t.Error("Stat offline", info, err)
+	}
+
+	if "symlink /link file,chtime /file" != strings.Join(cache.ListJournal(), ",") {
+		t.Error("ListJournal", cache.ListJournal())
+	}
+
+	atomic.StoreInt32(&storage.down, 0)
+
+	err = cache.ResetCache(nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 0 != len(cache.ListJournal()) || 0 != len(cache.ListConflicts()) {
+		t.Error("ListJournal after replay", cache.ListJournal(), cache.ListConflicts())
+	}
+
+	target, err = cache.readXSym("/link")
+	if nil != err || "file" != target {
+		t.Error("/link", target, err)
+	}
+	if !mtime.Equal(storage.mtimes["/file"]) {
+		t.Error("/file mtime", storage.mtimes["/file"])
+	}
+}
@@ -0,0 +1,157 @@
+/*
+ * migrate.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"fmt"
+
+	"github.com/billziss-gh/golib/errors"
+	"github.com/boltdb/bolt"
+)
+
+var versionname = []byte("version")
+
+// migrations upgrade the database in place: migrations[v] upgrades a
+// database of version v to version v + 1. When the database format changes,
+// bump Version and add a migration for the previous version.
+var migrations = map[uint64]func(tx *bolt.Tx) error{
+	1: migrateV1,
+	2: migrateV2,
+}
+
+// migrateV1 converts node records to the layout of version 2, which adds
+// symbolic links.
+func migrateV1(tx *bolt.Tx) error {
+	return rewriteNodes(tx, func(v []byte) []byte {
+		n := node_t{}
+		n.decodeV1(v)
+		return n.encodeV2(make([]byte, n.EncodeLen()))
+	})
+}
+
+// migrateV2 prefixes node records with their record version.
+func migrateV2(tx *bolt.Tx) error {
+	return rewriteNodes(tx, func(v []byte) []byte {
+		return append([]byte{2}, v...)
+	})
+}
+
+// rewriteNodes replaces every node record with the result of fn. Records
+// that cannot be converted are left as is; they fail to decode afterwards
+// and are reported by Check.
+func rewriteNodes(tx *bolt.Tx, fn func(v []byte) []byte) (err error) {
+	convert := func(v []byte) (w []byte) {
+		defer func() {
+			if r := recover(); nil != r {
+				w = nil
+			}
+		}()
+
+		return fn(v)
+	}
+
+	var keys, vals [][]byte
+	cursor := tx.Bucket(catname).Cursor()
+	for k, v := cursor.First(); nil != k; k, v = cursor.Next() {
+		if w := convert(v); nil != w {
+			keys = append(keys, append([]byte(nil), k...))
+			vals = append(vals, w)
+		}
+	}
+
+	for i, k := range keys {
+		err = tx.Bucket(catname).Put(k, vals[i])
+		if nil != err {
+			return
+		}
+	}
+
+	return
+}
+
+func getDatabaseVersion(tx *bolt.Tx) (version uint64) {
+	meta := tx.Bucket(metaname)
+	if nil == meta {
+		return
+	}
+
+	v := meta.Get(versionname)
+	if 8 == len(v) {
+		_, version = getUint64(v, 0)
+	}
+
+	return
+}
+
+func putDatabaseVersion(tx *bolt.Tx, version uint64) (err error) {
+	meta, err := tx.CreateBucketIfNotExists(metaname)
+	if nil != err {
+		return
+	}
+
+	var verbuf [8]byte
+	putUint64(verbuf[:], 0, version)
+	err = meta.Put(versionname, verbuf[:])
+
+	return
+}
+
+// backupDatabase copies a database that is about to be migrated to the file
+// idxpath.vN, where N is its version.
+func backupDatabase(database *bolt.DB, idxpath string) (err error) {
+	err = database.View(func(tx *bolt.Tx) (err error) {
+		version := getDatabaseVersion(tx)
+		if 0 != version && Version > version {
+			err = tx.CopyFile(fmt.Sprintf("%s.v%d", idxpath, version), 0600)
+		}
+
+		return
+	})
+
+	return
+}
+
+// migrateDatabase upgrades the database to the current Version.
+func migrateDatabase(tx *bolt.Tx) (err error) {
+	version := getDatabaseVersion(tx)
+	if 0 == version || Version < version {
+		err = errors.New(fmt.Sprintf("incorrect database version %d", version))
+		return
+	}
+
+	if Version == version {
+		return
+	}
+
+	for ; Version > version; version++ {
+		migrate := migrations[version]
+		if nil == migrate {
+			err = errors.New(fmt.Sprintf("cannot migrate database version %d", version))
+			return
+		}
+
+		err = migrate(tx)
+		if nil != err {
+			return
+		}
+	}
+
+	err = putDatabaseVersion(tx, version)
+
+	return
+}
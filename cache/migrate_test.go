@@ -0,0 +1,144 @@
+/*
+ * migrate_test.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/billziss-gh/objfs/objio/objiotest"
+	"github.com/boltdb/bolt"
+)
+
+// encodeV1 encodes a node record of database version 1.
+func encodeV1(node *node_t) []byte {
+	isdir := uint8(0)
+	if node.IsDir {
+		isdir = uint8(1)
+	}
+	lp, ls, lh := len(node.Path), len(node.Sig), len(node.Hash)
+
+	b := make([]byte, 8+8+8+8+2+2+1+1+lp+ls+lh)
+	i := 0
+	i = putUint64(b, i, node.Ino)
+	i = putUint64(b, i, uint64(node.Size))
+	i = putTime(b, i, node.Btime)
+	i = putTime(b, i, node.Mtime)
+	i = putUint16(b, i, uint16(lp))
+	i = putUint16(b, i, uint16(ls))
+	i = putUint8(b, i, isdir)
+	i = putUint8(b, i, uint8(lh))
+	i = putString(b, i, node.Path, 1<<16-1)
+	i = putString(b, i, node.Sig, 1<<16-1)
+	i = putBytes(b, i, node.Hash, 1<<8-1)
+	return b[:i]
+}
+
+func TestMigrate(t *testing.T) {
+	storage := objiotest.NewMemObjectStorage(false)
+
+	path := newTestDir(t)
+
+	idxpath := filepath.Join(path, "index")
+	db, err := bolt.Open(idxpath, 0600, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC()
+	n := node_t{
+		Ino:   42,
+		Path:  "/file",
+		Size:  4,
+		Btime: now,
+		Mtime: now,
+		Sig:   "sig",
+		Hash:  []byte{1, 2, 3},
+	}
+	err = db.Update(func(tx *bolt.Tx) (err error) {
+		err = putDatabaseVersion(tx, 1)
+		if nil != err {
+			return
+		}
+		idx, _ := tx.CreateBucket(idxname)
+		cat, _ := tx.CreateBucket(catname)
+		var kbuf [8]byte
+		putUint64(kbuf[:], 0, n.Ino)
+		idx.Put(kbuf[:], []byte(n.Path))
+		cat.Put([]byte(n.Path), encodeV1(&n))
+		cat.Put([]byte("/bad"), []byte{1})
+		return
+	})
+	db.Close()
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	cache, err := OpenCache(path, storage, nil, Inspect)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	m := node_t{}
+	err = cache.database.View(func(tx *bolt.Tx) (err error) {
+		if Version != getDatabaseVersion(tx) {
+			t.Error("version", getDatabaseVersion(tx))
+		}
+		return m.GetWithIno(&nodetx_t{Tx: tx}, n.Ino)
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if n.Path != m.Path || n.Size != m.Size || !n.Mtime.Equal(m.Mtime) || n.Sig != m.Sig ||
+		3 != len(m.Hash) || m.IsLink {
+		t.Error("migrated node", m)
+	}
+
+	problems, _, err := cache.Check(false)
+	if nil != err || 1 != len(problems) || CheckCorruptNode != problems[0].Kind {
+		t.Error("Check", problems, err)
+	}
+
+	cache.CloseCache()
+
+	// the backup is a database of the old version
+	db, err = bolt.Open(idxpath+".v1", 0600, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	db.View(func(tx *bolt.Tx) (err error) {
+		if 1 != getDatabaseVersion(tx) {
+			t.Error("backup version", getDatabaseVersion(tx))
+		}
+		return
+	})
+
+	// a database of a newer version is not opened
+	db.Update(func(tx *bolt.Tx) (err error) {
+		return putDatabaseVersion(tx, Version+1)
+	})
+	db.Close()
+	os.Rename(idxpath+".v1", idxpath)
+
+	_, err = OpenCache(path, storage, nil, Open)
+	if nil == err {
+		t.Error("OpenCache newer version")
+	}
+}
@@ -0,0 +1,114 @@
+/*
+ * mtime.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"time"
+
+	"github.com/billziss-gh/objfs/errno"
+	"github.com/billziss-gh/objfs/objio"
+	"github.com/boltdb/bolt"
+)
+
+// mtime_t records a modification time set on an object. The record applies
+// only while the object has signature Sig; it is used for storages that
+// cannot set the modification time themselves. A record with an empty Sig
+// is pending and is applied when the cached file is next uploaded.
+type mtime_t struct {
+	Mtime time.Time
+	Sig   string
+}
+
+func (mt *mtime_t) Get(tx *bolt.Tx, k []byte) (err error) {
+	v := tx.Bucket(mtimename).Get(k)
+	if nil == v || nil != mt.Decode(v) {
+		err = errno.ENOENT
+	}
+
+	return
+}
+
+func (mt *mtime_t) Put(tx *bolt.Tx, k []byte) (err error) {
+	if nil != mt {
+		v := make([]byte, mt.EncodeLen())
+		v = mt.Encode(v)
+		err = tx.Bucket(mtimename).Put(k, v)
+	} else {
+		err = tx.Bucket(mtimename).Delete(k)
+	}
+
+	return
+}
+
+func (mt *mtime_t) EncodeLen() int {
+	return 8 + 2 + len(mt.Sig)
+}
+
+func (mt *mtime_t) Encode(b []byte) []byte {
+	// encode order: uint64*, uint32*, uint16*, uint8*
+	// Mtime, len(Sig), Sig
+
+	ls := len(mt.Sig)
+
+	i := 0
+	i = putTime(b, i, mt.Mtime)
+	i = putUint16(b, i, uint16(ls))
+	i = putString(b, i, mt.Sig, 1<<16-1)
+	return b[:i]
+}
+
+func (mt *mtime_t) Decode(b []byte) (err error) {
+	// encode order: uint64*, uint32*, uint16*, uint8*
+	// Mtime, len(Sig), Sig
+
+	defer func() {
+		if r := recover(); nil != r {
+			err = errno.EIO
+		}
+	}()
+
+	i := 0
+	i, mtime := getTime(b, i)
+	i, ls := getUint16(b, i)
+	i, sig := getString(b, i, int(ls))
+
+	mt.Mtime = mtime
+	mt.Sig = sig
+
+	return nil
+}
+
+// mtimeinfo_t is an ObjectInfo whose modification time has been set.
+type mtimeinfo_t struct {
+	objio.ObjectInfo
+	mtime time.Time
+}
+
+func (info *mtimeinfo_t) Mtime() time.Time {
+	return info.mtime
+}
+
+// applyMtime applies any recorded modification time to info.
+func applyMtime(tx *bolt.Tx, k []byte, info objio.ObjectInfo) objio.ObjectInfo {
+	mt := mtime_t{}
+	if nil == mt.Get(tx, k) && "" != mt.Sig && info.Sig() == mt.Sig {
+		return &mtimeinfo_t{ObjectInfo: info, mtime: mt.Mtime}
+	}
+
+	return info
+}
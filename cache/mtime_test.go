@@ -0,0 +1,91 @@
+/*
+ * mtime_test.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestApplyMtime(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "cache_mtime_test")
+	os.Remove(path)
+	defer os.Remove(path)
+
+	db, err := bolt.Open(path, 0600, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	now := time.Now().UTC()
+	then := time.Date(2018, 3, 14, 15, 9, 26, 0, time.UTC)
+	k := []byte("/foo/Δοκιμή")
+
+	err = db.Update(func(tx *bolt.Tx) (err error) {
+		_, err = tx.CreateBucketIfNotExists(mtimename)
+		if nil == err {
+			err = (&mtime_t{Mtime: then, Sig: "fortytwo"}).Put(tx, k)
+		}
+		return
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	db.View(func(tx *bolt.Tx) (err error) {
+		info := applyMtime(tx, k, &nodeinfo_t{mtime: now, sig: "fortytwo"})
+		if !then.Equal(info.Mtime()) || "fortytwo" != info.Sig() {
+			t.Error()
+		}
+
+		info = applyMtime(tx, k, &nodeinfo_t{mtime: now, sig: "fortythree"})
+		if !now.Equal(info.Mtime()) {
+			t.Error()
+		}
+
+		info = applyMtime(tx, []byte("/foo"), &nodeinfo_t{mtime: now, sig: "fortytwo"})
+		if !now.Equal(info.Mtime()) {
+			t.Error()
+		}
+
+		return
+	})
+
+	err = db.Update(func(tx *bolt.Tx) (err error) {
+		err = (&mtime_t{Mtime: then}).Put(tx, k)
+		return
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	db.View(func(tx *bolt.Tx) (err error) {
+		// pending records do not apply
+		info := applyMtime(tx, k, &nodeinfo_t{mtime: now, sig: ""})
+		if !now.Equal(info.Mtime()) {
+			t.Error()
+		}
+
+		return
+	})
+}
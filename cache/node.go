@@ -19,6 +19,7 @@ package cache
 
 import (
 	"bytes"
+	"io"
 	"os"
 	"path"
 	"time"
@@ -52,20 +53,30 @@ func (tx *nodetx_t) Cat() *bolt.Bucket {
 
 type node_t struct {
 	// persistent
-	Ino   uint64    // read-only after init
-	Path  string    // guarded by lockPath/unlockPath
-	Size  int64     //     -ditto-
-	Btime time.Time //     -ditto-
-	Mtime time.Time //     -ditto-
-	IsDir bool      //     -ditto-
-	Sig   string    //     -ditto-
-	Hash  []byte    //     -ditto-
+	Ino    uint64    // read-only after init
+	Path   string    // guarded by lockPath/unlockPath
+	Size   int64     //     -ditto-
+	Btime  time.Time //     -ditto-
+	Mtime  time.Time //     -ditto-
+	IsDir  bool      //     -ditto-
+	IsLink bool      //     -ditto-
+	Sig    string    //     -ditto-
+	Link   string    //     -ditto-
+	Hash   []byte    //     -ditto-
+
+	// persistent: state of the cached file
+	Dirty     bool      // guarded by lockPath/unlockPath
+	FileSize  int64     //     -ditto-
+	FileMtime time.Time //     -ditto-
 
 	// transient
-	Valid   bool
-	Deleted bool
-	File    *os.File
-	refcnt  int
+	Valid    bool
+	Deleted  bool
+	File     *os.File
+	Blocks   *blocks_t     // present blocks if File is sparse
+	Reader   io.ReadCloser // ranged reader of a sparse File, opened on demand
+	Download *download_t   // background download if File is being downloaded
+	refcnt   int
 }
 
 func (node *node_t) Get(tx *nodetx_t, k []byte) (err error) {
@@ -108,13 +119,14 @@ func (node *node_t) NextIno(tx *nodetx_t) (ino uint64, err error) {
 
 func (node *node_t) Put(tx *nodetx_t, k []byte) (err error) {
 	if nil != node {
-		v := make([]byte, node.EncodeLen())
-		putUint64(v, 0, node.Ino)
+		i := make([]byte, 8)
+		putUint64(i, 0, node.Ino)
 
-		if k0 := tx.Idx().Get(v[:8]); !bytes.Equal(k0, k) {
-			err = tx.Idx().Put(v[:8], k)
+		if k0 := tx.Idx().Get(i); !bytes.Equal(k0, k) {
+			err = tx.Idx().Put(i, k)
 		}
 		if nil == err {
+			v := make([]byte, node.EncodeLen())
 			v = node.Encode(v)
 			err = tx.Cat().Put(k, v)
 		}
@@ -148,18 +160,57 @@ func (node *node_t) CopyStat(info objio.ObjectInfo) {
 	node.Valid = true
 }
 
+// SetLink sets the symbolic link fields. The target may be empty if the
+// node is a symbolic link whose target is not yet known.
+func (node *node_t) SetLink(islink bool, target string) {
+	node.IsLink = islink
+	node.Link = ""
+	if islink {
+		node.Link = target
+	}
+}
+
+// SetFileState records whether the cached file of the node is dirty (i.e.
+// modified since it was downloaded or uploaded), together with the size and
+// mtime of the file that tell if it has changed since. A nil fileinfo records
+// that the state of the file is unknown.
+func (node *node_t) SetFileState(dirty bool, fileinfo os.FileInfo) {
+	node.Dirty = dirty
+	node.FileSize = -1
+	node.FileMtime = time.Time{}
+	if nil != fileinfo {
+		node.FileSize = fileinfo.Size()
+		node.FileMtime = fileinfo.ModTime()
+	}
+}
+
+// FileState gets the recorded dirty state of the cached file of the node.
+// The state is valid (ok) only if the file has not changed since it was
+// recorded.
+func (node *node_t) FileState(fileinfo os.FileInfo) (dirty bool, ok bool) {
+	dirty = node.Dirty
+	ok = 0 <= node.FileSize &&
+		fileinfo.Size() == node.FileSize && fileinfo.ModTime().Equal(node.FileMtime)
+	return
+}
+
 func (node *node_t) Stat() (info objio.ObjectInfo, err error) {
 	if 0 == node.Ino || "" == node.Path || !node.Valid || node.Deleted {
 		panic(errno.EINVAL)
 	}
 
 	nodeinfo := nodeinfo_t{
-		name:  path.Base(node.Path),
-		size:  node.Size,
-		btime: node.Btime,
-		mtime: node.Mtime,
-		isdir: node.IsDir,
-		sig:   node.Sig,
+		name:   path.Base(node.Path),
+		size:   node.Size,
+		btime:  node.Btime,
+		mtime:  node.Mtime,
+		isdir:  node.IsDir,
+		islink: node.IsLink,
+		sig:    node.Sig,
+	}
+
+	if node.IsLink && "" != node.Link {
+		nodeinfo.size = int64(len(node.Link))
 	}
 
 	if nil != node.File {
@@ -187,24 +238,57 @@ func (node *node_t) Dereference() int {
 	return node.refcnt
 }
 
+// Node records start with a record version. Decode accepts records of all
+// versions, but Encode writes records of the current version only. This
+// allows fields to be added to node records without migrating the database:
+// bump nodeVersion, encode the new fields and decode the older versions.
+const nodeVersion = 3
+
 func (node *node_t) EncodeLen() int {
-	lp, ls, lh := len(node.Path), len(node.Sig), len(node.Hash)
-	return 8 + 8 + 8 + 8 + 2 + 2 + 1 + 1 + lp + ls + lh
+	lp, ls, ll, lh := len(node.Path), len(node.Sig), len(node.Link), len(node.Hash)
+	return 1 + 8 + 8 + 8 + 8 + 2 + 2 + 2 + 1 + 1 + 1 + lp + ls + ll + lh + 8 + 8 + 1
 }
 
 func (node *node_t) Encode(b []byte) []byte {
-	// encode order: uint64*, uint32*, uint16*, uint8*
-	// Ino, Size, Btime, Mtime, len(Path), len(Sig), IsDir, len(Hash), Path, Sig, Hash
+	// encode order: nodeVersion, node record of that version
 
 	if 0 == node.Ino || "" == node.Path || !node.Valid || node.Deleted {
 		panic(errno.EINVAL)
 	}
 
+	i := putUint8(b, 0, nodeVersion)
+	return b[:i+len(node.encodeV3(b[i:]))]
+}
+
+func (node *node_t) encodeV3(b []byte) []byte {
+	// encode order: node record of version 2, FileSize, FileMtime, Dirty
+
+	dirty := uint8(0)
+	if node.Dirty {
+		dirty = uint8(1)
+	}
+
+	i := len(node.encodeV2(b))
+	i = putUint64(b, i, uint64(node.FileSize))
+	i = putTime(b, i, node.FileMtime)
+	i = putUint8(b, i, dirty)
+	return b[:i]
+}
+
+func (node *node_t) encodeV2(b []byte) []byte {
+	// encode order: uint64*, uint32*, uint16*, uint8*
+	// Ino, Size, Btime, Mtime, len(Path), len(Sig), len(Link), IsDir, IsLink, len(Hash),
+	// Path, Sig, Link, Hash
+
 	isdir := uint8(0)
 	if node.IsDir {
 		isdir = uint8(1)
 	}
-	lp, ls, lh := len(node.Path), len(node.Sig), len(node.Hash)
+	islink := uint8(0)
+	if node.IsLink {
+		islink = uint8(1)
+	}
+	lp, ls, ll, lh := len(node.Path), len(node.Sig), len(node.Link), len(node.Hash)
 
 	i := 0
 	i = putUint64(b, i, node.Ino)
@@ -213,24 +297,58 @@ func (node *node_t) Encode(b []byte) []byte {
 	i = putTime(b, i, node.Mtime)
 	i = putUint16(b, i, uint16(lp))
 	i = putUint16(b, i, uint16(ls))
+	i = putUint16(b, i, uint16(ll))
 	i = putUint8(b, i, isdir)
+	i = putUint8(b, i, islink)
 	i = putUint8(b, i, uint8(lh))
 	i = putString(b, i, node.Path, 1<<16-1)
 	i = putString(b, i, node.Sig, 1<<16-1)
+	i = putString(b, i, node.Link, 1<<16-1)
 	i = putBytes(b, i, node.Hash, 1<<8-1)
 	return b[:i]
 }
 
 func (node *node_t) Decode(b []byte) (err error) {
-	// encode order: uint64*, uint32*, uint16*, uint8*
-	// Ino, Size, Btime, Mtime, len(Path), len(Sig), IsDir, len(Hash), Path, Sig, Hash
-
 	defer func() {
 		if r := recover(); nil != r {
 			err = errno.EIO
 		}
 	}()
 
+	i, version := getUint8(b, 0)
+	switch version {
+	case 3:
+		node.decodeV3(b[i:])
+	case 2:
+		node.decodeV2(b[i:])
+		node.SetFileState(false, nil)
+	default:
+		return errno.EIO
+	}
+
+	node.Valid = true
+
+	return nil
+}
+
+func (node *node_t) decodeV3(b []byte) {
+	// encode order: node record of version 2, FileSize, FileMtime, Dirty
+
+	i := node.decodeV2(b)
+	i, filesize := getUint64(b, i)
+	i, filemtime := getTime(b, i)
+	i, dirty := getUint8(b, i)
+
+	node.FileSize = int64(filesize)
+	node.FileMtime = filemtime
+	node.Dirty = 0 != dirty
+}
+
+func (node *node_t) decodeV2(b []byte) int {
+	// encode order: uint64*, uint32*, uint16*, uint8*
+	// Ino, Size, Btime, Mtime, len(Path), len(Sig), len(Link), IsDir, IsLink, len(Hash),
+	// Path, Sig, Link, Hash
+
 	i := 0
 	i, ino := getUint64(b, i)
 	i, size := getUint64(b, i)
@@ -238,10 +356,13 @@ func (node *node_t) Decode(b []byte) (err error) {
 	i, mtime := getTime(b, i)
 	i, lp := getUint16(b, i)
 	i, ls := getUint16(b, i)
+	i, ll := getUint16(b, i)
 	i, isdir := getUint8(b, i)
+	i, islink := getUint8(b, i)
 	i, lh := getUint8(b, i)
 	i, path := getString(b, i, int(lp))
 	i, sig := getString(b, i, int(ls))
+	i, link := getString(b, i, int(ll))
 	i, hash := getBytes(b, i, int(lh))
 
 	node.Ino = ino
@@ -249,21 +370,54 @@ func (node *node_t) Decode(b []byte) (err error) {
 	node.Btime = btime
 	node.Mtime = mtime
 	node.IsDir = 0 != isdir
+	node.IsLink = 0 != islink
 	node.Path = path
 	node.Sig = sig
+	node.Link = link
 	node.Hash = hash
-	node.Valid = true
 
-	return nil
+	return i
+}
+
+// decodeV1 decodes the unversioned node records of database version 1,
+// which predate symbolic links.
+func (node *node_t) decodeV1(b []byte) {
+	// encode order: uint64*, uint32*, uint16*, uint8*
+	// Ino, Size, Btime, Mtime, len(Path), len(Sig), IsDir, len(Hash), Path, Sig, Hash
+
+	i := 0
+	i, ino := getUint64(b, i)
+	i, size := getUint64(b, i)
+	i, btime := getTime(b, i)
+	i, mtime := getTime(b, i)
+	i, lp := getUint16(b, i)
+	i, ls := getUint16(b, i)
+	i, isdir := getUint8(b, i)
+	i, lh := getUint8(b, i)
+	i, path := getString(b, i, int(lp))
+	i, sig := getString(b, i, int(ls))
+	i, hash := getBytes(b, i, int(lh))
+
+	node.Ino = ino
+	node.Size = int64(size)
+	node.Btime = btime
+	node.Mtime = mtime
+	node.IsDir = 0 != isdir
+	node.IsLink = false
+	node.Path = path
+	node.Sig = sig
+	node.Link = ""
+	node.Hash = hash
 }
 
 type nodeinfo_t struct {
-	name  string
-	size  int64
-	btime time.Time
-	mtime time.Time
-	isdir bool
-	sig   string
+	name   string
+	size   int64
+	btime  time.Time
+	mtime  time.Time
+	isdir  bool
+	islink bool
+	sig    string
 }
 
 func (info *nodeinfo_t) Name() string {
@@ -286,6 +440,10 @@ func (info *nodeinfo_t) IsDir() bool {
 	return info.isdir
 }
 
+func (info *nodeinfo_t) IsSymlink() bool {
+	return info.islink
+}
+
 func (info *nodeinfo_t) Sig() string {
 	return info.sig
 }
@@ -371,6 +529,13 @@ func getBytes(b []byte, i int, l int) (int, []byte) {
 }
 
 var (
-	idxname = []byte("i")
-	catname = []byte("c")
+	metaname     = []byte("m")
+	idxname      = []byte("i")
+	catname      = []byte("c")
+	sessname     = []byte("u")
+	mtimename    = []byte("t")
+	blockname    = []byte("b")
+	pinname      = []byte("p")
+	conflictname = []byte("x")
+	journalname  = []byte("j")
 )
@@ -79,15 +79,21 @@ func TestStat(t *testing.T) {
 func TestEncodeDecode(t *testing.T) {
 	now := time.Now().UTC()
 	n := node_t{
-		Ino:   0x4142434445464748,
-		Path:  "/foo/Δοκιμή/bar",
-		Size:  0x5152535455565758,
-		Btime: now,
-		Mtime: now,
-		IsDir: true,
-		Sig:   "fortytwo",
-		Hash:  []byte{41, 42, 43, 44},
-		Valid: true,
+		Ino:    0x4142434445464748,
+		Path:   "/foo/Δοκιμή/bar",
+		Size:   0x5152535455565758,
+		Btime:  now,
+		Mtime:  now,
+		IsDir:  true,
+		IsLink: true,
+		Sig:    "fortytwo",
+		Link:   "../Δοκιμή",
+		Hash:   []byte{41, 42, 43, 44},
+		Valid:  true,
+
+		Dirty:     true,
+		FileSize:  0x6162636465666768,
+		FileMtime: now,
 	}
 
 	b := make([]byte, n.EncodeLen())
@@ -126,10 +132,18 @@ func TestEncodeDecode(t *testing.T) {
 		t.Error()
 	}
 
+	if n.IsLink != n2.IsLink {
+		t.Error()
+	}
+
 	if n.Sig != n2.Sig {
 		t.Error()
 	}
 
+	if n.Link != n2.Link {
+		t.Error()
+	}
+
 	if !bytes.Equal(n.Hash, n2.Hash) {
 		t.Error()
 	}
@@ -137,6 +151,18 @@ func TestEncodeDecode(t *testing.T) {
 	if true != n2.Valid {
 		t.Error()
 	}
+
+	if n.Dirty != n2.Dirty || n.FileSize != n2.FileSize || !n.FileMtime.Equal(n2.FileMtime) {
+		t.Error()
+	}
+
+	// a record of version 2 has no file state
+	v2 := append([]byte{2}, n.encodeV2(make([]byte, n.EncodeLen()))...)
+	n3 := node_t{}
+	err = n3.Decode(v2)
+	if nil != err || n.Path != n3.Path || n3.Dirty || -1 != n3.FileSize {
+		t.Error(err)
+	}
 }
 
 func TestPutGetDelete(t *testing.T) {
@@ -146,15 +172,17 @@ func TestPutGetDelete(t *testing.T) {
 
 	now := time.Now().UTC()
 	n := node_t{
-		Ino:   0x4142434445464748,
-		Path:  "/foo/Δοκιμή/bar",
-		Size:  0x5152535455565758,
-		Btime: now,
-		Mtime: now,
-		IsDir: true,
-		Sig:   "fortytwo",
-		Hash:  []byte{41, 42, 43, 44},
-		Valid: true,
+		Ino:    0x4142434445464748,
+		Path:   "/foo/Δοκιμή/bar",
+		Size:   0x5152535455565758,
+		Btime:  now,
+		Mtime:  now,
+		IsDir:  true,
+		IsLink: true,
+		Sig:    "fortytwo",
+		Link:   "../Δοκιμή",
+		Hash:   []byte{41, 42, 43, 44},
+		Valid:  true,
 	}
 
 	db, err := bolt.Open(path, 0600, nil)
@@ -219,10 +247,18 @@ func TestPutGetDelete(t *testing.T) {
 		t.Error()
 	}
 
+	if n.IsLink != n2.IsLink {
+		t.Error()
+	}
+
 	if n.Sig != n2.Sig {
 		t.Error()
 	}
 
+	if n.Link != n2.Link {
+		t.Error()
+	}
+
 	if !bytes.Equal(n.Hash, n2.Hash) {
 		t.Error()
 	}
@@ -265,10 +301,18 @@ func TestPutGetDelete(t *testing.T) {
 		t.Error()
 	}
 
+	if n.IsLink != n2.IsLink {
+		t.Error()
+	}
+
 	if n.Sig != n2.Sig {
 		t.Error()
 	}
 
+	if n.Link != n2.Link {
+		t.Error()
+	}
+
 	if !bytes.Equal(n.Hash, n2.Hash) {
 		t.Error()
 	}
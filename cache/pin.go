@@ -0,0 +1,61 @@
+/*
+ * pin.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"github.com/billziss-gh/objfs/errno"
+	"github.com/boltdb/bolt"
+)
+
+// Pins are kept in the pin bucket. They are keyed by path key and their
+// value is the pinned path. A pin on a directory applies to all files below
+// it.
+
+func getPin(tx *bolt.Tx, k []byte) (path string, err error) {
+	v := tx.Bucket(pinname).Get(k)
+	if nil == v {
+		err = errno.ENOENT
+		return
+	}
+
+	path = string(v)
+
+	return
+}
+
+func putPin(tx *bolt.Tx, k []byte, path string) (err error) {
+	if "" != path {
+		err = tx.Bucket(pinname).Put(k, []byte(path))
+	} else {
+		err = tx.Bucket(pinname).Delete(k)
+	}
+
+	return
+}
+
+// isPinned determines if the path key or any of its parents is pinned.
+func isPinned(tx *bolt.Tx, pathKey string) bool {
+	bucket := tx.Bucket(pinname)
+	for _, p := range partialPaths(pathKey) {
+		if nil != bucket.Get([]byte(p)) {
+			return true
+		}
+	}
+
+	return false
+}
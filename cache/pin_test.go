@@ -0,0 +1,162 @@
+/*
+ * pin_test.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/billziss-gh/objfs/objio/objiotest"
+	"github.com/boltdb/bolt"
+)
+
+func TestPin(t *testing.T) {
+	cache, _ := newTestCache(t, objiotest.NewMemObjectStorage(false), map[string]string{
+		"/dir/":      "",
+		"/dir/file1": "data",
+		"/dir/file2": "data",
+		"/file3":     "data",
+	}, nil, Open)
+	defer cache.CloseCache()
+
+	var progress []string
+	err := cache.Pin("/dir", func(path string) {
+		progress = append(progress, path)
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	sort.Strings(progress)
+	if "=/dir/,=/dir/file1,=/dir/file2" != strings.Join(progress, ",") {
+		t.Error("Pin progress", progress)
+	}
+
+	err = cache.Pin("/file3", nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if "/dir,/file3" != strings.Join(cache.ListPins(), ",") {
+		t.Error("ListPins", cache.ListPins())
+	}
+
+	cache.database.View(func(tx *bolt.Tx) (err error) {
+		if !isPinned(tx, "/dir/file1") || !isPinned(tx, "/dir") || isPinned(tx, "/") ||
+			isPinned(tx, "/dirx") {
+			t.Error("isPinned")
+		}
+		return
+	})
+
+	// pinned files are not evicted
+	err = cache.ResetCache(nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 3 != len(cache.ListCache()) {
+		t.Error("ListCache after ResetCache", cache.ListCache())
+	}
+
+	err = cache.Unpin("/dir")
+	if nil != err {
+		t.Fatal(err)
+	}
+	err = cache.Unpin("/dir")
+	if nil == err {
+		t.Error("Unpin twice")
+	}
+
+	err = cache.ResetCache(nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "=/file3" != strings.Join(cache.ListCache(), ",") {
+		t.Error("ListCache after Unpin", cache.ListCache())
+	}
+
+	// pins follow renames
+	ino, err := cache.Open("/file3")
+	if nil != err {
+		t.Fatal(err)
+	}
+	err = cache.Rename(ino, "/file4")
+	cache.Close(ino)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if "/file4" != strings.Join(cache.ListPins(), ",") {
+		t.Error("ListPins after Rename", cache.ListPins())
+	}
+}
+
+func TestPinChanges(t *testing.T) {
+	storage := &changesStorage{MemObjectStorage: objiotest.NewMemObjectStorage(false)}
+	cache, _ := newTestCache(t, storage, map[string]string{
+		"/dir/":      "",
+		"/dir/file1": "old",
+		"/dir/file2": "old",
+		"/dir/file3": "old",
+	}, nil, Open)
+	defer cache.CloseCache()
+
+	err := cache.syncChanges()
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	err = cache.Pin("/dir", nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	// change /dir/file1 and remove /dir/file3 remotely
+	writeTestObjects(t, storage, map[string]string{"/dir/file1": "new"})
+	storage.Remove("/dir/file3")
+	storage.change("/dir/file1")
+	storage.change("/dir/file3")
+
+	err = cache.syncChanges()
+	if nil != err {
+		t.Fatal(err)
+	}
+	err = cache.ResetCache(nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	list := cache.ListCache()
+	sort.Strings(list)
+	if "=/dir/file1,=/dir/file2" != strings.Join(list, ",") {
+		t.Error("ListCache", list)
+	}
+
+	for name, data := range map[string]string{"/dir/file1": "new", "/dir/file2": "old"} {
+		ino, err := cache.Open(name)
+		if nil != err {
+			t.Fatal(err)
+		}
+		rdata, err := ioutil.ReadFile(cache.filePath(ino))
+		cache.Close(ino)
+		if nil != err || data != string(rdata) {
+			t.Error("cached file", name, string(rdata), err)
+		}
+	}
+}
@@ -0,0 +1,434 @@
+/*
+ * policy.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"container/heap"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/billziss-gh/golib/errors"
+	"github.com/billziss-gh/objfs/errno"
+)
+
+// UploadPolicy controls the order and the times in which the background
+// thread uploads modified files. The zero UploadPolicy uploads files in the
+// order they were last modified, at any time.
+//
+// Path patterns use the syntax of path.Match. A pattern that starts with /
+// is matched against the path of a file and its parent directories; any
+// other pattern is matched against the name of a file.
+type UploadPolicy struct {
+	// Priorities orders uploads by path pattern. Files with higher priority
+	// are uploaded first; files that match no pattern have priority 0.
+	Priorities []UploadPriority
+
+	// Delays overrides the UploadDelay of files by path pattern.
+	Delays []UploadDelay
+
+	// SmallFirst uploads smaller files before larger ones of equal priority.
+	SmallFirst bool
+
+	// Windows are the times of the day in which files are uploaded. If there
+	// are no windows files are uploaded at any time. Uploads that are forced
+	// (e.g. by cache-reset or unmount) ignore the windows.
+	Windows []UploadWindow
+
+	// Unmetered uploads files only while the link to the storage is not
+	// metered. Forced uploads ignore it.
+	Unmetered bool
+
+	// Metered reports whether the link to the storage is metered. If it is
+	// nil the link is metered while a file named metered exists in the cache
+	// directory (e.g. as maintained by a network manager script).
+	Metered func() bool
+}
+
+// meteredName is the name of the file that marks the link as metered.
+const meteredName = "metered"
+
+type UploadPriority struct {
+	Pattern  string
+	Priority int
+}
+
+type UploadDelay struct {
+	Pattern string
+	Delay   time.Duration
+}
+
+type UploadWindow struct {
+	Days  [7]bool       // indexed by time.Weekday; all false means every day
+	Start time.Duration // time of day
+	End   time.Duration // time of day; before Start for windows past midnight
+}
+
+var weekdayNames = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+
+// Set sets an upload policy setting from its configuration name and value:
+//
+//	upload-priority=PATTERN:N,...
+//	upload-delay=PATTERN:DURATION,...
+//	upload-small-first=true|false
+//	upload-window=[DAYS@]HH:MM-HH:MM,...
+//	upload-unmetered=true|false
+//
+// DAYS is a day (Mon), a range of days (Mon-Fri) or a list of these (Sat+Sun).
+func (policy *UploadPolicy) Set(name string, value string) (err error) {
+	var items []string
+	if "" != value {
+		items = strings.Split(value, ",")
+	}
+
+	switch name {
+	case "upload-priority":
+		var priorities []UploadPriority
+		for _, item := range items {
+			pattern, v, e := splitPolicyItem(item)
+			if nil != e {
+				return e
+			}
+			prio, e := strconv.Atoi(v)
+			if nil != e {
+				return errors.New(": invalid upload priority "+item, nil, errno.EINVAL)
+			}
+			priorities = append(priorities, UploadPriority{pattern, prio})
+		}
+		policy.Priorities = priorities
+
+	case "upload-delay":
+		var delays []UploadDelay
+		for _, item := range items {
+			pattern, v, e := splitPolicyItem(item)
+			if nil != e {
+				return e
+			}
+			delay, e := time.ParseDuration(v)
+			if nil != e || 0 > delay {
+				return errors.New(": invalid upload delay "+item, nil, errno.EINVAL)
+			}
+			delays = append(delays, UploadDelay{pattern, delay})
+		}
+		policy.Delays = delays
+
+	case "upload-small-first":
+		policy.SmallFirst, err = strconv.ParseBool(value)
+		if nil != err {
+			err = errors.New(": invalid upload-small-first "+value, nil, errno.EINVAL)
+		}
+
+	case "upload-unmetered":
+		policy.Unmetered, err = strconv.ParseBool(value)
+		if nil != err {
+			err = errors.New(": invalid upload-unmetered "+value, nil, errno.EINVAL)
+		}
+
+	case "upload-window":
+		var windows []UploadWindow
+		for _, item := range items {
+			window, e := parseUploadWindow(strings.TrimSpace(item))
+			if nil != e {
+				return e
+			}
+			windows = append(windows, window)
+		}
+		policy.Windows = windows
+
+	default:
+		err = errors.New(": unknown upload policy setting "+name, nil, errno.EINVAL)
+	}
+
+	return
+}
+
+// Settings lists the settings of the policy that differ from the zero
+// policy in the form accepted by Set.
+func (policy *UploadPolicy) Settings() (settings []string) {
+	if 0 != len(policy.Priorities) {
+		items := make([]string, len(policy.Priorities))
+		for i, p := range policy.Priorities {
+			items[i] = fmt.Sprintf("%s:%d", p.Pattern, p.Priority)
+		}
+		settings = append(settings, "upload-priority="+strings.Join(items, ","))
+	}
+
+	if 0 != len(policy.Delays) {
+		items := make([]string, len(policy.Delays))
+		for i, d := range policy.Delays {
+			items[i] = fmt.Sprintf("%s:%v", d.Pattern, d.Delay)
+		}
+		settings = append(settings, "upload-delay="+strings.Join(items, ","))
+	}
+
+	if policy.SmallFirst {
+		settings = append(settings, "upload-small-first=true")
+	}
+
+	if 0 != len(policy.Windows) {
+		items := make([]string, len(policy.Windows))
+		for i, w := range policy.Windows {
+			items[i] = w.String()
+		}
+		settings = append(settings, "upload-window="+strings.Join(items, ","))
+	}
+
+	if policy.Unmetered {
+		settings = append(settings, "upload-unmetered=true")
+	}
+
+	return
+}
+
+// isOrdered determines if the policy changes the order of uploads or the
+// delay of files, so that uploads must be ranked.
+func (policy *UploadPolicy) isOrdered() bool {
+	return 0 != len(policy.Priorities) || 0 != len(policy.Delays) || policy.SmallFirst
+}
+
+// isAllowed determines if files may be uploaded at time t.
+func (policy *UploadPolicy) isAllowed(t time.Time) bool {
+	if 0 == len(policy.Windows) {
+		return true
+	}
+
+	for _, w := range policy.Windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (policy *UploadPolicy) priority(p string) int {
+	for _, r := range policy.Priorities {
+		if matchPolicyPattern(r.Pattern, p) {
+			return r.Priority
+		}
+	}
+
+	return 0
+}
+
+func (policy *UploadPolicy) delay(p string, delay time.Duration) time.Duration {
+	for _, r := range policy.Delays {
+		if matchPolicyPattern(r.Pattern, p) {
+			return r.Delay
+		}
+	}
+
+	return delay
+}
+
+// before determines if item a is uploaded before item b.
+func (policy *UploadPolicy) before(a *lruitem_t, b *lruitem_t) bool {
+	pa, pb := policy.priority(a.path), policy.priority(b.path)
+	if pa != pb {
+		return pa > pb
+	}
+
+	if policy.SmallFirst && a.size != b.size {
+		return a.size < b.size
+	}
+
+	return a.atime < b.atime
+}
+
+// uploadq_t is a heap of items waiting to be uploaded. The index of an item
+// in its heap is kept in the item, so that it can be removed when touched.
+type uploadq_t struct {
+	items []*lruitem_t
+	less  func(a *lruitem_t, b *lruitem_t) bool
+}
+
+func (q *uploadq_t) Len() int {
+	return len(q.items)
+}
+
+func (q *uploadq_t) Less(i, j int) bool {
+	return q.less(q.items[i], q.items[j])
+}
+
+func (q *uploadq_t) Swap(i, j int) {
+	q.items[i], q.items[j] = q.items[j], q.items[i]
+	q.items[i].qindex = i
+	q.items[j].qindex = j
+}
+
+func (q *uploadq_t) Push(x interface{}) {
+	item := x.(*lruitem_t)
+	item.queue = q
+	item.qindex = len(q.items)
+	q.items = append(q.items, item)
+}
+
+func (q *uploadq_t) Pop() interface{} {
+	n := len(q.items) - 1
+	item := q.items[n]
+	q.items[n] = nil
+	q.items = q.items[:n]
+	item.queue = nil
+	return item
+}
+
+// first returns the first item of the heap or nil.
+func (q *uploadq_t) first() *lruitem_t {
+	if 0 == len(q.items) {
+		return nil
+	}
+
+	return q.items[0]
+}
+
+// unqueue removes an item from the heap that it is in, if any.
+func (item *lruitem_t) unqueue() {
+	if nil != item.queue {
+		heap.Remove(item.queue, item.qindex)
+	}
+}
+
+func (window *UploadWindow) contains(t time.Time) bool {
+	days := window.Days
+	if [7]bool{} != days && !days[t.Weekday()] {
+		return false
+	}
+
+	y, m, d := t.Date()
+	tod := t.Sub(time.Date(y, m, d, 0, 0, 0, 0, t.Location()))
+	if window.Start <= window.End {
+		return window.Start <= tod && tod < window.End
+	}
+
+	return window.Start <= tod || tod < window.End
+}
+
+func (window *UploadWindow) String() string {
+	s := ""
+	if [7]bool{} != window.Days {
+		var days []string
+		for i, ok := range window.Days {
+			if ok {
+				days = append(days, weekdayNames[i])
+			}
+		}
+		s = strings.Join(days, "+") + "@"
+	}
+
+	return s + formatTimeOfDay(window.Start) + "-" + formatTimeOfDay(window.End)
+}
+
+func parseUploadWindow(s string) (window UploadWindow, err error) {
+	err = errors.New(": invalid upload window "+s, nil, errno.EINVAL)
+
+	times := s
+	if i := strings.IndexByte(s, '@'); -1 != i {
+		times = s[i+1:]
+		for _, d := range strings.Split(s[:i], "+") {
+			first, last := d, d
+			if j := strings.IndexByte(d, '-'); -1 != j {
+				first, last = d[:j], d[j+1:]
+			}
+			f, l := parseWeekday(first), parseWeekday(last)
+			if -1 == f || -1 == l {
+				return
+			}
+			for i := f; ; i = (i + 1) % 7 {
+				window.Days[i] = true
+				if l == i {
+					break
+				}
+			}
+		}
+	}
+
+	i := strings.IndexByte(times, '-')
+	if -1 == i {
+		return
+	}
+
+	var ok1, ok2 bool
+	window.Start, ok1 = parseTimeOfDay(times[:i])
+	window.End, ok2 = parseTimeOfDay(times[i+1:])
+	if !ok1 || !ok2 {
+		return
+	}
+
+	err = nil
+	return
+}
+
+func parseWeekday(s string) int {
+	for i, n := range weekdayNames {
+		if strings.EqualFold(n, s) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func parseTimeOfDay(s string) (tod time.Duration, ok bool) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); nil != err || 2 != n {
+		return
+	}
+	if 0 > h || 0 > m || 59 < m || 24 < h || (24 == h && 0 != m) {
+		return
+	}
+
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, true
+}
+
+func formatTimeOfDay(tod time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(tod/time.Hour), int(tod%time.Hour/time.Minute))
+}
+
+func splitPolicyItem(item string) (pattern string, value string, err error) {
+	item = strings.TrimSpace(item)
+	i := strings.LastIndexByte(item, ':')
+	if 0 >= i {
+		err = errors.New(": invalid policy item "+item, nil, errno.EINVAL)
+		return
+	}
+
+	pattern, value = item[:i], item[i+1:]
+	if _, e := path.Match(pattern, ""); nil != e {
+		err = errors.New(": invalid pattern "+pattern, nil, errno.EINVAL)
+	}
+
+	return
+}
+
+// matchPolicyPattern matches a path against a policy pattern.
+func matchPolicyPattern(pattern string, p string) bool {
+	if !strings.HasPrefix(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(p))
+		return ok
+	}
+
+	for _, d := range partialPaths(p) {
+		if ok, _ := path.Match(pattern, d); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,302 @@
+/*
+ * policy_test.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/billziss-gh/objfs/objio/objiotest"
+)
+
+func TestUploadPolicySet(t *testing.T) {
+	policy := UploadPolicy{}
+
+	settings := []string{
+		"upload-priority=*.doc:10,/important:20",
+		"upload-delay=*.log:1h0m0s",
+		"upload-small-first=true",
+		"upload-window=Mon-Fri@18:00-08:00,Sat+Sun@00:00-24:00",
+		"upload-unmetered=true",
+	}
+	for _, s := range settings {
+		i := strings.IndexByte(s, '=')
+		err := policy.Set(s[:i], s[i+1:])
+		if nil != err {
+			t.Error("Set", s, err)
+		}
+	}
+
+	if "Mon+Tue+Wed+Thu+Fri@18:00-08:00" != policy.Windows[0].String() {
+		t.Error("Windows", policy.Windows[0].String())
+	}
+	settings[3] = "upload-window=Mon+Tue+Wed+Thu+Fri@18:00-08:00,Sun+Sat@00:00-24:00"
+	if strings.Join(settings, "\n") != strings.Join(policy.Settings(), "\n") {
+		t.Error("Settings", policy.Settings())
+	}
+
+	for _, s := range [][2]string{
+		{"upload-priority", "*.doc"},
+		{"upload-priority", "*.doc:x"},
+		{"upload-priority", "[:1"},
+		{"upload-delay", "*.log:-1h"},
+		{"upload-small-first", "maybe"},
+		{"upload-unmetered", "maybe"},
+		{"upload-window", "18:00"},
+		{"upload-window", "Xyz@18:00-19:00"},
+		{"upload-window", "25:00-26:00"},
+		{"upload-unknown", ""},
+	} {
+		err := policy.Set(s[0], s[1])
+		if nil == err {
+			t.Error("Set invalid", s)
+		}
+	}
+
+	err := policy.Set("upload-priority", "")
+	if nil != err || 0 != len(policy.Priorities) {
+		t.Error("Set empty", err)
+	}
+}
+
+func TestUploadWindow(t *testing.T) {
+	policy := UploadPolicy{}
+	err := policy.Set("upload-window", "Mon-Fri@18:00-08:00,Sat+Sun@00:00-24:00")
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		t  time.Time
+		ok bool
+	}{
+		{time.Date(2018, 3, 14, 12, 0, 0, 0, time.Local), false}, // Wed
+		{time.Date(2018, 3, 14, 18, 0, 0, 0, time.Local), true},
+		{time.Date(2018, 3, 14, 7, 59, 0, 0, time.Local), true},
+		{time.Date(2018, 3, 14, 8, 0, 0, 0, time.Local), false},
+		{time.Date(2018, 3, 17, 12, 0, 0, 0, time.Local), true}, // Sat
+	} {
+		if c.ok != policy.isAllowed(c.t) {
+			t.Error("isAllowed", c.t)
+		}
+	}
+
+	if !(&UploadPolicy{}).isAllowed(time.Now()) {
+		t.Error("isAllowed without windows")
+	}
+}
+
+func TestMatchPolicyPattern(t *testing.T) {
+	for _, c := range []struct {
+		pattern string
+		path    string
+		ok      bool
+	}{
+		{"*.doc", "/a/b.doc", true},
+		{"*.doc", "/a.doc/b", false},
+		{"/a", "/a/b/c", true},
+		{"/a/*.doc", "/a/b.doc", true},
+		{"/a/*.doc", "/b/a/b.doc", false},
+		{"/b", "/a/b", false},
+	} {
+		if c.ok != matchPolicyPattern(c.pattern, c.path) {
+			t.Error("matchPolicyPattern", c.pattern, c.path)
+		}
+	}
+}
+
+func TestUploadOrder(t *testing.T) {
+	config := &Config{UploadDelay: time.Nanosecond, UploadWorkers: 1}
+	config.UploadPolicy.Set("upload-priority", "*.doc:10")
+	config.UploadPolicy.Set("upload-delay", "*.tmp:1h")
+	config.UploadPolicy.Set("upload-small-first", "true")
+
+	storage := objiotest.NewMemObjectStorage(false)
+	cache, _ := newTestCache(t, storage, nil, config, Open)
+	defer cache.CloseCache()
+
+	for _, f := range []struct {
+		name string
+		size int
+	}{
+		{"/a.txt", 300},
+		{"/b.txt", 100},
+		{"/c.doc", 200},
+		{"/d.tmp", 100},
+	} {
+		ino, err := cache.Open(f.name)
+		if nil != err {
+			t.Fatal(err)
+		}
+		err = cache.Make(ino, false)
+		if nil == err {
+			_, err = cache.WriteAt(ino, make([]byte, f.size), 0)
+		}
+		cache.Close(ino)
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(time.Millisecond)
+
+	var progress []string
+	err := cache.uploadAll(false, func(path string) {
+		progress = append(progress, path)
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "+/c.doc,+/b.txt,+/a.txt" != strings.Join(progress, ",") {
+		t.Error("uploadAll order", progress)
+	}
+
+	// outside the upload windows only forced uploads happen
+	cache.config.UploadPolicy.Windows = []UploadWindow{{Start: 0, End: 0}}
+	progress = nil
+	err = cache.uploadAll(false, func(path string) {
+		progress = append(progress, path)
+	})
+	if nil != err || 0 != len(progress) {
+		t.Error("uploadAll outside window", progress, err)
+	}
+	err = cache.uploadAll(true, func(path string) {
+		progress = append(progress, path)
+	})
+	if nil != err || "+/d.tmp" != strings.Join(progress, ",") {
+		t.Error("uploadAll forced", progress, err)
+	}
+}
+
+func TestUploadUnmetered(t *testing.T) {
+	metered := true
+	config := &Config{UploadDelay: time.Nanosecond, UploadWorkers: 1}
+	config.UploadPolicy.Set("upload-unmetered", "true")
+	config.UploadPolicy.Metered = func() bool { return metered }
+
+	storage := objiotest.NewMemObjectStorage(false)
+	cache, path := newTestCache(t, storage, nil, config, Open)
+	defer cache.CloseCache()
+
+	ino, err := cache.Open("/file")
+	if nil != err {
+		t.Fatal(err)
+	}
+	err = cache.Make(ino, false)
+	if nil == err {
+		_, err = cache.WriteAt(ino, []byte("data"), 0)
+	}
+	cache.Close(ino)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond)
+
+	var progress []string
+	err = cache.uploadAll(false, func(path string) {
+		progress = append(progress, path)
+	})
+	if nil != err || 0 != len(progress) {
+		t.Error("uploadAll metered", progress, err)
+	}
+
+	// without the Metered hook the link is metered while the metered file exists
+	cache.config.UploadPolicy.Metered = nil
+	err = ioutil.WriteFile(filepath.Join(path, meteredName), nil, 0644)
+	if nil != err {
+		t.Fatal(err)
+	}
+	err = cache.uploadAll(false, func(path string) {
+		progress = append(progress, path)
+	})
+	if nil != err || 0 != len(progress) {
+		t.Error("uploadAll metered file", progress, err)
+	}
+
+	os.Remove(filepath.Join(path, meteredName))
+	err = cache.uploadAll(false, func(path string) {
+		progress = append(progress, path)
+	})
+	if nil != err || "+/file" != strings.Join(progress, ",") {
+		t.Error("uploadAll unmetered", progress, err)
+	}
+}
+
+func TestUploadRank(t *testing.T) {
+	config := &Config{UploadDelay: time.Nanosecond, UploadWorkers: 1}
+	config.UploadPolicy.Set("upload-priority", "*.doc:10")
+
+	storage := objiotest.NewMemObjectStorage(false)
+	cache, _ := newTestCache(t, storage, nil, config, Open)
+	defer cache.CloseCache()
+
+	for _, name := range []string{"/a.txt", "/b.txt", "/c.txt"} {
+		ino, err := cache.Open(name)
+		if nil != err {
+			t.Fatal(err)
+		}
+		err = cache.Make(ino, false)
+		if nil == err {
+			_, err = cache.WriteAt(ino, []byte("data"), 0)
+		}
+		cache.Close(ino)
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	// items are ranked once
+	cache.rankUploads()
+	if 0 != len(cache.rankq) || 3 != cache.waitq.Len() {
+		t.Fatal("rankUploads", len(cache.rankq), cache.waitq.Len())
+	}
+
+	// a renamed file is ranked again by its new path
+	ino, err := cache.Open("/c.txt")
+	if nil == err {
+		err = cache.Rename(ino, "/c.doc")
+		cache.Close(ino)
+	}
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 1 != len(cache.rankq) || 2 != cache.waitq.Len() {
+		t.Fatal("unrankInos", len(cache.rankq), cache.waitq.Len())
+	}
+
+	time.Sleep(time.Millisecond)
+
+	var progress []string
+	err = cache.uploadAll(false, func(path string) {
+		progress = append(progress, path)
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "+/c.doc,+/a.txt,+/b.txt" != strings.Join(progress, ",") {
+		t.Error("uploadAll order", progress)
+	}
+	if 0 != cache.waitq.Len() || 0 != cache.readyq.Len() {
+		t.Error("uploadAll queues", cache.waitq.Len(), cache.readyq.Len())
+	}
+}
@@ -0,0 +1,167 @@
+/*
+ * session.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"time"
+
+	"github.com/billziss-gh/objfs/errno"
+	"github.com/billziss-gh/objfs/objio"
+	"github.com/boltdb/bolt"
+)
+
+// session_t records a resumable upload session for an ino. The Size and
+// Mtime of the cached file are recorded when the session is created; the
+// session can only be resumed if the cached file has not changed since and
+// is still uploaded to the same Path. Time is when the session was created
+// (zero for sessions recorded by older versions).
+type session_t struct {
+	Ino     uint64
+	Offset  int64
+	Size    int64
+	Mtime   time.Time
+	Session string
+	Time    time.Time
+	Path    string
+}
+
+// sessionMaxAge is the age after which an upload session is no longer
+// resumed; storages expire unfinished sessions after some days.
+const sessionMaxAge = 7 * 24 * time.Hour
+
+// IsExpired determines if the session is older than sessionMaxAge.
+func (session *session_t) IsExpired(now time.Time) bool {
+	return !session.Time.IsZero() && now.Sub(session.Time) > sessionMaxAge
+}
+
+func (session *session_t) Get(tx *bolt.Tx, ino uint64) (err error) {
+	var kbuf [8]byte
+	k := kbuf[:]
+
+	putUint64(k, 0, ino)
+	v := tx.Bucket(sessname).Get(k)
+	if nil == v || nil != session.Decode(v) {
+		err = errno.ENOENT
+	}
+
+	return
+}
+
+func (session *session_t) Put(tx *bolt.Tx, ino uint64) (err error) {
+	var kbuf [8]byte
+	k := kbuf[:]
+
+	putUint64(k, 0, ino)
+	if nil != session {
+		v := make([]byte, session.EncodeLen())
+		v = session.Encode(v)
+		err = tx.Bucket(sessname).Put(k, v)
+	} else {
+		err = tx.Bucket(sessname).Delete(k)
+	}
+
+	return
+}
+
+func (session *session_t) EncodeLen() int {
+	return 8 + 8 + 8 + 8 + 2 + len(session.Session) + 8 + 2 + len(session.Path)
+}
+
+func (session *session_t) Encode(b []byte) []byte {
+	// encode order: uint64*, uint32*, uint16*, uint8*
+	// Ino, Offset, Size, Mtime, len(Session), Session
+	// followed by: Time, len(Path), Path
+
+	ls := len(session.Session)
+	lp := len(session.Path)
+
+	i := 0
+	i = putUint64(b, i, session.Ino)
+	i = putUint64(b, i, uint64(session.Offset))
+	i = putUint64(b, i, uint64(session.Size))
+	i = putTime(b, i, session.Mtime)
+	i = putUint16(b, i, uint16(ls))
+	i = putString(b, i, session.Session, 1<<16-1)
+	i = putTime(b, i, session.Time)
+	i = putUint16(b, i, uint16(lp))
+	i = putString(b, i, session.Path, 1<<16-1)
+	return b[:i]
+}
+
+func (session *session_t) Decode(b []byte) (err error) {
+	// encode order: uint64*, uint32*, uint16*, uint8*
+	// Ino, Offset, Size, Mtime, len(Session), Session
+	// followed by: Time, len(Path), Path (absent in older records)
+
+	defer func() {
+		if r := recover(); nil != r {
+			err = errno.EIO
+		}
+	}()
+
+	i := 0
+	i, ino := getUint64(b, i)
+	i, offset := getUint64(b, i)
+	i, size := getUint64(b, i)
+	i, mtime := getTime(b, i)
+	i, ls := getUint16(b, i)
+	i, s := getString(b, i, int(ls))
+
+	var tm time.Time
+	var p string
+	if len(b) > i {
+		var lp uint16
+		i, tm = getTime(b, i)
+		i, lp = getUint16(b, i)
+		i, p = getString(b, i, int(lp))
+	}
+
+	session.Ino = ino
+	session.Offset = int64(offset)
+	session.Size = int64(size)
+	session.Mtime = mtime
+	session.Session = s
+	session.Time = tm
+	session.Path = p
+
+	return nil
+}
+
+// sessionWriter persists the committed offset of a resumable upload as the
+// upload progresses.
+type sessionWriter struct {
+	objio.ResumableWriteWaiter
+	database *bolt.DB
+	session  session_t
+}
+
+func (self *sessionWriter) Write(p []byte) (n int, err error) {
+	n, err = self.ResumableWriteWaiter.Write(p)
+
+	if off := self.Offset(); off >= self.session.Offset+sessionSaveSize {
+		self.session.Offset = off
+		self.database.Update(func(tx *bolt.Tx) (err error) {
+			err = self.session.Put(tx, self.session.Ino)
+			return
+		})
+	}
+
+	return
+}
+
+const sessionSaveSize = 4 * 1024 * 1024
@@ -0,0 +1,273 @@
+/*
+ * session_test.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/billziss-gh/golib/errors"
+	"github.com/billziss-gh/objfs/errno"
+	"github.com/billziss-gh/objfs/objio"
+	"github.com/billziss-gh/objfs/objio/objiotest"
+	"github.com/boltdb/bolt"
+)
+
+func TestSessionEncodeDecode(t *testing.T) {
+	now := time.Now().UTC()
+	s := session_t{
+		Ino:     0x4142434445464748,
+		Offset:  0x5152535455565758,
+		Size:    0x6162636465666768,
+		Mtime:   now,
+		Session: "https://example.com/upload/Δοκιμή",
+		Time:    now.Add(-time.Hour),
+		Path:    "/Δοκιμή/file",
+	}
+
+	b := make([]byte, s.EncodeLen())
+	b = s.Encode(b)
+	if len(b) != s.EncodeLen() {
+		t.Error()
+	}
+
+	s2 := session_t{}
+	err := s2.Decode(b)
+	if nil != err {
+		t.Error(err)
+	}
+
+	if s.Ino != s2.Ino {
+		t.Error()
+	}
+
+	if s.Offset != s2.Offset {
+		t.Error()
+	}
+
+	if s.Size != s2.Size {
+		t.Error()
+	}
+
+	if !s.Mtime.Equal(s2.Mtime) || s.Mtime.String() != s2.Mtime.String() {
+		t.Error()
+	}
+
+	if s.Session != s2.Session {
+		t.Error()
+	}
+
+	if !s.Time.Equal(s2.Time) || s.Path != s2.Path {
+		t.Error()
+	}
+
+	// a record of an older version lacks Time and Path
+	s3 := session_t{}
+	err = s3.Decode(b[:len(b)-8-2-len(s.Path)])
+	if nil != err || s.Session != s3.Session || !s3.Time.IsZero() || "" != s3.Path {
+		t.Error(err)
+	}
+	if s3.IsExpired(now) || s2.IsExpired(now) || !s2.IsExpired(now.Add(sessionMaxAge)) {
+		t.Error("IsExpired")
+	}
+}
+
+func TestSessionPutGetDelete(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "cache_session_test")
+	os.Remove(path)
+	defer os.Remove(path)
+
+	s := session_t{
+		Ino:     42,
+		Offset:  4096,
+		Size:    8192,
+		Mtime:   time.Now().UTC(),
+		Session: "fortytwo",
+	}
+
+	db, err := bolt.Open(path, 0600, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) (err error) {
+		_, err = tx.CreateBucketIfNotExists(sessname)
+		return
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) (err error) {
+		err = s.Put(tx, s.Ino)
+		return
+	})
+	if nil != err {
+		t.Error(err)
+	}
+
+	s2 := session_t{}
+	err = db.View(func(tx *bolt.Tx) (err error) {
+		err = s2.Get(tx, s.Ino)
+		return
+	})
+	if nil != err {
+		t.Error(err)
+	}
+
+	if s.Ino != s2.Ino || s.Offset != s2.Offset || s.Size != s2.Size ||
+		!s.Mtime.Equal(s2.Mtime) || s.Session != s2.Session {
+		t.Error()
+	}
+
+	err = db.Update(func(tx *bolt.Tx) (err error) {
+		err = (*session_t)(nil).Put(tx, s.Ino)
+		return
+	})
+	if nil != err {
+		t.Error(err)
+	}
+
+	s2 = session_t{}
+	err = db.View(func(tx *bolt.Tx) (err error) {
+		err = s2.Get(tx, s.Ino)
+		return
+	})
+	if errno.ENOENT != err {
+		t.Error(err)
+	}
+}
+
+// resumableStorage makes upload sessions that are never resumed and records
+// the sessions that are aborted.
+type resumableStorage struct {
+	*objiotest.MemObjectStorage
+	mux     sync.Mutex
+	count   int
+	aborted []string
+}
+
+type resumableWriter struct {
+	objio.WriteWaiter
+	session string
+}
+
+func (self *resumableStorage) OpenResumableWrite(
+	name string, size int64, session string) (writer objio.ResumableWriteWaiter, err error) {
+
+	if "" != session {
+		err = errors.New(": unknown session "+session, nil, errno.ENOENT)
+		return
+	}
+
+	w, err := self.OpenWrite(name, size)
+	if nil != err {
+		return
+	}
+
+	self.mux.Lock()
+	self.count++
+	session = fmt.Sprintf("%s#%d", name, self.count)
+	self.mux.Unlock()
+
+	writer = &resumableWriter{w, session}
+	return
+}
+
+func (self *resumableStorage) AbortResumableWrite(name string, session string) error {
+	self.mux.Lock()
+	self.aborted = append(self.aborted, session)
+	self.mux.Unlock()
+	return nil
+}
+
+func (self *resumableWriter) Session() string {
+	return self.session
+}
+
+func (self *resumableWriter) Offset() int64 {
+	return 0
+}
+
+func TestSessionAbort(t *testing.T) {
+	storage := &resumableStorage{MemObjectStorage: objiotest.NewMemObjectStorage(false)}
+	cache, _ := newTestCache(t, storage, nil, nil, Open)
+	defer cache.CloseCache()
+
+	ino, err := cache.Open("/file")
+	if nil == err {
+		err = cache.Make(ino, false)
+	}
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	// start an upload and interrupt it
+	open := func(data string) {
+		_, err := cache.WriteAt(ino, []byte(data), 0)
+		if nil != err {
+			t.Fatal(err)
+		}
+		stat, err := os.Stat(cache.filePath(ino))
+		if nil != err {
+			t.Fatal(err)
+		}
+		writer, _, err := cache.openResumableWrite(storage, ino, "/file", stat)
+		if nil != err {
+			t.Fatal(err)
+		}
+		writer.Close()
+	}
+
+	open("hello")
+	if 0 != len(storage.aborted) {
+		t.Error("aborted", storage.aborted)
+	}
+
+	// the file has changed; the previous session is aborted
+	open("hello, world")
+	if "/file#1" != strings.Join(storage.aborted, ",") {
+		t.Error("aborted after change", storage.aborted)
+	}
+
+	// the session is too old to be resumed; it is aborted
+	err = cache.database.Update(func(tx *bolt.Tx) (err error) {
+		session := session_t{}
+		err = session.Get(tx, ino)
+		if nil == err {
+			session.Time = time.Now().Add(-sessionMaxAge - time.Hour)
+			err = session.Put(tx, ino)
+		}
+		return
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	open("hello, world")
+	if "/file#1,/file#2" != strings.Join(storage.aborted, ",") {
+		t.Error("aborted after expiry", storage.aborted)
+	}
+
+	cache.Close(ino)
+}
@@ -0,0 +1,64 @@
+/*
+ * space.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"sync"
+)
+
+// space_t tracks the disk space used by the cache files and the disk space
+// still free. It is measured periodically and adjusted in between as files
+// are downloaded, written and evicted.
+type space_t struct {
+	mux   sync.Mutex
+	usage int64
+	free  int64
+}
+
+// Set sets the measured usage and free space.
+func (space *space_t) Set(usage int64, free int64) {
+	space.mux.Lock()
+	space.usage = usage
+	space.free = free
+	space.mux.Unlock()
+}
+
+// Add adjusts the usage by n bytes; the free space is adjusted by -n bytes.
+// Adjustments are approximate (e.g. they do not account for file system
+// blocks), so the usage is never let fall below zero.
+func (space *space_t) Add(n int64) {
+	space.mux.Lock()
+	if 0 > space.usage+n {
+		n = -space.usage
+	}
+	space.usage += n
+	space.free -= n
+	space.mux.Unlock()
+}
+
+// IsOverLimit determines if adding n bytes would make the usage exceed
+// maxsize or the free space fall below minfree. A zero maxsize or minfree
+// means no limit.
+func (space *space_t) IsOverLimit(n int64, maxsize int64, minfree int64) bool {
+	space.mux.Lock()
+	over := (0 < maxsize && space.usage+n > maxsize) ||
+		(0 < minfree && space.free-n < minfree)
+	space.mux.Unlock()
+
+	return over
+}
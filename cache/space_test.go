@@ -0,0 +1,103 @@
+/*
+ * space_test.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"os"
+	"testing"
+
+	"github.com/billziss-gh/golib/errors"
+	"github.com/billziss-gh/objfs/errno"
+	"github.com/billziss-gh/objfs/objio/objiotest"
+)
+
+func TestSpaceIsOverLimit(t *testing.T) {
+	space := space_t{}
+	space.Set(1000, 5000)
+
+	if space.IsOverLimit(0, 0, 0) || space.IsOverLimit(1000000, 0, 0) {
+		t.Error()
+	}
+
+	if space.IsOverLimit(0, 1000, 0) || !space.IsOverLimit(1, 1000, 0) {
+		t.Error()
+	}
+
+	if space.IsOverLimit(1000, 0, 4000) || !space.IsOverLimit(1001, 0, 4000) {
+		t.Error()
+	}
+
+	space.Add(-500)
+	if space.IsOverLimit(500, 1000, 0) || space.IsOverLimit(1500, 0, 4000) {
+		t.Error()
+	}
+}
+
+func TestMaxCacheSize(t *testing.T) {
+	const size = 64 * 1024
+
+	data := string(make([]byte, size))
+	config := &Config{BlockSize: -1, MaxCacheSize: 150 * 1024}
+	cache, _ := newTestCache(t, objiotest.NewMemObjectStorage(false), map[string]string{
+		"/file1": data,
+		"/file2": data,
+		"/file3": data,
+	}, config, Open)
+	defer cache.CloseCache()
+
+	inos := []uint64{}
+	for _, name := range []string{"/file1", "/file2", "/file3"} {
+		ino, err := cache.Open(name)
+		if nil != err {
+			t.Fatal(err)
+		}
+		_, err = cache.Stat(ino)
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, 1)
+		_, err = cache.ReadAt(ino, buf, size-1)
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		cache.Close(ino)
+		inos = append(inos, ino)
+	}
+
+	// file1 was least recently used and has been evicted
+	for i, ino := range inos {
+		_, err := os.Stat(cache.filePath(ino))
+		if (0 == i) != os.IsNotExist(err) {
+			t.Error("file", i+1, err)
+		}
+	}
+
+	// modified data alone exceeds the limit
+	ino, err := cache.Open("/file3")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer cache.Close(ino)
+
+	_, err = cache.WriteAt(ino, make([]byte, 200*1024), 0)
+	if !errors.HasAttachment(err, errno.ENOSPC) {
+		t.Error("WriteAt over limit", err)
+	}
+}
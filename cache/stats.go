@@ -0,0 +1,101 @@
+/*
+ * stats.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"os"
+	"sync"
+)
+
+// Stats are counters of the activity of a cache since it was opened (or
+// its counters were reset) and measurements of its current state.
+type Stats struct {
+	DirHits         uint64 // directories listed from the catalog
+	DirMisses       uint64 // directories listed from storage
+	NegHits         uint64 // paths known not to exist without asking storage
+	NegMisses       uint64 // paths looked up on storage
+	ContentHits     uint64 // files opened from cached content
+	Downloads       uint64 // files downloaded in full
+	RangedReads     uint64 // runs of blocks read into sparse files
+	BytesDownloaded uint64
+	Uploads         uint64
+	BytesUploaded   uint64
+	UploadFailures  uint64
+	Evictions       uint64
+
+	DirtyFiles int64 // modified files waiting to be uploaded
+	DirtyBytes int64
+	DiskUsage  int64 // disk space used by the cached files
+	DiskFree   int64 // disk space free on the disk that holds the cache
+}
+
+// stats_t holds the counters of a cache. The presence caches count their
+// own hits and misses.
+type stats_t struct {
+	mux sync.Mutex
+	Stats
+}
+
+// Count adds n to a counter of stats.
+func (stats *stats_t) Count(counter *uint64, n uint64) {
+	stats.mux.Lock()
+	*counter += n
+	stats.mux.Unlock()
+}
+
+// Stats gets the counters and current state of the cache.
+func (self *Cache) Stats() (stats Stats) {
+	self.stats.mux.Lock()
+	stats = self.stats.Stats
+	self.stats.mux.Unlock()
+
+	stats.DirHits, stats.DirMisses = self.dirpres.counts()
+	stats.NegHits, stats.NegMisses = self.negpres.counts()
+
+	self.lrumux.Lock()
+	inos := make([]uint64, 0, len(self.rwmap))
+	for ino := range self.rwmap {
+		inos = append(inos, ino)
+	}
+	self.lrumux.Unlock()
+
+	for _, ino := range inos {
+		if fileinfo, err := os.Stat(self.filePath(ino)); nil == err {
+			stats.DirtyFiles++
+			stats.DirtyBytes += fileinfo.Size()
+		}
+	}
+
+	// the space is adjusted approximately in between measurements
+	self.space.mux.Lock()
+	stats.DiskUsage = self.space.usage
+	stats.DiskFree = self.space.free
+	self.space.mux.Unlock()
+
+	return
+}
+
+// ResetStats resets the counters of the cache.
+func (self *Cache) ResetStats() {
+	self.stats.mux.Lock()
+	self.stats.Stats = Stats{}
+	self.stats.mux.Unlock()
+
+	self.dirpres.resetCounts()
+	self.negpres.resetCounts()
+}
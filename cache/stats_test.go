@@ -0,0 +1,113 @@
+/*
+ * stats_test.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"testing"
+
+	"github.com/billziss-gh/objfs/objio/objiotest"
+)
+
+func TestStats(t *testing.T) {
+	cache, _ := newTestCache(t, objiotest.NewMemObjectStorage(false), nil, nil, Open)
+	defer cache.CloseCache()
+
+	ino, err := cache.Open("/file")
+	if nil != err {
+		t.Fatal(err)
+	}
+	err = cache.Make(ino, false)
+	if nil == err {
+		_, err = cache.WriteAt(ino, []byte("hello"), 0)
+	}
+	cache.Close(ino)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	stats := cache.Stats()
+	if 1 != stats.DirtyFiles || 5 != stats.DirtyBytes || 5 > stats.DiskUsage {
+		t.Error("Stats dirty", stats)
+	}
+
+	read := func() {
+		ino, err := cache.Open("/file")
+		if nil != err {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 5)
+		_, err = cache.ReadAt(ino, buf, 0)
+		cache.Close(ino)
+		if nil != err || "hello" != string(buf) {
+			t.Fatal("ReadAt", err)
+		}
+	}
+
+	err = cache.uploadAll(true, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	read()
+	err = cache.evictAll(true, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	read()
+
+	for i := 0; 2 > i; i++ {
+		ino, err := cache.Open("/")
+		if nil == err {
+			_, err = cache.Readdir(ino, 0)
+			cache.Close(ino)
+		}
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		ino, err = cache.Open("/missing")
+		if nil == err {
+			_, err = cache.Stat(ino)
+			cache.Close(ino)
+		}
+		if nil == err {
+			t.Fatal("Stat /missing")
+		}
+	}
+
+	stats = cache.Stats()
+	if 1 != stats.Uploads || 5 != stats.BytesUploaded || 0 != stats.UploadFailures {
+		t.Error("Stats uploads", stats)
+	}
+	// the empty file made on storage is downloaded when it is first written
+	if 1 != stats.ContentHits || 2 != stats.Downloads || 5 != stats.BytesDownloaded {
+		t.Error("Stats downloads", stats)
+	}
+	if 1 != stats.Evictions || 0 != stats.DirtyFiles || 0 != stats.DirtyBytes ||
+		0 > stats.DiskUsage {
+		t.Error("Stats evictions", stats)
+	}
+	if 1 != stats.DirHits || 1 > stats.DirMisses || 1 > stats.NegHits || 1 > stats.NegMisses {
+		t.Error("Stats presence", stats)
+	}
+
+	cache.ResetStats()
+	stats = cache.Stats()
+	if 0 != stats.Uploads || 0 != stats.DirHits || 0 != stats.NegMisses {
+		t.Error("ResetStats", stats)
+	}
+}
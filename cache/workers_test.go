@@ -0,0 +1,117 @@
+/*
+ * workers_test.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package cache
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/billziss-gh/objfs/objio"
+	"github.com/billziss-gh/objfs/objio/objiotest"
+)
+
+// slowStorage makes writes slow and counts the writes in progress.
+type slowStorage struct {
+	*objiotest.MemObjectStorage
+	active int32
+	max    int32
+}
+
+type slowWriter struct {
+	objio.WriteWaiter
+	storage *slowStorage
+}
+
+func (self *slowStorage) OpenWrite(name string, size int64) (objio.WriteWaiter, error) {
+	writer, err := self.MemObjectStorage.OpenWrite(name, size)
+	if nil != err {
+		return nil, err
+	}
+
+	active := atomic.AddInt32(&self.active, 1)
+	for {
+		max := atomic.LoadInt32(&self.max)
+		if active <= max || atomic.CompareAndSwapInt32(&self.max, max, active) {
+			break
+		}
+	}
+
+	return &slowWriter{writer, self}, nil
+}
+
+func (self *slowWriter) Wait() (objio.ObjectInfo, error) {
+	time.Sleep(20 * time.Millisecond)
+	atomic.AddInt32(&self.storage.active, -1)
+	return self.WriteWaiter.Wait()
+}
+
+func TestUploadWorkers(t *testing.T) {
+	storage := &slowStorage{MemObjectStorage: objiotest.NewMemObjectStorage(false)}
+
+	cache, _ := newTestCache(t, storage, nil, &Config{UploadWorkers: 3}, Open)
+	defer cache.CloseCache()
+
+	var names []string
+	for i := 0; 9 > i; i++ {
+		name := fmt.Sprintf("/file%d", i)
+		names = append(names, "+"+name)
+
+		ino, err := cache.Open(name)
+		if nil != err {
+			t.Fatal(err)
+		}
+		err = cache.Make(ino, false)
+		if nil == err {
+			_, err = cache.WriteAt(ino, []byte(name), 0)
+		}
+		cache.Close(ino)
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	atomic.StoreInt32(&storage.max, 0)
+
+	var progress []string
+	err := cache.uploadAll(true, func(path string) {
+		progress = append(progress, path)
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	sort.Strings(progress)
+	if fmt.Sprint(names) != fmt.Sprint(progress) {
+		t.Error("uploadAll progress", progress)
+	}
+
+	max := atomic.LoadInt32(&storage.max)
+	if 1 >= max || 3 < max {
+		t.Error("uploadAll concurrency", max)
+	}
+
+	for i := 0; 9 > i; i++ {
+		name := fmt.Sprintf("/file%d", i)
+		if name != readObject(t, storage, name) {
+			t.Error("uploadAll content", name)
+		}
+	}
+}
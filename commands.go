@@ -40,6 +40,7 @@ import (
 	"github.com/billziss-gh/golib/util"
 	"github.com/billziss-gh/objfs/auth"
 	"github.com/billziss-gh/objfs/cache"
+	"github.com/billziss-gh/objfs/errno"
 	"github.com/billziss-gh/objfs/fs"
 	"github.com/billziss-gh/objfs/objio"
 )
@@ -78,18 +79,29 @@ func initCommands(cmdmap *cmd.CmdMap) {
 		Keyring)
 	addcmd(cmdmap, "auth output-credentials\nperform authentication/authorization",
 		Auth)
-	c = addcmd(cmdmap, "mount [-o option...] mountpoint\nmount file system",
+	c = addcmd(cmdmap, "mount [-o option...][-c name=value...] mountpoint\nmount file system",
 		Mount)
 	c.Flag.Var(new(mntopts), "o", "FUSE mount `option`")
+	c.Flag.Var(new(mntopts), "c", "cache `setting` (name=value)")
 	addcmd(cmdmap, "statfs\nget storage information",
 		Statfs)
-	c = addcmd(cmdmap, "ls [-l][-n count] path...\nlist files",
+	c = addcmd(cmdmap, "ls [-l][-n count][-R] path...\nlist files",
 		Ls)
 	c.Flag.Bool("l", false, "long format")
 	c.Flag.Int("n", 0, "max `count` of list entries")
+	c.Flag.Bool("R", false, "list subdirectories recursively")
 	c = addcmd(cmdmap, "stat [-l] path...\ndisplay file information",
 		Stat)
 	c.Flag.Bool("l", false, "long format")
+	c = addcmd(cmdmap, "du [-a][-s] path...\ndisplay disk usage",
+		Du)
+	c.Flag.Bool("a", false, "display an entry for each file")
+	c.Flag.Bool("s", false, "display only a total for each path")
+	c = addcmd(cmdmap, "find [-l][-n pattern][-t type] path...\nfind files",
+		Find)
+	c.Flag.Bool("l", false, "long format")
+	c.Flag.String("n", "", "only find files whose name matches `pattern`")
+	c.Flag.String("t", "", "only find files of `type` (f: file, d: directory, l: symlink)")
 	addcmd(cmdmap, "mkdir path...\nmake directories",
 		Mkdir)
 	addcmd(cmdmap, "rmdir path...\nremove directories",
@@ -98,16 +110,53 @@ func initCommands(cmdmap *cmd.CmdMap) {
 		Rm)
 	addcmd(cmdmap, "mv oldpath newpath\nmove (rename) files",
 		Mv)
-	c = addcmd(cmdmap, "get [-r range][-s signature] path [local-path]\nget (download) files",
+	c = addcmd(cmdmap,
+		"get [-p count][-P size][-r range][-s signature] path [local-path]\nget (download) files",
 		Get)
+	c.Flag.Int("p", objio.DefaultParallelism, "max `count` of parts transferred concurrently")
+	c.Flag.Int64("P", objio.DefaultPartSize, "part `size` for multi-part transfers")
 	c.Flag.String("r", "", "`range` to request (startpos-endpos)")
 	c.Flag.String("s", "", "only get file if it does not match `signature`")
-	addcmd(cmdmap, "put [local-path] path\nput (upload) files",
+	c = addcmd(cmdmap, "put [-p count][-P size] [local-path] path\nput (upload) files",
 		Put)
-	addcmd(cmdmap, "cache-pending\nlist pending cache files",
+	c.Flag.Int("p", objio.DefaultParallelism, "max `count` of parts transferred concurrently")
+	c.Flag.Int64("P", objio.DefaultPartSize, "part `size` for multi-part transfers")
+	c = addcmd(cmdmap, "watch [-l][-p period]\nwatch for storage changes",
+		Watch)
+	c.Flag.Bool("l", false, "long format")
+	c.Flag.Duration("p", 10*time.Second, "polling `period`")
+	c = addcmd(cmdmap, "trash-ls [-l]\nlist deleted files",
+		TrashLs)
+	c.Flag.Bool("l", false, "long format")
+	addcmd(cmdmap, "trash-restore id...\nrestore deleted files",
+		TrashRestore)
+	c = addcmd(cmdmap, "trash-purge [-a] [id...]\npermanently remove deleted files",
+		TrashPurge)
+	c.Flag.Bool("a", false, "purge all deleted files")
+	c = addcmd(cmdmap, "cache-pending [-verify]\nlist pending cache files",
 		CachePending)
+	c.Flag.Bool("verify", false, "hash cached files to find modified files")
 	addcmd(cmdmap, "cache-reset\nreset cache (upload and evict files)",
 		CacheReset)
+	c = addcmd(cmdmap, "cache-prefetch [-content][-depth N] path...\nprefetch directory trees into the cache",
+		CachePrefetch)
+	c.Flag.Bool("content", false, "also download file contents")
+	c.Flag.Int("depth", -1, "list at most `N` directory levels below path (-1: no limit)")
+	addcmd(cmdmap, "cache-pin path...\npin files and directories (keep available offline)",
+		CachePin)
+	addcmd(cmdmap, "cache-unpin path...\nunpin files and directories",
+		CacheUnpin)
+	addcmd(cmdmap, "cache-pinned\nlist pinned files and directories",
+		CachePinned)
+	c = addcmd(cmdmap, "cache-conflicts [-c]\nlist upload conflicts",
+		CacheConflicts)
+	c.Flag.Bool("c", false, "clear the list of conflicts")
+	c = addcmd(cmdmap, "cache-fsck [-r]\ncheck cache consistency",
+		CacheFsck)
+	c.Flag.Bool("r", false, "repair problems")
+	c = addcmd(cmdmap, "cache-stats [-r]\ndisplay cache statistics",
+		CacheStats)
+	c.Flag.Bool("r", false, "reset the counters")
 }
 
 func Version(cmd *cmd.Cmd, args []string) {
@@ -327,6 +376,7 @@ func Mount(cmd *cmd.Cmd, args []string) {
 
 	cmd.Flag.Parse(args)
 	opts := cmd.GetFlag("o").(mntopts)
+	settings := cmd.GetFlag("c").(mntopts)
 	mountpoint := cmd.Flag.Arg(0)
 	if "" == mountpoint {
 		usage(cmd)
@@ -336,7 +386,7 @@ func Mount(cmd *cmd.Cmd, args []string) {
 		opts[i] = "-o" + opts[i]
 	}
 
-	c, err := openCache(cache.Activate)
+	c, err := openCache(cache.Activate, settings...)
 	if nil != err {
 		fail(errors.New("mount", err))
 	}
@@ -376,11 +426,32 @@ func Ls(cmd *cmd.Cmd, args []string) {
 	cmd.Flag.Parse(args)
 	long := cmd.GetFlag("l").(bool)
 	maxcount := cmd.GetFlag("n").(int)
+	recursive := cmd.GetFlag("R").(bool)
 	count := maxcount
 
 	failed := false
 
 	for _, path := range cmd.Flag.Args() {
+		if recursive {
+			n := 0
+			err := objio.Walk(storage, path, func(name string, info objio.ObjectInfo) error {
+				printObjectInfo(&namedObjectInfo{info, name}, long)
+				n++
+				if 0 < maxcount && maxcount <= n {
+					return errWalkDone
+				}
+				return nil
+			})
+			if errWalkDone == err {
+				err = nil
+			}
+			if nil != err {
+				failed = true
+				warn(errors.New("ls "+path, err))
+			}
+			continue
+		}
+
 		marker := ""
 		infos := ([]objio.ObjectInfo)(nil)
 		for {
@@ -437,6 +508,127 @@ func Stat(cmd *cmd.Cmd, args []string) {
 	}
 }
 
+func Du(cmd *cmd.Cmd, args []string) {
+	needvar(&storage)
+
+	cmd.Flag.Parse(args)
+	all := cmd.GetFlag("a").(bool)
+	summary := cmd.GetFlag("s").(bool)
+
+	failed := false
+
+	for _, root := range cmd.Flag.Args() {
+		sizes := map[string]int64{}
+		names := []string{}
+		total := int64(0)
+
+		err := objio.Walk(storage, root, func(name string, info objio.ObjectInfo) error {
+			if summary {
+				if !info.IsDir() {
+					total += info.Size()
+				}
+				return nil
+			}
+
+			if info.IsDir() {
+				names = append(names, name)
+				return nil
+			}
+
+			total += info.Size()
+
+			if all {
+				sizes[name] = info.Size()
+				names = append(names, name)
+			}
+			for dir := path.Dir(name); "." != dir; dir = path.Dir(dir) {
+				sizes[dir] += info.Size()
+			}
+
+			return nil
+		})
+		if nil != err {
+			failed = true
+			warn(errors.New("du "+root, err))
+			continue
+		}
+
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%d\t%s\n", sizes[name], path.Join(root, name))
+		}
+		fmt.Printf("%d\t%s\n", total, root)
+	}
+
+	if failed {
+		exit(1)
+	}
+}
+
+func Find(cmd *cmd.Cmd, args []string) {
+	needvar(&storage)
+
+	cmd.Flag.Parse(args)
+	long := cmd.GetFlag("l").(bool)
+	pattern := cmd.GetFlag("n").(string)
+	typ := cmd.GetFlag("t").(string)
+
+	switch typ {
+	case "", "f", "d", "l":
+	default:
+		usage(cmd)
+	}
+
+	if "" != pattern {
+		if _, err := path.Match(pattern, ""); nil != err {
+			fail(errors.New("find: invalid pattern "+pattern, err))
+		}
+	}
+
+	failed := false
+
+	for _, root := range cmd.Flag.Args() {
+		err := objio.Walk(storage, root, func(name string, info objio.ObjectInfo) error {
+			if "" != pattern {
+				if ok, _ := path.Match(pattern, path.Base(name)); !ok {
+					return nil
+				}
+			}
+
+			switch typ {
+			case "f":
+				if info.IsDir() || objio.IsSymlink(info) {
+					return nil
+				}
+			case "d":
+				if !info.IsDir() {
+					return nil
+				}
+			case "l":
+				if !objio.IsSymlink(info) {
+					return nil
+				}
+			}
+
+			if long {
+				printObjectInfo(&namedObjectInfo{info, path.Join(root, name)}, true)
+			} else {
+				fmt.Println(path.Join(root, name))
+			}
+
+			return nil
+		})
+		if nil != err {
+			failed = true
+			warn(errors.New("find "+root, err))
+		}
+	}
+
+	if failed {
+		exit(1)
+	}
+}
+
 func Mkdir(cmd *cmd.Cmd, args []string) {
 	needvar(&storage)
 
@@ -524,6 +716,8 @@ func Get(cmd *cmd.Cmd, args []string) {
 	needvar(&storage)
 
 	cmd.Flag.Parse(args)
+	parallelism := cmd.GetFlag("p").(int)
+	partsize := cmd.GetFlag("P").(int64)
 	rng := cmd.GetFlag("r").(string)
 	sig := cmd.GetFlag("s").(string)
 
@@ -577,7 +771,15 @@ func Get(cmd *cmd.Cmd, args []string) {
 		}
 	}
 
-	_, err = io.Copy(writer, reader)
+	if readat, ok := reader.(io.ReaderAt); ok &&
+		"" == rng && 1 < parallelism && partsize < info.Size() {
+		err = writer.Truncate(info.Size())
+		if nil == err {
+			err = objio.ReadParallel(writer, readat, info.Size(), partsize, parallelism)
+		}
+	} else {
+		_, err = io.Copy(writer, reader)
+	}
 	if nil != err {
 		fail(errors.New("get "+ipath, err))
 	}
@@ -589,6 +791,8 @@ func Put(cmd *cmd.Cmd, args []string) {
 	needvar(&storage)
 
 	cmd.Flag.Parse(args)
+	parallelism := cmd.GetFlag("p").(int)
+	partsize := cmd.GetFlag("P").(int64)
 
 	if 1 > cmd.Flag.NArg() || 2 < cmd.Flag.NArg() {
 		usage(cmd)
@@ -612,6 +816,31 @@ func Put(cmd *cmd.Cmd, args []string) {
 		fail(errors.New("put "+opath, err))
 	}
 
+	if s, ok := storage.(objio.ObjectStorageMultipart); ok &&
+		1 < parallelism && partsize < stat.Size() {
+		var pwriter objio.PartWriteWaiter
+		pwriter, err = s.OpenWriteParts(opath, stat.Size(), partsize)
+		if nil == err {
+			defer pwriter.Close()
+
+			err = objio.WriteParallel(pwriter, reader, stat.Size(), partsize, parallelism)
+			if nil != err {
+				fail(errors.New("put "+opath, err))
+			}
+
+			info, err := pwriter.Wait()
+			if nil != err {
+				fail(errors.New("put "+opath, err))
+			}
+
+			printObjectInfo(info, false)
+			return
+		}
+		if !errors.HasAttachment(err, errno.ENOSYS) {
+			fail(errors.New("put "+opath, err))
+		}
+	}
+
 	writer, err := storage.OpenWrite(opath, stat.Size())
 	if nil != err {
 		fail(errors.New("put "+opath, err))
@@ -631,10 +860,173 @@ func Put(cmd *cmd.Cmd, args []string) {
 	printObjectInfo(info, false)
 }
 
+func Watch(cmd *cmd.Cmd, args []string) {
+	needvar(&storage)
+
+	cmd.Flag.Parse(args)
+	long := cmd.GetFlag("l").(bool)
+	period := cmd.GetFlag("p").(time.Duration)
+
+	if 0 != cmd.Flag.NArg() {
+		usage(cmd)
+	}
+
+	feed, ok := storage.(objio.ObjectStorageChanges)
+	if !ok {
+		fail(errors.New("watch; storage does not implement changes"))
+	}
+
+	cursor, _, err := feed.Changes("")
+	if nil != err {
+		fail(errors.New("watch", err))
+	}
+
+	for {
+		var changes []objio.ObjectChange
+		cursor, changes, err = feed.Changes(cursor)
+		if nil != err {
+			fail(errors.New("watch", err))
+		}
+
+		for _, change := range changes {
+			info := change.Info()
+			if change.IsRemoved() || nil == info {
+				fmt.Printf("-%s\n", change.Path())
+			} else if long {
+				fmt.Printf("+%s\n\t", change.Path())
+				printObjectInfo(info, true)
+			} else {
+				fmt.Printf("+%s\n", change.Path())
+			}
+		}
+
+		if 0 == len(changes) {
+			time.Sleep(period)
+		}
+	}
+}
+
+func TrashLs(cmd *cmd.Cmd, args []string) {
+	needvar(&storage)
+
+	cmd.Flag.Parse(args)
+	long := cmd.GetFlag("l").(bool)
+
+	if 0 != cmd.Flag.NArg() {
+		usage(cmd)
+	}
+
+	err := listTrash(func(info objio.TrashInfo) {
+		printTrashInfo(info, long)
+	})
+	if nil != err {
+		fail(errors.New("trash-ls", err))
+	}
+}
+
+func TrashRestore(cmd *cmd.Cmd, args []string) {
+	needvar(&storage)
+
+	cmd.Flag.Parse(args)
+
+	if 0 == cmd.Flag.NArg() {
+		usage(cmd)
+	}
+
+	trash, ok := storage.(objio.ObjectStorageTrash)
+	if !ok {
+		fail(errors.New("trash-restore; storage does not implement trash"))
+	}
+
+	failed := false
+
+	for _, id := range cmd.Flag.Args() {
+		err := trash.Restore(id)
+		if nil != err {
+			failed = true
+			warn(errors.New("trash-restore "+id, err))
+			continue
+		}
+	}
+
+	if failed {
+		exit(1)
+	}
+}
+
+func TrashPurge(cmd *cmd.Cmd, args []string) {
+	needvar(&storage)
+
+	cmd.Flag.Parse(args)
+	all := cmd.GetFlag("a").(bool)
+
+	if all == (0 != cmd.Flag.NArg()) {
+		usage(cmd)
+	}
+
+	trash, ok := storage.(objio.ObjectStorageTrash)
+	if !ok {
+		fail(errors.New("trash-purge; storage does not implement trash"))
+	}
+
+	ids := cmd.Flag.Args()
+	if all {
+		err := listTrash(func(info objio.TrashInfo) {
+			ids = append(ids, info.Id())
+		})
+		if nil != err {
+			fail(errors.New("trash-purge", err))
+		}
+	}
+
+	failed := false
+
+	for _, id := range ids {
+		err := trash.Purge(id)
+		if nil != err {
+			failed = true
+			warn(errors.New("trash-purge "+id, err))
+			continue
+		}
+	}
+
+	if failed {
+		exit(1)
+	}
+}
+
+func listTrash(fn func(info objio.TrashInfo)) (err error) {
+	trash, ok := storage.(objio.ObjectStorageTrash)
+	if !ok {
+		err = errors.New("; storage does not implement trash")
+		return
+	}
+
+	marker := ""
+	infos := ([]objio.TrashInfo)(nil)
+	for {
+		marker, infos, err = trash.ListTrash(marker, 0)
+		if nil != err {
+			return
+		}
+
+		for _, info := range infos {
+			fn(info)
+		}
+
+		if "" == marker {
+			break
+		}
+	}
+
+	return
+}
+
 func CachePending(cmd *cmd.Cmd, args []string) {
 	needvar(&storage, &cachePath)
 
 	cmd.Flag.Parse(args)
+	verify := cmd.GetFlag("verify").(bool)
 
 	if 0 != cmd.Flag.NArg() {
 		usage(cmd)
@@ -642,7 +1034,12 @@ func CachePending(cmd *cmd.Cmd, args []string) {
 
 	fmt.Printf("%s:\n", cachePath)
 
-	c, err := openCache(cache.OpenIfExists)
+	var settings []string
+	if verify {
+		settings = append(settings, "verify=true")
+	}
+
+	c, err := openCache(cache.OpenIfExists, settings...)
 	if nil != err {
 		fail(errors.New("cache-pending", err))
 	}
@@ -651,6 +1048,15 @@ func CachePending(cmd *cmd.Cmd, args []string) {
 	for _, p := range c.ListCache() {
 		fmt.Printf("\t%s\n", p)
 	}
+	for _, op := range c.ListJournal() {
+		fmt.Printf("\t>%s\n", op)
+	}
+
+	fmt.Printf("settings:\n")
+	config := c.Config()
+	for _, s := range config.Settings() {
+		fmt.Printf("\t%s\n", s)
+	}
 }
 
 func CacheReset(cmd *cmd.Cmd, args []string) {
@@ -678,6 +1084,290 @@ func CacheReset(cmd *cmd.Cmd, args []string) {
 	}
 }
 
+func CachePrefetch(cmd *cmd.Cmd, args []string) {
+	needvar(&storage, &cachePath)
+
+	cmd.Flag.Parse(args)
+	content := cmd.GetFlag("content").(bool)
+	depth := cmd.GetFlag("depth").(int)
+
+	if 0 == cmd.Flag.NArg() {
+		usage(cmd)
+	}
+
+	fmt.Printf("%s:\n", cachePath)
+
+	progress := func(path string) {
+		fmt.Printf("\t%s\n", path)
+	}
+
+	// If the cache is active (e.g. in a running mount) ask it to prefetch;
+	// otherwise open the cache ourselves.
+	var c *cache.Cache
+	failed := false
+	for _, path := range cmd.Flag.Args() {
+		var err error
+		if nil == c {
+			var reply []string
+			err = cache.CallControl(cachePath, "Control.Prefetch",
+				cache.PrefetchArgs{Path: path, Depth: depth, Content: content}, &reply)
+			for _, p := range reply {
+				progress(p)
+			}
+			if cache.ErrNoControl == err {
+				c, err = openCache(cache.Open)
+				if nil != err {
+					fail(errors.New("cache-prefetch", err))
+				}
+				defer c.CloseCache()
+			}
+		}
+		if nil != c {
+			err = c.Prefetch(path, depth, content, progress)
+		}
+
+		if nil != err {
+			failed = true
+			warn(errors.New("cache-prefetch "+path, err))
+		}
+	}
+
+	if failed {
+		exit(1)
+	}
+}
+
+func CachePin(cmd *cmd.Cmd, args []string) {
+	needvar(&storage, &cachePath)
+
+	cmd.Flag.Parse(args)
+
+	if 0 == cmd.Flag.NArg() {
+		usage(cmd)
+	}
+
+	fmt.Printf("%s:\n", cachePath)
+
+	c, err := openCache(cache.Open)
+	if nil != err {
+		fail(errors.New("cache-pin", err))
+	}
+	defer c.CloseCache()
+
+	failed := false
+	for _, path := range cmd.Flag.Args() {
+		err = c.Pin(path, func(path string) {
+			fmt.Printf("\t%s\n", path)
+		})
+		if nil != err {
+			failed = true
+			warn(errors.New("cache-pin "+path, err))
+		}
+	}
+
+	if failed {
+		exit(1)
+	}
+}
+
+func CacheUnpin(cmd *cmd.Cmd, args []string) {
+	needvar(&storage, &cachePath)
+
+	cmd.Flag.Parse(args)
+
+	if 0 == cmd.Flag.NArg() {
+		usage(cmd)
+	}
+
+	c, err := openCache(cache.OpenIfExists)
+	if nil != err {
+		fail(errors.New("cache-unpin", err))
+	}
+	defer c.CloseCache()
+
+	failed := false
+	for _, path := range cmd.Flag.Args() {
+		err = c.Unpin(path)
+		if nil != err {
+			failed = true
+			warn(errors.New("cache-unpin "+path, err))
+		}
+	}
+
+	if failed {
+		exit(1)
+	}
+}
+
+func CachePinned(cmd *cmd.Cmd, args []string) {
+	needvar(&storage, &cachePath)
+
+	cmd.Flag.Parse(args)
+
+	if 0 != cmd.Flag.NArg() {
+		usage(cmd)
+	}
+
+	fmt.Printf("%s:\n", cachePath)
+
+	c, err := openCache(cache.OpenIfExists)
+	if nil != err {
+		fail(errors.New("cache-pinned", err))
+	}
+	defer c.CloseCache()
+
+	for _, p := range c.ListPins() {
+		fmt.Printf("\t%s\n", p)
+	}
+}
+
+func CacheConflicts(cmd *cmd.Cmd, args []string) {
+	needvar(&storage, &cachePath)
+
+	cmd.Flag.Parse(args)
+	clear := cmd.GetFlag("c").(bool)
+
+	if 0 != cmd.Flag.NArg() {
+		usage(cmd)
+	}
+
+	fmt.Printf("%s:\n", cachePath)
+
+	// If the cache is active (e.g. in a running mount) ask it for the conflicts;
+	// otherwise open the cache ourselves.
+	var conflicts []cache.Conflict
+	err := cache.CallControl(cachePath, "Control.Conflicts", clear, &conflicts)
+	if cache.ErrNoControl == err {
+		var c *cache.Cache
+		c, err = openCache(cache.OpenIfExists)
+		if nil != err {
+			fail(errors.New("cache-conflicts", err))
+		}
+		defer c.CloseCache()
+
+		conflicts = c.ListConflicts()
+		if clear {
+			err = c.ClearConflicts()
+		}
+	}
+
+	for _, conflict := range conflicts {
+		fmt.Printf("\t%s %-11s %s",
+			conflict.Time.Local().Format("2006-01-02 15:04:05"), conflict.Policy, conflict.Path)
+		if "" != conflict.Copy {
+			fmt.Printf(" -> %s", conflict.Copy)
+		}
+		fmt.Println()
+	}
+
+	if nil != err {
+		fail(errors.New("cache-conflicts", err))
+	}
+}
+
+func CacheFsck(cmd *cmd.Cmd, args []string) {
+	needvar(&storage, &cachePath)
+
+	cmd.Flag.Parse(args)
+	repair := cmd.GetFlag("r").(bool)
+
+	if 0 != cmd.Flag.NArg() {
+		usage(cmd)
+	}
+
+	fmt.Printf("%s:\n", cachePath)
+
+	c, err := openCache(cache.Inspect)
+	if nil != err {
+		fail(errors.New("cache-fsck", err))
+	}
+	defer c.CloseCache()
+
+	problems, modified, err := c.Check(repair)
+	if nil != err {
+		fail(errors.New("cache-fsck", err))
+	}
+
+	for _, p := range problems {
+		if p.Repaired {
+			fmt.Printf("\t%s (repaired)\n", p)
+		} else {
+			fmt.Printf("\t%s\n", p)
+		}
+	}
+	for _, p := range modified {
+		fmt.Printf("\t+%s\n", p)
+	}
+
+	if !repair && 0 != len(problems) {
+		exit(1)
+	}
+}
+
+func CacheStats(cmd *cmd.Cmd, args []string) {
+	needvar(&storage, &cachePath)
+
+	cmd.Flag.Parse(args)
+	reset := cmd.GetFlag("r").(bool)
+
+	if 0 != cmd.Flag.NArg() {
+		usage(cmd)
+	}
+
+	fmt.Printf("%s:\n", cachePath)
+
+	// If the cache is active (e.g. in a running mount) ask it for its stats;
+	// otherwise open the cache ourselves (and get the stats of an idle cache).
+	var stats cache.Stats
+	var settings []string
+	err := cache.CallControl(cachePath, "Control.Stats", reset, &stats)
+	if nil == err {
+		err = cache.CallControl(cachePath, "Control.Settings", false, &settings)
+	} else if cache.ErrNoControl == err {
+		var c *cache.Cache
+		c, err = openCache(cache.OpenIfExists)
+		if nil != err {
+			fail(errors.New("cache-stats", err))
+		}
+		defer c.CloseCache()
+
+		stats = c.Stats()
+		config := c.Config()
+		settings = config.Settings()
+	}
+	if nil != err {
+		fail(errors.New("cache-stats", err))
+	}
+
+	for _, s := range settings {
+		fmt.Printf("\t%s\n", s)
+	}
+
+	ratio := func(hits uint64, misses uint64) string {
+		if 0 == hits+misses {
+			return ""
+		}
+		return fmt.Sprintf(" (%.1f%% hits)", float64(hits)*100/float64(hits+misses))
+	}
+
+	fmt.Printf("\tdir hits/misses      %d/%d%s\n",
+		stats.DirHits, stats.DirMisses, ratio(stats.DirHits, stats.DirMisses))
+	fmt.Printf("\tneg hits/misses      %d/%d%s\n",
+		stats.NegHits, stats.NegMisses, ratio(stats.NegHits, stats.NegMisses))
+	fmt.Printf("\tcontent hits         %d\n", stats.ContentHits)
+	fmt.Printf("\tdownloads            %d\n", stats.Downloads)
+	fmt.Printf("\tranged reads         %d\n", stats.RangedReads)
+	fmt.Printf("\tbytes downloaded     %d\n", stats.BytesDownloaded)
+	fmt.Printf("\tuploads              %d\n", stats.Uploads)
+	fmt.Printf("\tbytes uploaded       %d\n", stats.BytesUploaded)
+	fmt.Printf("\tupload failures      %d\n", stats.UploadFailures)
+	fmt.Printf("\tevictions            %d\n", stats.Evictions)
+	fmt.Printf("\tdirty files          %d\n", stats.DirtyFiles)
+	fmt.Printf("\tdirty bytes          %d\n", stats.DirtyBytes)
+	fmt.Printf("\tdisk usage           %d\n", stats.DiskUsage)
+	fmt.Printf("\tdisk free            %d\n", stats.DiskFree)
+}
+
 var shellCommands = []func(cmdmap *cmd.CmdMap){
 	initCommands,
 }
@@ -729,17 +1419,22 @@ func Shell(c *cmd.Cmd, args []string) {
 }
 
 func printStorageInfo(info objio.StorageInfo) {
+	caps, maxsize := objio.GetCapabilities(info)
 	fmt.Printf(`IsCaseInsensitive = %v
 IsReadOnly = %v
 MaxComponentLength = %v
 TotalSize = %v
 FreeSize = %v
+Capabilities = %v
+MaxObjectSize = %v
 `,
 		info.IsCaseInsensitive(),
 		info.IsReadOnly(),
 		info.MaxComponentLength(),
 		info.TotalSize(),
-		info.FreeSize())
+		info.FreeSize(),
+		caps,
+		maxsize)
 }
 
 var dtype = map[bool]string{
@@ -748,9 +1443,14 @@ var dtype = map[bool]string{
 }
 
 func printObjectInfo(info objio.ObjectInfo, long bool) {
+	t := dtype[info.IsDir()]
+	if objio.IsSymlink(info) {
+		t = "l"
+	}
+
 	if long {
 		fmt.Printf("%s %10d %s %s %s %s\n",
-			dtype[info.IsDir()],
+			t,
 			info.Size(),
 			info.Mtime().Format(time.RFC3339),
 			info.Btime().Format(time.RFC3339),
@@ -758,13 +1458,87 @@ func printObjectInfo(info objio.ObjectInfo, long bool) {
 			info.Name())
 	} else {
 		fmt.Printf("%s %10d %s %s\n",
-			dtype[info.IsDir()],
+			t,
 			info.Size(),
 			info.Mtime().Format(time.RFC3339),
 			info.Name())
 	}
 }
 
-func openCache(flag int) (*cache.Cache, error) {
-	return cache.OpenCache(cachePath, storage, nil, flag)
+func printTrashInfo(info objio.TrashInfo, long bool) {
+	if long {
+		fmt.Printf("%s %10d %s %s %s %s\n",
+			dtype[info.IsDir()],
+			info.Size(),
+			info.Dtime().Format(time.RFC3339),
+			info.Mtime().Format(time.RFC3339),
+			info.Id(),
+			info.Path())
+	} else {
+		fmt.Printf("%s %10d %s %s %s\n",
+			dtype[info.IsDir()],
+			info.Size(),
+			info.Dtime().Format(time.RFC3339),
+			info.Id(),
+			info.Path())
+	}
+}
+
+// errWalkDone stops an objio.Walk that has reported enough objects.
+var errWalkDone = errors.New("walk done")
+
+// namedObjectInfo is an ObjectInfo with a different name (e.g. a path).
+type namedObjectInfo struct {
+	objio.ObjectInfo
+	name string
+}
+
+func (info *namedObjectInfo) Name() string {
+	return info.name
+}
+
+func (info *namedObjectInfo) IsSymlink() bool {
+	return objio.IsSymlink(info.ObjectInfo)
+}
+
+func openCache(flag int, settings ...string) (*cache.Cache, error) {
+	config, err := cacheConfig(settings)
+	if nil != err {
+		return nil, err
+	}
+
+	return cache.OpenCache(cachePath, storage, config, flag)
+}
+
+// cacheConfig gets the cache configuration from the configuration section
+// of the storage and from settings of the form name=value, which take
+// precedence.
+func cacheConfig(settings []string) (config *cache.Config, err error) {
+	config = &cache.Config{}
+
+	for k, v := range programConfig[storageName] {
+		if cache.IsConfigName(k) {
+			err = config.Set(k, fmt.Sprint(v))
+			if nil != err {
+				err = errors.New("config "+storageName+"."+k, err)
+				return
+			}
+		}
+	}
+
+	for _, s := range settings {
+		i := strings.IndexByte(s, '=')
+		if -1 == i {
+			err = errors.New("cache setting "+s, nil, errno.EINVAL)
+			return
+		}
+
+		err = config.Set(s[:i], s[i+1:])
+		if nil != err {
+			err = errors.New("cache setting "+s[:i], err)
+			return
+		}
+	}
+
+	return
 }
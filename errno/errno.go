@@ -108,6 +108,7 @@ const (
 	ETXTBSY
 	EWOULDBLOCK
 	EXDEV
+	ESTALE
 )
 
 // ErrnoFromErr converts a Go error to an Errno.
@@ -96,6 +96,7 @@ var errnomap = map[errno.Errno]int{
 	errno.EROFS:           -fuse.EROFS,
 	errno.ESPIPE:          -fuse.ESPIPE,
 	errno.ESRCH:           -fuse.ESRCH,
+	errno.ESTALE:          -fuse.EIO, // cgofuse has no ESTALE
 	errno.ETIME:           -fuse.ETIME,
 	errno.ETIMEDOUT:       -fuse.ETIMEDOUT,
 	errno.ETXTBSY:         -fuse.ETXTBSY,
@@ -81,6 +81,8 @@ func CopyFusestatFromObjectInfo(dst *fuse.Stat_t, src objio.ObjectInfo) {
 	dst.Mode = fuse.S_IFREG | 0600
 	if src.IsDir() {
 		dst.Mode = fuse.S_IFDIR | 0700
+	} else if objio.IsSymlink(src) {
+		dst.Mode = fuse.S_IFLNK | 0777
 	}
 	dst.Nlink = 1
 	dst.Uid = startUid
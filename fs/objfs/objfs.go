@@ -20,6 +20,7 @@ package objfs
 import (
 	"io"
 	"runtime"
+	"time"
 
 	"github.com/billziss-gh/cgofuse/fuse"
 	"github.com/billziss-gh/golib/errors"
@@ -28,6 +29,12 @@ import (
 	"github.com/billziss-gh/objfs/fs"
 )
 
+// special Nsec values of Utimens (see utimensat(2)); cgofuse does not define them
+const (
+	utimeNow  = (1 << 30) - 1
+	utimeOmit = (1 << 30) - 2
+)
+
 type objfs struct {
 	fuse.FileSystemBase
 	cache *cache.Cache
@@ -104,8 +111,60 @@ func (self *objfs) Rename(oldpath string, newpath string) (errc int) {
 	return 0
 }
 
+func (self *objfs) Symlink(target string, newpath string) (errc int) {
+	ino, err := self.cache.Open(newpath)
+	if nil != err {
+		return fs.FuseErrc(err)
+	}
+	defer self.cache.Close(ino)
+
+	err = self.cache.Symlink(ino, target)
+	if nil != err {
+		return fs.FuseErrc(err)
+	}
+
+	return 0
+}
+
+func (self *objfs) Readlink(path string) (errc int, target string) {
+	ino, err := self.cache.Open(path)
+	if nil != err {
+		return fs.FuseErrc(err), ""
+	}
+	defer self.cache.Close(ino)
+
+	target, err = self.cache.Readlink(ino)
+	if nil != err {
+		return fs.FuseErrc(err), ""
+	}
+
+	return 0, target
+}
+
 func (self *objfs) Utimens(path string, tmsp []fuse.Timespec) (errc int) {
-	return -fuse.ENOSYS
+	mtime := time.Now()
+	if 2 <= len(tmsp) {
+		switch tmsp[1].Nsec {
+		case utimeOmit:
+			return 0
+		case utimeNow:
+		default:
+			mtime = tmsp[1].Time()
+		}
+	}
+
+	ino, err := self.cache.Open(path)
+	if nil != err {
+		return fs.FuseErrc(err)
+	}
+	defer self.cache.Close(ino)
+
+	err = self.cache.Chtime(ino, mtime)
+	if nil != err {
+		return fs.FuseErrc(err)
+	}
+
+	return 0
 }
 
 func (self *objfs) Create(path string, flags int, mode uint32) (errc int, ino uint64) {
@@ -168,6 +227,10 @@ func (self *objfs) Truncate(path string, size int64, ino uint64) (errc int) {
 		defer self.cache.Close(ino)
 	}
 
+	if self.isTooBig(size) {
+		return -fuse.EFBIG
+	}
+
 	err := self.cache.Truncate(ino, size)
 	if nil != err {
 		return fs.FuseErrc(err)
@@ -186,6 +249,10 @@ func (self *objfs) Read(path string, buff []byte, ofst int64, ino uint64) (n int
 }
 
 func (self *objfs) Write(path string, buff []byte, ofst int64, ino uint64) (n int) {
+	if self.isTooBig(ofst + int64(len(buff))) {
+		return -fuse.EFBIG
+	}
+
 	n, err := self.cache.WriteAt(ino, buff, ofst)
 	if nil != err {
 		return fs.FuseErrc(err)
@@ -284,6 +351,12 @@ func (self *objfs) Listxattr(path string, fill func(name string) bool) int {
 	return -fuse.EPERM
 }
 
+// isTooBig determines if a file of the specified size can be stored.
+func (self *objfs) isTooBig(size int64) bool {
+	_, maxsize := self.cache.Capabilities()
+	return 0 < maxsize && maxsize < size
+}
+
 func (self *objfs) IsCaseInsensitive() (res bool) {
 	res = false
 	info, err := self.cache.Storage().Info(false)
@@ -87,6 +87,7 @@ var (
 	programConfig config.TypedConfig
 
 	acceptTlsCert  bool
+	emulateTrash   bool
 	authName       string
 	authSession    auth.Session
 	cachePath      string
@@ -121,6 +122,8 @@ func init() {
 		"storage `name` to access")
 	flag.String("storage-uri", "",
 		"storage `uri` to access")
+	flag.Bool("trash", false,
+		"keep deleted files in a trash if the storage does not have one")
 }
 
 func usage(cmd *cmd.Cmd) {
@@ -195,7 +198,8 @@ func needvar(args ...interface{}) {
 			"datadir",
 			"keyring",
 			"storage",
-			"storage-uri")
+			"storage-uri",
+			"trash")
 
 		c, err := util.ReadFunc(configPath, func(file *os.File) (interface{}, error) {
 			return config.ReadTyped(file)
@@ -219,7 +223,8 @@ func needvar(args ...interface{}) {
 				"credentials",
 				"datadir",
 				"keyring",
-				"storage-uri")
+				"storage-uri",
+				"trash")
 		} else {
 			programConfig = config.TypedConfig{}
 		}
@@ -231,6 +236,7 @@ func needvar(args ...interface{}) {
 		keyringKind = flagMap["keyring"].(string)
 		storageName = flagMap["storage"].(string)
 		storageUri = flagMap["storage-uri"].(string)
+		emulateTrash = flagMap["trash"].(bool)
 
 		if "" == dataDir {
 			dir, err := appdata.DataDir()
@@ -253,6 +259,7 @@ func needvar(args ...interface{}) {
 			fmt.Printf("keyringKind=%#v\n", keyringKind)
 			fmt.Printf("storageName=%#v\n", storageName)
 			fmt.Printf("storageUri=%#v\n", storageUri)
+			fmt.Printf("emulateTrash=%#v\n", emulateTrash)
 		}
 
 		if acceptTlsCert {
@@ -332,6 +339,9 @@ func needvar(args ...interface{}) {
 				fail(err)
 			}
 			storage = s.(objio.ObjectStorage)
+			if emulateTrash {
+				storage = objio.NewTrashObjectStorage(storage)
+			}
 			if trace.Verbose {
 				storage = &objio.TraceObjectStorage{ObjectStorage: storage}
 			}
@@ -42,6 +42,83 @@ type StorageInfo interface {
 	FreeSize() int64
 }
 
+// Capability describes a feature that the storage supports.
+type Capability uint32
+
+// Capabilities.
+const (
+	// directories can be renamed natively
+	CapDirRename Capability = 1 << iota
+
+	// rename atomically replaces an existing object
+	CapRenameOverwrite
+
+	// readers returned by OpenRead support ranged reads (io.ReaderAt)
+	CapRangeRead
+
+	// objects can be copied on the server
+	CapServerCopy
+
+	// object modification time can be set
+	CapSetMtime
+
+	// empty directories can exist
+	CapEmptyDir
+
+	// listings reflect all completed changes
+	CapConsistentList
+)
+
+// DefaultCapabilities are the capabilities assumed for a storage whose
+// StorageInfo does not implement StorageInfoCapabilities.
+const DefaultCapabilities = CapDirRename | CapRenameOverwrite | CapEmptyDir | CapConsistentList
+
+var capabilityNames = []string{
+	"DirRename",
+	"RenameOverwrite",
+	"RangeRead",
+	"ServerCopy",
+	"SetMtime",
+	"EmptyDir",
+	"ConsistentList",
+}
+
+func (caps Capability) String() string {
+	s := ""
+	for i, n := range capabilityNames {
+		if 0 != caps&(1<<uint(i)) {
+			if "" != s {
+				s += ","
+			}
+			s += n
+		}
+	}
+	return s
+}
+
+// StorageInfoCapabilities is the interface that a StorageInfo implements
+// if it can describe the features of the storage.
+type StorageInfoCapabilities interface {
+	// storage capabilities
+	Capabilities() Capability
+
+	// maximum object size (0 for no limit)
+	MaxObjectSize() int64
+}
+
+// GetCapabilities gets the capabilities and maximum object size (0 for no
+// limit) of a storage. If the StorageInfo does not implement
+// StorageInfoCapabilities then DefaultCapabilities and no limit are assumed.
+func GetCapabilities(info StorageInfo) (caps Capability, maxsize int64) {
+	if i, ok := info.(StorageInfoCapabilities); ok {
+		caps = i.Capabilities()
+		maxsize = i.MaxObjectSize()
+	} else {
+		caps = DefaultCapabilities
+	}
+	return
+}
+
 // ObjectInfo contains information about an object.
 type ObjectInfo interface {
 	// object name (no path)
@@ -63,6 +140,19 @@ type ObjectInfo interface {
 	Sig() string
 }
 
+// ObjectInfoSymlink is the interface that an ObjectInfo implements if the
+// object may be a symbolic link.
+type ObjectInfoSymlink interface {
+	// issymlink flag
+	IsSymlink() bool
+}
+
+// IsSymlink determines if an object is a symbolic link.
+func IsSymlink(info ObjectInfo) bool {
+	i, ok := info.(ObjectInfoSymlink)
+	return ok && i.IsSymlink()
+}
+
 // WriteWaiter wraps a WriteCloser and a Wait method that waits until
 // all transfers are complete. After Wait has been called no further
 // Write's are possible and Close must be called. Calling Close without
@@ -72,6 +162,59 @@ type WriteWaiter interface {
 	Wait() (ObjectInfo, error)
 }
 
+// TrashInfo contains information about a deleted object.
+type TrashInfo interface {
+	ObjectInfo
+
+	// trash item identifier
+	Id() string
+
+	// original object path
+	Path() string
+
+	// object deletion time
+	Dtime() time.Time
+}
+
+// PartWriteWaiter writes an object in parts and has a Wait method that
+// waits until all transfers are complete. Parts have the part size that
+// the PartWriteWaiter was opened with (except the last part which may be
+// shorter) and they may be written concurrently and in any order. After
+// Wait has been called no further WritePart's are possible and Close must
+// be called. Calling Close without Wait cancels any pending tranfers.
+type PartWriteWaiter interface {
+	io.Closer
+	WritePart(part int, reader io.Reader, size int64) error
+	Wait() (ObjectInfo, error)
+}
+
+// ResumableWriteWaiter is a WriteWaiter that belongs to an upload session.
+// Calling Close without Wait cancels any pending transfers, but data that
+// have already been committed remain with the session so that it can be
+// resumed later.
+type ResumableWriteWaiter interface {
+	WriteWaiter
+
+	// Session gets the upload session identifier.
+	Session() string
+
+	// Offset gets the number of bytes committed to the storage. Writes
+	// always continue from this offset.
+	Offset() int64
+}
+
+// ObjectChange contains information about a change to an object.
+type ObjectChange interface {
+	// object path (from the storage root)
+	Path() string
+
+	// isremoved flag
+	IsRemoved() bool
+
+	// object information (nil if the object was removed)
+	Info() ObjectInfo
+}
+
 // ObjectStorage is the interface that an object storage must implement.
 // It provides methods to list, open and manipulate objects.
 type ObjectStorage interface {
@@ -115,5 +258,104 @@ type ObjectStorage interface {
 	OpenWrite(name string, size int64) (WriteWaiter, error)
 }
 
+// ObjectStorageFlatList is the interface that an object storage implements
+// if it can list all objects below a prefix at any depth in one listing.
+type ObjectStorageFlatList interface {
+	// ListRecursive lists all objects below the specified prefix at any depth.
+	// The names of the returned ObjectInfo are paths relative to the prefix
+	// (e.g. "dir/file"). Directories that have no object of their own may not
+	// be reported. Markers and maxcount are as in List.
+	ListRecursive(prefix string, marker string, maxcount int) (string, []ObjectInfo, error)
+}
+
+// ObjectStorageChanges is the interface that an object storage implements
+// if it can report changes made to its objects by other clients.
+type ObjectStorageChanges interface {
+	// Changes gets the changes made since the point identified by cursor.
+	// An empty cursor requests the current point only; no changes are
+	// reported in that case. Changes returns a new cursor and a slice of
+	// ObjectChange; it should be called repeatedly with the returned cursor
+	// until no more changes are reported. If the cursor is no longer valid
+	// an error with errno.EINVAL attached is returned and the caller must
+	// discard any state it has derived from the storage.
+	Changes(cursor string) (string, []ObjectChange, error)
+}
+
+// ObjectStorageMultipart is the interface that an object storage implements
+// if it supports writing objects in parts that are transferred concurrently.
+// Reading objects in parts is supported when the io.ReadCloser returned by
+// OpenRead also supports the io.ReaderAt interface.
+type ObjectStorageMultipart interface {
+	// OpenWriteParts opens an object for writing in parts. The parameter size
+	// specifies the size that the written object will have and the parameter
+	// partsize specifies the size of each part.
+	OpenWriteParts(name string, size int64, partsize int64) (PartWriteWaiter, error)
+}
+
+// ObjectStorageResumable is the interface that an object storage implements
+// if it supports upload sessions that can be resumed after a failure.
+type ObjectStorageResumable interface {
+	// OpenResumableWrite opens an object for writing within an upload
+	// session. If session is empty a new session is created. Otherwise the
+	// existing session is resumed and the returned ResumableWriteWaiter
+	// reports the Offset that writing must continue from. If the session is
+	// no longer valid an error with errno.ENOENT attached is returned.
+	OpenResumableWrite(name string, size int64, session string) (ResumableWriteWaiter, error)
+}
+
+// ObjectStorageResumableAbort is the interface that an object storage
+// implements if it can abandon upload sessions that will not be resumed.
+type ObjectStorageResumableAbort interface {
+	// AbortResumableWrite abandons an upload session, so that the storage
+	// can discard the data that have been committed to it.
+	AbortResumableWrite(name string, session string) error
+}
+
+// ObjectStorageConditional is the interface that an object storage implements
+// if it supports conditional writes.
+type ObjectStorageConditional interface {
+	// OpenWriteIf opens an object for writing only if the current signature
+	// of the object matches sig. If sig is empty the write is unconditional.
+	// If the object has changed an error with errno.ESTALE attached is
+	// returned by OpenWriteIf or by the Wait method of the WriteWaiter.
+	OpenWriteIf(name string, size int64, sig string) (WriteWaiter, error)
+}
+
+// ObjectStorageChtime is the interface that an object storage implements if
+// it can set the modification time of an object.
+type ObjectStorageChtime interface {
+	// Chtime sets the modification time of an object. It returns the updated
+	// object info.
+	Chtime(name string, mtime time.Time) (ObjectInfo, error)
+}
+
+// ObjectStorageSymlink is the interface that an object storage implements if
+// it supports symbolic links. Storages that do not can still store symbolic
+// links as XSym objects.
+type ObjectStorageSymlink interface {
+	// Symlink makes a symbolic link that points to target.
+	Symlink(name string, target string) (ObjectInfo, error)
+
+	// Readlink gets the target of a symbolic link.
+	Readlink(name string) (string, error)
+}
+
+// ObjectStorageTrash is the interface that an object storage implements if
+// it keeps deleted objects in a trash (recycle bin).
+type ObjectStorageTrash interface {
+	// ListTrash lists deleted objects. A marker can be used to continue a
+	// paginated listing. The listing will contain up to maxcount items; a 0
+	// specifies no limit (but the underlying storage may still limit the
+	// number of items returned). ListTrash returns an (optionally empty)
+	// marker and a slice of TrashInfo.
+	ListTrash(marker string, maxcount int) (string, []TrashInfo, error)
+
+	// Restore restores a deleted object to its original path.
+	Restore(id string) error
+
+	// Purge permanently deletes a deleted object.
+	Purge(id string) error
+}
+
 // Registry is the default object storage factory registry.
 var Registry = objreg.NewObjectFactoryRegistry()
@@ -0,0 +1,538 @@
+/*
+ * memstg.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package objiotest
+
+import (
+	"bytes"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/billziss-gh/golib/errors"
+	"github.com/billziss-gh/objfs/errno"
+	"github.com/billziss-gh/objfs/objio"
+)
+
+// MemObjectStorage is an object storage that keeps its objects in memory.
+// It is used to test code that uses object storages and to test the
+// conformance suite itself.
+type MemObjectStorage struct {
+	mux     sync.Mutex
+	objects map[string]*memObject
+	caseins bool
+	sigseq  uint64
+}
+
+type memObject struct {
+	name  string
+	data  []byte
+	btime time.Time
+	mtime time.Time
+	isdir bool
+	sig   string
+}
+
+// NewMemObjectStorage creates a new empty in-memory object storage.
+func NewMemObjectStorage(caseins bool) *MemObjectStorage {
+	self := &MemObjectStorage{
+		objects: map[string]*memObject{},
+		caseins: caseins,
+	}
+
+	now := time.Now().UTC()
+	self.objects["/"] = &memObject{name: "/", btime: now, mtime: now, isdir: true}
+
+	return self
+}
+
+func (self *MemObjectStorage) Info(getsize bool) (objio.StorageInfo, error) {
+	size := int64(0)
+	if getsize {
+		self.mux.Lock()
+		for _, obj := range self.objects {
+			size += int64(len(obj.data))
+		}
+		self.mux.Unlock()
+	}
+
+	return &memStorageInfo{caseins: self.caseins, size: size}, nil
+}
+
+func (self *MemObjectStorage) List(
+	prefix string, imarker string, maxcount int) (
+	omarker string, infos []objio.ObjectInfo, err error) {
+
+	self.mux.Lock()
+	defer self.mux.Unlock()
+
+	dir, err := self.get(prefix)
+	if nil != err {
+		return
+	}
+	if !dir.isdir {
+		err = errors.New(": "+prefix+" is not a directory", nil, errno.ENOTDIR)
+		return
+	}
+
+	return self.list(self.key(prefix), imarker, maxcount, false)
+}
+
+// ListRecursive implements objio.ObjectStorageFlatList.
+func (self *MemObjectStorage) ListRecursive(
+	prefix string, imarker string, maxcount int) (
+	omarker string, infos []objio.ObjectInfo, err error) {
+
+	self.mux.Lock()
+	defer self.mux.Unlock()
+
+	dir, err := self.get(prefix)
+	if nil != err {
+		return
+	}
+	if !dir.isdir {
+		err = errors.New(": "+prefix+" is not a directory", nil, errno.ENOTDIR)
+		return
+	}
+
+	return self.list(self.key(prefix), imarker, maxcount, true)
+}
+
+func (self *MemObjectStorage) Stat(name string) (info objio.ObjectInfo, err error) {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+
+	obj, err := self.get(name)
+	if nil != err {
+		return
+	}
+
+	info = obj.info(path.Base(obj.name))
+
+	return
+}
+
+func (self *MemObjectStorage) Mkdir(prefix string) (info objio.ObjectInfo, err error) {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+
+	obj, err := self.make(prefix, true)
+	if nil != err {
+		return
+	}
+
+	info = obj.info(path.Base(obj.name))
+
+	return
+}
+
+func (self *MemObjectStorage) Rmdir(prefix string) (err error) {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+
+	obj, err := self.get(prefix)
+	if nil != err {
+		return
+	}
+	if !obj.isdir {
+		err = errors.New(": "+prefix+" is not a directory", nil, errno.ENOTDIR)
+		return
+	}
+
+	k := self.key(prefix)
+	if "/" == k {
+		err = errors.New(": cannot remove root", nil, errno.EPERM)
+		return
+	}
+	for k0 := range self.objects {
+		if strings.HasPrefix(k0, k+"/") {
+			err = errors.New(": "+prefix+" is not empty", nil, errno.ENOTEMPTY)
+			return
+		}
+	}
+
+	delete(self.objects, k)
+
+	return
+}
+
+func (self *MemObjectStorage) Remove(name string) (err error) {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+
+	obj, err := self.get(name)
+	if nil != err {
+		return
+	}
+	if obj.isdir {
+		err = errors.New(": "+name+" is a directory", nil, errno.EISDIR)
+		return
+	}
+
+	delete(self.objects, self.key(name))
+
+	return
+}
+
+func (self *MemObjectStorage) Rename(oldname string, newname string) (err error) {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+
+	obj, err := self.get(oldname)
+	if nil != err {
+		return
+	}
+
+	k, newk := self.key(oldname), self.key(newname)
+	if "/" == k || strings.HasPrefix(newk, k+"/") {
+		err = errors.New(": cannot rename "+oldname+" to "+newname, nil, errno.EINVAL)
+		return
+	}
+
+	_, err = self.parent(newname)
+	if nil != err {
+		return
+	}
+
+	if dst, ok := self.objects[newk]; ok && k != newk {
+		if dst.isdir != obj.isdir {
+			err = errors.New(": cannot replace "+newname, nil, errno.EEXIST)
+			return
+		}
+		if dst.isdir {
+			for k0 := range self.objects {
+				if strings.HasPrefix(k0, newk+"/") {
+					err = errors.New(": "+newname+" is not empty", nil, errno.ENOTEMPTY)
+					return
+				}
+			}
+		}
+	}
+
+	oldname, newname = obj.name, path.Join("/", newname)
+	moved := map[string]*memObject{}
+	for k0, obj0 := range self.objects {
+		if k0 == k || strings.HasPrefix(k0, k+"/") {
+			delete(self.objects, k0)
+			obj0.name = newname + obj0.name[len(oldname):]
+			moved[newk+k0[len(k):]] = obj0
+		}
+	}
+	for k0, obj0 := range moved {
+		self.objects[k0] = obj0
+	}
+
+	return
+}
+
+func (self *MemObjectStorage) OpenRead(
+	name string, sig string) (
+	info objio.ObjectInfo, reader io.ReadCloser, err error) {
+
+	self.mux.Lock()
+	defer self.mux.Unlock()
+
+	obj, err := self.get(name)
+	if nil != err {
+		return
+	}
+	if obj.isdir {
+		err = errors.New(": "+name+" is a directory", nil, errno.EISDIR)
+		return
+	}
+
+	info = obj.info(path.Base(obj.name))
+	if "" != sig && obj.sig == sig {
+		return
+	}
+
+	reader = &memReader{bytes.NewReader(obj.data)}
+
+	return
+}
+
+func (self *MemObjectStorage) OpenWrite(
+	name string, size int64) (
+	writer objio.WriteWaiter, err error) {
+
+	self.mux.Lock()
+	defer self.mux.Unlock()
+
+	_, err = self.parent(name)
+	if nil != err {
+		return
+	}
+
+	if obj, ok := self.objects[self.key(name)]; ok && obj.isdir {
+		err = errors.New(": "+name+" is a directory", nil, errno.EISDIR)
+		return
+	}
+
+	writer = &memWriter{storage: self, name: path.Join("/", name), size: size}
+
+	return
+}
+
+func (self *MemObjectStorage) key(name string) string {
+	name = path.Join("/", name)
+	if self.caseins {
+		name = strings.ToUpper(name)
+	}
+	return name
+}
+
+func (self *MemObjectStorage) get(name string) (obj *memObject, err error) {
+	obj, ok := self.objects[self.key(name)]
+	if !ok {
+		err = errors.New(": "+name+" not found", nil, errno.ENOENT)
+	}
+	return
+}
+
+func (self *MemObjectStorage) parent(name string) (obj *memObject, err error) {
+	obj, err = self.get(path.Dir(path.Join("/", name)))
+	if nil == err && !obj.isdir {
+		err = errors.New(": parent of "+name+" is not a directory", nil, errno.ENOTDIR)
+	}
+	return
+}
+
+func (self *MemObjectStorage) make(name string, isdir bool) (obj *memObject, err error) {
+	_, err = self.parent(name)
+	if nil != err {
+		return
+	}
+
+	k := self.key(name)
+	if _, ok := self.objects[k]; ok {
+		err = errors.New(": "+name+" exists", nil, errno.EEXIST)
+		return
+	}
+
+	now := time.Now().UTC()
+	obj = &memObject{
+		name:  path.Join("/", name),
+		btime: now,
+		mtime: now,
+		isdir: isdir,
+		sig:   self.nextSig(),
+	}
+	self.objects[k] = obj
+
+	return
+}
+
+func (self *MemObjectStorage) nextSig() string {
+	self.sigseq++
+	return strconv.FormatUint(self.sigseq, 16)
+}
+
+func (self *MemObjectStorage) list(
+	k string, imarker string, maxcount int, recursive bool) (
+	omarker string, infos []objio.ObjectInfo, err error) {
+
+	base := k
+	if "/" != base {
+		base += "/"
+	}
+
+	keys := make([]string, 0, 16)
+	for k0 := range self.objects {
+		if !strings.HasPrefix(k0, base) || k0 == base {
+			continue
+		}
+		if !recursive && strings.ContainsRune(k0[len(base):], '/') {
+			continue
+		}
+		if "" != imarker && k0 <= imarker {
+			continue
+		}
+		keys = append(keys, k0)
+	}
+	sort.Strings(keys)
+
+	if 0 < maxcount && maxcount < len(keys) {
+		keys = keys[:maxcount]
+		omarker = keys[len(keys)-1]
+	}
+
+	infos = make([]objio.ObjectInfo, 0, len(keys))
+	for _, k0 := range keys {
+		obj := self.objects[k0]
+		name := path.Base(obj.name)
+		if recursive {
+			name = obj.name[len(base):]
+		}
+		infos = append(infos, obj.info(name))
+	}
+
+	return
+}
+
+func (obj *memObject) info(name string) objio.ObjectInfo {
+	return &memObjectInfo{
+		name:  name,
+		size:  int64(len(obj.data)),
+		btime: obj.btime,
+		mtime: obj.mtime,
+		isdir: obj.isdir,
+		sig:   obj.sig,
+	}
+}
+
+type memStorageInfo struct {
+	caseins bool
+	size    int64
+}
+
+func (info *memStorageInfo) IsCaseInsensitive() bool {
+	return info.caseins
+}
+
+func (info *memStorageInfo) IsReadOnly() bool {
+	return false
+}
+
+func (info *memStorageInfo) MaxComponentLength() int {
+	return 255
+}
+
+func (info *memStorageInfo) TotalSize() int64 {
+	return 1 << 40
+}
+
+func (info *memStorageInfo) FreeSize() int64 {
+	return 1<<40 - info.size
+}
+
+func (info *memStorageInfo) Capabilities() objio.Capability {
+	return objio.DefaultCapabilities | objio.CapRangeRead
+}
+
+func (info *memStorageInfo) MaxObjectSize() int64 {
+	return 0
+}
+
+type memObjectInfo struct {
+	name  string
+	size  int64
+	btime time.Time
+	mtime time.Time
+	isdir bool
+	sig   string
+}
+
+func (info *memObjectInfo) Name() string {
+	return info.name
+}
+
+func (info *memObjectInfo) Size() int64 {
+	return info.size
+}
+
+func (info *memObjectInfo) Btime() time.Time {
+	return info.btime
+}
+
+func (info *memObjectInfo) Mtime() time.Time {
+	return info.mtime
+}
+
+func (info *memObjectInfo) IsDir() bool {
+	return info.isdir
+}
+
+func (info *memObjectInfo) Sig() string {
+	return info.sig
+}
+
+type memReader struct {
+	*bytes.Reader
+}
+
+func (self *memReader) Close() error {
+	return nil
+}
+
+type memWriter struct {
+	storage *MemObjectStorage
+	name    string
+	size    int64
+	buf     bytes.Buffer
+	done    bool
+}
+
+func (self *memWriter) Write(p []byte) (n int, err error) {
+	if self.done {
+		err = errors.New(": write after wait or close", nil, errno.EPERM)
+		return
+	}
+
+	return self.buf.Write(p)
+}
+
+func (self *memWriter) Wait() (info objio.ObjectInfo, err error) {
+	if self.done {
+		err = errors.New(": wait after wait or close", nil, errno.EPERM)
+		return
+	}
+	self.done = true
+
+	if self.size != int64(self.buf.Len()) {
+		err = errors.New(": size mismatch", nil, errno.EIO)
+		return
+	}
+
+	storage := self.storage
+	storage.mux.Lock()
+	defer storage.mux.Unlock()
+
+	_, err = storage.parent(self.name)
+	if nil != err {
+		return
+	}
+
+	now := time.Now().UTC()
+	k := storage.key(self.name)
+	obj, ok := storage.objects[k]
+	if !ok {
+		obj = &memObject{name: self.name, btime: now}
+		storage.objects[k] = obj
+	} else if obj.isdir {
+		err = errors.New(": "+self.name+" is a directory", nil, errno.EISDIR)
+		return
+	}
+	obj.data = append([]byte(nil), self.buf.Bytes()...)
+	obj.mtime = now
+	obj.sig = storage.nextSig()
+
+	info = obj.info(path.Base(obj.name))
+
+	return
+}
+
+func (self *memWriter) Close() error {
+	self.done = true
+	return nil
+}
+
+var _ objio.ObjectStorage = (*MemObjectStorage)(nil)
+var _ objio.ObjectStorageFlatList = (*MemObjectStorage)(nil)
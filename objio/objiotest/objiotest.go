@@ -0,0 +1,636 @@
+/*
+ * objiotest.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+// Package objiotest provides a conformance test suite for object storages.
+//
+// A storage implementation can be tested against the contract documented in
+// package objio by calling TestObjectStorage from one of its own tests:
+//
+//	func TestConformance(t *testing.T) {
+//	    objiotest.TestObjectStorage(t, func() (objio.ObjectStorage, error) {
+//	        return newTestStorage()
+//	    })
+//	}
+//
+// The suite works inside a uniquely named directory that it creates in the
+// root of the storage and removes when done, so it may be run against a live
+// storage.
+package objiotest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/billziss-gh/golib/errors"
+	"github.com/billziss-gh/objfs/errno"
+	"github.com/billziss-gh/objfs/objio"
+)
+
+// Factory creates the object storage to test.
+type Factory func() (objio.ObjectStorage, error)
+
+// TestObjectStorage runs the conformance suite against the storage created
+// by factory. Every test gets a new storage from the factory.
+func TestObjectStorage(t *testing.T, factory Factory) {
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			storage, err := factory()
+			if nil != err {
+				t.Fatal(err)
+			}
+
+			root := fmt.Sprintf("/objiotest-%x", time.Now().UnixNano())
+			_, err = storage.Mkdir(root)
+			if nil != err {
+				t.Fatal(err)
+			}
+			defer removeAll(storage, root)
+
+			test.fn(t, storage, root)
+		})
+	}
+}
+
+var tests = []struct {
+	name string
+	fn   func(t *testing.T, storage objio.ObjectStorage, root string)
+}{
+	{"Info", testInfo},
+	{"MkdirRmdir", testMkdirRmdir},
+	{"WriteRead", testWriteRead},
+	{"ReadSig", testReadSig},
+	{"RangeRead", testRangeRead},
+	{"WriteCancel", testWriteCancel},
+	{"List", testList},
+	{"ListMarker", testListMarker},
+	{"Rename", testRename},
+	{"RenameDir", testRenameDir},
+	{"Remove", testRemove},
+	{"ENOENT", testENOENT},
+	{"CaseInsensitive", testCaseInsensitive},
+	{"Unicode", testUnicode},
+}
+
+func testInfo(t *testing.T, storage objio.ObjectStorage, root string) {
+	info, err := storage.Info(true)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if 0 >= info.MaxComponentLength() {
+		t.Error("MaxComponentLength", info.MaxComponentLength())
+	}
+
+	if 0 > info.TotalSize() || 0 > info.FreeSize() {
+		t.Error("TotalSize/FreeSize", info.TotalSize(), info.FreeSize())
+	}
+}
+
+func testMkdirRmdir(t *testing.T, storage objio.ObjectStorage, root string) {
+	name := path.Join(root, "dir")
+
+	info, err := storage.Mkdir(name)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "dir" != info.Name() || !info.IsDir() {
+		t.Error("Mkdir info", info.Name(), info.IsDir())
+	}
+
+	info, err = storage.Stat(name)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "dir" != info.Name() || !info.IsDir() {
+		t.Error("Stat info", info.Name(), info.IsDir())
+	}
+
+	_, err = storage.Mkdir(name)
+	if !errors.HasAttachment(err, errno.EEXIST) {
+		t.Error("Mkdir existing", err)
+	}
+
+	writeObject(t, storage, path.Join(name, "file"), []byte("file"))
+
+	err = storage.Rmdir(name)
+	if !errors.HasAttachment(err, errno.ENOTEMPTY) {
+		t.Error("Rmdir nonempty", err)
+	}
+
+	err = storage.Remove(path.Join(name, "file"))
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	err = storage.Rmdir(name)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	_, err = storage.Stat(name)
+	if !errors.HasAttachment(err, errno.ENOENT) {
+		t.Error("Stat after Rmdir", err)
+	}
+}
+
+func testWriteRead(t *testing.T, storage objio.ObjectStorage, root string) {
+	for _, size := range []int{0, 1, 4096, 1024*1024 + 1} {
+		name := path.Join(root, fmt.Sprintf("file%d", size))
+		data := makeData(size)
+
+		winfo := writeObject(t, storage, name, data)
+		if int64(size) != winfo.Size() || winfo.IsDir() {
+			t.Error("Wait info", winfo.Size(), winfo.IsDir())
+		}
+
+		info, err := storage.Stat(name)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if int64(size) != info.Size() || info.IsDir() || winfo.Sig() != info.Sig() {
+			t.Error("Stat info", info.Size(), info.IsDir(), info.Sig())
+		}
+
+		rdata, rinfo := readObject(t, storage, name, "")
+		if !bytes.Equal(data, rdata) {
+			t.Error("OpenRead data", size)
+		}
+		if int64(size) != rinfo.Size() {
+			t.Error("OpenRead info", rinfo.Size())
+		}
+	}
+
+	// overwrite
+	name := path.Join(root, "file")
+	writeObject(t, storage, name, []byte("old"))
+	writeObject(t, storage, name, []byte("new data"))
+	rdata, _ := readObject(t, storage, name, "")
+	if "new data" != string(rdata) {
+		t.Error("overwrite", string(rdata))
+	}
+}
+
+func testReadSig(t *testing.T, storage objio.ObjectStorage, root string) {
+	name := path.Join(root, "file")
+
+	winfo := writeObject(t, storage, name, []byte("data"))
+	if "" == winfo.Sig() {
+		t.Skip("storage does not report signatures")
+	}
+
+	info, reader, err := storage.OpenRead(name, winfo.Sig())
+	if nil != err {
+		t.Fatal(err)
+	}
+	if nil != reader {
+		reader.Close()
+		t.Error("OpenRead with matching sig returned reader")
+	}
+	if nil == info || winfo.Sig() != info.Sig() {
+		t.Error("OpenRead with matching sig info")
+	}
+
+	winfo2 := writeObject(t, storage, name, []byte("new data"))
+	if winfo.Sig() == winfo2.Sig() {
+		t.Error("sig did not change after write")
+	}
+
+	rdata, _ := readObject(t, storage, name, winfo.Sig())
+	if "new data" != string(rdata) {
+		t.Error("OpenRead with stale sig", string(rdata))
+	}
+}
+
+func testRangeRead(t *testing.T, storage objio.ObjectStorage, root string) {
+	caps := capabilities(t, storage)
+	if 0 == caps&objio.CapRangeRead {
+		t.Skip("storage does not support ranged reads")
+	}
+
+	name := path.Join(root, "file")
+	data := makeData(100000)
+	writeObject(t, storage, name, data)
+
+	_, reader, err := storage.OpenRead(name, "")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	readat, ok := reader.(io.ReaderAt)
+	if !ok {
+		t.Fatal("OpenRead reader does not support ReadAt")
+	}
+
+	for _, r := range [][2]int{{0, 1}, {99999, 1}, {4096, 8192}, {50000, 50000}, {12345, 1}} {
+		buf := make([]byte, r[1])
+		n, err := readat.ReadAt(buf, int64(r[0]))
+		if io.EOF == err && n == len(buf) {
+			err = nil
+		}
+		if nil != err || n != len(buf) || !bytes.Equal(data[r[0]:r[0]+r[1]], buf) {
+			t.Error("ReadAt", r[0], r[1], n, err)
+		}
+	}
+}
+
+func testWriteCancel(t *testing.T, storage objio.ObjectStorage, root string) {
+	name := path.Join(root, "file")
+
+	writer, err := storage.OpenWrite(name, 4)
+	if nil != err {
+		t.Fatal(err)
+	}
+	_, err = writer.Write([]byte("data"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	writer.Close()
+
+	_, err = storage.Stat(name)
+	if !errors.HasAttachment(err, errno.ENOENT) {
+		t.Error("Close without Wait did not cancel", err)
+	}
+
+	// cancelling an overwrite keeps the old object
+	writeObject(t, storage, name, []byte("old"))
+
+	writer, err = storage.OpenWrite(name, 3)
+	if nil != err {
+		t.Fatal(err)
+	}
+	_, err = writer.Write([]byte("new"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	writer.Close()
+
+	rdata, _ := readObject(t, storage, name, "")
+	if "old" != string(rdata) {
+		t.Error("Close without Wait changed object", string(rdata))
+	}
+}
+
+func testList(t *testing.T, storage objio.ObjectStorage, root string) {
+	expected := []string{"a", "b", "c", "d"}
+	for _, n := range expected[:3] {
+		writeObject(t, storage, path.Join(root, n), []byte(n))
+	}
+	_, err := storage.Mkdir(path.Join(root, "d"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	writeObject(t, storage, path.Join(root, "d", "e"), []byte("e"))
+
+	infos := listAll(t, storage, root, 0)
+	names := infoNames(infos)
+	if strings.Join(expected, ",") != strings.Join(names, ",") {
+		t.Error("List names", names)
+	}
+
+	for _, info := range infos {
+		if ("d" == info.Name()) != info.IsDir() {
+			t.Error("List isdir", info.Name(), info.IsDir())
+		}
+	}
+}
+
+func testListMarker(t *testing.T, storage objio.ObjectStorage, root string) {
+	const count = 25
+
+	expected := make([]string, 0, count)
+	for i := 0; count > i; i++ {
+		n := fmt.Sprintf("file%02d", i)
+		writeObject(t, storage, path.Join(root, n), nil)
+		expected = append(expected, n)
+	}
+
+	for _, maxcount := range []int{1, 2, 7, count, count + 1} {
+		infos := listAll(t, storage, root, maxcount)
+		names := infoNames(infos)
+		if strings.Join(expected, ",") != strings.Join(names, ",") {
+			t.Error("List with markers", maxcount, names)
+		}
+	}
+}
+
+func testRename(t *testing.T, storage objio.ObjectStorage, root string) {
+	oldname := path.Join(root, "old")
+	newname := path.Join(root, "new")
+
+	writeObject(t, storage, oldname, []byte("data"))
+
+	err := storage.Rename(oldname, newname)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	_, err = storage.Stat(oldname)
+	if !errors.HasAttachment(err, errno.ENOENT) {
+		t.Error("Stat old after Rename", err)
+	}
+
+	rdata, _ := readObject(t, storage, newname, "")
+	if "data" != string(rdata) {
+		t.Error("Rename data", string(rdata))
+	}
+
+	caps := capabilities(t, storage)
+	if 0 != caps&objio.CapRenameOverwrite {
+		writeObject(t, storage, oldname, []byte("other"))
+
+		err = storage.Rename(oldname, newname)
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		rdata, _ = readObject(t, storage, newname, "")
+		if "other" != string(rdata) {
+			t.Error("Rename overwrite data", string(rdata))
+		}
+	}
+}
+
+func testRenameDir(t *testing.T, storage objio.ObjectStorage, root string) {
+	caps := capabilities(t, storage)
+	if 0 == caps&objio.CapDirRename {
+		t.Skip("storage does not support directory rename")
+	}
+
+	olddir := path.Join(root, "old")
+	newdir := path.Join(root, "new")
+
+	_, err := storage.Mkdir(olddir)
+	if nil != err {
+		t.Fatal(err)
+	}
+	_, err = storage.Mkdir(path.Join(olddir, "sub"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	writeObject(t, storage, path.Join(olddir, "file"), []byte("file"))
+	writeObject(t, storage, path.Join(olddir, "sub", "file"), []byte("subfile"))
+
+	err = storage.Rename(olddir, newdir)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	_, err = storage.Stat(olddir)
+	if !errors.HasAttachment(err, errno.ENOENT) {
+		t.Error("Stat old dir after Rename", err)
+	}
+
+	rdata, _ := readObject(t, storage, path.Join(newdir, "file"), "")
+	if "file" != string(rdata) {
+		t.Error("RenameDir data", string(rdata))
+	}
+	rdata, _ = readObject(t, storage, path.Join(newdir, "sub", "file"), "")
+	if "subfile" != string(rdata) {
+		t.Error("RenameDir subdir data", string(rdata))
+	}
+}
+
+func testRemove(t *testing.T, storage objio.ObjectStorage, root string) {
+	name := path.Join(root, "file")
+
+	writeObject(t, storage, name, []byte("data"))
+
+	err := storage.Remove(name)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	_, err = storage.Stat(name)
+	if !errors.HasAttachment(err, errno.ENOENT) {
+		t.Error("Stat after Remove", err)
+	}
+
+	infos := listAll(t, storage, root, 0)
+	if 0 != len(infos) {
+		t.Error("List after Remove", infoNames(infos))
+	}
+}
+
+func testENOENT(t *testing.T, storage objio.ObjectStorage, root string) {
+	name := path.Join(root, "nonexistent")
+
+	_, err := storage.Stat(name)
+	if !errors.HasAttachment(err, errno.ENOENT) {
+		t.Error("Stat", err)
+	}
+
+	_, _, err = storage.List(name, "", 0)
+	if !errors.HasAttachment(err, errno.ENOENT) {
+		t.Error("List", err)
+	}
+
+	_, _, err = storage.OpenRead(name, "")
+	if !errors.HasAttachment(err, errno.ENOENT) {
+		t.Error("OpenRead", err)
+	}
+
+	err = storage.Remove(name)
+	if !errors.HasAttachment(err, errno.ENOENT) {
+		t.Error("Remove", err)
+	}
+
+	err = storage.Rmdir(name)
+	if !errors.HasAttachment(err, errno.ENOENT) {
+		t.Error("Rmdir", err)
+	}
+
+	err = storage.Rename(name, path.Join(root, "other"))
+	if !errors.HasAttachment(err, errno.ENOENT) {
+		t.Error("Rename", err)
+	}
+}
+
+func testCaseInsensitive(t *testing.T, storage objio.ObjectStorage, root string) {
+	info, err := storage.Info(false)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	writeObject(t, storage, path.Join(root, "file"), []byte("data"))
+
+	_, err = storage.Stat(path.Join(root, "FILE"))
+	if info.IsCaseInsensitive() {
+		if nil != err {
+			t.Error("Stat on case-insensitive storage", err)
+		}
+	} else {
+		if !errors.HasAttachment(err, errno.ENOENT) {
+			t.Error("Stat on case-sensitive storage", err)
+		}
+
+		writeObject(t, storage, path.Join(root, "FILE"), []byte("DATA"))
+
+		names := infoNames(listAll(t, storage, root, 0))
+		if "FILE,file" != strings.Join(names, ",") {
+			t.Error("List on case-sensitive storage", names)
+		}
+	}
+}
+
+func testUnicode(t *testing.T, storage objio.ObjectStorage, root string) {
+	dir := path.Join(root, "Δοκιμή")
+	_, err := storage.Mkdir(dir)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	expected := []string{"tschüß", "日本語", "😀 emoji"}
+	for _, n := range expected {
+		writeObject(t, storage, path.Join(dir, n), []byte(n))
+	}
+
+	names := infoNames(listAll(t, storage, dir, 0))
+	sort.Strings(expected)
+	if strings.Join(expected, ",") != strings.Join(names, ",") {
+		t.Error("List Unicode names", names)
+	}
+
+	for _, n := range expected {
+		rdata, info := readObject(t, storage, path.Join(dir, n), "")
+		if n != string(rdata) || n != info.Name() {
+			t.Error("OpenRead Unicode name", n, info.Name())
+		}
+	}
+}
+
+func capabilities(t *testing.T, storage objio.ObjectStorage) objio.Capability {
+	info, err := storage.Info(false)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	caps, _ := objio.GetCapabilities(info)
+	return caps
+}
+
+func makeData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func writeObject(
+	t *testing.T, storage objio.ObjectStorage, name string, data []byte) objio.ObjectInfo {
+	writer, err := storage.OpenWrite(name, int64(len(data)))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	_, err = writer.Write(data)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	info, err := writer.Wait()
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	return info
+}
+
+func readObject(
+	t *testing.T, storage objio.ObjectStorage, name string, sig string) ([]byte, objio.ObjectInfo) {
+	info, reader, err := storage.OpenRead(name, sig)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if nil == reader {
+		t.Fatal("OpenRead returned nil reader", name)
+	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	return data, info
+}
+
+func listAll(
+	t *testing.T, storage objio.ObjectStorage, prefix string, maxcount int) []objio.ObjectInfo {
+	var infos []objio.ObjectInfo
+
+	marker := ""
+	for {
+		var i []objio.ObjectInfo
+		var err error
+		marker, i, err = storage.List(prefix, marker, maxcount)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if 0 < maxcount && maxcount < len(i) {
+			t.Error("List returned more than maxcount", maxcount, len(i))
+		}
+
+		infos = append(infos, i...)
+
+		if "" == marker {
+			break
+		}
+	}
+
+	return infos
+}
+
+func infoNames(infos []objio.ObjectInfo) []string {
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func removeAll(storage objio.ObjectStorage, name string) {
+	info, err := storage.Stat(name)
+	if nil != err {
+		return
+	}
+
+	if info.IsDir() {
+		_, infos, err := storage.List(name, "", 0)
+		for nil == err && 0 != len(infos) {
+			for _, info := range infos {
+				removeAll(storage, path.Join(name, info.Name()))
+			}
+			_, infos, err = storage.List(name, "", 0)
+		}
+
+		storage.Rmdir(name)
+	} else {
+		storage.Remove(name)
+	}
+}
@@ -0,0 +1,151 @@
+/*
+ * objiotest_test.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package objiotest
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/billziss-gh/golib/errors"
+	"github.com/billziss-gh/objfs/errno"
+	"github.com/billziss-gh/objfs/objio"
+)
+
+func TestMemObjectStorage(t *testing.T) {
+	TestObjectStorage(t, func() (objio.ObjectStorage, error) {
+		return NewMemObjectStorage(false), nil
+	})
+}
+
+func TestMemObjectStorageCaseInsensitive(t *testing.T) {
+	TestObjectStorage(t, func() (objio.ObjectStorage, error) {
+		return NewMemObjectStorage(true), nil
+	})
+}
+
+func TestTrashObjectStorage(t *testing.T) {
+	TestObjectStorage(t, func() (objio.ObjectStorage, error) {
+		return objio.NewTrashObjectStorage(NewMemObjectStorage(false)), nil
+	})
+}
+
+func TestTrashRestorePurge(t *testing.T) {
+	storage := objio.NewTrashObjectStorage(NewMemObjectStorage(false))
+	trash := storage.(objio.ObjectStorageTrash)
+
+	storage.Mkdir("/dir")
+	writeObject(t, storage, "/dir/file", []byte("old"))
+	writeObject(t, storage, "/keep", []byte("keep"))
+
+	remove := func() string {
+		err := storage.Remove("/dir/file")
+		if nil != err {
+			t.Fatal(err)
+		}
+		_, trinfos, err := trash.ListTrash("", 0)
+		if nil != err || 1 != len(trinfos) || "/dir/file" != trinfos[0].Path() {
+			t.Fatal("ListTrash", trinfos, err)
+		}
+		return trinfos[0].Id()
+	}
+
+	id := remove()
+	err := trash.Restore(id)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if data, _ := readObject(t, storage, "/dir/file", ""); "old" != string(data) {
+		t.Error("Restore", string(data))
+	}
+	if _, trinfos, _ := trash.ListTrash("", 0); 0 != len(trinfos) {
+		t.Error("ListTrash after Restore", trinfos)
+	}
+	err = trash.Restore(id)
+	if nil == err {
+		t.Error("Restore twice")
+	}
+
+	// a deleted object is not restored over a new object
+	id = remove()
+	writeObject(t, storage, "/dir/file", []byte("new"))
+	err = trash.Restore(id)
+	if !errors.HasAttachment(err, errno.EEXIST) {
+		t.Error("Restore over object", err)
+	}
+
+	err = trash.Purge(id)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, trinfos, _ := trash.ListTrash("", 0); 0 != len(trinfos) {
+		t.Error("ListTrash after Purge", trinfos)
+	}
+	if data, _ := readObject(t, storage, "/dir/file", ""); "new" != string(data) {
+		t.Error("Purge", string(data))
+	}
+
+	// ids that do not name an object in the trash are rejected
+	for _, id := range []string{
+		"", ".", "..", "0~%2F/../..", "0~%2F..%2F..", "0~%2F", "0~%2Fdir/file", "0~keep", "keep",
+	} {
+		if err := trash.Restore(id); !errors.HasAttachment(err, errno.EINVAL) {
+			t.Error("Restore invalid", id, err)
+		}
+		if err := trash.Purge(id); !errors.HasAttachment(err, errno.EINVAL) {
+			t.Error("Purge invalid", id, err)
+		}
+	}
+	if names := infoNames(listAll(t, storage, "/", 0)); "dir,keep" != strings.Join(names, ",") {
+		t.Error("List after invalid ids", names)
+	}
+}
+
+// treeStorage hides the optional interfaces of the storage it wraps.
+type treeStorage struct {
+	objio.ObjectStorage
+}
+
+func TestWalk(t *testing.T) {
+	storage := NewMemObjectStorage(false)
+	storage.Mkdir("/d")
+	storage.Mkdir("/d/e")
+	storage.Mkdir("/f")
+	for _, n := range []string{"/a", "/d/b", "/d/e/c"} {
+		w, _ := storage.OpenWrite(n, 0)
+		w.Wait()
+		w.Close()
+	}
+
+	expected := "a,d,d/b,d/e,d/e/c,f"
+	for _, s := range []objio.ObjectStorage{storage, treeStorage{storage}} {
+		var names []string
+		err := objio.Walk(s, "/", func(name string, info objio.ObjectInfo) error {
+			names = append(names, name)
+			return nil
+		})
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		sort.Strings(names)
+		if expected != strings.Join(names, ",") {
+			t.Error("Walk", names)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+/*
+ * parallel.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package objio
+
+import (
+	"io"
+	"sync"
+)
+
+const (
+	DefaultPartSize    = 8 * 1024 * 1024
+	DefaultParallelism = 4
+)
+
+// ReadParallel copies size bytes from src to dst. The copy is split into
+// parts of partsize bytes and up to parallelism parts are copied concurrently.
+func ReadParallel(
+	dst io.WriterAt, src io.ReaderAt, size int64, partsize int64, parallelism int) error {
+	return forEachPart(size, partsize, parallelism, func() func(part int, off int64, n int64) error {
+		var buf []byte
+		return func(part int, off int64, n int64) (err error) {
+			if int64(len(buf)) < n {
+				buf = make([]byte, n)
+			}
+
+			m, err := src.ReadAt(buf[:n], off)
+			if io.EOF == err && int64(m) == n {
+				err = nil
+			}
+			if nil != err {
+				return
+			}
+
+			_, err = dst.WriteAt(buf[:n], off)
+			return
+		}
+	})
+}
+
+// WriteParallel copies size bytes from src to dst. The copy is split into
+// parts of partsize bytes (which must be the partsize that dst was opened
+// with) and up to parallelism parts are copied concurrently.
+func WriteParallel(
+	dst PartWriteWaiter, src io.ReaderAt, size int64, partsize int64, parallelism int) error {
+	return forEachPart(size, partsize, parallelism, func() func(part int, off int64, n int64) error {
+		return func(part int, off int64, n int64) error {
+			return dst.WritePart(part, io.NewSectionReader(src, off, n), n)
+		}
+	})
+}
+
+func forEachPart(
+	size int64, partsize int64, parallelism int,
+	newfn func() func(part int, off int64, n int64) error) (
+	err error) {
+
+	if 0 >= partsize {
+		partsize = DefaultPartSize
+	}
+	if 0 >= parallelism {
+		parallelism = 1
+	}
+
+	parts := make(chan int64)
+	mux := sync.Mutex{}
+	wg := sync.WaitGroup{}
+
+	for i := 0; parallelism > i; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			fn := newfn()
+			for off := range parts {
+				n := size - off
+				if n > partsize {
+					n = partsize
+				}
+
+				e := fn(int(off/partsize), off, n)
+				if nil != e {
+					mux.Lock()
+					if nil == err {
+						err = e
+					}
+					mux.Unlock()
+				}
+			}
+		}()
+	}
+
+	for off := int64(0); size > off; off += partsize {
+		mux.Lock()
+		failed := nil != err
+		mux.Unlock()
+		if failed {
+			break
+		}
+
+		parts <- off
+	}
+	close(parts)
+
+	wg.Wait()
+
+	return
+}
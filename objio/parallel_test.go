@@ -0,0 +1,110 @@
+/*
+ * parallel_test.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package objio
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+)
+
+type testWriterAt struct {
+	mux sync.Mutex
+	buf []byte
+}
+
+func (self *testWriterAt) WriteAt(p []byte, off int64) (n int, err error) {
+	self.mux.Lock()
+	n = copy(self.buf[off:], p)
+	self.mux.Unlock()
+	return
+}
+
+type testPartWriteWaiter struct {
+	testWriterAt
+	partsize int64
+}
+
+func (self *testPartWriteWaiter) WritePart(part int, reader io.Reader, size int64) error {
+	p, err := ioutil.ReadAll(reader)
+	if nil == err {
+		_, err = self.WriteAt(p, int64(part)*self.partsize)
+	}
+	return err
+}
+
+func (self *testPartWriteWaiter) Wait() (ObjectInfo, error) {
+	return nil, nil
+}
+
+func (self *testPartWriteWaiter) Close() error {
+	return nil
+}
+
+func TestReadParallel(t *testing.T) {
+	src := make([]byte, 1000)
+	for i := range src {
+		src[i] = byte(i)
+	}
+
+	for _, partsize := range []int64{1, 7, 100, 999, 1000, 1001} {
+		for _, parallelism := range []int{1, 3, 16} {
+			dst := &testWriterAt{buf: make([]byte, len(src))}
+			err := ReadParallel(
+				dst, bytes.NewReader(src), int64(len(src)), partsize, parallelism)
+			if nil != err {
+				t.Error(err)
+			}
+			if !bytes.Equal(src, dst.buf) {
+				t.Error(partsize, parallelism)
+			}
+		}
+	}
+
+	dst := &testWriterAt{buf: make([]byte, len(src)+1)}
+	err := ReadParallel(dst, bytes.NewReader(src), int64(len(src)+1), 100, 3)
+	if nil == err {
+		t.Error()
+	}
+}
+
+func TestWriteParallel(t *testing.T) {
+	src := make([]byte, 1000)
+	for i := range src {
+		src[i] = byte(i)
+	}
+
+	for _, partsize := range []int64{1, 7, 100, 999, 1000, 1001} {
+		for _, parallelism := range []int{1, 3, 16} {
+			dst := &testPartWriteWaiter{
+				testWriterAt: testWriterAt{buf: make([]byte, len(src))},
+				partsize:     partsize,
+			}
+			err := WriteParallel(
+				dst, bytes.NewReader(src), int64(len(src)), partsize, parallelism)
+			if nil != err {
+				t.Error(err)
+			}
+			if !bytes.Equal(src, dst.buf) {
+				t.Error(partsize, parallelism)
+			}
+		}
+	}
+}
@@ -20,8 +20,11 @@ package objio
 import (
 	"fmt"
 	"io"
+	"time"
 
+	"github.com/billziss-gh/golib/errors"
 	"github.com/billziss-gh/golib/trace"
+	"github.com/billziss-gh/objfs/errno"
 )
 
 // TraceObjectStorage wraps a storage and traces calls to it.
@@ -90,6 +93,146 @@ func (self *TraceObjectStorage) OpenWrite(
 	return
 }
 
+func (self *TraceObjectStorage) ListRecursive(
+	prefix string, imarker string, maxcount int) (
+	omarker string, infos []ObjectInfo, err error) {
+	defer traceStg(
+		self.ObjectStorage, prefix, imarker, maxcount)(
+		&omarker, traceWrap{&infos}, traceWrap{&err})
+	if s, ok := self.ObjectStorage.(ObjectStorageFlatList); ok {
+		return s.ListRecursive(prefix, imarker, maxcount)
+	}
+	err = errors.New(": flat list not supported", nil, errno.ENOSYS)
+	return
+}
+
+func (self *TraceObjectStorage) Changes(
+	icursor string) (
+	ocursor string, changes []ObjectChange, err error) {
+	defer traceStg(self.ObjectStorage, icursor)(&ocursor, traceWrap{&changes}, traceWrap{&err})
+	if s, ok := self.ObjectStorage.(ObjectStorageChanges); ok {
+		return s.Changes(icursor)
+	}
+	err = errors.New(": changes not supported", nil, errno.ENOSYS)
+	return
+}
+
+func (self *TraceObjectStorage) OpenWriteParts(
+	name string, size int64, partsize int64) (
+	writer PartWriteWaiter, err error) {
+	defer traceStg(self.ObjectStorage, name, size, partsize)(traceWrap{&err})
+	if s, ok := self.ObjectStorage.(ObjectStorageMultipart); ok {
+		writer, err = s.OpenWriteParts(name, size, partsize)
+		if nil == err {
+			writer = &tracePartWriteWaiter{writer}
+		}
+		return
+	}
+	err = errors.New(": multipart write not supported", nil, errno.ENOSYS)
+	return
+}
+
+func (self *TraceObjectStorage) OpenResumableWrite(
+	name string, size int64, session string) (
+	writer ResumableWriteWaiter, err error) {
+	defer traceStg(self.ObjectStorage, name, size, session)(traceWrap{&err})
+	if s, ok := self.ObjectStorage.(ObjectStorageResumable); ok {
+		writer, err = s.OpenResumableWrite(name, size, session)
+		if nil == err {
+			writer = &traceResumableWriteWaiter{writer}
+		}
+		return
+	}
+	err = errors.New(": resumable write not supported", nil, errno.ENOSYS)
+	return
+}
+
+func (self *TraceObjectStorage) AbortResumableWrite(name string, session string) (err error) {
+	defer traceStg(self.ObjectStorage, name, session)(traceWrap{&err})
+	if s, ok := self.ObjectStorage.(ObjectStorageResumableAbort); ok {
+		return s.AbortResumableWrite(name, session)
+	}
+	err = errors.New(": resumable write abort not supported", nil, errno.ENOSYS)
+	return
+}
+
+func (self *TraceObjectStorage) OpenWriteIf(
+	name string, size int64, sig string) (
+	writer WriteWaiter, err error) {
+	defer traceStg(self.ObjectStorage, name, size, sig)(traceWrap{&err})
+	if s, ok := self.ObjectStorage.(ObjectStorageConditional); ok {
+		writer, err = s.OpenWriteIf(name, size, sig)
+		if nil == err {
+			writer = &traceWriteWaiter{writer}
+		}
+		return
+	}
+	err = errors.New(": conditional write not supported", nil, errno.ENOSYS)
+	return
+}
+
+func (self *TraceObjectStorage) Chtime(
+	name string, mtime time.Time) (
+	info ObjectInfo, err error) {
+	defer traceStg(self.ObjectStorage, name, mtime)(traceWrap{&info}, traceWrap{&err})
+	if s, ok := self.ObjectStorage.(ObjectStorageChtime); ok {
+		return s.Chtime(name, mtime)
+	}
+	err = errors.New(": chtime not supported", nil, errno.ENOSYS)
+	return
+}
+
+func (self *TraceObjectStorage) Symlink(
+	name string, target string) (
+	info ObjectInfo, err error) {
+	defer traceStg(self.ObjectStorage, name, target)(traceWrap{&info}, traceWrap{&err})
+	if s, ok := self.ObjectStorage.(ObjectStorageSymlink); ok {
+		return s.Symlink(name, target)
+	}
+	err = errors.New(": symlink not supported", nil, errno.ENOSYS)
+	return
+}
+
+func (self *TraceObjectStorage) Readlink(name string) (target string, err error) {
+	defer traceStg(self.ObjectStorage, name)(&target, traceWrap{&err})
+	if s, ok := self.ObjectStorage.(ObjectStorageSymlink); ok {
+		return s.Readlink(name)
+	}
+	err = errors.New(": symlink not supported", nil, errno.ENOSYS)
+	return
+}
+
+func (self *TraceObjectStorage) ListTrash(
+	imarker string, maxcount int) (
+	omarker string, infos []TrashInfo, err error) {
+	defer traceStg(
+		self.ObjectStorage, imarker, maxcount)(
+		&omarker, traceWrap{&infos}, traceWrap{&err})
+	if s, ok := self.ObjectStorage.(ObjectStorageTrash); ok {
+		return s.ListTrash(imarker, maxcount)
+	}
+	err = errors.New(": trash not supported", nil, errno.ENOSYS)
+	return
+}
+
+func (self *TraceObjectStorage) Restore(id string) (err error) {
+	defer traceStg(self.ObjectStorage, id)(traceWrap{&err})
+	if s, ok := self.ObjectStorage.(ObjectStorageTrash); ok {
+		return s.Restore(id)
+	}
+	err = errors.New(": trash not supported", nil, errno.ENOSYS)
+	return
+}
+
+func (self *TraceObjectStorage) Purge(id string) (err error) {
+	defer traceStg(self.ObjectStorage, id)(traceWrap{&err})
+	if s, ok := self.ObjectStorage.(ObjectStorageTrash); ok {
+		return s.Purge(id)
+	}
+	err = errors.New(": trash not supported", nil, errno.ENOSYS)
+	return
+}
+
 type traceWriteWaiter struct {
 	WriteWaiter
 }
@@ -99,6 +242,24 @@ func (self *traceWriteWaiter) Wait() (info ObjectInfo, err error) {
 	return self.WriteWaiter.Wait()
 }
 
+type tracePartWriteWaiter struct {
+	PartWriteWaiter
+}
+
+func (self *tracePartWriteWaiter) Wait() (info ObjectInfo, err error) {
+	defer traceStg(self.PartWriteWaiter)(traceWrap{&info}, traceWrap{&err})
+	return self.PartWriteWaiter.Wait()
+}
+
+type traceResumableWriteWaiter struct {
+	ResumableWriteWaiter
+}
+
+func (self *traceResumableWriteWaiter) Wait() (info ObjectInfo, err error) {
+	defer traceStg(self.ResumableWriteWaiter)(traceWrap{&info}, traceWrap{&err})
+	return self.ResumableWriteWaiter.Wait()
+}
+
 type traceWrap struct {
 	v interface{}
 }
@@ -116,6 +277,10 @@ func (t traceWrap) GoString() string {
 		return fmt.Sprintf("%#v", *i)
 	case *[]ObjectInfo:
 		return fmt.Sprintf("%T (len=%d)", i, len(*i))
+	case *[]ObjectChange:
+		return fmt.Sprintf("%T (len=%d)", i, len(*i))
+	case *[]TrashInfo:
+		return fmt.Sprintf("%T (len=%d)", i, len(*i))
 	default:
 		return fmt.Sprintf("%#v", t.v)
 	}
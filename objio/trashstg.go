@@ -0,0 +1,369 @@
+/*
+ * trashstg.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package objio
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/billziss-gh/golib/errors"
+	"github.com/billziss-gh/objfs/errno"
+)
+
+// DefaultTrashPrefix is the default directory where TrashObjectStorage
+// keeps deleted objects.
+const DefaultTrashPrefix = "/.objfs-trash"
+
+// TrashObjectStorage wraps a storage that does not have a trash and emulates
+// one by moving deleted objects into a hidden trash directory. The optional
+// interfaces of the wrapped storage are forwarded.
+type TrashObjectStorage struct {
+	ObjectStorage
+	Prefix string
+}
+
+// NewTrashObjectStorage wraps a storage so that it supports a trash. If the
+// storage already implements ObjectStorageTrash it is returned unchanged.
+func NewTrashObjectStorage(storage ObjectStorage) ObjectStorage {
+	if _, ok := storage.(ObjectStorageTrash); ok {
+		return storage
+	}
+
+	return &TrashObjectStorage{ObjectStorage: storage, Prefix: DefaultTrashPrefix}
+}
+
+func (self *TrashObjectStorage) List(
+	prefix string, imarker string, maxcount int) (
+	omarker string, infos []ObjectInfo, err error) {
+	omarker, infos, err = self.ObjectStorage.List(prefix, imarker, maxcount)
+	if nil != err {
+		return
+	}
+
+	if path.Join("/", prefix) == path.Dir(self.Prefix) {
+		name := path.Base(self.Prefix)
+		for i, info := range infos {
+			if name == info.Name() {
+				infos = append(infos[:i], infos[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return
+}
+
+func (self *TrashObjectStorage) Rmdir(prefix string) (err error) {
+	_, infos, err := self.ObjectStorage.List(prefix, "", 1)
+	if nil != err {
+		return
+	}
+	if 0 != len(infos) {
+		err = errors.New(": directory not empty", nil, errno.ENOTEMPTY)
+		return
+	}
+
+	return self.moveToTrash(prefix)
+}
+
+func (self *TrashObjectStorage) Remove(name string) (err error) {
+	return self.moveToTrash(name)
+}
+
+func (self *TrashObjectStorage) ListRecursive(
+	prefix string, imarker string, maxcount int) (
+	omarker string, infos []ObjectInfo, err error) {
+	s, ok := self.ObjectStorage.(ObjectStorageFlatList)
+	if !ok {
+		err = errors.New(": flat list not supported", nil, errno.ENOSYS)
+		return
+	}
+
+	omarker, infos, err = s.ListRecursive(prefix, imarker, maxcount)
+	if nil != err {
+		return
+	}
+
+	// hide the trash directory and its contents
+	dir := path.Join("/", prefix)
+	if dir == self.Prefix || !strings.HasPrefix(self.Prefix, strings.TrimSuffix(dir, "/")+"/") {
+		return
+	}
+	rel := strings.TrimPrefix(self.Prefix, strings.TrimSuffix(dir, "/")+"/")
+	i := 0
+	for _, info := range infos {
+		name := strings.Trim(info.Name(), "/")
+		if name != rel && !strings.HasPrefix(name, rel+"/") {
+			infos[i] = info
+			i++
+		}
+	}
+	infos = infos[:i]
+
+	return
+}
+
+func (self *TrashObjectStorage) Changes(
+	icursor string) (
+	ocursor string, changes []ObjectChange, err error) {
+	if s, ok := self.ObjectStorage.(ObjectStorageChanges); ok {
+		return s.Changes(icursor)
+	}
+	err = errors.New(": changes not supported", nil, errno.ENOSYS)
+	return
+}
+
+func (self *TrashObjectStorage) OpenWriteParts(
+	name string, size int64, partsize int64) (
+	writer PartWriteWaiter, err error) {
+	if s, ok := self.ObjectStorage.(ObjectStorageMultipart); ok {
+		return s.OpenWriteParts(name, size, partsize)
+	}
+	err = errors.New(": multipart write not supported", nil, errno.ENOSYS)
+	return
+}
+
+func (self *TrashObjectStorage) OpenResumableWrite(
+	name string, size int64, session string) (
+	writer ResumableWriteWaiter, err error) {
+	if s, ok := self.ObjectStorage.(ObjectStorageResumable); ok {
+		return s.OpenResumableWrite(name, size, session)
+	}
+	err = errors.New(": resumable write not supported", nil, errno.ENOSYS)
+	return
+}
+
+func (self *TrashObjectStorage) AbortResumableWrite(name string, session string) (err error) {
+	if s, ok := self.ObjectStorage.(ObjectStorageResumableAbort); ok {
+		return s.AbortResumableWrite(name, session)
+	}
+	err = errors.New(": resumable write abort not supported", nil, errno.ENOSYS)
+	return
+}
+
+func (self *TrashObjectStorage) OpenWriteIf(
+	name string, size int64, sig string) (
+	writer WriteWaiter, err error) {
+	if s, ok := self.ObjectStorage.(ObjectStorageConditional); ok {
+		return s.OpenWriteIf(name, size, sig)
+	}
+	err = errors.New(": conditional write not supported", nil, errno.ENOSYS)
+	return
+}
+
+func (self *TrashObjectStorage) Chtime(
+	name string, mtime time.Time) (
+	info ObjectInfo, err error) {
+	if s, ok := self.ObjectStorage.(ObjectStorageChtime); ok {
+		return s.Chtime(name, mtime)
+	}
+	err = errors.New(": chtime not supported", nil, errno.ENOSYS)
+	return
+}
+
+func (self *TrashObjectStorage) Symlink(
+	name string, target string) (
+	info ObjectInfo, err error) {
+	if s, ok := self.ObjectStorage.(ObjectStorageSymlink); ok {
+		return s.Symlink(name, target)
+	}
+	err = errors.New(": symlink not supported", nil, errno.ENOSYS)
+	return
+}
+
+func (self *TrashObjectStorage) Readlink(name string) (target string, err error) {
+	if s, ok := self.ObjectStorage.(ObjectStorageSymlink); ok {
+		return s.Readlink(name)
+	}
+	err = errors.New(": symlink not supported", nil, errno.ENOSYS)
+	return
+}
+
+func (self *TrashObjectStorage) ListTrash(
+	imarker string, maxcount int) (
+	omarker string, trinfos []TrashInfo, err error) {
+	var infos []ObjectInfo
+	omarker, infos, err = self.ObjectStorage.List(self.Prefix, imarker, maxcount)
+	if nil != err {
+		if errors.HasAttachment(err, errno.ENOENT) {
+			omarker, err = "", nil
+		}
+		return
+	}
+
+	trinfos = make([]TrashInfo, 0, len(infos))
+	for _, info := range infos {
+		trinfo, ok := newTrashInfo(info)
+		if ok {
+			trinfos = append(trinfos, trinfo)
+		}
+	}
+
+	return
+}
+
+func (self *TrashObjectStorage) Restore(id string) (err error) {
+	trinfo, ok := newTrashInfo(&trashIdInfo{id: id})
+	if !ok {
+		err = errors.New(": invalid trash id "+id, nil, errno.EINVAL)
+		return
+	}
+
+	_, err = self.ObjectStorage.Stat(trinfo.Path())
+	if nil == err {
+		err = errors.New(": "+trinfo.Path()+" exists", nil, errno.EEXIST)
+		return
+	} else if !errors.HasAttachment(err, errno.ENOENT) {
+		return
+	}
+
+	return self.ObjectStorage.Rename(path.Join(self.Prefix, id), trinfo.Path())
+}
+
+func (self *TrashObjectStorage) Purge(id string) (err error) {
+	if _, ok := newTrashInfo(&trashIdInfo{id: id}); !ok {
+		err = errors.New(": invalid trash id "+id, nil, errno.EINVAL)
+		return
+	}
+
+	return self.removeAll(path.Join(self.Prefix, id))
+}
+
+func (self *TrashObjectStorage) moveToTrash(name string) (err error) {
+	name = path.Join("/", name)
+	if name == self.Prefix || strings.HasPrefix(name, self.Prefix+"/") {
+		return self.removeAll(name)
+	}
+
+	_, err = self.ObjectStorage.Stat(name)
+	if nil != err {
+		return
+	}
+
+	_, err = self.ObjectStorage.Mkdir(self.Prefix)
+	if nil != err && !errors.HasAttachment(err, errno.EEXIST) {
+		return
+	}
+
+	id := fmt.Sprintf("%016x~%s", time.Now().UnixNano(), url.PathEscape(name))
+	return self.ObjectStorage.Rename(name, path.Join(self.Prefix, id))
+}
+
+func (self *TrashObjectStorage) removeAll(name string) (err error) {
+	info, err := self.ObjectStorage.Stat(name)
+	if nil != err {
+		return
+	}
+
+	if !info.IsDir() {
+		return self.ObjectStorage.Remove(name)
+	}
+
+	for {
+		var infos []ObjectInfo
+		_, infos, err = self.ObjectStorage.List(name, "", 0)
+		if nil != err {
+			return
+		}
+		if 0 == len(infos) {
+			break
+		}
+
+		for _, info := range infos {
+			err = self.removeAll(path.Join(name, info.Name()))
+			if nil != err {
+				return
+			}
+		}
+	}
+
+	return self.ObjectStorage.Rmdir(name)
+}
+
+type trashInfo struct {
+	ObjectInfo
+	id    string
+	path  string
+	dtime time.Time
+}
+
+func newTrashInfo(info ObjectInfo) (trinfo *trashInfo, ok bool) {
+	id := info.Name()
+
+	// an id is a single path component within the trash directory
+	if strings.ContainsRune(id, '/') || path.Base(id) != id {
+		return
+	}
+
+	i := strings.IndexByte(id, '~')
+	if -1 == i {
+		return
+	}
+
+	var nsec int64
+	_, err := fmt.Sscanf(id[:i], "%x", &nsec)
+	if nil != err {
+		return
+	}
+
+	p, err := url.PathUnescape(id[i+1:])
+	if nil != err || !strings.HasPrefix(p, "/") || path.Clean(p) != p || "/" == p {
+		return
+	}
+
+	trinfo = &trashInfo{
+		ObjectInfo: info,
+		id:         id,
+		path:       p,
+		dtime:      time.Unix(0, nsec).UTC(),
+	}
+	ok = true
+
+	return
+}
+
+func (info *trashInfo) Name() string {
+	return path.Base(info.path)
+}
+
+func (info *trashInfo) Id() string {
+	return info.id
+}
+
+func (info *trashInfo) Path() string {
+	return info.path
+}
+
+func (info *trashInfo) Dtime() time.Time {
+	return info.dtime
+}
+
+// trashIdInfo is used to parse a trash id.
+type trashIdInfo struct {
+	ObjectInfo
+	id string
+}
+
+func (info *trashIdInfo) Name() string {
+	return info.id
+}
+
+var _ ObjectStorageTrash = (*TrashObjectStorage)(nil)
@@ -0,0 +1,168 @@
+/*
+ * walk.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package objio
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/billziss-gh/golib/errors"
+	"github.com/billziss-gh/objfs/errno"
+)
+
+// WalkFunc is called by Walk for every object. The name is the path of the
+// object relative to the walked prefix. If WalkFunc returns an error the
+// walk stops and Walk returns that error.
+type WalkFunc func(name string, info ObjectInfo) error
+
+// Walk walks the objects below prefix at any depth. If the storage supports
+// flat listings it uses them; otherwise it lists every directory. A directory
+// is always reported before its contents, even if the storage does not
+// report directories in its flat listing; the order is otherwise unspecified.
+func Walk(storage ObjectStorage, prefix string, fn WalkFunc) (err error) {
+	if s, ok := storage.(ObjectStorageFlatList); ok {
+		err = walkFlat(s, prefix, fn)
+		if nil == err || !errors.HasAttachment(err, errno.ENOSYS) {
+			return
+		}
+	}
+
+	return walkTree(storage, prefix, "", fn)
+}
+
+func walkFlat(storage ObjectStorageFlatList, prefix string, fn WalkFunc) (err error) {
+	seen := map[string]bool{}
+
+	marker := ""
+	for {
+		var infos []ObjectInfo
+		marker, infos, err = storage.ListRecursive(prefix, marker, 0)
+		if nil != err {
+			return
+		}
+
+		for _, info := range infos {
+			name := strings.Trim(info.Name(), "/")
+			if "" == name {
+				continue
+			}
+
+			// report any parent directories not already reported
+			for i := 0; ; {
+				j := strings.IndexByte(name[i:], '/')
+				if -1 == j {
+					break
+				}
+				i += j
+				dir := name[:i]
+				if !seen[dir] {
+					seen[dir] = true
+					err = fn(dir, &walkDirInfo{name: path.Base(dir)})
+					if nil != err {
+						return
+					}
+				}
+				i++
+			}
+
+			if info.IsDir() {
+				if seen[name] {
+					continue
+				}
+				seen[name] = true
+			}
+
+			err = fn(name, info)
+			if nil != err {
+				return
+			}
+		}
+
+		if "" == marker {
+			break
+		}
+	}
+
+	return
+}
+
+func walkTree(storage ObjectStorage, prefix string, rel string, fn WalkFunc) (err error) {
+	var infos []ObjectInfo
+	marker := ""
+	for {
+		var i []ObjectInfo
+		marker, i, err = storage.List(path.Join(prefix, rel), marker, 0)
+		if nil != err {
+			return
+		}
+
+		infos = append(infos, i...)
+
+		if "" == marker {
+			break
+		}
+	}
+
+	for _, info := range infos {
+		name := path.Join(rel, info.Name())
+
+		err = fn(name, info)
+		if nil != err {
+			return
+		}
+
+		if info.IsDir() {
+			err = walkTree(storage, prefix, name, fn)
+			if nil != err {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// walkDirInfo is a directory that is not reported by a flat listing.
+type walkDirInfo struct {
+	name string
+}
+
+func (info *walkDirInfo) Name() string {
+	return info.name
+}
+
+func (info *walkDirInfo) Size() int64 {
+	return 0
+}
+
+func (info *walkDirInfo) Btime() time.Time {
+	return time.Time{}
+}
+
+func (info *walkDirInfo) Mtime() time.Time {
+	return time.Time{}
+}
+
+func (info *walkDirInfo) IsDir() bool {
+	return true
+}
+
+func (info *walkDirInfo) Sig() string {
+	return ""
+}
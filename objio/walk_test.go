@@ -0,0 +1,206 @@
+/*
+ * walk_test.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package objio
+
+import (
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/billziss-gh/golib/errors"
+	"github.com/billziss-gh/objfs/errno"
+)
+
+type testObjectInfo struct {
+	name  string
+	isdir bool
+}
+
+func (info *testObjectInfo) Name() string {
+	return info.name
+}
+
+func (info *testObjectInfo) Size() int64 {
+	return 0
+}
+
+func (info *testObjectInfo) Btime() time.Time {
+	return time.Time{}
+}
+
+func (info *testObjectInfo) Mtime() time.Time {
+	return time.Time{}
+}
+
+func (info *testObjectInfo) IsDir() bool {
+	return info.isdir
+}
+
+func (info *testObjectInfo) Sig() string {
+	return ""
+}
+
+// testTreeStorage lists a fixed tree of objects, two at a time. Directory
+// names end in /.
+type testTreeStorage struct {
+	ObjectStorage
+	names []string
+	lists int
+}
+
+func (self *testTreeStorage) List(
+	prefix string, imarker string, maxcount int) (
+	omarker string, infos []ObjectInfo, err error) {
+	self.lists++
+
+	prefix = strings.TrimPrefix(path.Join(prefix, "/"), "/")
+	if "" != prefix {
+		prefix += "/"
+	}
+
+	var children []ObjectInfo
+	for _, n := range self.names {
+		if !strings.HasPrefix(n, prefix) || n == prefix {
+			continue
+		}
+		rel := n[len(prefix):]
+		if i := strings.IndexByte(rel, '/'); -1 != i && len(rel)-1 != i {
+			continue
+		}
+		children = append(children, &testObjectInfo{
+			name:  strings.TrimSuffix(rel, "/"),
+			isdir: strings.HasSuffix(rel, "/"),
+		})
+	}
+
+	return listPage(children, imarker)
+}
+
+// testFlatStorage is a testTreeStorage that also lists flat. The flat
+// listing reports directories only if flatdirs is set.
+type testFlatStorage struct {
+	testTreeStorage
+	flatdirs bool
+	enosys   bool
+}
+
+func (self *testFlatStorage) ListRecursive(
+	prefix string, imarker string, maxcount int) (
+	omarker string, infos []ObjectInfo, err error) {
+	if self.enosys {
+		err = errors.New(": flat list not supported", nil, errno.ENOSYS)
+		return
+	}
+
+	self.lists++
+
+	var all []ObjectInfo
+	for _, n := range self.names {
+		isdir := strings.HasSuffix(n, "/")
+		if isdir && !self.flatdirs {
+			continue
+		}
+		all = append(all, &testObjectInfo{name: n, isdir: isdir})
+	}
+
+	return listPage(all, imarker)
+}
+
+func listPage(infos []ObjectInfo, imarker string) (omarker string, page []ObjectInfo, err error) {
+	i, _ := strconv.Atoi(imarker)
+	j := i + 2
+	if j < len(infos) {
+		omarker = strconv.Itoa(j)
+	} else {
+		j = len(infos)
+	}
+	page = infos[i:j]
+	return
+}
+
+func TestWalk(t *testing.T) {
+	names := []string{"a", "d/", "d/b", "d/e/", "d/e/c"}
+
+	for _, c := range []struct {
+		storage ObjectStorage
+		lists   int
+	}{
+		{&testTreeStorage{names: names}, 3},
+		{&testFlatStorage{testTreeStorage: testTreeStorage{names: names}}, 2},
+		{&testFlatStorage{testTreeStorage: testTreeStorage{names: names}, flatdirs: true}, 3},
+		{&testFlatStorage{testTreeStorage: testTreeStorage{names: names}, enosys: true}, 3},
+	} {
+		var walked []string
+		seen := map[string]bool{}
+		err := Walk(c.storage, "/", func(name string, info ObjectInfo) error {
+			if d := path.Dir(name); "." != d && !seen[d] {
+				t.Error("Walk: reported before its directory", name)
+			}
+			seen[name] = true
+			if info.IsDir() {
+				name += "/"
+			}
+			walked = append(walked, name)
+			return nil
+		})
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		sort.Strings(walked)
+		if strings.Join(names, ",") != strings.Join(walked, ",") {
+			t.Error("Walk", walked)
+		}
+
+		lists := 0
+		switch s := c.storage.(type) {
+		case *testTreeStorage:
+			lists = s.lists
+		case *testFlatStorage:
+			lists = s.lists
+		}
+		if c.lists != lists {
+			t.Error("Walk lists", lists)
+		}
+	}
+}
+
+func TestWalkStop(t *testing.T) {
+	names := []string{"a", "b", "c", "d/", "d/e"}
+	stop := errors.New("stop")
+
+	for _, storage := range []ObjectStorage{
+		&testTreeStorage{names: names},
+		&testFlatStorage{testTreeStorage: testTreeStorage{names: names}},
+	} {
+		n := 0
+		err := Walk(storage, "/", func(name string, info ObjectInfo) error {
+			n++
+			if 2 == n {
+				return stop
+			}
+			return nil
+		})
+		if stop != err || 2 != n {
+			t.Error("Walk stop", n, err)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ * xsym.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package objio
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+
+	"github.com/billziss-gh/golib/errors"
+	"github.com/billziss-gh/objfs/errno"
+)
+
+// XSym symbolic links are regular objects that contain the link target.
+// They are used with storages that do not support symbolic links. The format
+// is the one by Minshall and French that is also used by Samba and macOS:
+//
+//     XSym\n
+//     len(target) as %04d\n
+//     md5(target) as %032x\n
+//     target\n
+//     space padding to XSymSize
+
+// XSymSize is the size of an XSym symbolic link.
+const XSymSize = 1067
+
+// XSymMaxTarget is the maximum length of an XSym symbolic link target.
+const XSymMaxTarget = XSymSize - 44
+
+// EncodeXSym encodes a symbolic link target as an XSym object.
+func EncodeXSym(target string) (b []byte, err error) {
+	if 0 == len(target) {
+		err = errors.New(": empty symlink target", nil, errno.ENOENT)
+		return
+	}
+	if XSymMaxTarget < len(target) {
+		err = errors.New(": symlink target too long", nil, errno.ENAMETOOLONG)
+		return
+	}
+
+	b = make([]byte, 0, XSymSize)
+	b = append(b, fmt.Sprintf("XSym\n%04d\n%032x\n%s\n", len(target), md5.Sum([]byte(target)), target)...)
+	b = append(b, bytes.Repeat([]byte{' '}, XSymSize-len(b))...)
+
+	return
+}
+
+// DecodeXSym decodes the symbolic link target of an XSym object.
+func DecodeXSym(b []byte) (target string, ok bool) {
+	if XSymSize != len(b) || !bytes.HasPrefix(b, []byte("XSym\n")) {
+		return
+	}
+
+	var l int
+	_, err := fmt.Sscanf(string(b[5:10]), "%04d\n", &l)
+	if nil != err || 0 == l || XSymMaxTarget < l || '\n' != b[42] || '\n' != b[43+l] {
+		return
+	}
+
+	t := string(b[43 : 43+l])
+	if string(b[10:42]) != fmt.Sprintf("%032x", md5.Sum([]byte(t))) {
+		return
+	}
+
+	target = t
+	ok = true
+
+	return
+}
@@ -0,0 +1,60 @@
+/*
+ * xsym_test.go
+ *
+ * Copyright 2018 Bill Zissimopoulos
+ */
+/*
+ * This file is part of Objfs.
+ *
+ * You can redistribute it and/or modify it under the terms of the GNU
+ * Affero General Public License version 3 as published by the Free
+ * Software Foundation.
+ *
+ * Licensees holding a valid commercial license may use this file in
+ * accordance with the commercial license agreement provided with the
+ * software.
+ */
+
+package objio
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestXSym(t *testing.T) {
+	for _, target := range []string{"a", "../foo/Δοκιμή", strings.Repeat("x", XSymMaxTarget)} {
+		b, err := EncodeXSym(target)
+		if nil != err {
+			t.Error(err)
+		}
+		if XSymSize != len(b) {
+			t.Error(len(b))
+		}
+
+		s, ok := DecodeXSym(b)
+		if !ok || target != s {
+			t.Error(s)
+		}
+	}
+
+	_, err := EncodeXSym("")
+	if nil == err {
+		t.Error()
+	}
+
+	_, err = EncodeXSym(strings.Repeat("x", XSymMaxTarget+1))
+	if nil == err {
+		t.Error()
+	}
+
+	b, _ := EncodeXSym("foo")
+	b[43] = 'g'
+	if _, ok := DecodeXSym(b); ok {
+		t.Error()
+	}
+
+	if _, ok := DecodeXSym(make([]byte, XSymSize)); ok {
+		t.Error()
+	}
+}